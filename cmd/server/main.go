@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/rand"
 	"database/sql"
+	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -12,6 +13,7 @@ import (
 	"log"
 	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -19,25 +21,62 @@ import (
 	"time"
 
 	"lojagtec/internal/admin"
+	"lojagtec/internal/analytics"
+	"lojagtec/internal/audit"
 	"lojagtec/internal/banners"
+	"lojagtec/internal/carts"
 	"lojagtec/internal/checkout"
 	"lojagtec/internal/database"
+	"lojagtec/internal/deliveries"
+	"lojagtec/internal/installments"
 	"lojagtec/internal/logging"
 	"lojagtec/internal/offers"
 	"lojagtec/internal/orders"
 	"lojagtec/internal/products"
+	"lojagtec/internal/scheduler"
+	"lojagtec/internal/spreadsheet"
 )
 
 const (
 	maxUploadSize = 5 << 20 // 5MB
 	uploadPath    = "web/static/images/uploads"
+	auditPageSize = 50
+	orderPageSize = 50
+
+	deliveryRunsLimit = 30
+
+	catalogPageSize    = 24
+	catalogMaxPageSize = 100
+
+	searchDropdownLimit = 6
+	searchPageSize      = 20
+	finderMatchesLimit  = 20
+
+	analyticsTopLimit = 10
+	searchReportLimit = 20
+)
+
+var (
+	errInvalidAuditFilter     = errors.New("Filtro inválido. Verifique o usuário e as datas informadas.")
+	errInvalidAnalyticsPeriod = errors.New("Período inválido. Verifique as datas informadas.")
+	errInvalidOrderFilter     = errors.New("Filtro inválido. Verifique as datas informadas.")
+	errInvalidOrderExport     = errors.New("Exportação inválida. Escolha o formato e ao menos uma coluna.")
+	errInvalidDeliveryRun     = errors.New("Informe a data e o entregador da rota.")
 )
 
 type adminDashboardData struct {
-	CanViewOrders bool
-	Brands        []products.Brand
-	Products      []products.ProductOption
-	Categories    []products.Category
+	CanViewOrders  bool
+	CanManageUsers bool
+	CanViewAudit   bool
+	Brands         []products.Brand
+	Products       []products.ProductOption
+	Categories     []products.Category
+
+	// CanViewAnalytics shows the sales charts, which expose revenue
+	CanViewAnalytics bool
+
+	// CanViewDeliveries links the delivery runs
+	CanViewDeliveries bool
 }
 
 type adminEditData struct {
@@ -54,21 +93,58 @@ type adminEditData struct {
 type brandModalData struct {
 	Name  string
 	Error string
+
+	// Brand is the brand being edited, Targets the brands it can be merged into
+	Brand   *products.Brand
+	Targets []products.Brand
 }
 
 type categoryModalData struct {
 	Category *products.Category
 	Error    string
+
+	// Parents are the categories it can be placed under, ParentID the chosen one
+	Parents  []products.Category
+	ParentID int
+}
+
+type cartModalData struct {
+	*carts.Cart
+	Error string
 }
 
 type productPageData struct {
 	Product            *products.Product
+	CategoryPath       []products.Category
 	Brands             []products.Brand
 	CompatibleProducts []products.Product
 	PartsForProduct    []products.Product
 	RelatedProducts    []products.Product
 }
 
+type categoryPageData struct {
+	Category      *products.Category
+	Ancestors     []products.Category // top-level first
+	Subcategories []products.Category
+	Products      *products.CatalogPage
+}
+
+type brandPageData struct {
+	Brand    *products.Brand
+	Products *products.CatalogPage
+}
+
+type refillFinderData struct {
+	Brands        []products.BrandSearchResult
+	BrandID       int
+	Models        []products.FinderModel
+	Query         string
+	Matches       []products.FinderModel
+	Model         *products.FinderModel
+	ModelNotFound bool
+	Parts         []products.Product
+}
+
 // setCacheHeaders sets HTTP cache headers for HTMX modal responses
 func setCacheHeaders(w http.ResponseWriter, maxAgeSeconds int) {
 	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAgeSeconds))
@@ -104,6 +180,10 @@ func translatePaymentStatus(status string) string {
 		return "Falhou"
 	case "waiting":
 		return "Aguardando"
+	case "expired":
+		return "Expirado"
+	case "refund_pending":
+		return "Reembolso pendente"
 	default:
 		return status
 	}
@@ -140,6 +220,114 @@ func parseBrandIDs(brands string) []int {
 	return brandIDs
 }
 
+// parseCatalogFilters reads the storefront filters. The category comes from the
+// /products/{slug} path ("all" for none, "ofertas" for the offers) or the category
+// parameter; brands accepts a comma-separated list or repeated values, price is a
+// "min-max" range with either side optional, spec is a repeated "key:value" and sort
+// one of the products.Sort* orders. Invalid values are ignored.
+func parseCatalogFilters(query url.Values, slug string) products.CatalogFilters {
+	filters := products.CatalogFilters{
+		OnOffer:   query.Get("offer") == "1",
+		Available: query.Get("available") == "1",
+	}
+	if sort := query.Get("sort"); products.ValidCatalogSort(sort) && sort != products.SortNewest {
+		filters.Sort = sort
+	}
+
+	switch slug {
+	case "", "all":
+		filters.Category = strings.TrimSpace(query.Get("category"))
+	case "ofertas":
+		filters.Category = strings.TrimSpace(query.Get("category"))
+		filters.OnOffer = true
+	default:
+		filters.Category = slug
+	}
+
+	for _, brands := range query["brands"] {
+		filters.BrandIDs = append(filters.BrandIDs, parseBrandIDs(brands)...)
+	}
+
+	if low, high, ok := strings.Cut(query.Get("price"), "-"); ok {
+		if value, err := strconv.ParseFloat(low, 64); err == nil && value > 0 {
+			filters.MinPrice = value
+		}
+		if value, err := strconv.ParseFloat(high, 64); err == nil && value > filters.MinPrice {
+			filters.MaxPrice = value
+		}
+	}
+
+	for _, spec := range query["spec"] {
+		key, value, ok := strings.Cut(spec, ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			continue
+		}
+		if filters.Specs == nil {
+			filters.Specs = make(map[string][]string)
+		}
+		filters.Specs[key] = append(filters.Specs[key], value)
+	}
+
+	return filters
+}
+
+// catalogQuery encodes the filters the way parseCatalogFilters reads them, for
+// shareable storefront URLs
+func catalogQuery(filters products.CatalogFilters) url.Values {
+	query := url.Values{}
+	if filters.Category != "" {
+		query.Set("category", filters.Category)
+	}
+	if len(filters.BrandIDs) > 0 {
+		ids := make([]string, len(filters.BrandIDs))
+		for i, id := range filters.BrandIDs {
+			ids[i] = strconv.Itoa(id)
+		}
+		query.Set("brands", strings.Join(ids, ","))
+	}
+	if filters.MinPrice > 0 || filters.MaxPrice > 0 {
+		query.Set("price", catalogPriceValue(filters.MinPrice, filters.MaxPrice))
+	}
+	if filters.OnOffer {
+		query.Set("offer", "1")
+	}
+	if filters.Available {
+		query.Set("available", "1")
+	}
+	for key, values := range filters.Specs {
+		for _, value := range values {
+			query.Add("spec", key+":"+value)
+		}
+	}
+	if filters.Sort != "" {
+		query.Set("sort", filters.Sort)
+	}
+	return query
+}
+
+// parseCatalogPage reads the page parameter of the catalog listing, 1 when missing or invalid
+func parseCatalogPage(query url.Values) int {
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		return 1
+	}
+	return page
+}
+
+// catalogPriceValue formats a price range as the price parameter, leaving out zero bounds
+func catalogPriceValue(low, high float64) string {
+	value := ""
+	if low > 0 {
+		value = strconv.FormatFloat(low, 'f', -1, 64)
+	}
+	value += "-"
+	if high > 0 {
+		value += strconv.FormatFloat(high, 'f', -1, 64)
+	}
+	return value
+}
+
 // orderFuncMap returns a template.FuncMap with order-related helper functions
 func orderFuncMap() template.FuncMap {
 	return template.FuncMap{
@@ -152,6 +340,47 @@ func orderFuncMap() template.FuncMap {
 	}
 }
 
+// searchSessionKey identifies the visitor of a search for the search log: the cart cookie
+// or, before there is a cart, the address and browser of the client
+func searchSessionKey(r *http.Request) string {
+	if token := carts.TokenFromRequest(r); token != "" {
+		return token
+	}
+	return admin.ClientIP(r) + " " + r.UserAgent()
+}
+
+// searchFuncMap returns a template.FuncMap with search-related helper functions
+func searchFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"highlight": highlightSearchMatches,
+	}
+}
+
+// highlightSearchMatches escapes a search highlight and marks the matched words with <mark>
+func highlightSearchMatches(text string) template.HTML {
+	return template.HTML(strings.NewReplacer(
+		products.HighlightStart, "<mark>",
+		products.HighlightStop, "</mark>",
+	).Replace(template.HTMLEscapeString(text)))
+}
+
+// cartFuncMap returns a template.FuncMap with cart-related helper functions
+func cartFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"add": func(a, b int) int {
+			return a + b
+		},
+	}
+}
+
+// installmentFuncMap returns a template.FuncMap with the credit card installment helpers
+func installmentFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"installmentPlans":     installments.Plans,
+		"installmentHighlight": installments.Highlight,
+	}
+}
+
 // cacheControlWrapper wraps a handler to add cache control headers
 type cacheControlWrapper struct {
 	handler http.Handler
@@ -200,15 +429,29 @@ func main() {
 	admin.SetDatabase(db)
 	orders.SetDatabase(db)
 	banners.SetDatabase(db)
+	carts.SetDatabase(db)
 	offers.SetDatabase(db)
 	checkout.SetDatabase(db)
 	logging.SetDatabase(db)
+	audit.SetDatabase(db)
+	analytics.SetDatabase(db)
+	deliveries.SetDatabase(db)
+
+	if err := installments.Load("configs/config.toml"); err != nil {
+		log.Fatalf("Could not load installment rules: %v", err)
+	}
 
 	// Apply database schema
 	if err := database.RunSchema(db); err != nil {
 		log.Fatalf("Could not apply database schema: %v", err)
 	}
 
+	// Background jobs: remind customers about boletos/PIX about to expire and cancel the unpaid ones
+	scheduler.Every("payment_reminders", time.Minute, checkout.SendPaymentReminders)
+	scheduler.Every("expire_unpaid_orders", time.Minute, checkout.CancelExpiredOrders)
+	scheduler.Every("prune_login_attempts", 24*time.Hour, admin.PruneLoginAttempts)
+	scheduler.Every("prune_password_resets", 24*time.Hour, admin.PruneExpiredPasswordResets)
+
 	// Ensure upload directory exists
 	if err := os.MkdirAll(uploadPath, 0755); err != nil {
 		log.Fatalf("Could not create upload directory: %v", err)
@@ -219,13 +462,166 @@ func main() {
 
 	// Cart modal route (must be before catch-all "/")
 	http.HandleFunc("/cart-modal", func(w http.ResponseWriter, r *http.Request) {
-		tmpl, err := template.ParseFiles("web/templates/cart-modal.html")
+		cart, err := carts.GetCart(carts.TokenFromRequest(r))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		tmpl.Execute(w, nil)
+		tmpl, err := template.New("cart-modal.html").Funcs(cartFuncMap()).ParseFiles("web/templates/cart-modal.html", "web/templates/cart-body.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tmpl.Execute(w, cartModalData{Cart: cart})
+	})
+
+	// Cart API: every mutation answers with the re-rendered modal body
+	http.HandleFunc("/api/cart", func(w http.ResponseWriter, r *http.Request) {
+		token := carts.TokenFromRequest(r)
+
+		switch r.Method {
+		case http.MethodGet:
+			renderCartBody(w, token, "")
+		case http.MethodDelete:
+			if token != "" {
+				if err := carts.Clear(token); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			renderCartBody(w, token, "")
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/api/cart/count", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		cart, err := carts.GetCart(carts.TokenFromRequest(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-store")
+		fmt.Fprintf(w, "%d", cart.ItemCount)
+	})
+
+	http.HandleFunc("/api/cart/items", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		itemID, err := strconv.Atoi(r.FormValue("item_id"))
+		if err != nil || itemID <= 0 {
+			http.Error(w, "Invalid item ID", http.StatusBadRequest)
+			return
+		}
+		quantity, err := strconv.Atoi(r.FormValue("quantity"))
+		if err != nil {
+			quantity = 1
+		}
+
+		token, err := carts.EnsureToken(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := carts.AddItem(token, itemID, quantity); err != nil {
+			if errors.Is(err, carts.ErrItemUnavailable) || errors.Is(err, carts.ErrItemNotFound) {
+				renderCartBody(w, token, err.Error())
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		renderCartBody(w, token, "")
+	})
+
+	http.HandleFunc("/api/cart/items/", func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/cart/items/"))
+		if err != nil {
+			http.Error(w, "Invalid item ID", http.StatusBadRequest)
+			return
+		}
+
+		token := carts.TokenFromRequest(r)
+		if token == "" {
+			renderCartBody(w, token, "")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			quantity, err := strconv.Atoi(r.FormValue("quantity"))
+			if err != nil {
+				http.Error(w, "Invalid quantity", http.StatusBadRequest)
+				return
+			}
+			err = carts.UpdateQuantity(token, itemID, quantity)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case http.MethodDelete:
+			if err := carts.RemoveItem(token, itemID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		renderCartBody(w, token, "")
+	})
+
+	// Adds (POST) or removes (DELETE) the installation service during checkout
+	http.HandleFunc("/api/cart/installation", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		token, err := carts.EnsureToken(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := carts.SetInstallationService(token, r.Method == http.MethodPost); err != nil {
+			if !errors.Is(err, orders.ErrInstallationServiceUnavailable) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			logging.LogError("cart", "installation_service", err.Error(), nil)
+		}
+
+		cart, err := carts.GetCart(token)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tmpl, err := template.New("checkout-summary.html").Funcs(installmentFuncMap()).ParseFiles("web/templates/checkout-summary.html", "web/templates/installment-options.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setCartUpdatedTrigger(w, cart)
+		tmpl.ExecuteTemplate(w, "checkout-summary", cart)
+		// The installment options depend on the total, which the installation service changes
+		tmpl.ExecuteTemplate(w, "installment-options-oob", cart)
 	})
 
 	// Installation service modal route
@@ -247,17 +643,30 @@ func main() {
 			return
 		}
 
-		tmpl.Execute(w, nil)
+		// A shared or bookmarked listing carries its filters in the query string
+		productsURL := "/products/all"
+		if query := catalogQuery(parseCatalogFilters(r.URL.Query(), "")).Encode(); query != "" {
+			productsURL += "?" + query
+		}
+		tmpl.Execute(w, map[string]interface{}{
+			"ProductsURL": template.URL(productsURL),
+		})
 	})
 
 	http.HandleFunc("/checkout", func(w http.ResponseWriter, r *http.Request) {
-		tmpl, err := template.ParseFiles("web/templates/checkout.html", "web/templates/footer.html")
+		cart, err := carts.GetCart(carts.TokenFromRequest(r))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		tmpl.Execute(w, nil)
+		tmpl, err := template.New("checkout.html").Funcs(installmentFuncMap()).ParseFiles("web/templates/checkout.html", "web/templates/checkout-summary.html", "web/templates/installment-options.html", "web/templates/footer.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tmpl.Execute(w, cart)
 	})
 
 	http.HandleFunc("/checkout/success", func(w http.ResponseWriter, r *http.Request) {
@@ -273,6 +682,11 @@ func main() {
 			return
 		}
 
+		trackingURL := ""
+		if order.HasAccessToken(r.URL.Query().Get("token")) {
+			trackingURL = checkout.OrderTrackingURL(order)
+		}
+
 		tmpl, err := template.ParseFiles("web/templates/checkout-success-page.html", "web/templates/footer.html")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -280,7 +694,8 @@ func main() {
 		}
 
 		tmpl.Execute(w, map[string]interface{}{
-			"Order": order,
+			"Order":       order,
+			"TrackingURL": trackingURL,
 		})
 	})
 
@@ -297,101 +712,287 @@ func main() {
 			return
 		}
 
-		tmpl, err := template.ParseFiles("web/templates/checkout-cancel-page.html", "web/templates/footer.html")
+		// Only the customer holding the order link may pay it again
+		isOwner := order.HasAccessToken(r.URL.Query().Get("token"))
+		trackingURL := ""
+		if isOwner {
+			trackingURL = checkout.OrderTrackingURL(order)
+		}
+
+		tmpl, err := template.ParseFiles("web/templates/checkout-cancel-page.html", "web/templates/payment-retry-form.html", "web/templates/footer.html")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		tmpl.Execute(w, map[string]interface{}{
-			"Order": order,
+			"Order":       order,
+			"CanRetry":    isOwner && orders.CanRetryPayment(order),
+			"TrackingURL": trackingURL,
 		})
 	})
 
-	// Checkout endpoint for order processing
-	http.HandleFunc("/api/checkout", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// Customer order tracking page, reached through the link with the order access token
+	http.HandleFunc("/pedido/", func(w http.ResponseWriter, r *http.Request) {
+		orderNumber := strings.TrimPrefix(r.URL.Path, "/pedido/")
+		order, err := orders.GetOrderForCustomer(orderNumber, r.URL.Query().Get("token"))
+		if err != nil {
+			if errors.Is(err, orders.ErrOrderNotFound) {
+				http.Error(w, "Pedido não encontrado", http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Parse form data
-		if err := r.ParseForm(); err != nil {
-			http.Error(w, "Invalid form data", http.StatusBadRequest)
+		items, err := orders.GetOrderItems(order.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Create checkout form from request data
-		form := orders.CheckoutForm{
-			Email:         r.FormValue("email"),
-			Phone:         r.FormValue("phone"),
-			FirstName:     r.FormValue("firstName"),
-			LastName:      r.FormValue("lastName"),
-			Address:       r.FormValue("address"),
-			Neighborhood:  r.FormValue("neighborhood"),
-			City:          r.FormValue("city"),
-			State:         r.FormValue("state"),
-			ZipCode:       r.FormValue("zipCode"),
-			Apartment:     r.FormValue("apartment"),
-			CPF:           r.FormValue("cpf"),
-			PaymentMethod: r.FormValue("paymentMethod"),
+		tmpl, err := template.New("order-tracking.html").Funcs(orderFuncMap()).ParseFiles("web/templates/order-tracking.html", "web/templates/payment-retry-form.html", "web/templates/footer.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		// Parse cart items from form data
-		cartData := r.FormValue("cart_items")
-		if cartData == "" {
-			// Return error for empty cart
-			tmpl, err := template.ParseFiles("web/templates/validation-error.html")
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		w.Header().Set("Cache-Control", "no-store")
+		tmpl.Execute(w, map[string]interface{}{
+			"Order":    order,
+			"Items":    items,
+			"CanRetry": orders.CanRetryPayment(order),
+		})
+	})
+
+	// Customer payment page for providers that collect on our site (PIX QR code, local simulator)
+	http.HandleFunc("/pagamento/", func(w http.ResponseWriter, r *http.Request) {
+		orderNumber := strings.TrimPrefix(r.URL.Path, "/pagamento/")
+		order, err := orders.GetOrderForCustomer(orderNumber, r.URL.Query().Get("token"))
+		if err != nil {
+			if errors.Is(err, orders.ErrOrderNotFound) {
+				http.Error(w, "Pedido não encontrado", http.StatusNotFound)
 				return
 			}
-			tmpl.Execute(w, orders.ValidationError{Field: "cart", Message: "Seu carrinho está vazio"})
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		if err := json.Unmarshal([]byte(cartData), &form.CartItems); err != nil {
-			http.Error(w, "Invalid cart data", http.StatusBadRequest)
+		if order.PaymentStatus == "paid" {
+			http.Redirect(w, r, checkout.SuccessURL(order), http.StatusSeeOther)
 			return
 		}
 
-		// Validate the form
-		result := orders.ValidateCheckoutForm(form)
-		if !result.IsValid {
-			// Return validation errors
-			tmpl, err := template.ParseFiles("web/templates/validation-error.html")
+		attempts, err := orders.GetPaymentAttempts(order.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(attempts) == 0 || (attempts[0].Provider != "pix" && attempts[0].Provider != "fake") {
+			http.Redirect(w, r, checkout.OrderTrackingURL(order), http.StatusSeeOther)
+			return
+		}
+		attempt := attempts[0]
+
+		qrCode := ""
+		if attempt.Provider == "pix" {
+			qrCode, err = checkout.PixQRCodeDataURI(attempt.Payload)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			tmpl.Execute(w, result.Errors[0])
-			return
 		}
 
-		// Create the order
-		order, err := orders.CreateOrder(form)
+		tmpl, err := template.New("payment-page.html").Funcs(orderFuncMap()).ParseFiles("web/templates/payment-page.html", "web/templates/payment-retry-form.html", "web/templates/footer.html")
 		if err != nil {
-			tmpl, parseErr := template.ParseFiles("web/templates/validation-error.html")
-			if parseErr != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			if errors.Is(err, orders.ErrInstallationServiceUnavailable) || errors.Is(err, orders.ErrInvalidCartItem) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		tmpl.Execute(w, map[string]interface{}{
+			"Order":     order,
+			"Attempt":   attempt,
+			"QRCode":    template.URL(qrCode), // generated by us, safe as a data URI
+			"IsExpired": attempt.Status == "expired" || (attempt.ExpiresAt != nil && attempt.ExpiresAt.Before(time.Now())),
+			"CanRetry":  orders.CanRetryPayment(order),
+		})
+	})
+
+	http.HandleFunc("/api/orders/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(path, "/payment-status"):
+			handlePaymentStatus(w, r, strings.TrimSuffix(path, "/payment-status"))
+			return
+		case r.Method == http.MethodPost && strings.HasSuffix(path, "/pay"):
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Pay again: starts a new payment for an existing unpaid order
+		orderNumber := strings.TrimSuffix(path, "/pay")
+		order, err := orders.GetOrderForCustomer(orderNumber, r.FormValue("token"))
+		if err != nil {
+			if errors.Is(err, orders.ErrOrderNotFound) {
+				renderValidationError(w, "general", err.Error())
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !orders.CanRetryPayment(order) {
+			renderValidationError(w, "general", orders.ErrPaymentNotRetryable.Error())
+			return
+		}
+
+		paymentMethod := r.FormValue("paymentMethod")
+		if paymentMethod != "" && paymentMethod != order.PaymentMethod {
+			if err := orders.UpdateOrderPaymentMethod(order.ID, paymentMethod); err != nil {
+				renderValidationError(w, "paymentMethod", "Forma de pagamento inválida")
+				return
+			}
+			// The switch drops the card interest, so the total and installments come from the database
+			order, err = orders.GetOrderByID(order.ID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		items, err := orders.GetOrderItems(order.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Earlier sessions and charges must not be paid on top of the new one
+		if err := checkout.ExpireOpenPayments(order.ID); err != nil {
+			logging.LogError("payment", "payment_retry_expire_attempts", err.Error(), map[string]interface{}{
+				"order_id": order.ID,
+			})
+			renderValidationError(w, "general", "Erro ao iniciar pagamento. Tente novamente.")
+			return
+		}
+
+		form := orders.CheckoutFormFromOrder(order, items)
+		paymentURL, err := checkout.StartPayment(form, order)
+		if err != nil {
+			var validationErr checkout.ValidationError
+			switch {
+			case errors.Is(err, checkout.ErrProviderNotConfigured):
+				renderValidationError(w, "general", "Pagamento temporariamente indisponível.")
+			case errors.As(err, &validationErr):
+				renderValidationError(w, validationErr.Field, validationErr.Message)
+			default:
+				log.Printf("Failed to start payment retry: %v", err)
+				logging.LogError("payment", "payment_retry", err.Error(), map[string]interface{}{
+					"order_id": order.ID,
+				})
+				renderValidationError(w, "general", "Erro ao iniciar pagamento. Tente novamente.")
+			}
+			return
+		}
+
+		w.Header().Set("HX-Redirect", paymentURL)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Checkout endpoint for order processing
+	http.HandleFunc("/api/checkout", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Parse form data
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form data", http.StatusBadRequest)
+			return
+		}
+
+		// Create checkout form from request data
+		form := orders.CheckoutForm{
+			Email:         r.FormValue("email"),
+			Phone:         r.FormValue("phone"),
+			FirstName:     r.FormValue("firstName"),
+			LastName:      r.FormValue("lastName"),
+			Address:       r.FormValue("address"),
+			Neighborhood:  r.FormValue("neighborhood"),
+			City:          r.FormValue("city"),
+			State:         r.FormValue("state"),
+			ZipCode:       r.FormValue("zipCode"),
+			Apartment:     r.FormValue("apartment"),
+			CPF:           r.FormValue("cpf"),
+			PaymentMethod: r.FormValue("paymentMethod"),
+		}
+		if count, err := strconv.Atoi(r.FormValue("installments")); err == nil {
+			form.Installments = count
+		}
+
+		// Cart items and prices come from the server-side cart
+		cartToken := carts.TokenFromRequest(r)
+		cart, err := carts.GetCart(cartToken)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if cart.HasUnavailable {
+			tmpl, err := template.ParseFiles("web/templates/validation-error.html")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			tmpl.Execute(w, orders.ValidationError{Field: "cart", Message: "Alguns itens do seu carrinho estão indisponíveis. Remova-os para continuar."})
+			return
+		}
+		if cart.ItemCount > 0 {
+			form.CartItems = cart.CheckoutItems()
+		}
+
+		// Validate the form
+		result := orders.ValidateCheckoutForm(form)
+		if !result.IsValid {
+			// Return validation errors
+			tmpl, err := template.ParseFiles("web/templates/validation-error.html")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			tmpl.Execute(w, result.Errors[0])
+			return
+		}
+
+		// Create the order
+		order, err := orders.CreateOrder(form)
+		if err != nil {
+			tmpl, parseErr := template.ParseFiles("web/templates/validation-error.html")
+			if parseErr != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if errors.Is(err, orders.ErrInstallationServiceUnavailable) || errors.Is(err, orders.ErrInvalidCartItem) {
 				tmpl.Execute(w, orders.ValidationError{Field: "cart", Message: err.Error()})
 				return
 			}
+			if errors.Is(err, installments.ErrInvalidPlan) {
+				tmpl.Execute(w, orders.ValidationError{Field: "installments", Message: err.Error()})
+				return
+			}
 			tmpl.Execute(w, orders.ValidationError{Field: "general", Message: "Erro ao processar pedido: " + err.Error()})
 			return
 		}
 
-		stripeSessionURL, err := checkout.CreateCheckoutSession(form, order)
+		paymentURL, err := checkout.StartPayment(form, order)
 		if err != nil {
-			logging.LogError("stripe", "checkout_session_create", err.Error(), order)
+			logging.LogError("payment", "payment_create", err.Error(), order)
 			var validationErr checkout.ValidationError
-			if errors.Is(err, checkout.ErrStripeNotConfigured) {
+			if errors.Is(err, checkout.ErrProviderNotConfigured) {
 				tmpl, parseErr := template.ParseFiles("web/templates/validation-error.html")
 				if parseErr != nil {
-					http.Error(w, "Stripe configuration error", http.StatusInternalServerError)
+					http.Error(w, "Payment configuration error", http.StatusInternalServerError)
 					return
 				}
 				tmpl.Execute(w, orders.ValidationError{Field: "general", Message: "Pagamento temporariamente indisponível."})
@@ -407,8 +1008,8 @@ func main() {
 				return
 			}
 
-			log.Printf("Failed to create Stripe session: %v", err)
-			logging.LogError("stripe", "checkout_session_create", err.Error(), map[string]interface{}{
+			log.Printf("Failed to start payment: %v", err)
+			logging.LogError("payment", "payment_create", err.Error(), map[string]interface{}{
 				"order_id": order.ID,
 			})
 			tmpl, parseErr := template.ParseFiles("web/templates/validation-error.html")
@@ -420,7 +1021,14 @@ func main() {
 			return
 		}
 
-		w.Header().Set("HX-Redirect", stripeSessionURL)
+		// The order now holds the items; start the next visit with an empty cart
+		if err := carts.Clear(cartToken); err != nil {
+			logging.LogError("cart", "cart_clear", err.Error(), map[string]interface{}{
+				"order_id": order.ID,
+			})
+		}
+
+		w.Header().Set("HX-Redirect", paymentURL)
 		w.WriteHeader(http.StatusOK)
 	})
 
@@ -428,139 +1036,126 @@ func main() {
 		checkout.HandleStripeWebhook(w, r)
 	})
 
-	// Consolidated product filter route
+	// Provider webhooks: /api/payments/{provider}/webhook
+	http.HandleFunc("/api/payments/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/api/payments/")
+		if !strings.HasSuffix(path, "/webhook") {
+			http.NotFound(w, r)
+			return
+		}
+		checkout.HandleWebhook(w, r, strings.TrimSuffix(path, "/webhook"))
+	})
+
+	// Consolidated product filter route: a page of product cards ending with the "load more"
+	// button. The first page is followed by the facets, which replace the filter panel out of band.
 	http.HandleFunc("/products/", func(w http.ResponseWriter, r *http.Request) {
-		slug := strings.TrimPrefix(r.URL.Path, "/products/")
-		brandIDs := parseBrandIDs(r.URL.Query().Get("brands"))
+		filters := parseCatalogFilters(r.URL.Query(), strings.TrimPrefix(r.URL.Path, "/products/"))
 
-		var prods []products.Product
-		var err error
+		page, err := products.GetCatalogPage(filters, parseCatalogPage(r.URL.Query()), catalogPageSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-		switch slug {
-		case "all":
-			prods, err = products.GetProductsByCategoryAndBrands("", brandIDs)
-		case "ofertas":
-			offerProducts, err := offers.GetActiveOffers()
+		var facets *products.CatalogFacets
+		if page.Page == 1 {
+			facets, err = products.GetCatalogFacets(filters)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			prods = make([]products.Product, len(offerProducts))
-			for i, offer := range offerProducts {
-				image, _ := products.GetPrimaryProductImage(offer.ProductID)
-				prods[i] = products.Product{
-					ID:             offer.ID,
-					ProductID:      offer.ProductID,
-					Name:           offer.Name,
-					Price:          offer.Price,
-					Image:          image,
-					Category:       offer.Category,
-					CategoryName:   offer.CategoryName,
-					IsOnOffer:      true,
-					OfferPrice:     offer.OfferPrice,
-					OfferStartDate: offer.StartDate,
-					OfferEndDate:   offer.EndDate,
-					IsAvailable:    true,
-				}
-			}
-		default:
-			prods, err = products.GetProductsByCategoryAndBrands(slug, brandIDs)
-		}
-
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
 		}
 
 		templateFile := "web/templates/product-cards.html"
-		if len(prods) == 0 {
+		if page.Total == 0 {
 			templateFile = "web/templates/product-empty-state.html"
 		}
 
-		tmpl, err := template.ParseFiles(templateFile)
+		funcs := installmentFuncMap()
+		funcs["catalogPrice"] = catalogPriceValue
+		tmpl, err := template.New(filepath.Base(templateFile)).Funcs(funcs).ParseFiles(templateFile, "web/templates/catalog-more.html", "web/templates/catalog-facets.html")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		tmpl.Execute(w, prods)
-	})
 
-	// Brands endpoint for filter UI
-	http.HandleFunc("/api/brands", func(w http.ResponseWriter, r *http.Request) {
-		brands, err := products.GetAllBrands()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		query := catalogQuery(filters)
+		// Keep the filter state in the storefront URL so the listing can be shared and bookmarked
+		if r.Header.Get("HX-Request") == "true" && facets != nil {
+			pageURL := "/"
+			if encoded := query.Encode(); encoded != "" {
+				pageURL += "?" + encoded
+			}
+			w.Header().Set("HX-Replace-Url", pageURL)
 		}
 
-		w.Header().Set("Content-Type", "text/html")
-		for _, brand := range brands {
-			fmt.Fprintf(w, `<button type="button"
-				data-brand-id="%d"
-				class="brand-pill px-3 py-1 rounded-full text-sm transition-colors duration-200 bg-gray-200 text-gray-700 hover:bg-gray-300"
-				onclick="toggleBrandFilter(this)">
-				%s
-			</button>`, brand.ID, brand.Name)
+		tmpl.Execute(w, page.Products)
+		if page.HasMore() {
+			query.Set("page", strconv.Itoa(page.NextPage()))
+			tmpl.ExecuteTemplate(w, "catalog-more.html", map[string]interface{}{
+				"URL":       template.URL("/products/all?" + query.Encode()),
+				"Remaining": page.Total - page.Page*page.PageSize,
+			})
+		}
+		if facets != nil {
+			tmpl.ExecuteTemplate(w, "catalog-facets.html", facets)
 		}
 	})
 
-	// Public categories endpoint for store filter
-	http.HandleFunc("/api/categories/options", func(w http.ResponseWriter, r *http.Request) {
+	// Catalog listing as JSON, with the same filters, sorting and pages as the storefront
+	http.HandleFunc("/api/products", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		categories, err := products.GetActiveCategories()
+		pageSize := catalogPageSize
+		if size, err := strconv.Atoi(r.URL.Query().Get("page_size")); err == nil && size > 0 && size <= catalogMaxPageSize {
+			pageSize = size
+		}
+
+		page, err := products.GetCatalogPage(parseCatalogFilters(r.URL.Query(), ""), parseCatalogPage(r.URL.Query()), pageSize)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		w.Header().Set("Content-Type", "text/html")
-		for _, c := range categories {
-			fmt.Fprintf(w, `<option value="%s">%s</option>`, c.Slug, c.Name)
+		if page.Products == nil {
+			page.Products = []products.Product{}
 		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			*products.CatalogPage
+			HasMore bool `json:"hasMore"`
+		}{page, page.HasMore()})
 	})
 
-	// Search endpoint for fuzzy product and brand search
+	// Search dropdown: the best product and brand matches while the customer types
 	http.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
-		query := r.URL.Query().Get("q")
-		if query == "" {
-			// Return empty results if no query
-			tmpl, err := template.ParseFiles("web/templates/search-results.html")
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			tmpl.Execute(w, map[string]interface{}{
-				"Query":    "",
-				"Products": []products.Product{},
-				"Brands":   []products.BrandSearchResult{},
-			})
-			return
-		}
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
 
-		// Search for products (max 6 results)
-		productResults, err := products.SearchProducts(query, 6)
+		productResults, err := products.SearchProducts(query, searchDropdownLimit)
 		if err != nil {
 			log.Printf("Error searching products: %v", err)
 			http.Error(w, "Error searching products", http.StatusInternalServerError)
 			return
 		}
 
-		// Search for brands (max 6 results)
-		brandResults, err := products.SearchBrandsWithCount(query, 6)
+		brandResults, err := products.SearchBrandsWithCount(query, searchDropdownLimit)
 		if err != nil {
 			log.Printf("Error searching brands: %v", err)
 			http.Error(w, "Error searching brands", http.StatusInternalServerError)
 			return
 		}
 
+		if err := analytics.LogSearch(query, len(productResults), analytics.SearchSourceDropdown, searchSessionKey(r)); err != nil {
+			log.Printf("Error logging search: %v", err)
+		}
+
 		// Prepare data for template
 		searchData := struct {
 			Query    string
-			Products []products.Product
+			Products []products.SearchResult
 			Brands   []products.BrandSearchResult
 		}{
 			Query:    query,
@@ -569,7 +1164,7 @@ func main() {
 		}
 
 		// Render the search results template
-		tmpl, err := template.ParseFiles("web/templates/search-results.html")
+		tmpl, err := template.New("search-results.html").Funcs(searchFuncMap()).ParseFiles("web/templates/search-results.html")
 		if err != nil {
 			log.Printf("Error parsing search results template: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -580,1460 +1175,3529 @@ func main() {
 		tmpl.Execute(w, searchData)
 	})
 
-	// Product detail page
-	http.HandleFunc("/produto/", func(w http.ResponseWriter, r *http.Request) {
+	// Search results page
+	http.HandleFunc("/busca", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// Extract product ID from URL
-		path := strings.TrimPrefix(r.URL.Path, "/produto/")
-		parts := strings.Split(path, "/")
-		if len(parts) == 0 || parts[0] == "" {
-			http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		page, err := products.SearchProductsPage(query, parseCatalogPage(r.URL.Query()), searchPageSize)
+		if err != nil {
+			log.Printf("Error searching products: %v", err)
+			http.Error(w, "Error searching products", http.StatusInternalServerError)
 			return
 		}
 
-		productID, err := strconv.Atoi(parts[0])
+		brandResults, err := products.SearchBrandsWithCount(query, searchDropdownLimit)
 		if err != nil {
-			http.Error(w, "Invalid product ID", http.StatusBadRequest)
+			log.Printf("Error searching brands: %v", err)
+			http.Error(w, "Error searching brands", http.StatusInternalServerError)
 			return
 		}
 
-		// Get product from database
-		product, err := products.GetProductByID(productID)
-		if err != nil {
-			// Check if product not found
-			if errors.Is(err, sql.ErrNoRows) {
-				http.Error(w, "Product not found", http.StatusNotFound)
-				return
+		// Following pages are the same search
+		if page.Page == 1 {
+			if err := analytics.LogSearch(query, page.Total, analytics.SearchSourcePage, searchSessionKey(r)); err != nil {
+				log.Printf("Error logging search: %v", err)
 			}
+		}
+
+		funcs := searchFuncMap()
+		for name, fn := range installmentFuncMap() {
+			funcs[name] = fn
+		}
+		tmpl, err := template.New("search.html").Funcs(funcs).ParseFiles("web/templates/search.html", "web/templates/footer.html")
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Rule 1: Block unavailable products
-		if !product.IsAvailable {
-			// Return 404 page
-			tmpl, err := template.ParseFiles("web/templates/404.html", "web/templates/footer.html")
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			w.WriteHeader(http.StatusNotFound)
-			tmpl.Execute(w, nil)
+		tmpl.Execute(w, map[string]interface{}{
+			"Search": page,
+			"Brands": brandResults,
+		})
+	})
+
+	// Category landing pages: the content edited in the category modal over a paginated grid
+	// of the category's products, subcategories included. Inactive categories have none.
+	http.HandleFunc("/categoria/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// Get brand names for this product
-		brandNames, err := products.GetBrandNamesByProductID(product.ProductID)
+		category, err := products.GetCategoryBySlug(strings.TrimPrefix(r.URL.Path, "/categoria/"))
+		if errors.Is(err, products.ErrCategoryNotFound) {
+			http.NotFound(w, r)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		// Get compatible products (for categories that allow compatibility)
-		var compatibleProducts []products.Product
-		if product.AllowsCompatibility {
-			compatibleProducts, err = products.GetCompatibleProductsByProductID(product.ProductID)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		if !category.IsActive {
+			http.NotFound(w, r)
+			return
 		}
 
-		// Get parts/refills compatible with this product
-		partsForProduct, err := products.GetPartsForProduct(product.ProductID)
+		page, err := products.GetCatalogPage(products.CatalogFilters{Category: category.Slug}, parseCatalogPage(r.URL.Query()), catalogPageSize)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if page.Page > 1 && len(page.Products) == 0 {
+			http.NotFound(w, r)
+			return
+		}
 
-		// Get related products (same category, excluding current product)
-		relatedProducts, err := products.GetRelatedProducts(product.ProductID, product.Category, 8)
+		path, err := products.GetCategoryPath(category.ID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		// Parse template with custom function map
-		tmpl, err := template.New("product.html").Funcs(template.FuncMap{
-			"sub": func(a, b float64) float64 {
-				return a - b
-			},
-		}).ParseFiles("web/templates/product.html", "web/templates/footer.html")
+		active, err := products.GetActiveCategories()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		data := productPageData{
-			Product:            product,
-			Brands:             brandNames,
-			CompatibleProducts: compatibleProducts,
-			PartsForProduct:    partsForProduct,
-			RelatedProducts:    relatedProducts,
+		data := categoryPageData{Category: category, Products: page}
+		if len(path) > 1 {
+			data.Ancestors = path[:len(path)-1]
+		}
+		for _, c := range active {
+			if c.ParentID == category.ID {
+				data.Subcategories = append(data.Subcategories, c)
+			}
 		}
 
+		tmpl, err := template.New("category.html").Funcs(installmentFuncMap()).ParseFiles("web/templates/category.html", "web/templates/product-cards.html", "web/templates/footer.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		tmpl.Execute(w, data)
 	})
 
-	// Admin routes
-	http.HandleFunc("/admin/login", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet {
-			// Check if already authenticated
-			if admin.IsAuthenticated(r) {
-				http.Redirect(w, r, "/admin", http.StatusSeeOther)
-				return
-			}
+	// Brand pages: the logo and description edited in the brand modal over a paginated grid
+	// of the brand's products
+	http.HandleFunc("/marca/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-			tmpl, err := template.ParseFiles("web/templates/admin-login.html")
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			tmpl.Execute(w, nil)
-			return
-		}
-
-		if r.Method == http.MethodPost {
-			username := r.FormValue("username")
-			password := r.FormValue("password")
-
-			err := admin.Login(w, username, password)
-			if err != nil {
-				tmpl, _ := template.ParseFiles("web/templates/admin-login.html")
-				tmpl.Execute(w, map[string]string{"Error": err.Error()})
-				return
-			}
-
-			http.Redirect(w, r, "/admin", http.StatusSeeOther)
+		brand, err := products.GetBrandBySlug(strings.TrimPrefix(r.URL.Path, "/marca/"))
+		if errors.Is(err, products.ErrBrandNotFound) {
+			http.NotFound(w, r)
 			return
 		}
-
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-	})
-
-	http.HandleFunc("/admin/logout", func(w http.ResponseWriter, r *http.Request) {
-		admin.Logout(w, r)
-		http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
-	})
-
-	http.HandleFunc("/admin", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		brands, err := products.GetAllBrands()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		productOptions, err := products.GetAllProductOptions()
+
+		page, err := products.GetCatalogPage(products.CatalogFilters{BrandIDs: []int{brand.ID}}, parseCatalogPage(r.URL.Query()), catalogPageSize)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		categories, err := products.GetAllCategories()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if page.Page > 1 && len(page.Products) == 0 {
+			http.NotFound(w, r)
 			return
 		}
-		tmpl, err := template.ParseFiles("web/templates/admin-dashboard.html")
+
+		tmpl, err := template.New("brand.html").Funcs(installmentFuncMap()).ParseFiles("web/templates/brand.html", "web/templates/product-cards.html", "web/templates/footer.html")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		tmpl.Execute(w, adminDashboardData{
-			CanViewOrders: true,
-			Brands:        brands,
-			Products:      productOptions,
-			Categories:    categories,
-		})
-	}))
+		tmpl.Execute(w, brandPageData{Brand: brand, Products: page})
+	})
 
-	http.HandleFunc("/admin/brands/new", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
+	// Refill finder: brand, then model, then the parts that fit it. Every step is a plain
+	// GET so banners and other pages can link to any of them.
+	http.HandleFunc("/encontre-seu-refil", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		tmpl, err := template.ParseFiles("web/templates/admin-brand-modal.html")
+
+		query := r.URL.Query()
+		data := refillFinderData{Query: strings.TrimSpace(query.Get("q"))}
+		data.BrandID, _ = strconv.Atoi(query.Get("brand"))
+		modelID, _ := strconv.Atoi(query.Get("model"))
+
+		var err error
+		data.Brands, err = products.GetFinderBrands()
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		tmpl.Execute(w, brandModalData{})
-	}))
+		if data.BrandID > 0 {
+			data.Models, err = products.GetFinderModels(data.BrandID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 
-	http.HandleFunc("/admin/categories", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+		if data.Query != "" && modelID == 0 {
+			data.Matches, err = products.FindModels(data.Query, finderMatchesLimit)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// A single match is the customer's model
+			if len(data.Matches) == 1 {
+				modelID = data.Matches[0].ID
+			}
 		}
-		tmpl, err := template.ParseFiles("web/templates/admin-categories.html")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+
+		if modelID > 0 {
+			data.Model, err = products.GetFinderModel(modelID)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			data.ModelNotFound = data.Model == nil
 		}
-		categories, err := products.GetAllCategories()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		if data.Model != nil {
+			data.Parts, err = products.GetPartsForProduct(data.Model.ID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 		}
-		tmpl.Execute(w, categories)
-	}))
 
-	http.HandleFunc("/admin/categories/new", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		tmpl, err := template.ParseFiles("web/templates/admin-category-modal.html")
+		tmpl, err := template.New("refill-finder.html").Funcs(installmentFuncMap()).ParseFiles(
+			"web/templates/refill-finder.html", "web/templates/product-cards.html", "web/templates/footer.html")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		tmpl.Execute(w, categoryModalData{})
-	}))
+		tmpl.Execute(w, data)
+	})
 
-	http.HandleFunc("/admin/categories/edit/", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
+	// Product detail page
+	http.HandleFunc("/produto/", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		path := strings.TrimPrefix(r.URL.Path, "/admin/categories/edit/")
-		id, err := strconv.Atoi(path)
-		if err != nil {
-			http.Error(w, "Invalid category ID", http.StatusBadRequest)
+
+		// Extract product ID from URL
+		path := strings.TrimPrefix(r.URL.Path, "/produto/")
+		parts := strings.Split(path, "/")
+		if len(parts) == 0 || parts[0] == "" {
+			http.Error(w, "Invalid product ID", http.StatusBadRequest)
 			return
 		}
-		category, err := products.GetCategoryByID(id)
+
+		productID, err := strconv.Atoi(parts[0])
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
+			http.Error(w, "Invalid product ID", http.StatusBadRequest)
 			return
 		}
-		tmpl, err := template.ParseFiles("web/templates/admin-category-modal.html")
+
+		// Get product from database
+		product, err := products.GetProductByID(productID)
 		if err != nil {
+			// Check if product not found
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "Product not found", http.StatusNotFound)
+				return
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		tmpl.Execute(w, categoryModalData{Category: category})
-	}))
 
-	http.HandleFunc("/admin/orders", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		tmpl, err := template.ParseFiles("web/templates/admin-orders.html")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		// Rule 1: Block unavailable products
+		if !product.IsAvailable {
+			// Return 404 page
+			tmpl, err := template.ParseFiles("web/templates/404.html", "web/templates/footer.html")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			tmpl.Execute(w, nil)
 			return
 		}
-		tmpl.Execute(w, nil)
-	}))
 
-	http.HandleFunc("/admin/banners", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		tmpl, err := template.ParseFiles("web/templates/admin-banners.html")
+		// Breadcrumb from the top-level category down to the product's
+		categoryPath, err := products.GetCategoryPath(product.CategoryID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		tmpl.Execute(w, nil)
-	}))
 
-	http.HandleFunc("/admin/offers", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		tmpl, err := template.ParseFiles("web/templates/admin-offers.html")
+		// Get brand names for this product
+		brandNames, err := products.GetBrandNamesByProductID(product.ProductID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		tmpl.Execute(w, nil)
-	}))
 
-	// Admin API routes
-	http.HandleFunc("/api/admin/orders", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+		// Get compatible products (for categories that allow compatibility)
+		var compatibleProducts []products.Product
+		if product.AllowsCompatibility {
+			compatibleProducts, err = products.GetCompatibleProductsByProductID(product.ProductID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 		}
 
-		status := r.URL.Query().Get("status")
-		paymentStatus := r.URL.Query().Get("payment_status")
-
-		filters := orders.OrderFilters{
-			Status:        status,
-			PaymentStatus: paymentStatus,
-			Limit:         50,
-			Offset:        0,
+		// Get parts/refills compatible with this product
+		partsForProduct, err := products.GetPartsForProduct(product.ProductID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		ordersList, err := orders.GetOrders(filters)
+		// Get related products (same category, excluding current product)
+		relatedProducts, err := products.GetRelatedProducts(product.ProductID, product.Category, 8)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		role, _ := admin.RoleFromRequest(r)
-		canViewFinancialData := role == "admin"
-
-		w.Header().Set("Content-Type", "text/html")
-		funcMap := orderFuncMap()
-		tmpl, err := template.New("admin-orders-list.html").Funcs(funcMap).ParseFiles("web/templates/admin-orders-list.html")
+		// Parse template with custom function map
+		tmpl, err := template.New("product.html").Funcs(template.FuncMap{
+			"sub": func(a, b float64) float64 {
+				return a - b
+			},
+		}).Funcs(installmentFuncMap()).ParseFiles("web/templates/product.html", "web/templates/footer.html")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		data := map[string]interface{}{
-			"Orders":               ordersList,
-			"CanViewFinancialData": canViewFinancialData,
+		data := productPageData{
+			Product:            product,
+			CategoryPath:       categoryPath,
+			Brands:             brandNames,
+			CompatibleProducts: compatibleProducts,
+			PartsForProduct:    partsForProduct,
+			RelatedProducts:    relatedProducts,
 		}
 
-		if canViewFinancialData {
-			totals, err := orders.GetOrderTotals(filters)
+		tmpl.Execute(w, data)
+	})
+
+	// Admin routes
+	http.HandleFunc("/admin/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// Check if already authenticated
+			if admin.IsAuthenticated(r) {
+				http.Redirect(w, r, "/admin", http.StatusSeeOther)
+				return
+			}
+
+			tmpl, err := template.ParseFiles("web/templates/admin-login.html")
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			data["Totals"] = totals
+			data := map[string]string{}
+			if r.URL.Query().Get("reset") == "1" {
+				data["Notice"] = "Senha redefinida. Entre com a nova senha."
+			}
+			tmpl.Execute(w, data)
+			return
 		}
 
-		tmpl.Execute(w, data)
-	}))
+		if r.Method == http.MethodPost {
+			username := r.FormValue("username")
+			password := r.FormValue("password")
 
-	http.HandleFunc("/api/admin/brands/options", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			err := admin.Login(w, r, username, password)
+			if errors.Is(err, admin.ErrTwoFactorRequired) {
+				http.Redirect(w, r, "/admin/login/2fa", http.StatusSeeOther)
+				return
+			}
+			if errors.Is(err, admin.ErrTwoFactorSetupRequired) {
+				http.Redirect(w, r, "/admin/login/2fa/setup", http.StatusSeeOther)
+				return
+			}
+			var throttled *admin.LoginThrottledError
+			if errors.As(err, &throttled) {
+				w.Header().Set("Retry-After", strconv.Itoa(int(throttled.RetryAfter.Seconds())+1))
+				w.WriteHeader(http.StatusTooManyRequests)
+			}
+			if err != nil {
+				tmpl, _ := template.ParseFiles("web/templates/admin-login.html")
+				tmpl.Execute(w, map[string]string{"Error": err.Error()})
+				return
+			}
+
+			http.Redirect(w, r, "/admin", http.StatusSeeOther)
 			return
 		}
-		brands, err := products.GetAllBrands()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	})
+
+	http.HandleFunc("/admin/login/2fa", func(w http.ResponseWriter, r *http.Request) {
+		pending, ok := admin.PendingLoginFromRequest(r)
+		if !ok || pending.Enroll {
+			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
 			return
 		}
-		tmpl, err := template.ParseFiles("web/templates/admin-brand-options.html")
+
+		tmpl, err := template.ParseFiles("web/templates/admin-login-2fa.html")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		w.Header().Set("Content-Type", "text/html")
-		tmpl.Execute(w, brands)
-	}))
+		data := map[string]string{"Username": pending.Username}
 
-	http.HandleFunc("/api/admin/brands", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		if err := r.ParseForm(); err != nil {
-			http.Error(w, "Invalid form data", http.StatusBadRequest)
-			return
-		}
-		name := r.FormValue("name")
-		brand, err := products.CreateBrand(name)
-		if err != nil {
-			if r.Header.Get("HX-Request") == "true" {
-				tmpl, tmplErr := template.ParseFiles("web/templates/admin-brand-modal.html")
-				if tmplErr != nil {
-					http.Error(w, tmplErr.Error(), http.StatusInternalServerError)
-					return
-				}
-				setCacheHeaders(w, 86400) // 1 day cache for modal template
-				w.WriteHeader(http.StatusBadRequest)
-				tmpl.Execute(w, brandModalData{Name: name, Error: err.Error()})
+		switch r.Method {
+		case http.MethodGet:
+			tmpl.Execute(w, data)
+
+		case http.MethodPost:
+			err := admin.VerifyTwoFactorLogin(w, r, r.FormValue("code"))
+			if errors.Is(err, admin.ErrTwoFactorLoginExpired) {
+				loginTmpl, _ := template.ParseFiles("web/templates/admin-login.html")
+				loginTmpl.Execute(w, map[string]string{"Error": err.Error()})
 				return
 			}
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		if r.Header.Get("HX-Request") == "true" {
-			w.Header().Set("HX-Trigger", "refreshBrands,closeBrandModal")
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(brand)
-	}))
+			if err != nil {
+				data["Error"] = err.Error()
+				tmpl.Execute(w, data)
+				return
+			}
+			http.Redirect(w, r, "/admin", http.StatusSeeOther)
 
-	// Admin category API routes
-	http.HandleFunc("/api/admin/categories/options", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
+		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/admin/login/2fa/setup", func(w http.ResponseWriter, r *http.Request) {
+		pending, ok := admin.PendingLoginFromRequest(r)
+		if !ok || !pending.Enroll {
+			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
 			return
 		}
-		categories, err := products.GetAllCategories()
+
+		tmpl, err := template.ParseFiles(
+			"web/templates/admin-2fa-setup.html",
+			"web/templates/admin-2fa-qr.html",
+			"web/templates/admin-backup-codes.html",
+		)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		tmpl, err := template.ParseFiles("web/templates/admin-category-options.html")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Content-Type", "text/html")
-		tmpl.Execute(w, categories)
-	}))
+		w.Header().Set("Cache-Control", "no-store")
+		data := map[string]interface{}{"Username": pending.Username}
 
-	http.HandleFunc("/api/admin/categories", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			categories, err := products.GetAllCategories()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		case http.MethodPost:
+			codes, err := admin.CompleteLoginEnrollment(w, r, r.FormValue("code"))
+			if errors.Is(err, admin.ErrTwoFactorLoginExpired) {
+				loginTmpl, _ := template.ParseFiles("web/templates/admin-login.html")
+				loginTmpl.Execute(w, map[string]string{"Error": err.Error()})
 				return
 			}
-			tmpl, err := template.ParseFiles("web/templates/admin-category-list.html")
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if err == nil {
+				data["BackupCodes"] = codes
+				tmpl.Execute(w, data)
 				return
 			}
-			w.Header().Set("Content-Type", "text/html")
-			tmpl.Execute(w, categories)
+			data["Error"] = err.Error()
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		enrollment, err := admin.BeginLoginEnrollment(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data["Enrollment"] = enrollmentViewData(enrollment)
+		tmpl.Execute(w, data)
+	})
+
+	http.HandleFunc("/admin/password", func(w http.ResponseWriter, r *http.Request) {
+		// Plain session check: admins holding a temporary password are sent here by the other admin routes
+		if !admin.IsAuthenticated(r) {
+			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+			return
+		}
+
+		tmpl, err := adminPageTemplate(r, "web/templates/admin-password.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data := map[string]interface{}{
+			"MustChange": admin.MustChangePassword(r),
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			tmpl.Execute(w, data)
 
 		case http.MethodPost:
-			if err := r.ParseForm(); err != nil {
-				http.Error(w, "Invalid form data", http.StatusBadRequest)
+			if !admin.ValidCSRFToken(r) {
+				data["Error"] = "Sessão expirada ou formulário inválido. Recarregue a página e tente novamente."
+				tmpl.Execute(w, data)
 				return
 			}
-			name := r.FormValue("name")
-			allowsCompatibility := r.FormValue("allows_compatibility") == "on"
-
-			category, err := products.CreateCategory(name, allowsCompatibility)
+			err := admin.ChangePassword(w, r, r.FormValue("current_password"), r.FormValue("new_password"), r.FormValue("confirm_password"))
 			if err != nil {
-				if r.Header.Get("HX-Request") == "true" {
-					tmpl, tmplErr := template.ParseFiles("web/templates/admin-category-modal.html")
-					if tmplErr != nil {
-						http.Error(w, tmplErr.Error(), http.StatusInternalServerError)
-						return
-					}
-					w.WriteHeader(http.StatusBadRequest)
-					tmpl.Execute(w, categoryModalData{Error: err.Error()})
-					return
-				}
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-
-			if r.Header.Get("HX-Request") == "true" {
-				w.Header().Set("HX-Trigger", "refreshCategories,closeCategoryModal")
-				w.WriteHeader(http.StatusNoContent)
+				data["Error"] = err.Error()
+				tmpl.Execute(w, data)
 				return
 			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusCreated)
-			json.NewEncoder(w).Encode(category)
+			http.Redirect(w, r, "/admin", http.StatusSeeOther)
 
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
-	}))
+	})
 
-	http.HandleFunc("/api/admin/categories/", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		path := strings.TrimPrefix(r.URL.Path, "/api/admin/categories/")
+	http.HandleFunc("/admin/forgot-password", func(w http.ResponseWriter, r *http.Request) {
+		tmpl, err := template.ParseFiles("web/templates/admin-forgot-password.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-		// Handle toggle: /api/admin/categories/{id}/toggle
-		if strings.HasSuffix(path, "/toggle") {
-			if r.Method != http.MethodPut {
-				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-				return
-			}
+		switch r.Method {
+		case http.MethodGet:
+			tmpl.Execute(w, nil)
 
-			idStr := strings.TrimSuffix(path, "/toggle")
-			id, err := strconv.Atoi(idStr)
-			if err != nil {
-				http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		case http.MethodPost:
+			// The same answer is shown whether or not the account exists
+			if err := admin.RequestPasswordReset(r, r.FormValue("login"), checkout.BaseURL()+"/admin/reset-password"); err != nil {
+				logging.LogError("admin", "password_reset_request", err.Error(), nil)
+				tmpl.Execute(w, map[string]interface{}{"Error": "Não foi possível enviar o link agora. Tente novamente em alguns minutos."})
 				return
 			}
+			tmpl.Execute(w, map[string]interface{}{"Sent": true})
 
-			if err := products.ToggleCategoryActive(id); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
 
-			if r.Header.Get("HX-Request") == "true" {
-				w.Header().Set("HX-Trigger", "refreshCategories")
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-			w.WriteHeader(http.StatusOK)
+	http.HandleFunc("/admin/reset-password", func(w http.ResponseWriter, r *http.Request) {
+		tmpl, err := template.ParseFiles("web/templates/admin-reset-password.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		// The token is in the URL: keep the page out of caches and referrers
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
 
-		// Handle update: /api/admin/categories/{id}
-		if r.Method == http.MethodPut {
-			id, err := strconv.Atoi(path)
-			if err != nil {
-				http.Error(w, "Invalid category ID", http.StatusBadRequest)
-				return
-			}
-
-			if err := r.ParseForm(); err != nil {
-				http.Error(w, "Invalid form data", http.StatusBadRequest)
-				return
+		token := r.FormValue("token")
+		data := map[string]interface{}{"Token": token}
+		account, err := admin.ValidateResetToken(token)
+		if err != nil {
+			if !errors.Is(err, admin.ErrInvalidResetToken) {
+				logging.LogError("admin", "password_reset_validate", err.Error(), nil)
 			}
+			data["Error"] = admin.ErrInvalidResetToken.Error()
+			tmpl.Execute(w, data)
+			return
+		}
+		data["Username"] = account.Username
 
-			name := r.FormValue("name")
-			allowsCompatibility := r.FormValue("allows_compatibility") == "on"
-			isActive := r.FormValue("is_active") == "on"
+		switch r.Method {
+		case http.MethodGet:
+			tmpl.Execute(w, data)
 
-			if err := products.UpdateCategory(id, name, allowsCompatibility, isActive); err != nil {
-				if r.Header.Get("HX-Request") == "true" {
-					tmpl, tmplErr := template.ParseFiles("web/templates/admin-category-modal.html")
-					if tmplErr != nil {
-						http.Error(w, tmplErr.Error(), http.StatusInternalServerError)
-						return
-					}
-					w.WriteHeader(http.StatusBadRequest)
-					cat, _ := products.GetCategoryByID(id)
-					tmpl.Execute(w, categoryModalData{Category: cat, Error: err.Error()})
-					return
+		case http.MethodPost:
+			err := admin.ResetPasswordWithToken(r, token, r.FormValue("new_password"), r.FormValue("confirm_password"))
+			if err != nil {
+				if errors.Is(err, admin.ErrInvalidResetToken) {
+					delete(data, "Username")
 				}
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				data["Error"] = err.Error()
+				tmpl.Execute(w, data)
 				return
 			}
+			http.Redirect(w, r, "/admin/login?reset=1", http.StatusSeeOther)
 
-			if r.Header.Get("HX-Request") == "true" {
-				w.Header().Set("HX-Trigger", "refreshCategories,closeCategoryModal")
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-			w.WriteHeader(http.StatusOK)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/admin/security", admin.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		adminID, _ := admin.AdminIDFromRequest(r)
+		account, err := admin.GetAdminByID(adminID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status, err := admin.GetTwoFactorStatus(adminID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tmpl, err := adminPageTemplate(r, "web/templates/admin-security.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		tmpl.Execute(w, map[string]interface{}{
+			"Username": account.Username,
+			"Status":   status,
+		})
 	}))
 
-	// Banner management routes
-	http.HandleFunc("/api/admin/banners", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			// Return HTML list for HTMX requests
-			if r.Header.Get("HX-Request") == "true" {
-				tmpl, err := template.ParseFiles("web/templates/admin-banner-list.html")
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+	// Self-service second factor: /api/admin/security/2fa/{setup|confirm|backup-codes|disable}
+	http.HandleFunc("/api/admin/security/2fa/", admin.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-				bannerList, err := banners.GetAllBanners()
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+		adminID, _ := admin.AdminIDFromRequest(r)
+		action := strings.TrimPrefix(r.URL.Path, "/api/admin/security/2fa/")
+		w.Header().Set("Cache-Control", "no-store")
 
-				w.Header().Set("Content-Type", "text/html")
-				tmpl.Execute(w, bannerList)
-			} else {
-				// Return JSON for non-HTMX requests
-				w.Header().Set("Content-Type", "application/json")
-				bannerList, err := banners.GetAllBanners()
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				json.NewEncoder(w).Encode(bannerList)
-			}
+		tmpl, err := template.ParseFiles("web/templates/admin-2fa-qr.html", "web/templates/admin-backup-codes.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-		case http.MethodPost:
-			// Parse multipart form (max 5MB)
-			if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-				http.Error(w, "File too large or invalid form data", http.StatusBadRequest)
+		switch action {
+		case "setup":
+			account, err := admin.GetAdminByID(adminID)
+			if err != nil {
+				renderSecurityError(w, err)
 				return
 			}
-
-			// Get form values
-			title := r.FormValue("title")
-			linkURL := r.FormValue("link_url")
-
-			// Validate title is required
-			if title == "" {
-				http.Error(w, "Title is required", http.StatusBadRequest)
+			enrollment, err := admin.BeginTOTPEnrollment(adminID, account.Username)
+			if err != nil {
+				renderSecurityError(w, err)
 				return
 			}
+			tmpl.ExecuteTemplate(w, "two-factor-enroll", enrollmentViewData(enrollment))
 
-			// Handle file upload
-			imagePath, err := handleImageUpload(r, "image")
+		case "confirm":
+			codes, err := admin.ConfirmTOTPEnrollment(adminID, r.FormValue("code"))
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Image upload failed: %v", err), http.StatusBadRequest)
+				renderSecurityError(w, err)
 				return
 			}
+			tmpl.ExecuteTemplate(w, "backup-codes", codes)
 
-			// Create banner
-			banner, err := banners.CreateBanner(imagePath, title, linkURL)
+		case "backup-codes":
+			codes, err := admin.RegenerateBackupCodes(adminID, r.FormValue("code"))
 			if err != nil {
-				// Clean up uploaded file on failure
-				os.Remove(filepath.Join(uploadPath, filepath.Base(imagePath)))
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				renderSecurityError(w, err)
 				return
 			}
+			tmpl.ExecuteTemplate(w, "backup-codes", codes)
 
-			if r.Header.Get("HX-Request") == "true" {
-				w.Header().Set("HX-Trigger", "refreshBanners")
-				w.WriteHeader(http.StatusCreated)
+		case "disable":
+			if err := admin.DisableTwoFactor(adminID, r.FormValue("code")); err != nil {
+				renderSecurityError(w, err)
 				return
 			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusCreated)
-			json.NewEncoder(w).Encode(banner)
+			w.Header().Set("HX-Refresh", "true")
+			w.WriteHeader(http.StatusOK)
 
 		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			http.Error(w, "Not found", http.StatusNotFound)
 		}
 	}))
 
-	// Delete banner route
-	http.HandleFunc("/api/admin/banners/", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		path := strings.TrimPrefix(r.URL.Path, "/api/admin/banners/")
-
-		// Handle toggle status: /api/admin/banners/{id}/toggle
-		if strings.HasSuffix(path, "/toggle") {
-			if r.Method != http.MethodPut {
-				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-				return
-			}
-
-			idStr := strings.TrimSuffix(path, "/toggle")
-			id, err := strconv.Atoi(idStr)
-			if err != nil {
-				http.Error(w, "Invalid banner ID", http.StatusBadRequest)
-				return
-			}
+	http.HandleFunc("/admin/logout", func(w http.ResponseWriter, r *http.Request) {
+		admin.Logout(w, r)
+		http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+	})
 
-			isActive, err := banners.ToggleBannerStatus(id)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+	http.HandleFunc("/admin", admin.RequireAuth(func(w http.ResponseWriter, r *http.Request) {
+		permissions := admin.PermissionsFromRequest(r)
+		if !permissions[admin.PermProductsWrite] {
+			// Send admins without catalog access to the first screen they can use
+			switch {
+			case permissions[admin.PermOrdersRead]:
+				http.Redirect(w, r, "/admin/orders", http.StatusSeeOther)
+			case permissions[admin.PermUsersManage]:
+				http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+			case permissions[admin.PermBannersWrite]:
+				http.Redirect(w, r, "/admin/banners", http.StatusSeeOther)
+			case permissions[admin.PermOffersWrite]:
+				http.Redirect(w, r, "/admin/offers", http.StatusSeeOther)
+			case permissions[admin.PermDeliveriesRun]:
+				http.Redirect(w, r, "/admin/deliveries", http.StatusSeeOther)
+			default:
+				http.Error(w, "Forbidden", http.StatusForbidden)
 			}
+			return
+		}
 
-			if r.Header.Get("HX-Request") == "true" {
-				w.Header().Set("HX-Trigger", "refreshBanners")
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]bool{"is_active": isActive})
+		brands, err := products.GetAllBrands()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		productOptions, err := products.GetAllProductOptions()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		categories, err := products.GetAllCategories()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl, err := adminPageTemplate(r, "web/templates/admin-dashboard.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		tmpl.Execute(w, adminDashboardData{
+			CanViewOrders:  permissions[admin.PermOrdersRead],
+			CanManageUsers: permissions[admin.PermUsersManage],
+			CanViewAudit:   permissions[admin.PermAuditRead],
+			Brands:         brands,
+			Products:       productOptions,
+			Categories:     categories,
 
-		// Handle reorder: /api/admin/banners/{id}/reorder
-		if strings.HasSuffix(path, "/reorder") {
-			if r.Method != http.MethodPost {
-				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-				return
-			}
+			CanViewAnalytics: permissions[admin.PermOrdersFinancial],
 
-			idStr := strings.TrimSuffix(path, "/reorder")
-			id, err := strconv.Atoi(idStr)
-			if err != nil {
-				http.Error(w, "Invalid banner ID", http.StatusBadRequest)
-				return
-			}
+			CanViewDeliveries: permissions[admin.PermDeliveriesRun],
+		})
+	}))
 
-			if err := r.ParseForm(); err != nil {
-				http.Error(w, "Invalid form data", http.StatusBadRequest)
-				return
-			}
+	http.HandleFunc("/admin/brands/new", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tmpl, err := template.ParseFiles("web/templates/admin-brand-modal.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, brandModalData{})
+	}))
 
-			newOrder, err := strconv.Atoi(r.FormValue("order"))
-			if err != nil {
-				http.Error(w, "Invalid order value", http.StatusBadRequest)
-				return
-			}
+	http.HandleFunc("/admin/brands", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tmpl, err := adminPageTemplate(r, "web/templates/admin-brands.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, nil)
+	}))
 
-			if err := banners.UpdateBannerOrder(id, newOrder); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+	http.HandleFunc("/admin/brands/edit/", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/admin/brands/edit/"))
+		if err != nil {
+			http.Error(w, "Invalid brand ID", http.StatusBadRequest)
+			return
+		}
+		brand, err := products.GetBrandByID(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		tmpl, err := template.ParseFiles("web/templates/admin-brand-modal.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data, err := newBrandModalData(brand, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, data)
+	}))
 
-			if r.Header.Get("HX-Request") == "true" {
-				w.Header().Set("HX-Trigger", "refreshBanners")
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-			w.WriteHeader(http.StatusOK)
+	http.HandleFunc("/admin/categories", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tmpl, err := adminPageTemplate(r, "web/templates/admin-categories.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		categories, err := products.GetAllCategories()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, categories)
+	}))
 
-		// Handle delete: /api/admin/banners/{id}
-		if r.Method != http.MethodDelete {
+	http.HandleFunc("/admin/categories/new", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		tmpl, err := template.ParseFiles("web/templates/admin-category-modal.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data, err := newCategoryModalData(nil, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// "Adicionar subcategoria" opens the modal with the parent chosen
+		data.ParentID, _ = strconv.Atoi(r.URL.Query().Get("parent"))
+		tmpl.Execute(w, data)
+	}))
 
+	http.HandleFunc("/admin/categories/edit/", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/admin/categories/edit/")
 		id, err := strconv.Atoi(path)
 		if err != nil {
-			http.Error(w, "Invalid banner ID", http.StatusBadRequest)
+			http.Error(w, "Invalid category ID", http.StatusBadRequest)
 			return
 		}
-
-		// Get banner to delete its image file
-		banner, err := banners.GetBannerByID(id)
+		category, err := products.GetCategoryByID(id)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
+		tmpl, err := template.ParseFiles("web/templates/admin-category-modal.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data, err := newCategoryModalData(category, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, data)
+	}))
 
-		// Delete from database
-		if err := banners.DeleteBanner(id); err != nil {
+	http.HandleFunc("/admin/orders", admin.RequirePermission(admin.PermOrdersRead)(func(w http.ResponseWriter, r *http.Request) {
+		neighborhoods, err := orders.GetNeighborhoods()
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Delete image file
-		os.Remove(filepath.Join(uploadPath, filepath.Base(banner.ImagePath)))
+		tmpl, err := adminPageTemplate(r, "web/templates/admin-orders.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, map[string]interface{}{
+			"Neighborhoods":        neighborhoods,
+			"CanViewFinancialData": admin.HasPermission(r, admin.PermOrdersFinancial),
+			"ExportColumns":        availableOrderExportColumns(r),
+		})
+	}))
 
-		if r.Header.Get("HX-Request") == "true" {
-			w.Header().Set("HX-Trigger", "refreshBanners")
-			w.WriteHeader(http.StatusOK)
+	http.HandleFunc("/admin/banners", admin.RequirePermission(admin.PermBannersWrite)(func(w http.ResponseWriter, r *http.Request) {
+		tmpl, err := adminPageTemplate(r, "web/templates/admin-banners.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
+		tmpl.Execute(w, nil)
 	}))
 
-	// Public banner endpoint - returns carousel HTML
-	http.HandleFunc("/api/banners", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/admin/offers", admin.RequirePermission(admin.PermOffersWrite)(func(w http.ResponseWriter, r *http.Request) {
+		tmpl, err := adminPageTemplate(r, "web/templates/admin-offers.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, nil)
+	}))
+
+	// Admin API routes
+	http.HandleFunc("/api/admin/orders", admin.RequirePermission(admin.PermOrdersRead)(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		tmpl, err := template.ParseFiles("web/templates/carousel.html")
+		canViewFinancialData := admin.HasPermission(r, admin.PermOrdersFinancial)
+
+		filters, err := parseOrderFilters(r, canViewFinancialData)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			renderAdminError(w, err)
 			return
 		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		filters.Limit = orderPageSize
+		filters.Offset = (page - 1) * orderPageSize
 
-		bannerList, err := banners.GetActiveBanners()
+		ordersList, err := orders.GetOrders(filters)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		total, err := orders.CountOrders(filters)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "text/html")
-		tmpl.Execute(w, bannerList)
-	})
-
-	// Admin offers management routes
-	http.HandleFunc("/api/admin/offers", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			// Return HTML list for HTMX requests
-			if r.Header.Get("HX-Request") == "true" {
-				tmpl, err := template.ParseFiles("web/templates/admin-offers-list.html")
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				offerList, err := offers.GetAllOffers()
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				w.Header().Set("Content-Type", "text/html")
-				tmpl.Execute(w, offerList)
-			} else {
-				// Return JSON for non-HTMX requests
-				w.Header().Set("Content-Type", "application/json")
-				offerList, err := offers.GetAllOffers()
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				json.NewEncoder(w).Encode(offerList)
-			}
+		funcMap := orderFuncMap()
+		tmpl, err := template.New("admin-orders-list.html").Funcs(funcMap).ParseFiles("web/templates/admin-orders-list.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-		case http.MethodPost:
-			if err := r.ParseForm(); err != nil {
-				http.Error(w, "Invalid form data", http.StatusBadRequest)
-				return
-			}
+		data := map[string]interface{}{
+			"Orders":               ordersList,
+			"CanViewFinancialData": canViewFinancialData,
+			"Total":                total,
+			"Page":                 page,
+			"PrevPage":             page - 1,
+			"NextPage":             page + 1,
+			"HasNext":              page*orderPageSize < total,
+		}
 
-			productID, err := strconv.Atoi(r.FormValue("product_id"))
+		if canViewFinancialData {
+			totals, err := orders.GetOrderTotals(filters)
 			if err != nil {
-				http.Error(w, "Invalid product ID", http.StatusBadRequest)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			data["Totals"] = totals
+		}
 
-			offerPrice, err := strconv.ParseFloat(r.FormValue("offer_price"), 64)
+		tmpl.Execute(w, data)
+	}))
+
+	// Printable packing slips and installation service orders, for chosen orders (?id=) or for
+	// every order in processing (optionally only those placed on ?date=)
+	http.HandleFunc("/admin/orders/print", admin.RequirePermission(admin.PermOrdersRead)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		filters := orders.OrderFilters{SortBy: "created_at"}
+		for _, value := range query["id"] {
+			id, err := strconv.Atoi(value)
 			if err != nil {
-				http.Error(w, "Invalid offer price", http.StatusBadRequest)
+				http.Error(w, "Invalid order ID", http.StatusBadRequest)
 				return
 			}
+			filters.IDs = append(filters.IDs, id)
+		}
+		var day *time.Time
+		if len(filters.IDs) == 0 {
+			filters.Status = "processing"
+			if value := query.Get("date"); value != "" {
+				start, err := time.ParseInLocation("2006-01-02", value, time.Local)
+				if err != nil {
+					http.Error(w, errInvalidOrderFilter.Error(), http.StatusBadRequest)
+					return
+				}
+				end := start.AddDate(0, 0, 1)
+				filters.From, filters.To, day = &start, &end, &start
+			}
+		}
 
-			form := offers.OfferForm{
-				ProductID:  productID,
-				OfferPrice: offerPrice,
-			}
-
-			// Parse optional dates
-			startDateStr := r.FormValue("offer_start_date")
-			if startDateStr != "" {
-				startDate, err := time.Parse("2006-01-02T15:04", startDateStr)
-				if err == nil {
-					form.StartDate = &startDate
-				}
-			}
-
-			endDateStr := r.FormValue("offer_end_date")
-			if endDateStr != "" {
-				endDate, err := time.Parse("2006-01-02T15:04", endDateStr)
-				if err == nil {
-					form.EndDate = &endDate
-				}
-			}
-
-			if err := offers.CreateOffer(form); err != nil {
-				if r.Header.Get("HX-Request") == "true" {
-					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
-					tmpl.Execute(w, err.Error())
-				} else {
-					http.Error(w, err.Error(), http.StatusBadRequest)
-				}
-				return
-			}
-
-			if r.Header.Get("HX-Request") == "true" {
-				w.Header().Set("HX-Trigger", "refreshOffers")
-				w.WriteHeader(http.StatusCreated)
-				return
-			}
-			w.WriteHeader(http.StatusCreated)
-
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	}))
-
-	// Admin offers products endpoint - returns available products for selection
-	http.HandleFunc("/api/admin/offers/products", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		documents, err := orders.GetOrderDocuments(filters)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		products, err := offers.GetProductsForOfferSelection()
+		// doc chooses the documents: "slip", "service" or both by default
+		doc := query.Get("doc")
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "no-store")
+		tmpl, err := template.New("admin-order-print.html").Funcs(orderFuncMap()).ParseFiles("web/templates/admin-order-print.html")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		tmpl.Execute(w, map[string]interface{}{
+			"Documents":               documents,
+			"Day":                     day,
+			"Batch":                   len(filters.IDs) == 0,
+			"PackingSlips":            doc != "service",
+			"ServiceOrder":            doc != "slip",
+			"InstallationServiceName": orders.InstallationServiceName,
+		})
+	}))
 
-		w.Header().Set("Content-Type", "text/html")
-		for _, p := range products {
-			fmt.Fprintf(w, `<option value="%d">%s</option>`, p.ID, p.Name)
+	// Delivery runs: planners see every run and the orders ready to go out; drivers and
+	// technicians see the runs assigned to them
+	http.HandleFunc("/admin/deliveries", admin.RequirePermission(admin.PermDeliveriesRun)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
-	}))
 
-	// Admin offer detail/update/delete routes
-	http.HandleFunc("/api/admin/offers/", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		path := strings.TrimPrefix(r.URL.Path, "/api/admin/offers/")
+		canManage := admin.HasPermission(r, admin.PermDeliveriesManage)
+		data := map[string]interface{}{
+			"CanManage": canManage,
+			"Today":     time.Now().Format("2006-01-02"),
+		}
 
-		switch r.Method {
-		case http.MethodPut:
-			id, err := strconv.Atoi(path)
+		assigneeID := 0
+		if canManage {
+			groups, err := deliveries.GetReadyOrders()
 			if err != nil {
-				http.Error(w, "Invalid offer ID", http.StatusBadRequest)
-				return
-			}
-
-			if err := r.ParseForm(); err != nil {
-				http.Error(w, "Invalid form data", http.StatusBadRequest)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-
-			offerPrice, err := strconv.ParseFloat(r.FormValue("offer_price"), 64)
+			assignees, err := admin.ListActiveAdminsWithPermission(admin.PermDeliveriesRun)
 			if err != nil {
-				http.Error(w, "Invalid offer price", http.StatusBadRequest)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			data["ReadyGroups"] = groups
+			data["Assignees"] = assignees
+		} else {
+			assigneeID, _ = admin.AdminIDFromRequest(r)
+		}
 
-			form := offers.OfferForm{
-				OfferPrice: offerPrice,
-			}
-
-			// Parse optional dates
-			startDateStr := r.FormValue("offer_start_date")
-			if startDateStr != "" {
-				startDate, err := time.Parse("2006-01-02T15:04", startDateStr)
-				if err == nil {
-					form.StartDate = &startDate
-				}
-			}
-
-			endDateStr := r.FormValue("offer_end_date")
-			if endDateStr != "" {
-				endDate, err := time.Parse("2006-01-02T15:04", endDateStr)
-				if err == nil {
-					form.EndDate = &endDate
-				}
-			}
+		runs, err := deliveries.GetRuns(assigneeID, deliveryRunsLimit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data["Runs"] = runs
 
-			if err := offers.UpdateOffer(id, form); err != nil {
-				if r.Header.Get("HX-Request") == "true" {
-					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
-					tmpl.Execute(w, err.Error())
-				} else {
-					http.Error(w, err.Error(), http.StatusBadRequest)
-				}
-				return
-			}
+		tmpl, err := adminPageTemplate(r, "web/templates/admin-deliveries.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, data)
+	}))
 
-			if r.Header.Get("HX-Request") == "true" {
-				w.Header().Set("HX-Trigger", "refreshOffers")
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-			w.WriteHeader(http.StatusOK)
+	http.HandleFunc("/api/admin/deliveries", admin.RequirePermission(admin.PermDeliveriesManage)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form", http.StatusBadRequest)
+			return
+		}
 
-		case http.MethodDelete:
-			id, err := strconv.Atoi(path)
-			if err != nil {
-				http.Error(w, "Invalid offer ID", http.StatusBadRequest)
-				return
+		runDate, err := time.ParseInLocation("2006-01-02", r.FormValue("run_date"), time.Local)
+		if err != nil {
+			renderDeliveryError(w, errInvalidDeliveryRun)
+			return
+		}
+		assigneeID, err := strconv.Atoi(r.FormValue("assignee_id"))
+		if err != nil {
+			renderDeliveryError(w, errInvalidDeliveryRun)
+			return
+		}
+		assignees, err := admin.ListActiveAdminsWithPermission(admin.PermDeliveriesRun)
+		if err != nil {
+			renderDeliveryError(w, err)
+			return
+		}
+		assigneeName := ""
+		for _, assignee := range assignees {
+			if assignee.ID == assigneeID {
+				assigneeName = assignee.Username
 			}
+		}
+		if assigneeName == "" {
+			renderDeliveryError(w, errInvalidDeliveryRun)
+			return
+		}
 
-			_, err = offers.ToggleOfferStatus(id)
+		var orderIDs []int
+		for _, value := range r.Form["order_id"] {
+			id, err := strconv.Atoi(value)
 			if err != nil {
-				if r.Header.Get("HX-Request") == "true" {
-					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
-					tmpl.Execute(w, err.Error())
-				} else {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-				}
-				return
-			}
-
-			if r.Header.Get("HX-Request") == "true" {
-				w.Header().Set("HX-Trigger", "refreshOffers")
-				w.WriteHeader(http.StatusOK)
+				http.Error(w, "Invalid order ID", http.StatusBadRequest)
 				return
 			}
-			w.WriteHeader(http.StatusOK)
+			orderIDs = append(orderIDs, id)
+		}
 
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		createdBy, _ := admin.AdminIDFromRequest(r)
+		runID, err := deliveries.CreateRun(runDate, assigneeID, createdBy, orderIDs)
+		if err != nil {
+			renderDeliveryError(w, err)
+			return
 		}
+		audit.Record(r, audit.ActionCreate, audit.EntityDeliveryRun, runID, nil, map[string]interface{}{
+			"run_date": runDate.Format("2006-01-02"),
+			"assignee": assigneeName,
+			"orders":   orderIDs,
+		})
+
+		w.Header().Set("HX-Redirect", fmt.Sprintf("/admin/deliveries/%d", runID))
+		w.WriteHeader(http.StatusOK)
 	}))
 
-	http.HandleFunc("/api/admin/orders/", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
+	// Mobile-friendly page of a run, used on the road to mark each stop delivered
+	http.HandleFunc("/admin/deliveries/{id}", admin.RequirePermission(admin.PermDeliveriesRun)(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		path := strings.TrimPrefix(r.URL.Path, "/api/admin/orders/")
-		id, err := strconv.Atoi(path)
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/admin/deliveries/"))
 		if err != nil {
-			http.Error(w, "Invalid order ID", http.StatusBadRequest)
+			http.Error(w, "Invalid run ID", http.StatusBadRequest)
+			return
+		}
+		run, err := deliveries.GetRun(id)
+		if errors.Is(err, deliveries.ErrRunNotFound) {
+			http.NotFound(w, r)
 			return
 		}
-
-		order, items, err := orders.GetOrderWithItems(id)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if !canAccessDeliveryRun(r, run) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
 
-		role, _ := admin.RoleFromRequest(r)
-		canViewFinancialData := role == "admin"
-
-		w.Header().Set("Content-Type", "text/html")
-		funcMap := orderFuncMap()
-		tmpl, err := template.New("admin-order-detail.html").Funcs(funcMap).ParseFiles("web/templates/admin-order-detail.html")
+		tmpl, err := adminPageTemplate(r, "web/templates/admin-delivery-run.html")
+		if err == nil {
+			tmpl, err = tmpl.Funcs(orderFuncMap()).ParseFiles("web/templates/admin-delivery-stops.html")
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		tmpl.Execute(w, map[string]interface{}{
-			"Order":                order,
-			"Items":                items,
-			"CanViewFinancialData": canViewFinancialData,
+			"Run":       run,
+			"CanManage": admin.HasPermission(r, admin.PermDeliveriesManage),
 		})
 	}))
 
-	http.HandleFunc("/api/admin/orders/{id}/status-modal", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
+	http.HandleFunc("/api/admin/deliveries/{id}/replan", admin.RequirePermission(admin.PermDeliveriesRun)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		path := strings.TrimPrefix(r.URL.Path, "/api/admin/orders/")
-		path = strings.TrimSuffix(path, "/status-modal")
-		id, err := strconv.Atoi(path)
+		path := strings.TrimPrefix(r.URL.Path, "/api/admin/deliveries/")
+		id, err := strconv.Atoi(strings.TrimSuffix(path, "/replan"))
 		if err != nil {
-			http.Error(w, "Invalid order ID", http.StatusBadRequest)
+			http.Error(w, "Invalid run ID", http.StatusBadRequest)
 			return
 		}
-
-		order, err := orders.GetOrderByID(id)
+		run, err := deliveries.GetRun(id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			renderDeliveryError(w, err)
 			return
 		}
-
-		setCacheHeaders(w, 86400) // 1 day cache for static modal
-		w.Header().Set("Content-Type", "text/html")
-		tmpl, err := template.ParseFiles("web/templates/admin-order-status-modal.html")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if !canAccessDeliveryRun(r, run) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
-		tmpl.Execute(w, map[string]interface{}{
-			"OrderID":       order.ID,
-			"CurrentStatus": order.Status,
-		})
+		if err := deliveries.ReplanRun(id); err != nil {
+			renderDeliveryError(w, err)
+			return
+		}
+		if after, err := deliveries.GetRun(id); err == nil {
+			audit.Record(r, audit.ActionUpdate, audit.EntityDeliveryRun, id, map[string]interface{}{
+				"stop_order": deliveryStopOrder(run),
+			}, map[string]interface{}{
+				"stop_order": deliveryStopOrder(after),
+			})
+		}
+		renderDeliveryStops(w, r, id)
 	}))
 
-	http.HandleFunc("/api/admin/orders/{id}/status", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/api/admin/deliveries/{id}/delete", admin.RequirePermission(admin.PermDeliveriesManage)(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		path := strings.TrimPrefix(r.URL.Path, "/api/admin/orders/")
-		path = strings.TrimSuffix(path, "/status")
-		id, err := strconv.Atoi(path)
+		path := strings.TrimPrefix(r.URL.Path, "/api/admin/deliveries/")
+		id, err := strconv.Atoi(strings.TrimSuffix(path, "/delete"))
 		if err != nil {
-			http.Error(w, "Invalid order ID", http.StatusBadRequest)
+			http.Error(w, "Invalid run ID", http.StatusBadRequest)
+			return
+		}
+		before, err := deliveries.GetRun(id)
+		if err != nil {
+			renderDeliveryError(w, err)
+			return
+		}
+		if err := deliveries.DeleteRun(id); err != nil {
+			renderDeliveryError(w, err)
 			return
 		}
+		audit.Record(r, audit.ActionDelete, audit.EntityDeliveryRun, id, map[string]interface{}{
+			"run_date": before.RunDate.Format("2006-01-02"),
+			"assignee": before.AssigneeName,
+			"stops":    before.StopCount,
+		}, nil)
 
-		status := r.FormValue("status")
-		if status == "" {
-			http.Error(w, "Status is required", http.StatusBadRequest)
+		w.Header().Set("HX-Redirect", "/admin/deliveries")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Marks a stop delivered and completes its order
+	http.HandleFunc("/api/admin/deliveries/stops/{id}/delivered", admin.RequirePermission(admin.PermDeliveriesRun)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		err = orders.UpdateOrderStatus(id, status)
+		path := strings.TrimPrefix(r.URL.Path, "/api/admin/deliveries/stops/")
+		id, err := strconv.Atoi(strings.TrimSuffix(path, "/delivered"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Invalid stop ID", http.StatusBadRequest)
 			return
 		}
-
-		// Return the updated order row
-		order, err := orders.GetOrderByID(id)
+		stop, err := deliveries.GetStop(id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			renderDeliveryError(w, err)
 			return
 		}
-
-		role, _ := admin.RoleFromRequest(r)
-		canViewFinancialData := role == "admin"
-
-		w.Header().Set("Content-Type", "text/html")
-		funcMap := orderFuncMap()
-		tmpl, err := template.New("admin-order-row.html").Funcs(funcMap).ParseFiles("web/templates/admin-order-row.html")
+		run, err := deliveries.GetRun(stop.RunID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			renderDeliveryError(w, err)
 			return
 		}
-		tmpl.Execute(w, map[string]interface{}{
-			"Order":                order,
-			"CanViewFinancialData": canViewFinancialData,
-		})
+		if !canAccessDeliveryRun(r, run) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if stop.DeliveredAt == nil {
+			before, _ := orders.GetOrderByID(stop.OrderID)
+			adminID, _ := admin.AdminIDFromRequest(r)
+			if err := deliveries.MarkStopDelivered(id, adminID); err != nil {
+				renderDeliveryError(w, err)
+				return
+			}
+			after, _ := orders.GetOrderByID(stop.OrderID)
+			audit.Record(r, audit.ActionUpdate, audit.EntityOrder, stop.OrderID, before, after)
+		}
+		renderDeliveryStops(w, r, stop.RunID)
 	}))
 
-	http.HandleFunc("/api/admin/products", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			// Check if this is an HTMX request for HTML fragment
-			if r.Header.Get("HX-Request") == "true" {
-				tmpl, err := template.ParseFiles("web/templates/admin-product-list.html")
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+	// Saves coordinates for a stop address (or its whole neighborhood) and replans the run
+	http.HandleFunc("/api/admin/deliveries/stops/{id}/location", admin.RequirePermission(admin.PermDeliveriesRun)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-				prods, err := products.GetAllProducts()
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+		path := strings.TrimPrefix(r.URL.Path, "/api/admin/deliveries/stops/")
+		id, err := strconv.Atoi(strings.TrimSuffix(path, "/location"))
+		if err != nil {
+			http.Error(w, "Invalid stop ID", http.StatusBadRequest)
+			return
+		}
+		stop, err := deliveries.GetStop(id)
+		if err != nil {
+			renderDeliveryError(w, err)
+			return
+		}
+		run, err := deliveries.GetRun(stop.RunID)
+		if err != nil {
+			renderDeliveryError(w, err)
+			return
+		}
+		if !canAccessDeliveryRun(r, run) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
 
-				w.Header().Set("Content-Type", "text/html")
-				tmpl.Execute(w, prods)
-			} else {
-				// Original JSON response for non-HTMX requests
-				w.Header().Set("Content-Type", "application/json")
-				prods, err := products.GetAllProducts()
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-				json.NewEncoder(w).Encode(prods)
-			}
+		point, err := deliveries.ParseCoordinates(r.FormValue("coordinates"))
+		if err != nil {
+			renderDeliveryError(w, err)
+			return
+		}
+		scope := "address"
+		if r.FormValue("scope") == "neighborhood" {
+			scope = "neighborhood"
+		}
+		if _, err := deliveries.SetStopLocation(id, point, scope == "neighborhood"); err != nil {
+			renderDeliveryError(w, err)
+			return
+		}
+		before := map[string]interface{}{}
+		if stop.Location != nil {
+			before[fmt.Sprintf("stop_%d_coordinates", id)] = fmt.Sprintf("%.6f, %.6f", stop.Location.Latitude, stop.Location.Longitude)
+		}
+		after := map[string]interface{}{
+			fmt.Sprintf("stop_%d_coordinates", id): fmt.Sprintf("%.6f, %.6f", point.Latitude, point.Longitude),
+			fmt.Sprintf("stop_%d_scope", id):       scope,
+		}
+		if replanned, err := deliveries.GetRun(stop.RunID); err == nil {
+			before["stop_order"] = deliveryStopOrder(run)
+			after["stop_order"] = deliveryStopOrder(replanned)
+		}
+		audit.Record(r, audit.ActionUpdate, audit.EntityDeliveryRun, stop.RunID, before, after)
+		renderDeliveryStops(w, r, stop.RunID)
+	}))
 
-		case http.MethodPost:
-			// Parse multipart form (max 5MB)
-			if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-				http.Error(w, "File too large or invalid form data", http.StatusBadRequest)
-				return
-			}
+	// Export of the orders matching the list filters, streamed as CSV or XLSX
+	http.HandleFunc("/admin/orders/export", admin.RequirePermission(admin.PermOrdersRead)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-			// Get form values
-			name := r.FormValue("name")
-			priceStr := r.FormValue("price")
-			categoryIDStr := r.FormValue("category_id")
-			description := r.FormValue("description")
-			sku := r.FormValue("sku")
-			isAvailableStr := r.FormValue("is_available")
-			brandIDs, err := parseIDList(r.Form["brand_ids"])
-			if err != nil {
-				http.Error(w, "Invalid brand selection", http.StatusBadRequest)
-				return
-			}
-			fitsProductIDs, err := parseIDList(r.Form["fits_product_ids"])
-			if err != nil {
-				http.Error(w, "Invalid compatibility selection", http.StatusBadRequest)
-				return
-			}
-			partProductIDs, err := parseIDList(r.Form["part_product_ids"])
-			if err != nil {
-				http.Error(w, "Invalid part selection", http.StatusBadRequest)
-				return
-			}
+		filters, err := parseOrderFilters(r, admin.HasPermission(r, admin.PermOrdersFinancial))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query := r.URL.Query()
+		format := query.Get("format")
+		if format == "" {
+			format = "csv"
+		}
+		withItems := query.Get("items") == "1"
+		columns := selectOrderExportColumns(availableOrderExportColumns(r), query["columns"], withItems)
+		if (format != "csv" && format != "xlsx") || len(columns) == 0 {
+			http.Error(w, errInvalidOrderExport.Error(), http.StatusBadRequest)
+			return
+		}
 
-			if name == "" || priceStr == "" || categoryIDStr == "" {
-				http.Error(w, "Missing required fields", http.StatusBadRequest)
-				return
+		filename := "pedidos-" + time.Now().Format("20060102-150405") + "." + format
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		w.Header().Set("Cache-Control", "no-store")
+
+		var writer spreadsheet.Writer
+		if format == "xlsx" {
+			w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+			writer, err = spreadsheet.NewXLSX(w, "Pedidos")
+		} else {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			writer, err = spreadsheet.NewCSV(w)
+		}
+		if err != nil {
+			logging.LogError("orders", "export", err.Error(), nil)
+			return
+		}
+
+		titles := make([]string, len(columns))
+		for i, column := range columns {
+			titles[i] = column.Label
+		}
+		writer.WriteHeader(titles)
+
+		err = orders.EachOrder(filters, withItems, func(order orders.Order, item *orders.OrderItem) error {
+			cells := make([]spreadsheet.Cell, len(columns))
+			for i, column := range columns {
+				if column.Item && item == nil {
+					cells[i] = spreadsheet.Text("")
+					continue
+				}
+				cells[i] = column.Value(order, item)
 			}
+			return writer.WriteRow(cells)
+		})
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			logging.LogError("orders", "export", err.Error(), map[string]interface{}{
+				"format": format,
+			})
+		}
+	}))
 
-			categoryID, err := strconv.Atoi(categoryIDStr)
+	http.HandleFunc("/api/admin/brands/options", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		brands, err := products.GetAllBrands()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl, err := template.ParseFiles("web/templates/admin-brand-options.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		tmpl.Execute(w, brands)
+	}))
+
+	http.HandleFunc("/api/admin/brands", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			brands, err := products.GetBrandsWithCount()
 			if err != nil {
-				http.Error(w, "Invalid category", http.StatusBadRequest)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-
-			price, err := strconv.ParseFloat(priceStr, 64)
+			tmpl, err := template.ParseFiles("web/templates/admin-brand-list.html")
 			if err != nil {
-				http.Error(w, "Invalid price format", http.StatusBadRequest)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			w.Header().Set("Content-Type", "text/html")
+			tmpl.Execute(w, brands)
 
-			isAvailable := isAvailableStr == "on"
-			// Create product
-			product, err := products.CreateProduct(name, price, categoryID, description, sku, isAvailable, brandIDs, fitsProductIDs, partProductIDs)
-			if err != nil {
-				// Return error message for HTMX
-				if r.Header.Get("HX-Request") == "true" {
-					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
-					tmpl.Execute(w, err.Error())
-				} else {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-				}
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "Invalid form data", http.StatusBadRequest)
 				return
 			}
-
-			// Handle multiple image uploads
-			if err := handleMultipleImageUploads(r, "images", product.ProductID); err != nil {
-				// Clean up product if image upload fails
-				products.DeleteProduct(product.ID)
+			name := r.FormValue("name")
+			brand, err := products.CreateBrand(name)
+			if err != nil {
 				if r.Header.Get("HX-Request") == "true" {
-					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
-					tmpl.Execute(w, err.Error())
-				} else {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					tmpl, tmplErr := template.ParseFiles("web/templates/admin-brand-modal.html")
+					if tmplErr != nil {
+						http.Error(w, tmplErr.Error(), http.StatusInternalServerError)
+						return
+					}
+					setCacheHeaders(w, 86400) // 1 day cache for modal template
+					w.WriteHeader(http.StatusBadRequest)
+					tmpl.Execute(w, brandModalData{Name: name, Error: err.Error()})
+					return
 				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-
-			// Return product card HTML for HTMX
+			audit.Record(r, audit.ActionCreate, audit.EntityBrand, brand.ID, nil, brand)
 			if r.Header.Get("HX-Request") == "true" {
-				tmpl, err := template.ParseFiles("web/templates/admin-product-card.html")
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				w.Header().Set("Content-Type", "text/html")
-				tmpl.Execute(w, product)
-			} else {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusCreated)
-				json.NewEncoder(w).Encode(product)
+				w.Header().Set("HX-Trigger", "refreshBrands,closeBrandModal")
+				w.WriteHeader(http.StatusNoContent)
+				return
 			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(brand)
 
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	}))
 
-	http.HandleFunc("/api/admin/products/", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		// Extract path after /api/admin/products/
-		path := strings.TrimPrefix(r.URL.Path, "/api/admin/products/")
-		parts := strings.Split(path, "/")
+	http.HandleFunc("/api/admin/brands/", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/api/admin/brands/")
 
-		// Check if this is an image delete request: /{productID}/images/{imageID}
-		if len(parts) >= 3 && parts[1] == "images" {
-			productID, err := strconv.Atoi(parts[0])
+		// Handle merge: /api/admin/brands/{id}/merge moves the products to target_id and
+		// deletes the brand
+		if strings.HasSuffix(path, "/merge") {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			id, err := strconv.Atoi(strings.TrimSuffix(path, "/merge"))
 			if err != nil {
-				http.Error(w, "Invalid product ID", http.StatusBadRequest)
+				http.Error(w, "Invalid brand ID", http.StatusBadRequest)
 				return
 			}
-			imageID, err := strconv.Atoi(parts[2])
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "Invalid form data", http.StatusBadRequest)
+				return
+			}
+			targetID, err := strconv.Atoi(r.FormValue("target_id"))
 			if err != nil {
-				http.Error(w, "Invalid image ID", http.StatusBadRequest)
+				http.Error(w, "Invalid target brand ID", http.StatusBadRequest)
 				return
 			}
 
-			if r.Method == http.MethodDelete {
-				// Get image to find file path
-				images, err := products.GetProductImages(productID)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				var imageURL string
-				for _, img := range images {
-					if img.ID == imageID {
-						imageURL = img.ImageURL
-						break
-					}
-				}
-
-				// Delete from database
-				if err := products.DeleteProductImage(imageID); err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
-
-				// Delete file from filesystem if it's in uploads folder
-				if strings.Contains(imageURL, "/uploads/") {
-					filePath := filepath.Join("web/static", strings.TrimPrefix(imageURL, "/static/"))
-					os.Remove(filePath)
-				}
-
-				// Return empty response for HTMX
-				if r.Header.Get("HX-Request") == "true" {
-					w.WriteHeader(http.StatusOK)
-				} else {
-					w.Header().Set("Content-Type", "application/json")
-					json.NewEncoder(w).Encode(map[string]string{"message": "Image deleted successfully"})
-				}
+			source, err := products.GetBrandByID(id)
+			if err != nil {
+				renderAdminError(w, err)
+				return
+			}
+			target, err := products.GetBrandByID(targetID)
+			if err != nil {
+				renderAdminError(w, err)
+				return
+			}
+			moved, err := products.MergeBrands(id, targetID)
+			if err != nil {
+				renderAdminError(w, err)
 				return
 			}
+			audit.Record(r, audit.ActionDelete, audit.EntityBrand, id, map[string]interface{}{
+				"name":        source.Name,
+				"merged_into": target.Name,
+				"products":    moved,
+			}, nil)
+			removeUploadedImage(source.Logo)
+
+			w.Header().Set("HX-Trigger", "refreshBrands,closeBrandModal")
+			w.WriteHeader(http.StatusOK)
+			return
 		}
 
-		// Regular product ID parsing
 		id, err := strconv.Atoi(path)
 		if err != nil {
-			http.Error(w, "Invalid product ID", http.StatusBadRequest)
+			http.Error(w, "Invalid brand ID", http.StatusBadRequest)
 			return
 		}
 
 		switch r.Method {
 		case http.MethodPut:
-			// Parse multipart form
 			if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-				fmt.Printf("\n%v\n", err.Error())
 				http.Error(w, "File too large or invalid form data", http.StatusBadRequest)
 				return
 			}
 
-			// Get form values
-			name := r.FormValue("name")
-			priceStr := r.FormValue("price")
-			categoryIDStr := r.FormValue("category_id")
-			description := r.FormValue("description")
-			sku := r.FormValue("sku")
-			isAvailableStr := r.FormValue("is_available")
-			brandIDs, err := parseIDList(r.Form["brand_ids"])
+			before, err := products.GetBrandByID(id)
 			if err != nil {
-				http.Error(w, "Invalid brand selection", http.StatusBadRequest)
+				http.Error(w, err.Error(), http.StatusNotFound)
 				return
 			}
-			fitsProductIDs, err := parseIDList(r.Form["fits_product_ids"])
+			logo := before.Logo
+			if r.FormValue("remove_logo") == "on" {
+				logo = ""
+			}
+			uploaded, err := uploadBrandLogo(r)
+			if err == nil {
+				if uploaded != "" {
+					logo = uploaded
+				}
+				err = products.UpdateBrand(id, r.FormValue("name"), r.FormValue("slug"), logo, r.FormValue("description"))
+				if err != nil {
+					removeUploadedImage(uploaded)
+				}
+			}
 			if err != nil {
-				http.Error(w, "Invalid compatibility selection", http.StatusBadRequest)
+				if r.Header.Get("HX-Request") == "true" {
+					tmpl, tmplErr := template.ParseFiles("web/templates/admin-brand-modal.html")
+					if tmplErr != nil {
+						http.Error(w, tmplErr.Error(), http.StatusInternalServerError)
+						return
+					}
+					data, dataErr := newBrandModalData(before, err.Error())
+					if dataErr != nil {
+						http.Error(w, dataErr.Error(), http.StatusInternalServerError)
+						return
+					}
+					w.WriteHeader(http.StatusBadRequest)
+					tmpl.Execute(w, data)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			partProductIDs, err := parseIDList(r.Form["part_product_ids"])
+			after, _ := products.GetBrandByID(id)
+			audit.Record(r, audit.ActionUpdate, audit.EntityBrand, id, before, after)
+
+			// The replaced or removed logo is no longer used
+			if before.Logo != logo {
+				removeUploadedImage(before.Logo)
+			}
+
+			if r.Header.Get("HX-Request") == "true" {
+				w.Header().Set("HX-Trigger", "refreshBrands,closeBrandModal")
+			}
+			w.WriteHeader(http.StatusOK)
+
+		case http.MethodDelete:
+			before, err := products.GetBrandByID(id)
 			if err != nil {
-				http.Error(w, "Invalid part selection", http.StatusBadRequest)
+				renderBrandError(w, err)
 				return
 			}
-
-			if name == "" || priceStr == "" || categoryIDStr == "" {
-				http.Error(w, "Missing required fields", http.StatusBadRequest)
+			if err := products.DeleteBrand(id); err != nil {
+				renderBrandError(w, err)
 				return
 			}
+			audit.Record(r, audit.ActionDelete, audit.EntityBrand, id, before, nil)
+			removeUploadedImage(before.Logo)
 
-			categoryID, err := strconv.Atoi(categoryIDStr)
+			w.Header().Set("HX-Trigger", "refreshBrands")
+			w.WriteHeader(http.StatusOK)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	// Admin category API routes
+	http.HandleFunc("/api/admin/categories/options", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		categories, err := products.GetAllCategories()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl, err := template.ParseFiles("web/templates/admin-category-options.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		tmpl.Execute(w, categories)
+	}))
+
+	http.HandleFunc("/api/admin/categories", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			categories, err := products.GetAllCategories()
 			if err != nil {
-				http.Error(w, "Invalid category", http.StatusBadRequest)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-
-			price, err := strconv.ParseFloat(priceStr, 64)
+			tmpl, err := template.ParseFiles("web/templates/admin-category-list.html")
 			if err != nil {
-				http.Error(w, "Invalid price format", http.StatusBadRequest)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			w.Header().Set("Content-Type", "text/html")
+			tmpl.Execute(w, categories)
 
-			// Parse is_available checkbox (unchecked checkboxes are not sent in form data)
-			isAvailable := isAvailableStr == "on"
-
-			// Update product
-			if err := products.UpdateProduct(id, name, price, categoryID, description, sku, isAvailable, brandIDs, fitsProductIDs, partProductIDs); err != nil {
-				// Return error message for HTMX
+		case http.MethodPost:
+			if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+				http.Error(w, "File too large or invalid form data", http.StatusBadRequest)
+				return
+			}
+			name := r.FormValue("name")
+			allowsCompatibility := r.FormValue("allows_compatibility") == "on"
+			parentID, _ := strconv.Atoi(r.FormValue("parent_id"))
+			content := categoryContentFromForm(r)
+
+			heroImage, err := uploadCategoryHeroImage(r)
+			var category *products.Category
+			if err == nil {
+				content.HeroImage = heroImage
+				category, err = products.CreateCategory(name, allowsCompatibility, parentID, content)
+				if err != nil {
+					removeUploadedImage(heroImage)
+				}
+			}
+			if err != nil {
 				if r.Header.Get("HX-Request") == "true" {
-					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
-					tmpl.Execute(w, err.Error())
-				} else {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					tmpl, tmplErr := template.ParseFiles("web/templates/admin-category-modal.html")
+					if tmplErr != nil {
+						http.Error(w, tmplErr.Error(), http.StatusInternalServerError)
+						return
+					}
+					data, dataErr := newCategoryModalData(nil, err.Error())
+					if dataErr != nil {
+						http.Error(w, dataErr.Error(), http.StatusInternalServerError)
+						return
+					}
+					data.ParentID = parentID
+					w.WriteHeader(http.StatusBadRequest)
+					tmpl.Execute(w, data)
+					return
 				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			audit.Record(r, audit.ActionCreate, audit.EntityCategory, category.ID, nil, category)
 
-			// Get product ID for images
-			product, err := products.GetProductByID(id)
+			if r.Header.Get("HX-Request") == "true" {
+				w.Header().Set("HX-Trigger", "refreshCategories,closeCategoryModal")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(category)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	http.HandleFunc("/api/admin/categories/", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/api/admin/categories/")
+
+		// Handle toggle: /api/admin/categories/{id}/toggle
+		if strings.HasSuffix(path, "/toggle") {
+			if r.Method != http.MethodPut {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			idStr := strings.TrimSuffix(path, "/toggle")
+			id, err := strconv.Atoi(idStr)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, "Invalid category ID", http.StatusBadRequest)
 				return
 			}
 
-			// Handle multiple image uploads
-			if err := handleMultipleImageUploads(r, "images", product.ProductID); err != nil {
-				if r.Header.Get("HX-Request") == "true" {
-					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
-					tmpl.Execute(w, err.Error())
-				} else {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-				}
+			before, _ := products.GetCategoryByID(id)
+			if err := products.ToggleCategoryActive(id); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			after, _ := products.GetCategoryByID(id)
+			audit.Record(r, audit.ActionUpdate, audit.EntityCategory, id, before, after)
 
-			// Return updated product card HTML for HTMX
 			if r.Header.Get("HX-Request") == "true" {
-				// Get the updated product data
-				updatedProduct, err := products.GetProductByID(id)
-				if err != nil {
-					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
-					tmpl.Execute(w, err.Error())
-					return
-				}
+				w.Header().Set("HX-Trigger", "refreshCategories")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 
-				tmpl, err := template.ParseFiles("web/templates/admin-product-card.html")
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+		// Handle drag and drop: /api/admin/categories/{id}/move
+		if strings.HasSuffix(path, "/move") {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
 
-				w.Header().Set("Content-Type", "text/html")
-				w.Header().Set("HX-Trigger", "closeEditModal")
-				tmpl.Execute(w, updatedProduct)
-			} else {
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]string{"message": "Product updated successfully"})
+			id, err := strconv.Atoi(strings.TrimSuffix(path, "/move"))
+			if err != nil {
+				http.Error(w, "Invalid category ID", http.StatusBadRequest)
+				return
+			}
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "Invalid form data", http.StatusBadRequest)
+				return
+			}
+			targetID, err := strconv.Atoi(r.FormValue("target_id"))
+			if err != nil {
+				http.Error(w, "Invalid target category ID", http.StatusBadRequest)
+				return
 			}
 
-		case http.MethodDelete:
-			// Get product to find image path
-			product, err := products.GetProductByID(id)
-			if err == nil && strings.Contains(product.Image, "/uploads/") {
-				// Delete image file if it's in uploads folder
-				imagePath := filepath.Join("web/static", strings.TrimPrefix(product.Image, "/static/"))
-				os.Remove(imagePath)
+			// The list is reloaded either way, putting a refused drop back in place
+			w.Header().Set("HX-Trigger", "refreshCategories")
+			before, _ := products.GetCategoryByID(id)
+			if err := products.MoveCategory(id, targetID, r.FormValue("placement")); err != nil {
+				renderCategoryError(w, err)
+				return
 			}
+			after, _ := products.GetCategoryByID(id)
+			audit.Record(r, audit.ActionUpdate, audit.EntityCategory, id, before, after)
 
-			if err := products.DeleteProduct(id); err != nil {
-				// Return error message for HTMX
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		// Handle update: /api/admin/categories/{id}
+		if r.Method == http.MethodPut {
+			id, err := strconv.Atoi(path)
+			if err != nil {
+				http.Error(w, "Invalid category ID", http.StatusBadRequest)
+				return
+			}
+
+			if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+				http.Error(w, "File too large or invalid form data", http.StatusBadRequest)
+				return
+			}
+
+			name := r.FormValue("name")
+			allowsCompatibility := r.FormValue("allows_compatibility") == "on"
+			isActive := r.FormValue("is_active") == "on"
+			parentID, _ := strconv.Atoi(r.FormValue("parent_id"))
+			content := categoryContentFromForm(r)
+
+			before, _ := products.GetCategoryByID(id)
+			if before != nil && r.FormValue("remove_hero_image") != "on" {
+				content.HeroImage = before.HeroImage
+			}
+			heroImage, err := uploadCategoryHeroImage(r)
+			if err == nil {
+				if heroImage != "" {
+					content.HeroImage = heroImage
+				}
+				err = products.UpdateCategory(id, name, allowsCompatibility, isActive, parentID, content)
+				if err != nil {
+					removeUploadedImage(heroImage)
+				}
+			}
+			if err != nil {
 				if r.Header.Get("HX-Request") == "true" {
-					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
-					tmpl.Execute(w, err.Error())
-				} else {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					tmpl, tmplErr := template.ParseFiles("web/templates/admin-category-modal.html")
+					if tmplErr != nil {
+						http.Error(w, tmplErr.Error(), http.StatusInternalServerError)
+						return
+					}
+					cat, _ := products.GetCategoryByID(id)
+					data, dataErr := newCategoryModalData(cat, err.Error())
+					if dataErr != nil {
+						http.Error(w, dataErr.Error(), http.StatusInternalServerError)
+						return
+					}
+					w.WriteHeader(http.StatusBadRequest)
+					tmpl.Execute(w, data)
+					return
 				}
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			after, _ := products.GetCategoryByID(id)
+			audit.Record(r, audit.ActionUpdate, audit.EntityCategory, id, before, after)
+
+			// The replaced or removed hero image is no longer used
+			if before != nil && before.HeroImage != content.HeroImage {
+				removeUploadedImage(before.HeroImage)
+			}
 
-			// Return empty response for HTMX (element will be deleted)
 			if r.Header.Get("HX-Request") == "true" {
+				w.Header().Set("HX-Trigger", "refreshCategories,closeCategoryModal")
 				w.WriteHeader(http.StatusOK)
-			} else {
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(map[string]string{"message": "Product deleted successfully"})
+				return
 			}
-
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			w.WriteHeader(http.StatusOK)
+			return
 		}
+
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}))
 
-	// HTMX-specific admin routes
-	http.HandleFunc("/admin/products/", admin.RequireRole("admin", "product_admin")(func(w http.ResponseWriter, r *http.Request) {
-		// Extract ID from path
-		path := strings.TrimPrefix(r.URL.Path, "/admin/products/")
-		parts := strings.Split(path, "/")
-		if len(parts) < 1 {
-			http.Error(w, "Invalid path", http.StatusBadRequest)
+	// Banner management routes
+	http.HandleFunc("/api/admin/banners", admin.RequirePermission(admin.PermBannersWrite)(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			// Return HTML list for HTMX requests
+			if r.Header.Get("HX-Request") == "true" {
+				tmpl, err := template.ParseFiles("web/templates/admin-banner-list.html")
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				bannerList, err := banners.GetAllBanners()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				w.Header().Set("Content-Type", "text/html")
+				tmpl.Execute(w, bannerList)
+			} else {
+				// Return JSON for non-HTMX requests
+				w.Header().Set("Content-Type", "application/json")
+				bannerList, err := banners.GetAllBanners()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				json.NewEncoder(w).Encode(bannerList)
+			}
+
+		case http.MethodPost:
+			// Parse multipart form (max 5MB)
+			if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+				http.Error(w, "File too large or invalid form data", http.StatusBadRequest)
+				return
+			}
+
+			// Get form values
+			title := r.FormValue("title")
+			linkURL := r.FormValue("link_url")
+
+			// Validate title is required
+			if title == "" {
+				http.Error(w, "Title is required", http.StatusBadRequest)
+				return
+			}
+
+			// Handle file upload
+			imagePath, err := handleImageUpload(r, "image")
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Image upload failed: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			// Create banner
+			banner, err := banners.CreateBanner(imagePath, title, linkURL)
+			if err != nil {
+				// Clean up uploaded file on failure
+				os.Remove(filepath.Join(uploadPath, filepath.Base(imagePath)))
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			audit.Record(r, audit.ActionCreate, audit.EntityBanner, banner.ID, nil, banner)
+
+			if r.Header.Get("HX-Request") == "true" {
+				w.Header().Set("HX-Trigger", "refreshBanners")
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(banner)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	// Delete banner route
+	http.HandleFunc("/api/admin/banners/", admin.RequirePermission(admin.PermBannersWrite)(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/api/admin/banners/")
+
+		// Handle toggle status: /api/admin/banners/{id}/toggle
+		if strings.HasSuffix(path, "/toggle") {
+			if r.Method != http.MethodPut {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			idStr := strings.TrimSuffix(path, "/toggle")
+			id, err := strconv.Atoi(idStr)
+			if err != nil {
+				http.Error(w, "Invalid banner ID", http.StatusBadRequest)
+				return
+			}
+
+			before, _ := banners.GetBannerByID(id)
+			isActive, err := banners.ToggleBannerStatus(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			after, _ := banners.GetBannerByID(id)
+			audit.Record(r, audit.ActionUpdate, audit.EntityBanner, id, before, after)
+
+			if r.Header.Get("HX-Request") == "true" {
+				w.Header().Set("HX-Trigger", "refreshBanners")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]bool{"is_active": isActive})
+			return
+		}
+
+		// Handle reorder: /api/admin/banners/{id}/reorder
+		if strings.HasSuffix(path, "/reorder") {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			idStr := strings.TrimSuffix(path, "/reorder")
+			id, err := strconv.Atoi(idStr)
+			if err != nil {
+				http.Error(w, "Invalid banner ID", http.StatusBadRequest)
+				return
+			}
+
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "Invalid form data", http.StatusBadRequest)
+				return
+			}
+
+			newOrder, err := strconv.Atoi(r.FormValue("order"))
+			if err != nil {
+				http.Error(w, "Invalid order value", http.StatusBadRequest)
+				return
+			}
+
+			before, _ := banners.GetBannerByID(id)
+			if err := banners.UpdateBannerOrder(id, newOrder); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			after, _ := banners.GetBannerByID(id)
+			audit.Record(r, audit.ActionUpdate, audit.EntityBanner, id, before, after)
+
+			if r.Header.Get("HX-Request") == "true" {
+				w.Header().Set("HX-Trigger", "refreshBanners")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		// Handle delete: /api/admin/banners/{id}
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, err := strconv.Atoi(path)
+		if err != nil {
+			http.Error(w, "Invalid banner ID", http.StatusBadRequest)
+			return
+		}
+
+		// Get banner to delete its image file
+		banner, err := banners.GetBannerByID(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		// Delete from database
+		if err := banners.DeleteBanner(id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit.Record(r, audit.ActionDelete, audit.EntityBanner, id, banner, nil)
+
+		// Delete image file
+		os.Remove(filepath.Join(uploadPath, filepath.Base(banner.ImagePath)))
+
+		if r.Header.Get("HX-Request") == "true" {
+			w.Header().Set("HX-Trigger", "refreshBanners")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Public banner endpoint - returns carousel HTML
+	http.HandleFunc("/api/banners", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		tmpl, err := template.ParseFiles("web/templates/carousel.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		bannerList, err := banners.GetActiveBanners()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		tmpl.Execute(w, bannerList)
+	})
+
+	// Admin offers management routes
+	http.HandleFunc("/api/admin/offers", admin.RequirePermission(admin.PermOffersWrite)(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			// Return HTML list for HTMX requests
+			if r.Header.Get("HX-Request") == "true" {
+				tmpl, err := template.ParseFiles("web/templates/admin-offers-list.html")
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				offerList, err := offers.GetAllOffers()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				w.Header().Set("Content-Type", "text/html")
+				tmpl.Execute(w, offerList)
+			} else {
+				// Return JSON for non-HTMX requests
+				w.Header().Set("Content-Type", "application/json")
+				offerList, err := offers.GetAllOffers()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				json.NewEncoder(w).Encode(offerList)
+			}
+
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "Invalid form data", http.StatusBadRequest)
+				return
+			}
+
+			productID, err := strconv.Atoi(r.FormValue("product_id"))
+			if err != nil {
+				http.Error(w, "Invalid product ID", http.StatusBadRequest)
+				return
+			}
+
+			offerPrice, err := strconv.ParseFloat(r.FormValue("offer_price"), 64)
+			if err != nil {
+				http.Error(w, "Invalid offer price", http.StatusBadRequest)
+				return
+			}
+
+			form := offers.OfferForm{
+				ProductID:  productID,
+				OfferPrice: offerPrice,
+			}
+
+			// Parse optional dates
+			startDateStr := r.FormValue("offer_start_date")
+			if startDateStr != "" {
+				startDate, err := time.Parse("2006-01-02T15:04", startDateStr)
+				if err == nil {
+					form.StartDate = &startDate
+				}
+			}
+
+			endDateStr := r.FormValue("offer_end_date")
+			if endDateStr != "" {
+				endDate, err := time.Parse("2006-01-02T15:04", endDateStr)
+				if err == nil {
+					form.EndDate = &endDate
+				}
+			}
+
+			if err := offers.CreateOffer(form); err != nil {
+				if r.Header.Get("HX-Request") == "true" {
+					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
+					tmpl.Execute(w, err.Error())
+				} else {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				}
+				return
+			}
+			if offer, err := offers.GetOfferByProductID(form.ProductID); err == nil {
+				audit.Record(r, audit.ActionCreate, audit.EntityOffer, offer.ID, nil, offer)
+			}
+
+			if r.Header.Get("HX-Request") == "true" {
+				w.Header().Set("HX-Trigger", "refreshOffers")
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	// Admin offers products endpoint - returns available products for selection
+	http.HandleFunc("/api/admin/offers/products", admin.RequirePermission(admin.PermOffersWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		products, err := offers.GetProductsForOfferSelection()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		for _, p := range products {
+			fmt.Fprintf(w, `<option value="%d">%s</option>`, p.ID, p.Name)
+		}
+	}))
+
+	// Admin offer detail/update/delete routes
+	http.HandleFunc("/api/admin/offers/", admin.RequirePermission(admin.PermOffersWrite)(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/api/admin/offers/")
+
+		switch r.Method {
+		case http.MethodPut:
+			id, err := strconv.Atoi(path)
+			if err != nil {
+				http.Error(w, "Invalid offer ID", http.StatusBadRequest)
+				return
+			}
+
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "Invalid form data", http.StatusBadRequest)
+				return
+			}
+
+			offerPrice, err := strconv.ParseFloat(r.FormValue("offer_price"), 64)
+			if err != nil {
+				http.Error(w, "Invalid offer price", http.StatusBadRequest)
+				return
+			}
+
+			form := offers.OfferForm{
+				OfferPrice: offerPrice,
+			}
+
+			// Parse optional dates
+			startDateStr := r.FormValue("offer_start_date")
+			if startDateStr != "" {
+				startDate, err := time.Parse("2006-01-02T15:04", startDateStr)
+				if err == nil {
+					form.StartDate = &startDate
+				}
+			}
+
+			endDateStr := r.FormValue("offer_end_date")
+			if endDateStr != "" {
+				endDate, err := time.Parse("2006-01-02T15:04", endDateStr)
+				if err == nil {
+					form.EndDate = &endDate
+				}
+			}
+
+			before, _ := offers.GetOfferByID(id)
+			if err := offers.UpdateOffer(id, form); err != nil {
+				if r.Header.Get("HX-Request") == "true" {
+					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
+					tmpl.Execute(w, err.Error())
+				} else {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				}
+				return
+			}
+			after, _ := offers.GetOfferByID(id)
+			audit.Record(r, audit.ActionUpdate, audit.EntityOffer, id, before, after)
+
+			if r.Header.Get("HX-Request") == "true" {
+				w.Header().Set("HX-Trigger", "refreshOffers")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+
+		case http.MethodDelete:
+			id, err := strconv.Atoi(path)
+			if err != nil {
+				http.Error(w, "Invalid offer ID", http.StatusBadRequest)
+				return
+			}
+
+			before, _ := offers.GetOfferByID(id)
+			_, err = offers.ToggleOfferStatus(id)
+			if err != nil {
+				if r.Header.Get("HX-Request") == "true" {
+					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
+					tmpl.Execute(w, err.Error())
+				} else {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+			after, _ := offers.GetOfferByID(id)
+			audit.Record(r, audit.ActionUpdate, audit.EntityOffer, id, before, after)
+
+			if r.Header.Get("HX-Request") == "true" {
+				w.Header().Set("HX-Trigger", "refreshOffers")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	http.HandleFunc("/api/admin/orders/", admin.RequirePermission(admin.PermOrdersRead)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/api/admin/orders/")
+		id, err := strconv.Atoi(path)
+		if err != nil {
+			http.Error(w, "Invalid order ID", http.StatusBadRequest)
+			return
+		}
+
+		order, items, err := orders.GetOrderWithItems(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		attempts, err := orders.GetPaymentAttempts(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		canViewFinancialData := admin.HasPermission(r, admin.PermOrdersFinancial)
+
+		w.Header().Set("Content-Type", "text/html")
+		funcMap := orderFuncMap()
+		tmpl, err := template.New("admin-order-detail.html").Funcs(funcMap).ParseFiles("web/templates/admin-order-detail.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, map[string]interface{}{
+			"Order":                order,
+			"Items":                items,
+			"PaymentAttempts":      attempts,
+			"CanViewFinancialData": canViewFinancialData,
+			"NeedsInstallation":    orders.OrderDocument{Order: *order, Items: items}.NeedsInstallation(),
+		})
+	}))
+
+	http.HandleFunc("/api/admin/orders/{id}/status-modal", admin.RequirePermission(admin.PermOrdersRead)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/api/admin/orders/")
+		path = strings.TrimSuffix(path, "/status-modal")
+		id, err := strconv.Atoi(path)
+		if err != nil {
+			http.Error(w, "Invalid order ID", http.StatusBadRequest)
+			return
+		}
+
+		order, err := orders.GetOrderByID(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		setCacheHeaders(w, 86400) // 1 day cache for static modal
+		w.Header().Set("Content-Type", "text/html")
+		tmpl, err := template.ParseFiles("web/templates/admin-order-status-modal.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, map[string]interface{}{
+			"OrderID":       order.ID,
+			"CurrentStatus": order.Status,
+		})
+	}))
+
+	http.HandleFunc("/api/admin/orders/{id}/status", admin.RequirePermission(admin.PermOrdersWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/api/admin/orders/")
+		path = strings.TrimSuffix(path, "/status")
+		id, err := strconv.Atoi(path)
+		if err != nil {
+			http.Error(w, "Invalid order ID", http.StatusBadRequest)
+			return
+		}
+
+		status := r.FormValue("status")
+		if status == "" {
+			http.Error(w, "Status is required", http.StatusBadRequest)
+			return
+		}
+
+		if status == "cancelled" && !admin.HasPermission(r, admin.PermOrdersRefund) {
+			current, err := orders.GetOrderByID(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if current.PaymentStatus == "paid" {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		before, _ := orders.GetOrderByID(id)
+		err = orders.UpdateOrderStatus(id, status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Return the updated order row
+		order, err := orders.GetOrderByID(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit.Record(r, audit.ActionUpdate, audit.EntityOrder, id, before, order)
+
+		canViewFinancialData := admin.HasPermission(r, admin.PermOrdersFinancial)
+
+		w.Header().Set("Content-Type", "text/html")
+		funcMap := orderFuncMap()
+		tmpl, err := template.New("admin-order-row.html").Funcs(funcMap).ParseFiles("web/templates/admin-order-row.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, map[string]interface{}{
+			"Order":                order,
+			"CanViewFinancialData": canViewFinancialData,
+		})
+	}))
+
+	http.HandleFunc("/api/admin/products", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			// Check if this is an HTMX request for HTML fragment
+			if r.Header.Get("HX-Request") == "true" {
+				tmpl, err := template.ParseFiles("web/templates/admin-product-list.html")
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				prods, err := products.GetAllProducts()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				w.Header().Set("Content-Type", "text/html")
+				tmpl.Execute(w, prods)
+			} else {
+				// Original JSON response for non-HTMX requests
+				w.Header().Set("Content-Type", "application/json")
+				prods, err := products.GetAllProducts()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				json.NewEncoder(w).Encode(prods)
+			}
+
+		case http.MethodPost:
+			// Parse multipart form (max 5MB)
+			if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+				http.Error(w, "File too large or invalid form data", http.StatusBadRequest)
+				return
+			}
+
+			// Get form values
+			name := r.FormValue("name")
+			priceStr := r.FormValue("price")
+			categoryIDStr := r.FormValue("category_id")
+			description := r.FormValue("description")
+			sku := r.FormValue("sku")
+			isAvailableStr := r.FormValue("is_available")
+			brandIDs, err := parseIDList(r.Form["brand_ids"])
+			if err != nil {
+				http.Error(w, "Invalid brand selection", http.StatusBadRequest)
+				return
+			}
+			fitsProductIDs, err := parseIDList(r.Form["fits_product_ids"])
+			if err != nil {
+				http.Error(w, "Invalid compatibility selection", http.StatusBadRequest)
+				return
+			}
+			partProductIDs, err := parseIDList(r.Form["part_product_ids"])
+			if err != nil {
+				http.Error(w, "Invalid part selection", http.StatusBadRequest)
+				return
+			}
+
+			if name == "" || priceStr == "" || categoryIDStr == "" {
+				http.Error(w, "Missing required fields", http.StatusBadRequest)
+				return
+			}
+
+			categoryID, err := strconv.Atoi(categoryIDStr)
+			if err != nil {
+				http.Error(w, "Invalid category", http.StatusBadRequest)
+				return
+			}
+
+			price, err := strconv.ParseFloat(priceStr, 64)
+			if err != nil {
+				http.Error(w, "Invalid price format", http.StatusBadRequest)
+				return
+			}
+
+			isAvailable := isAvailableStr == "on"
+			// Create product
+			product, err := products.CreateProduct(name, price, categoryID, description, sku, isAvailable, brandIDs, fitsProductIDs, partProductIDs)
+			if err != nil {
+				// Return error message for HTMX
+				if r.Header.Get("HX-Request") == "true" {
+					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
+					tmpl.Execute(w, err.Error())
+				} else {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+
+			// Handle multiple image uploads
+			if err := handleMultipleImageUploads(r, "images", product.ProductID); err != nil {
+				// Clean up product if image upload fails
+				products.DeleteProduct(product.ID)
+				if r.Header.Get("HX-Request") == "true" {
+					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
+					tmpl.Execute(w, err.Error())
+				} else {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+			if created, err := products.GetProductByID(product.ID); err == nil {
+				audit.Record(r, audit.ActionCreate, audit.EntityProduct, product.ID, nil, created)
+			}
+
+			// Return product card HTML for HTMX
+			if r.Header.Get("HX-Request") == "true" {
+				tmpl, err := template.ParseFiles("web/templates/admin-product-card.html")
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				w.Header().Set("Content-Type", "text/html")
+				tmpl.Execute(w, product)
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(product)
+			}
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	http.HandleFunc("/api/admin/products/", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		// Extract path after /api/admin/products/
+		path := strings.TrimPrefix(r.URL.Path, "/api/admin/products/")
+		parts := strings.Split(path, "/")
+
+		// Check if this is an image delete request: /{productID}/images/{imageID}
+		if len(parts) >= 3 && parts[1] == "images" {
+			productID, err := strconv.Atoi(parts[0])
+			if err != nil {
+				http.Error(w, "Invalid product ID", http.StatusBadRequest)
+				return
+			}
+			imageID, err := strconv.Atoi(parts[2])
+			if err != nil {
+				http.Error(w, "Invalid image ID", http.StatusBadRequest)
+				return
+			}
+
+			if r.Method == http.MethodDelete {
+				// Get image to find file path
+				images, err := products.GetProductImages(productID)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				var imageURL string
+				var deleted *products.ProductImage
+				for i, img := range images {
+					if img.ID == imageID {
+						imageURL = img.ImageURL
+						deleted = &images[i]
+						break
+					}
+				}
+
+				// Delete from database
+				if err := products.DeleteProductImage(imageID); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				audit.Record(r, audit.ActionDelete, audit.EntityProductImage, imageID, deleted, nil)
+
+				// Delete file from filesystem if it's in uploads folder
+				if strings.Contains(imageURL, "/uploads/") {
+					filePath := filepath.Join("web/static", strings.TrimPrefix(imageURL, "/static/"))
+					os.Remove(filePath)
+				}
+
+				// Return empty response for HTMX
+				if r.Header.Get("HX-Request") == "true" {
+					w.WriteHeader(http.StatusOK)
+				} else {
+					w.Header().Set("Content-Type", "application/json")
+					json.NewEncoder(w).Encode(map[string]string{"message": "Image deleted successfully"})
+				}
+				return
+			}
+		}
+
+		// Regular product ID parsing
+		id, err := strconv.Atoi(path)
+		if err != nil {
+			http.Error(w, "Invalid product ID", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			// Parse multipart form
+			if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+				fmt.Printf("\n%v\n", err.Error())
+				http.Error(w, "File too large or invalid form data", http.StatusBadRequest)
+				return
+			}
+
+			// Get form values
+			name := r.FormValue("name")
+			priceStr := r.FormValue("price")
+			categoryIDStr := r.FormValue("category_id")
+			description := r.FormValue("description")
+			sku := r.FormValue("sku")
+			isAvailableStr := r.FormValue("is_available")
+			brandIDs, err := parseIDList(r.Form["brand_ids"])
+			if err != nil {
+				http.Error(w, "Invalid brand selection", http.StatusBadRequest)
+				return
+			}
+			fitsProductIDs, err := parseIDList(r.Form["fits_product_ids"])
+			if err != nil {
+				http.Error(w, "Invalid compatibility selection", http.StatusBadRequest)
+				return
+			}
+			partProductIDs, err := parseIDList(r.Form["part_product_ids"])
+			if err != nil {
+				http.Error(w, "Invalid part selection", http.StatusBadRequest)
+				return
+			}
+
+			if name == "" || priceStr == "" || categoryIDStr == "" {
+				http.Error(w, "Missing required fields", http.StatusBadRequest)
+				return
+			}
+
+			categoryID, err := strconv.Atoi(categoryIDStr)
+			if err != nil {
+				http.Error(w, "Invalid category", http.StatusBadRequest)
+				return
+			}
+
+			price, err := strconv.ParseFloat(priceStr, 64)
+			if err != nil {
+				http.Error(w, "Invalid price format", http.StatusBadRequest)
+				return
+			}
+
+			// Parse is_available checkbox (unchecked checkboxes are not sent in form data)
+			isAvailable := isAvailableStr == "on"
+
+			before, _ := products.GetProductByID(id)
+
+			// Update product
+			if err := products.UpdateProduct(id, name, price, categoryID, description, sku, isAvailable, brandIDs, fitsProductIDs, partProductIDs); err != nil {
+				// Return error message for HTMX
+				if r.Header.Get("HX-Request") == "true" {
+					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
+					tmpl.Execute(w, err.Error())
+				} else {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+
+			// Get product ID for images
+			product, err := products.GetProductByID(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			// Handle multiple image uploads
+			if err := handleMultipleImageUploads(r, "images", product.ProductID); err != nil {
+				if r.Header.Get("HX-Request") == "true" {
+					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
+					tmpl.Execute(w, err.Error())
+				} else {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+			if after, err := products.GetProductByID(id); err == nil {
+				audit.Record(r, audit.ActionUpdate, audit.EntityProduct, id, before, after)
+			}
+
+			// Return updated product card HTML for HTMX
+			if r.Header.Get("HX-Request") == "true" {
+				// Get the updated product data
+				updatedProduct, err := products.GetProductByID(id)
+				if err != nil {
+					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
+					tmpl.Execute(w, err.Error())
+					return
+				}
+
+				tmpl, err := template.ParseFiles("web/templates/admin-product-card.html")
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("HX-Trigger", "closeEditModal")
+				tmpl.Execute(w, updatedProduct)
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]string{"message": "Product updated successfully"})
+			}
+
+		case http.MethodDelete:
+			// Get product to find image path
+			product, err := products.GetProductByID(id)
+			if err == nil && strings.Contains(product.Image, "/uploads/") {
+				// Delete image file if it's in uploads folder
+				imagePath := filepath.Join("web/static", strings.TrimPrefix(product.Image, "/static/"))
+				os.Remove(imagePath)
+			}
+
+			if err := products.DeleteProduct(id); err != nil {
+				// Return error message for HTMX
+				if r.Header.Get("HX-Request") == "true" {
+					tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
+					tmpl.Execute(w, err.Error())
+				} else {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+			audit.Record(r, audit.ActionDelete, audit.EntityProduct, id, product, nil)
+
+			// Return empty response for HTMX (element will be deleted)
+			if r.Header.Get("HX-Request") == "true" {
+				w.WriteHeader(http.StatusOK)
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]string{"message": "Product deleted successfully"})
+			}
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	// HTMX-specific admin routes
+	http.HandleFunc("/admin/products/", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		// Extract ID from path
+		path := strings.TrimPrefix(r.URL.Path, "/admin/products/")
+		parts := strings.Split(path, "/")
+		if len(parts) < 1 {
+			http.Error(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "Invalid product ID", http.StatusBadRequest)
+			return
+		}
+
+		// Handle edit form request
+		if len(parts) >= 2 && parts[1] == "edit" {
+			product, err := products.GetProductByID(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			brands, err := products.GetAllBrands()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			productOptions, err := products.GetAllProductOptions()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			filteredOptions := make([]products.ProductOption, 0, len(productOptions))
+			for _, option := range productOptions {
+				if option.ID == product.ProductID {
+					continue
+				}
+				filteredOptions = append(filteredOptions, option)
+			}
+
+			// Get product images
+			productImages, err := products.GetProductImages(product.ProductID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			categories, err := products.GetAllCategories()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			tmpl, err := template.ParseFiles("web/templates/admin-edit-form.html")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			editData := adminEditData{
+				Product:         product,
+				ProductImages:   productImages,
+				Brands:          brands,
+				Products:        filteredOptions,
+				Categories:      categories,
+				BrandSelections: buildIDSet(product.BrandIDs),
+				FitSelections:   buildIDSet(product.FitsProductIDs),
+				PartSelections:  buildIDSet(product.PartProductIDs),
+			}
+			tmpl.Execute(w, editData)
+			return
+		}
+
+		http.Error(w, "Not found", http.StatusNotFound)
+	}))
+
+	http.HandleFunc("/admin/users", admin.RequirePermission(admin.PermUsersManage)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		roles, err := admin.GetRoles()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl, err := adminPageTemplate(r, "web/templates/admin-users.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, map[string]interface{}{
+			"Roles": roles,
+		})
+	}))
+
+	http.HandleFunc("/api/admin/users", admin.RequirePermission(admin.PermUsersManage)(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			adminUsers, err := admin.ListAdmins()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			roles, err := admin.GetRoles()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			currentID, _ := admin.AdminIDFromRequest(r)
+
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Cache-Control", "no-store")
+			tmpl, err := template.ParseFiles("web/templates/admin-users-list.html")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			tmpl.Execute(w, map[string]interface{}{
+				"Admins":         adminUsers,
+				"Roles":          roles,
+				"CurrentAdminID": currentID,
+			})
+
+		case http.MethodPost:
+			username := strings.TrimSpace(r.FormValue("username"))
+			password, err := admin.InviteAdmin(username, r.FormValue("email"), r.FormValue("role"))
+			if err != nil {
+				renderAdminError(w, err)
+				return
+			}
+			if adminUsers, err := admin.ListAdmins(); err == nil {
+				for _, invited := range adminUsers {
+					if strings.EqualFold(invited.Username, username) {
+						audit.Record(r, audit.ActionCreate, audit.EntityAdminUser, invited.ID, nil, adminAuditSnapshot(&invited))
+						break
+					}
+				}
+			}
+
+			w.Header().Set("HX-Trigger", "refreshUsers")
+			renderTemporaryPassword(w, username, password)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	// User actions: /api/admin/users/{id}/{disable|enable|reset-password|reset-2fa|role}
+	http.HandleFunc("/api/admin/users/", admin.RequirePermission(admin.PermUsersManage)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/api/admin/users/")
+		parts := strings.Split(path, "/")
+		if len(parts) != 2 {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		currentID, _ := admin.AdminIDFromRequest(r)
+
+		var before map[string]interface{}
+		if target, err := admin.GetAdminByID(id); err == nil {
+			before = adminAuditSnapshot(target)
+		}
+		recordUserChange := func(extra map[string]interface{}) {
+			target, err := admin.GetAdminByID(id)
+			if err != nil {
+				return
+			}
+			after := adminAuditSnapshot(target)
+			for field, value := range extra {
+				after[field] = value
+			}
+			audit.Record(r, audit.ActionUpdate, audit.EntityAdminUser, id, before, after)
+		}
+
+		switch parts[1] {
+		case "disable", "enable":
+			err = admin.SetAdminActive(id, parts[1] == "enable", currentID)
+			if err != nil {
+				renderAdminError(w, err)
+				return
+			}
+			recordUserChange(nil)
+			message := "Usuário desativado. As sessões abertas foram encerradas."
+			if parts[1] == "enable" {
+				message = "Usuário reativado."
+			}
+			w.Header().Set("HX-Trigger", "refreshUsers")
+			renderAdminSuccess(w, message)
+
+		case "reset-password":
+			target, err := admin.GetAdminByID(id)
+			if err != nil {
+				renderAdminError(w, err)
+				return
+			}
+			password, err := admin.ResetAdminPassword(id)
+			if err != nil {
+				renderAdminError(w, err)
+				return
+			}
+			recordUserChange(map[string]interface{}{"password": "redefinida"})
+			renderTemporaryPassword(w, target.Username, password)
+
+		case "reset-2fa":
+			if err := admin.ResetTwoFactor(id, currentID); err != nil {
+				renderAdminError(w, err)
+				return
+			}
+			recordUserChange(nil)
+			w.Header().Set("HX-Trigger", "refreshUsers")
+			renderAdminSuccess(w, "Verificação em duas etapas removida. O usuário precisará configurá-la novamente se a função exigir.")
+
+		case "role":
+			if err := admin.ChangeAdminRole(id, r.FormValue("role"), currentID); err != nil {
+				w.Header().Set("HX-Trigger", "refreshUsers")
+				renderAdminError(w, err)
+				return
+			}
+			recordUserChange(nil)
+			w.Header().Set("HX-Trigger", "refreshUsers")
+			renderAdminSuccess(w, "Função atualizada. O usuário precisará entrar novamente.")
+
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	}))
+
+	http.HandleFunc("/api/admin/roles", admin.RequirePermission(admin.PermUsersManage)(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			roles, err := admin.GetRoles()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Cache-Control", "no-store")
+			tmpl, err := template.ParseFiles("web/templates/admin-roles-list.html")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			tmpl.Execute(w, map[string]interface{}{
+				"Roles":       roles,
+				"Permissions": admin.AllPermissions,
+			})
+
+		case http.MethodPost:
+			name := strings.TrimSpace(r.FormValue("name"))
+			if err := admin.CreateRole(name, r.FormValue("description")); err != nil {
+				renderAdminError(w, err)
+				return
+			}
+			audit.Record(r, audit.ActionCreate, audit.EntityAdminRole, name, nil, roleAuditSnapshot(name))
+			w.Header().Set("HX-Trigger", "refreshRoles, refreshUsers")
+			renderAdminSuccess(w, "Função criada. Marque as permissões abaixo.")
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	// Role actions: POST /api/admin/roles/{name}/permissions, DELETE /api/admin/roles/{name}
+	http.HandleFunc("/api/admin/roles/", admin.RequirePermission(admin.PermUsersManage)(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/api/admin/roles/")
+
+		if strings.HasSuffix(path, "/permissions") {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "Invalid form data", http.StatusBadRequest)
+				return
+			}
+
+			role := strings.TrimSuffix(path, "/permissions")
+			before := roleAuditSnapshot(role)
+			if err := admin.SetRolePermissions(role, r.Form["permissions"]); err != nil {
+				w.Header().Set("HX-Trigger", "refreshRoles")
+				renderAdminError(w, err)
+				return
+			}
+			if err := admin.SetRoleTwoFactorRequired(role, r.FormValue("require_two_factor") == "on"); err != nil {
+				renderAdminError(w, err)
+				return
+			}
+			audit.Record(r, audit.ActionUpdate, audit.EntityAdminRole, role, before, roleAuditSnapshot(role))
+			renderAdminSuccess(w, "Permissões da função "+role+" atualizadas.")
+			return
+		}
+
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		before := roleAuditSnapshot(path)
+		if err := admin.DeleteRole(path); err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		audit.Record(r, audit.ActionDelete, audit.EntityAdminRole, path, before, nil)
+		w.Header().Set("HX-Trigger", "refreshRoles, refreshUsers")
+		renderAdminSuccess(w, "Função excluída.")
+	}))
+
+	// Sales analytics of the dashboard; revenue is financial data
+	http.HandleFunc("/api/admin/analytics", admin.RequirePermission(admin.PermOrdersFinancial)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		period, granularity, err := parseAnalyticsPeriod(r)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+
+		summary, err := analytics.GetSummary(period)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		series, err := analytics.GetRevenueSeries(period, granularity)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		topByRevenue, err := analytics.GetTopProducts(period, "revenue", analyticsTopLimit)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		topByQuantity, err := analytics.GetTopProducts(period, "quantity", analyticsTopLimit)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		categories, err := analytics.GetTopCategories(period, "revenue", analyticsTopLimit)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		offerSplit, err := analytics.GetOfferSplit(period)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		conversion, err := analytics.GetConversion(period)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		neighborhoods, err := analytics.GetNeighborhoods(period, analyticsTopLimit)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "no-store")
+		tmpl, err := template.New("admin-analytics.html").Funcs(analyticsFuncMap()).ParseFiles("web/templates/admin-analytics.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, map[string]interface{}{
+			"From":          period.From,
+			"To":            period.To.AddDate(0, 0, -1),
+			"Summary":       summary,
+			"Chart":         analytics.NewRevenueChart(series, granularity),
+			"TopByRevenue":  topByRevenue,
+			"TopByQuantity": topByQuantity,
+			"Categories":    categories,
+			"OfferSplit":    offerSplit,
+			"Conversion":    conversion,
+			"Neighborhoods": neighborhoods,
+		})
+	}))
+
+	http.HandleFunc("/admin/compatibility", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		categories, err := products.GetAllCategories()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		brands, err := products.GetAllBrands()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl, err := adminPageTemplate(r, "web/templates/admin-compatibility.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, map[string]interface{}{
+			"Categories": categories,
+			"Brands":     brands,
+		})
+	}))
+
+	http.HandleFunc("/api/admin/compatibility", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		var filter products.MatrixFilter
+		filter.PartCategoryID, _ = strconv.Atoi(query.Get("part_category"))
+		filter.ModelCategoryID, _ = strconv.Atoi(query.Get("model_category"))
+		filter.ModelBrandID, _ = strconv.Atoi(query.Get("model_brand"))
+
+		matrix, err := products.GetCompatibilityMatrix(filter)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		brands, err := products.GetAllBrands()
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "no-store")
+		tmpl, err := template.ParseFiles("web/templates/admin-compatibility-matrix.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, map[string]interface{}{
+			"Matrix": matrix,
+			"Brands": brands,
+		})
+	}))
+
+	http.HandleFunc("/api/admin/compatibility/toggle", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form data", http.StatusBadRequest)
+			return
+		}
+		partID, _ := strconv.Atoi(r.FormValue("part_id"))
+		modelID, _ := strconv.Atoi(r.FormValue("model_id"))
+
+		change, err := products.SetCompatibility(partID, modelID, r.FormValue("fits") == "1")
+		if err != nil {
+			// Reload the matrix so the checkbox shows the saved state again
+			w.Header().Set("HX-Trigger", "refreshMatrix")
+			renderCompatibilityError(w, err)
+			return
+		}
+		recordCompatibilityChange(r, change)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	http.HandleFunc("/api/admin/compatibility/brand", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form data", http.StatusBadRequest)
+			return
+		}
+		partID, _ := strconv.Atoi(r.FormValue("part_id"))
+		brandID, _ := strconv.Atoi(r.FormValue("brand_id"))
+		fits := r.FormValue("action") != "remove"
+
+		change, err := products.SetCompatibilityByBrand(partID, brandID, fits)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		recordCompatibilityChange(r, change)
+
+		w.Header().Set("HX-Trigger", "refreshMatrix")
+		count := len(change.After) - len(change.Before)
+		if fits {
+			renderAdminSuccess(w, fmt.Sprintf("Peça associada a %d novo(s) modelo(s) da marca.", count))
+		} else {
+			renderAdminSuccess(w, fmt.Sprintf("Peça removida de %d modelo(s) da marca.", -count))
+		}
+	}))
+
+	http.HandleFunc("/api/admin/compatibility/export", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pairs, err := products.GetCompatibilityPairs()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		filename := "compatibilidade-" + time.Now().Format("20060102-150405") + ".csv"
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		writer, err := spreadsheet.NewCSV(w)
+		if err != nil {
+			logging.LogError("products", "compatibility_export", err.Error(), nil)
+			return
+		}
+		if err := writer.WriteHeader([]string{products.CompatibilityPartSKUColumn, "Peça", products.CompatibilityModelSKUColumn, "Modelo"}); err != nil {
+			logging.LogError("products", "compatibility_export", err.Error(), nil)
+			return
+		}
+		for _, pair := range pairs {
+			cells := []spreadsheet.Cell{
+				spreadsheet.Text(pair.PartSKU), spreadsheet.Text(pair.PartName),
+				spreadsheet.Text(pair.ModelSKU), spreadsheet.Text(pair.ModelName),
+			}
+			if err := writer.WriteRow(cells); err != nil {
+				logging.LogError("products", "compatibility_export", err.Error(), nil)
+				return
+			}
+		}
+		if err := writer.Close(); err != nil {
+			logging.LogError("products", "compatibility_export", err.Error(), nil)
+		}
+	}))
+
+	http.HandleFunc("/api/admin/compatibility/import", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+			renderAdminError(w, products.ErrInvalidCompatibilityFile)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			renderAdminError(w, products.ErrInvalidCompatibilityFile)
+			return
+		}
+		defer file.Close()
+
+		result, err := products.ImportCompatibility(file, r.FormValue("replace") == "1")
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		for i := range result.Changes {
+			recordCompatibilityChange(r, &result.Changes[i])
+		}
+
+		if len(result.Changes) > 0 {
+			w.Header().Set("HX-Trigger", "refreshMatrix")
+		}
+		w.Header().Set("Content-Type", "text/html")
+		tmpl, err := template.ParseFiles("web/templates/admin-compatibility-import.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, result)
+	}))
+
+	http.HandleFunc("/admin/search", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tmpl, err := adminPageTemplate(r, "web/templates/admin-search.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, nil)
+	}))
+
+	http.HandleFunc("/api/admin/search/report", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		period, _, err := parseAnalyticsPeriod(r)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+
+		summary, err := analytics.GetSearchSummary(period)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		top, err := analytics.GetTopSearches(period, searchReportLimit)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		zeroResults, err := analytics.GetZeroResultSearches(period, searchReportLimit)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "no-store")
+		tmpl, err := template.New("admin-search-report.html").Funcs(analyticsFuncMap()).ParseFiles("web/templates/admin-search-report.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, map[string]interface{}{
+			"From":        period.From,
+			"To":          period.To.AddDate(0, 0, -1),
+			"Summary":     summary,
+			"Top":         top,
+			"ZeroResults": zeroResults,
+		})
+	}))
+
+	http.HandleFunc("/api/admin/search/synonyms", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			synonyms, err := products.GetSearchSynonyms()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Cache-Control", "no-store")
+			tmpl, err := template.ParseFiles("web/templates/admin-search-synonyms.html")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			tmpl.Execute(w, synonyms)
+		case http.MethodPost:
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, "Invalid form data", http.StatusBadRequest)
+				return
+			}
+			created, err := products.CreateSearchSynonym(r.FormValue("term"), r.FormValue("synonym"), r.FormValue("two_way") == "1")
+			if err != nil {
+				renderAdminError(w, err)
+				return
+			}
+			for _, synonym := range created {
+				audit.Record(r, audit.ActionCreate, audit.EntitySearchSynonym, synonym.ID, nil, synonym)
+			}
+			w.Header().Set("HX-Trigger", "refreshSynonyms")
+			renderAdminSuccess(w, "Sinônimo cadastrado.")
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+
+	http.HandleFunc("/api/admin/search/synonyms/", admin.RequirePermission(admin.PermProductsWrite)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/admin/search/synonyms/"))
+		if err != nil {
+			http.Error(w, "Invalid synonym ID", http.StatusBadRequest)
+			return
+		}
+		synonym, err := products.DeleteSearchSynonym(id)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		audit.Record(r, audit.ActionDelete, audit.EntitySearchSynonym, synonym.ID, synonym, nil)
+		w.Header().Set("HX-Trigger", "refreshSynonyms")
+		renderAdminSuccess(w, "Sinônimo removido.")
+	}))
+
+	http.HandleFunc("/admin/audit", admin.RequirePermission(admin.PermAuditRead)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		adminUsers, err := admin.ListAdmins()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl, err := adminPageTemplate(r, "web/templates/admin-audit.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, map[string]interface{}{
+			"Admins":      adminUsers,
+			"EntityTypes": audit.EntityTypes,
+			"Query":       r.URL.Query(),
+		})
+	}))
+
+	http.HandleFunc("/api/admin/audit", admin.RequirePermission(admin.PermAuditRead)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		filter, err := parseAuditFilter(r)
+		if err != nil {
+			renderAdminError(w, err)
+			return
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		filter.Limit = auditPageSize
+		filter.Offset = (page - 1) * auditPageSize
+
+		entries, total, err := audit.ListEntries(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "no-store")
+		tmpl, err := template.New("admin-audit-list.html").Funcs(auditFuncMap()).ParseFiles("web/templates/admin-audit-list.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, map[string]interface{}{
+			"Entries":  entries,
+			"Total":    total,
+			"Page":     page,
+			"PrevPage": page - 1,
+			"NextPage": page + 1,
+			"HasNext":  page*auditPageSize < total,
+		})
+	}))
+
+	// CSV export of the audit log with the same filters as the listing
+	http.HandleFunc("/admin/audit/export.csv", admin.RequirePermission(admin.PermAuditRead)(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		id, err := strconv.Atoi(parts[0])
+		filter, err := parseAuditFilter(r)
 		if err != nil {
-			http.Error(w, "Invalid product ID", http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Handle edit form request
-		if len(parts) >= 2 && parts[1] == "edit" {
-			product, err := products.GetProductByID(id)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusNotFound)
-				return
-			}
-			brands, err := products.GetAllBrands()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			productOptions, err := products.GetAllProductOptions()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			filteredOptions := make([]products.ProductOption, 0, len(productOptions))
-			for _, option := range productOptions {
-				if option.ID == product.ProductID {
-					continue
-				}
-				filteredOptions = append(filteredOptions, option)
-			}
-
-			// Get product images
-			productImages, err := products.GetProductImages(product.ProductID)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="auditoria-%s.csv"`, time.Now().Format("20060102-150405")))
+		w.Header().Set("Cache-Control", "no-store")
 
-			categories, err := products.GetAllCategories()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		// BOM and ";" so spreadsheet apps configured for pt-BR open the file correctly
+		io.WriteString(w, "\ufeff")
+		writer := csv.NewWriter(w)
+		writer.Comma = ';'
+		writer.Write([]string{"Data", "Usuário", "Ação", "Entidade", "ID", "Alterações", "IP"})
 
-			tmpl, err := template.ParseFiles("web/templates/admin-edit-form.html")
+		err = audit.EachEntry(filter, func(entry audit.Entry) error {
+			changes, err := json.Marshal(entry.Changes)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return err
 			}
-
-			editData := adminEditData{
-				Product:         product,
-				ProductImages:   productImages,
-				Brands:          brands,
-				Products:        filteredOptions,
-				Categories:      categories,
-				BrandSelections: buildIDSet(product.BrandIDs),
-				FitSelections:   buildIDSet(product.FitsProductIDs),
-				PartSelections:  buildIDSet(product.PartProductIDs),
+			username := entry.AdminUsername
+			if username == "" {
+				username = "-"
 			}
-			tmpl.Execute(w, editData)
-			return
+			return writer.Write([]string{
+				entry.CreatedAt.Format("02/01/2006 15:04:05"),
+				username,
+				audit.ActionLabel(entry.Action),
+				audit.EntityLabel(entry.EntityType),
+				entry.EntityID,
+				string(changes),
+				entry.IPAddress,
+			})
+		})
+		writer.Flush()
+		if err != nil {
+			logging.LogError("audit", "export_csv", err.Error(), nil)
 		}
-
-		http.Error(w, "Not found", http.StatusNotFound)
 	}))
 
 	fmt.Println("Server starting at port 8080")
@@ -2159,6 +4823,612 @@ func handleMultipleImageUploads(r *http.Request, fieldName string, productID int
 	return nil
 }
 
+// handlePaymentStatus is polled by the payment page; it redirects the customer once the payment settles
+func handlePaymentStatus(w http.ResponseWriter, r *http.Request, orderNumber string) {
+	order, err := orders.GetOrderForCustomer(orderNumber, r.URL.Query().Get("token"))
+	if err != nil {
+		http.Error(w, "Pedido não encontrado", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if order.PaymentStatus == "paid" {
+		w.Header().Set("HX-Redirect", checkout.SuccessURL(order))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	attempts, err := orders.GetPaymentAttempts(order.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(attempts) > 0 && (attempts[0].Status == "failed" || attempts[0].Status == "expired") {
+		w.Header().Set("HX-Redirect", checkout.CancelURL(order))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// renderAdminError shows a user-facing error in the admin feedback area.
+// Unexpected errors are logged and replaced by a generic message.
+func renderAdminError(w http.ResponseWriter, err error) {
+	message := err.Error()
+	if !isAdminUserError(err) {
+		logging.LogError("admin", "users", message, nil)
+		message = "Não foi possível concluir a operação. Tente novamente."
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	tmpl, _ := template.ParseFiles("web/templates/admin-error-message.html")
+	tmpl.Execute(w, message)
+}
+
+func isAdminUserError(err error) bool {
+	for _, target := range []error{
+		admin.ErrAdminNotFound, admin.ErrUsernameTaken, admin.ErrInvalidUsername, admin.ErrInvalidEmail,
+		admin.ErrCannotChangeSelf, admin.ErrLastUserManager, admin.ErrRoleNotFound, admin.ErrInvalidRoleName,
+		admin.ErrRoleInUse, admin.ErrInvalidTwoFactorCode, admin.ErrTwoFactorEnforced, admin.ErrTwoFactorNotEnabled,
+		admin.ErrTwoFactorEnabled, admin.ErrEnrollmentExpired, errInvalidAuditFilter, errInvalidAnalyticsPeriod,
+		errInvalidOrderFilter, errInvalidDeliveryRun, deliveries.ErrNoOrdersSelected, deliveries.ErrOrderNotReady,
+		deliveries.ErrRunNotFound, deliveries.ErrStopNotFound, deliveries.ErrRunStarted, deliveries.ErrInvalidCoordinates,
+		deliveries.ErrOrderNotDeliverable,
+		products.ErrInvalidSynonym, products.ErrSynonymExists, products.ErrSynonymNotFound,
+		products.ErrNotAPart, products.ErrCompatibleWithItself, products.ErrCompatibilityNotFound, products.ErrInvalidCompatibilityFile,
+		products.ErrCategoryNotFound, products.ErrCategoryLoop, products.ErrInvalidCategoryPlace,
+		products.ErrBrandNotFound, products.ErrBrandSlugTaken, products.ErrInvalidBrandSlug, products.ErrMergeSameBrand, products.ErrBrandInUse,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderSecurityError shows an error of the security page in its feedback area
+func renderSecurityError(w http.ResponseWriter, err error) {
+	w.Header().Set("HX-Retarget", "#security-feedback")
+	renderAdminError(w, err)
+}
+
+// deliveryStopOrder lists the orders of a run in visiting order, as recorded in the audit log
+func deliveryStopOrder(run *deliveries.Run) []int {
+	order := make([]int, 0, len(run.Stops))
+	for _, stop := range run.Stops {
+		order = append(order, stop.OrderID)
+	}
+	return order
+}
+
+// renderDeliveryError shows an error of the delivery pages in their feedback area
+func renderDeliveryError(w http.ResponseWriter, err error) {
+	w.Header().Set("HX-Retarget", "#delivery-feedback")
+	w.Header().Set("HX-Reswap", "innerHTML")
+	renderAdminError(w, err)
+}
+
+// categoryContentFromForm reads the landing page fields of the category modal; the hero
+// image is handled apart
+func categoryContentFromForm(r *http.Request) products.CategoryContent {
+	return products.CategoryContent{
+		Description:     r.FormValue("description"),
+		SEOTitle:        r.FormValue("seo_title"),
+		MetaDescription: r.FormValue("meta_description"),
+	}
+}
+
+// uploadCategoryHeroImage saves the hero image sent with the category modal, returning ""
+// when none was chosen
+func uploadCategoryHeroImage(r *http.Request) (string, error) {
+	if r.MultipartForm == nil || len(r.MultipartForm.File["hero_image"]) == 0 {
+		return "", nil
+	}
+	return handleImageUpload(r, "hero_image")
+}
+
+// removeUploadedImage deletes an image saved by handleImageUpload; other paths (static
+// images shipped with the site, "") are left alone
+func removeUploadedImage(imagePath string) {
+	if strings.HasPrefix(imagePath, "/static/images/uploads/") {
+		os.Remove(filepath.Join(uploadPath, filepath.Base(imagePath)))
+	}
+}
+
+// renderCategoryError shows an error of the category list in its feedback area
+func renderCategoryError(w http.ResponseWriter, err error) {
+	w.Header().Set("HX-Retarget", "#categories-feedback")
+	w.Header().Set("HX-Reswap", "innerHTML")
+	renderAdminError(w, err)
+}
+
+// newCategoryModalData fills the category modal with the parents the category can be
+// placed under, leaving out the category itself and its subcategories
+func newCategoryModalData(category *products.Category, message string) (categoryModalData, error) {
+	categories, err := products.GetAllCategories()
+	if err != nil {
+		return categoryModalData{}, err
+	}
+
+	data := categoryModalData{Category: category, Error: message, Parents: categories}
+	if category != nil {
+		data.Parents = products.WithoutSubtree(categories, category.ID)
+		data.ParentID = category.ParentID
+	}
+	return data, nil
+}
+
+// uploadBrandLogo saves the logo sent with the brand modal, returning "" when none was chosen
+func uploadBrandLogo(r *http.Request) (string, error) {
+	if r.MultipartForm == nil || len(r.MultipartForm.File["logo"]) == 0 {
+		return "", nil
+	}
+	return handleImageUpload(r, "logo")
+}
+
+// renderBrandError shows an error of the brand list in its feedback area
+func renderBrandError(w http.ResponseWriter, err error) {
+	w.Header().Set("HX-Retarget", "#brands-feedback")
+	w.Header().Set("HX-Reswap", "innerHTML")
+	renderAdminError(w, err)
+}
+
+// newBrandModalData fills the edit modal of a brand with the other brands it can be merged
+// into
+func newBrandModalData(brand *products.Brand, message string) (brandModalData, error) {
+	brands, err := products.GetAllBrands()
+	if err != nil {
+		return brandModalData{}, err
+	}
+
+	data := brandModalData{Brand: brand, Error: message}
+	for _, b := range brands {
+		if b.ID != brand.ID {
+			data.Targets = append(data.Targets, b)
+		}
+	}
+	return data, nil
+}
+
+// renderCompatibilityError shows an error of the compatibility matrix in its feedback area
+func renderCompatibilityError(w http.ResponseWriter, err error) {
+	w.Header().Set("HX-Retarget", "#compatibility-feedback")
+	w.Header().Set("HX-Reswap", "innerHTML")
+	renderAdminError(w, err)
+}
+
+// recordCompatibilityChange audits the models a part fits before and after a matrix change
+func recordCompatibilityChange(r *http.Request, change *products.CompatibilityChange) {
+	audit.Record(r, audit.ActionUpdate, audit.EntityProductCompatibility, change.PartID,
+		map[string]interface{}{"fitsProductIds": change.Before},
+		map[string]interface{}{"fitsProductIds": change.After})
+}
+
+// enrollmentViewData prepares a TOTP enrollment for the "two-factor-qr" template
+func enrollmentViewData(enrollment *admin.Enrollment) map[string]interface{} {
+	return map[string]interface{}{
+		"Secret": enrollment.Secret,
+		"QRCode": template.URL(enrollment.QRCode),
+	}
+}
+
+func renderAdminSuccess(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "text/html")
+	tmpl, _ := template.ParseFiles("web/templates/admin-success-message.html")
+	tmpl.Execute(w, message)
+}
+
+// renderTemporaryPassword shows a temporary password once, right after it is generated
+// adminPageTemplate parses a full admin page; csrfToken gives the page the CSRF token of the session
+func adminPageTemplate(r *http.Request, filename string) (*template.Template, error) {
+	return template.New(filepath.Base(filename)).Funcs(template.FuncMap{
+		"csrfToken": func() string {
+			return admin.CSRFToken(r)
+		},
+	}).ParseFiles(filename)
+}
+
+// canAccessDeliveryRun reports whether the admin behind the request plans runs or is the
+// driver/technician the run was assigned to
+func canAccessDeliveryRun(r *http.Request, run *deliveries.Run) bool {
+	if admin.HasPermission(r, admin.PermDeliveriesManage) {
+		return true
+	}
+	adminID, ok := admin.AdminIDFromRequest(r)
+	return ok && run.AssigneeID != nil && *run.AssigneeID == adminID
+}
+
+// renderDeliveryStops renders the stop list of a run, after a change to one of its stops
+func renderDeliveryStops(w http.ResponseWriter, r *http.Request, runID int) {
+	run, err := deliveries.GetRun(runID)
+	if err != nil {
+		renderDeliveryError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	tmpl, err := template.New("admin-delivery-stops.html").Funcs(orderFuncMap()).ParseFiles("web/templates/admin-delivery-stops.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, map[string]interface{}{
+		"Run":       run,
+		"CanManage": admin.HasPermission(r, admin.PermDeliveriesManage),
+	})
+}
+
+// adminAuditSnapshot returns the audited fields of an admin user; the password hash is left out
+func adminAuditSnapshot(account *admin.Admin) map[string]interface{} {
+	return map[string]interface{}{
+		"username":           account.Username,
+		"email":              account.Email,
+		"role":               account.Role,
+		"is_active":          account.IsActive,
+		"two_factor_enabled": account.TwoFactorEnabled,
+	}
+}
+
+// roleAuditSnapshot returns the audited fields of a role, or nil when it does not exist
+func roleAuditSnapshot(name string) map[string]interface{} {
+	roles, err := admin.GetRoles()
+	if err != nil {
+		return nil
+	}
+	for _, role := range roles {
+		if role.Name != name {
+			continue
+		}
+		var permissions []string
+		for _, permission := range admin.AllPermissions {
+			if role.Permissions[permission.Name] {
+				permissions = append(permissions, permission.Name)
+			}
+		}
+		return map[string]interface{}{
+			"description":        role.Description,
+			"permissions":        permissions,
+			"require_two_factor": role.RequireTwoFactor,
+		}
+	}
+	return nil
+}
+
+// parseAuditFilter reads the audit log filters from the query string; dates are whole days
+func parseAuditFilter(r *http.Request) (audit.Filter, error) {
+	query := r.URL.Query()
+	filter := audit.Filter{
+		EntityType: query.Get("entity_type"),
+		EntityID:   strings.TrimSpace(query.Get("entity_id")),
+	}
+
+	if adminID := query.Get("admin_id"); adminID != "" {
+		id, err := strconv.Atoi(adminID)
+		if err != nil {
+			return filter, errInvalidAuditFilter
+		}
+		filter.AdminID = id
+	}
+	if from := query.Get("from"); from != "" {
+		day, err := time.ParseInLocation("2006-01-02", from, time.Local)
+		if err != nil {
+			return filter, errInvalidAuditFilter
+		}
+		filter.From = &day
+	}
+	if to := query.Get("to"); to != "" {
+		day, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			return filter, errInvalidAuditFilter
+		}
+		end := day.AddDate(0, 0, 1)
+		filter.To = &end
+	}
+	return filter, nil
+}
+
+// parseOrderFilters reads the search, filters and sorting of the admin order list. Sorting by
+// total is only allowed to admins who can see the amounts.
+func parseOrderFilters(r *http.Request, canViewFinancialData bool) (orders.OrderFilters, error) {
+	query := r.URL.Query()
+	filters := orders.OrderFilters{
+		Status:        query.Get("status"),
+		PaymentStatus: query.Get("payment_status"),
+		Search:        strings.TrimSpace(query.Get("q")),
+		PaymentMethod: query.Get("payment_method"),
+		Neighborhood:  strings.TrimSpace(query.Get("neighborhood")),
+		Product:       strings.TrimSpace(query.Get("product")),
+		SortBy:        query.Get("sort"),
+		SortDesc:      query.Get("dir") != "asc",
+	}
+	// "awaiting" groups the unpaid pending orders (boleto/PIX not paid yet)
+	if filters.PaymentStatus == "awaiting" {
+		filters.PaymentStatus = ""
+		filters.AwaitingPayment = true
+	}
+	if filters.SortBy == "total_amount" && !canViewFinancialData {
+		filters.SortBy = ""
+	}
+
+	if from := query.Get("from"); from != "" {
+		day, err := time.ParseInLocation("2006-01-02", from, time.Local)
+		if err != nil {
+			return filters, errInvalidOrderFilter
+		}
+		filters.From = &day
+	}
+	if to := query.Get("to"); to != "" {
+		day, err := time.ParseInLocation("2006-01-02", to, time.Local)
+		if err != nil {
+			return filters, errInvalidOrderFilter
+		}
+		end := day.AddDate(0, 0, 1)
+		filters.To = &end
+	}
+	return filters, nil
+}
+
+// orderExportColumn is a column of the order export. Item columns are only exported with the
+// items, one row per item; Financial columns require orders.financial.
+type orderExportColumn struct {
+	Key       string
+	Label     string
+	Item      bool
+	Financial bool
+	Value     func(order orders.Order, item *orders.OrderItem) spreadsheet.Cell
+}
+
+var orderExportColumns = []orderExportColumn{
+	{Key: "order_number", Label: "Pedido", Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell { return spreadsheet.Text(o.OrderNumber) }},
+	{Key: "created_at", Label: "Data", Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell { return spreadsheet.DateTime(o.CreatedAt) }},
+	{Key: "status", Label: "Status", Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell {
+		return spreadsheet.Text(translateStatus(o.Status))
+	}},
+	{Key: "payment_status", Label: "Pagamento", Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell {
+		return spreadsheet.Text(translatePaymentStatus(o.PaymentStatus))
+	}},
+	{Key: "payment_method", Label: "Forma de pagamento", Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell {
+		return spreadsheet.Text(translatePaymentMethod(o.PaymentMethod))
+	}},
+	{Key: "customer", Label: "Cliente", Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell {
+		return spreadsheet.Text(strings.TrimSpace(o.FirstName + " " + o.LastName))
+	}},
+	{Key: "cpf", Label: "CPF/CNPJ", Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell { return spreadsheet.Text(o.CPF) }},
+	{Key: "email", Label: "Email", Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell { return spreadsheet.Text(o.Email) }},
+	{Key: "phone", Label: "Telefone", Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell { return spreadsheet.Text(o.Phone) }},
+	{Key: "address", Label: "Endereço", Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell {
+		address := o.Address
+		if o.Apartment != "" {
+			address += ", " + o.Apartment
+		}
+		return spreadsheet.Text(address)
+	}},
+	{Key: "neighborhood", Label: "Bairro", Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell { return spreadsheet.Text(o.Neighborhood) }},
+	{Key: "city", Label: "Cidade", Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell { return spreadsheet.Text(o.City) }},
+	{Key: "state", Label: "UF", Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell { return spreadsheet.Text(o.State) }},
+	{Key: "zip_code", Label: "CEP", Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell { return spreadsheet.Text(o.ZipCode) }},
+	{Key: "installments", Label: "Parcelas", Financial: true, Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell {
+		if o.PaymentMethod != "credit_card" {
+			return spreadsheet.Text("")
+		}
+		return spreadsheet.Int(o.Installments)
+	}},
+	{Key: "total_amount", Label: "Total do pedido", Financial: true, Value: func(o orders.Order, _ *orders.OrderItem) spreadsheet.Cell {
+		return spreadsheet.Money(o.TotalAmount)
+	}},
+	{Key: "item_name", Label: "Item", Item: true, Value: func(_ orders.Order, item *orders.OrderItem) spreadsheet.Cell {
+		return spreadsheet.Text(item.ItemName)
+	}},
+	{Key: "quantity", Label: "Quantidade", Item: true, Value: func(_ orders.Order, item *orders.OrderItem) spreadsheet.Cell {
+		return spreadsheet.Int(item.Quantity)
+	}},
+	{Key: "unit_price", Label: "Preço unitário", Item: true, Financial: true, Value: func(_ orders.Order, item *orders.OrderItem) spreadsheet.Cell {
+		return spreadsheet.Money(item.UnitPrice)
+	}},
+	{Key: "item_total", Label: "Total do item", Item: true, Financial: true, Value: func(_ orders.Order, item *orders.OrderItem) spreadsheet.Cell {
+		return spreadsheet.Money(item.TotalPrice)
+	}},
+}
+
+// availableOrderExportColumns returns the export columns the admin behind the request may see
+func availableOrderExportColumns(r *http.Request) []orderExportColumn {
+	canViewFinancialData := admin.HasPermission(r, admin.PermOrdersFinancial)
+	var columns []orderExportColumn
+	for _, column := range orderExportColumns {
+		if column.Financial && !canViewFinancialData {
+			continue
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// selectOrderExportColumns keeps the requested columns in their standard order; all of them
+// when none is requested. Item columns are dropped when the items are not exported.
+func selectOrderExportColumns(available []orderExportColumn, requested []string, withItems bool) []orderExportColumn {
+	wanted := make(map[string]bool, len(requested))
+	for _, key := range requested {
+		wanted[key] = true
+	}
+
+	var columns []orderExportColumn
+	for _, column := range available {
+		if column.Item && !withItems {
+			continue
+		}
+		if len(wanted) > 0 && !wanted[column.Key] {
+			continue
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+// parseAnalyticsPeriod reads the dashboard date range (whole days, last 30 days by default) and
+// the granularity of the revenue chart
+func parseAnalyticsPeriod(r *http.Request) (analytics.Range, string, error) {
+	query := r.URL.Query()
+	today := time.Now()
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.Local)
+
+	to := today
+	if value := query.Get("to"); value != "" {
+		day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			return analytics.Range{}, "", errInvalidAnalyticsPeriod
+		}
+		to = day
+	}
+	from := to.AddDate(0, 0, -29)
+	if value := query.Get("from"); value != "" {
+		day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			return analytics.Range{}, "", errInvalidAnalyticsPeriod
+		}
+		from = day
+	}
+	if from.After(to) {
+		return analytics.Range{}, "", errInvalidAnalyticsPeriod
+	}
+
+	granularity := query.Get("granularity")
+	if granularity == "" {
+		granularity = analytics.GranularityDay
+	}
+	if !analytics.ValidGranularity(granularity) {
+		return analytics.Range{}, "", errInvalidAnalyticsPeriod
+	}
+	// Keep the chart readable: long periods are grouped by week or month
+	days := int(to.Sub(from).Hours()/24) + 1
+	if granularity == analytics.GranularityDay && days > 92 {
+		granularity = analytics.GranularityWeek
+	}
+	if granularity == analytics.GranularityWeek && days > 731 {
+		granularity = analytics.GranularityMonth
+	}
+
+	return analytics.Range{From: from, To: to.AddDate(0, 0, 1)}, granularity, nil
+}
+
+// analyticsFuncMap returns the helpers of the dashboard charts
+func analyticsFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"percent": analytics.Percent,
+		"maxRevenue": func(rows []analytics.Ranked) float64 {
+			max := 0.0
+			for _, row := range rows {
+				if row.Revenue > max {
+					max = row.Revenue
+				}
+			}
+			return max
+		},
+		"maxQuantity": func(rows []analytics.Ranked) float64 {
+			max := 0
+			for _, row := range rows {
+				if row.Quantity > max {
+					max = row.Quantity
+				}
+			}
+			return float64(max)
+		},
+		"float": func(n int) float64 {
+			return float64(n)
+		},
+		"add": func(a, b float64) float64 {
+			return a + b
+		},
+		"sub": func(a, b float64) float64 {
+			return a - b
+		},
+		"half": func(a float64) float64 {
+			return a / 2
+		},
+	}
+}
+
+// auditFuncMap returns the helpers of the audit log listing
+func auditFuncMap() template.FuncMap {
+	return template.FuncMap{
+		"entityLabel": audit.EntityLabel,
+		"actionLabel": audit.ActionLabel,
+		"auditValue":  formatAuditValue,
+	}
+}
+
+// formatAuditValue renders a JSON-decoded value of the audit log for display
+func formatAuditValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "—"
+	case string:
+		if v == "" {
+			return "\"\""
+		}
+		return v
+	case bool:
+		if v {
+			return "sim"
+		}
+		return "não"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	}
+}
+
+func renderTemporaryPassword(w http.ResponseWriter, username, password string) {
+	tmpl, err := template.ParseFiles("web/templates/admin-user-password.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	tmpl.Execute(w, map[string]string{
+		"Username": username,
+		"Password": password,
+	})
+}
+
+// renderValidationError renders the checkout validation error fragment
+func renderValidationError(w http.ResponseWriter, field, message string) {
+	tmpl, err := template.ParseFiles("web/templates/validation-error.html")
+	if err != nil {
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, orders.ValidationError{Field: field, Message: message})
+}
+
+// renderCartBody renders the cart modal body for the given cart token
+func renderCartBody(w http.ResponseWriter, token, errMsg string) {
+	cart, err := carts.GetCart(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.New("cart-body.html").Funcs(cartFuncMap()).ParseFiles("web/templates/cart-body.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	setCartUpdatedTrigger(w, cart)
+	tmpl.ExecuteTemplate(w, "cart-body", cartModalData{Cart: cart, Error: errMsg})
+}
+
+// setCartUpdatedTrigger tells the page that the cart changed so it can refresh the badge
+func setCartUpdatedTrigger(w http.ResponseWriter, cart *carts.Cart) {
+	w.Header().Set("HX-Trigger", fmt.Sprintf(`{"cartUpdated": {"count": %d}}`, cart.ItemCount))
+}
+
 func parseIDList(values []string) ([]int, error) {
 	ids := make([]int, 0, len(values))
 	for _, value := range values {
@@ -9,3 +9,5 @@ require (
 )
 
 require github.com/stripe/stripe-go/v84 v84.2.0
+
+require github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
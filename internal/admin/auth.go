@@ -4,8 +4,10 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -14,9 +16,13 @@ import (
 type Admin struct {
 	ID           int
 	Username     string
+	Email        string
 	PasswordHash string
 	Role         string
+	IsActive     bool
 	CreatedAt    time.Time
+
+	TwoFactorEnabled bool
 }
 
 type Session struct {
@@ -24,10 +30,17 @@ type Session struct {
 	AdminID   int
 	Role      string
 	ExpiresAt time.Time
+
+	Username           string
+	MustChangePassword bool
+
+	// CSRFToken must accompany every unsafe request made with the session (see csrf.go)
+	CSRFToken string
 }
 
 var db *sql.DB
 var sessions = make(map[string]Session)
+var sessionsMu sync.RWMutex
 
 const sessionCookieName = "admin_session"
 
@@ -55,9 +68,16 @@ func CreateAdmin(username, password string) error {
 
 // CreateAdminWithRole creates a new admin user with a role
 func CreateAdminWithRole(username, password, role string) error {
-	validRoles := map[string]bool{"admin": true, "product_admin": true}
-	if !validRoles[role] {
-		return fmt.Errorf("função inválida: %s (permitidas: admin, product_admin)", role)
+	if err := ValidatePassword(password, username); err != nil {
+		return err
+	}
+
+	exists, err := RoleExists(role)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("função inválida: %s", role)
 	}
 
 	hash, err := HashPassword(password)
@@ -76,9 +96,9 @@ func CreateAdminWithRole(username, password, role string) error {
 func GetAdminByUsername(username string) (*Admin, error) {
 	var admin Admin
 	err := db.QueryRow(
-		"SELECT id, username, password_hash, role, created_at FROM admin_users WHERE username = $1",
+		"SELECT id, username, COALESCE(email, ''), password_hash, role, is_active, created_at FROM admin_users WHERE username = $1",
 		username,
-	).Scan(&admin.ID, &admin.Username, &admin.PasswordHash, &admin.Role, &admin.CreatedAt)
+	).Scan(&admin.ID, &admin.Username, &admin.Email, &admin.PasswordHash, &admin.Role, &admin.IsActive, &admin.CreatedAt)
 
 	if err != nil {
 		return nil, err
@@ -102,27 +122,36 @@ func CreateSession(adminID int, role string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	csrfToken, err := generateSessionToken()
+	if err != nil {
+		return "", err
+	}
 
 	session := Session{
 		Token:     token,
 		AdminID:   adminID,
 		Role:      role,
 		ExpiresAt: time.Now().Add(24 * time.Hour),
+		CSRFToken: csrfToken,
 	}
 
+	sessionsMu.Lock()
 	sessions[token] = session
+	sessionsMu.Unlock()
 	return token, nil
 }
 
 // GetSession retrieves a session by token
 func GetSession(token string) (*Session, bool) {
+	sessionsMu.RLock()
 	session, exists := sessions[token]
+	sessionsMu.RUnlock()
 	if !exists {
 		return nil, false
 	}
 
 	if time.Now().After(session.ExpiresAt) {
-		delete(sessions, token)
+		DeleteSession(token)
 		return nil, false
 	}
 
@@ -131,25 +160,108 @@ func GetSession(token string) (*Session, bool) {
 
 // DeleteSession deletes a session
 func DeleteSession(token string) {
+	sessionsMu.Lock()
 	delete(sessions, token)
+	sessionsMu.Unlock()
 }
 
-// Login authenticates a user and creates a session
-func Login(w http.ResponseWriter, username, password string) error {
+// DeleteSessionsForAdmin logs an admin out everywhere, e.g. after a role change or deactivation
+func DeleteSessionsForAdmin(adminID int) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for token, session := range sessions {
+		if session.AdminID == adminID {
+			delete(sessions, token)
+		}
+	}
+}
+
+// Login authenticates a user and creates a session.
+// Repeated failures for the username or the client IP are throttled (see throttle.go).
+// Users with a second factor get ErrTwoFactorRequired, and users whose role demands one
+// without having it get ErrTwoFactorSetupRequired; both continue on /admin/login/2fa.
+func Login(w http.ResponseWriter, r *http.Request, username, password string) error {
+	ip := ClientIP(r)
+	if err := checkLoginThrottle(username, ip, time.Now()); err != nil {
+		var throttled *LoginThrottledError
+		if errors.As(err, &throttled) {
+			RecordLoginAttempt(username, ip, false, loginReasonThrottled)
+		}
+		return err
+	}
+
 	admin, err := GetAdminByUsername(username)
 	if err != nil {
+		// Spend the same time as a real check so unknown usernames cannot be told apart
+		CheckPassword(password, dummyPasswordHash())
+		RecordLoginAttempt(username, ip, false, loginReasonUnknownUser)
 		return fmt.Errorf("Credenciais Inválidas")
 	}
 
 	if !CheckPassword(password, admin.PasswordHash) {
+		RecordLoginAttempt(username, ip, false, loginReasonBadPassword)
+		return fmt.Errorf("Credenciais Inválidas")
+	}
+	if !admin.IsActive {
+		RecordLoginAttempt(username, ip, false, loginReasonInactive)
 		return fmt.Errorf("Credenciais Inválidas")
 	}
 
-	token, err := CreateSession(admin.ID, admin.Role)
+	// With a second factor the session only starts after the code is checked
+	status, err := GetTwoFactorStatus(admin.ID)
+	if err != nil {
+		return err
+	}
+	if status.Enabled {
+		if err := startPendingLogin(w, admin, false); err != nil {
+			return err
+		}
+		return ErrTwoFactorRequired
+	}
+	if status.Required {
+		if err := startPendingLogin(w, admin, true); err != nil {
+			return err
+		}
+		return ErrTwoFactorSetupRequired
+	}
+
+	RecordLoginAttempt(username, ip, true, loginReasonSuccess)
+	return startSession(w, admin.ID, admin.Role)
+}
+
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = HashPassword("dummy password for unknown users")
+	})
+	return dummyHash
+}
+
+// startSession creates a session and sets its cookie.
+// Admins still using a temporary password are held on the password change form.
+func startSession(w http.ResponseWriter, adminID int, role string) error {
+	var username string
+	var mustChange bool
+	err := db.QueryRow("SELECT username, must_change_password FROM admin_users WHERE id = $1", adminID).Scan(&username, &mustChange)
 	if err != nil {
 		return err
 	}
 
+	token, err := CreateSession(adminID, role)
+	if err != nil {
+		return err
+	}
+	sessionsMu.Lock()
+	session := sessions[token]
+	session.Username = username
+	session.MustChangePassword = mustChange
+	sessions[token] = session
+	sessionsMu.Unlock()
+
 	http.SetCookie(w, &http.Cookie{
 		Name:     sessionCookieName,
 		Value:    token,
@@ -188,47 +300,24 @@ func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		_, valid := GetSession(cookie.Value)
+		session, valid := GetSession(cookie.Value)
 		if !valid {
 			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
 			return
 		}
+		if session.MustChangePassword {
+			redirectToPasswordChange(w, r)
+			return
+		}
+		if !validCSRFToken(r, session) {
+			rejectCSRF(w, r)
+			return
+		}
 
 		next(w, r)
 	}
 }
 
-// RequireRole ensures the admin has one of the allowed roles
-func RequireRole(roles ...string) func(http.HandlerFunc) http.HandlerFunc {
-	allowed := make(map[string]struct{}, len(roles))
-	for _, role := range roles {
-		allowed[role] = struct{}{}
-	}
-
-	return func(next http.HandlerFunc) http.HandlerFunc {
-		return func(w http.ResponseWriter, r *http.Request) {
-			cookie, err := r.Cookie(sessionCookieName)
-			if err != nil {
-				http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
-				return
-			}
-
-			session, valid := GetSession(cookie.Value)
-			if !valid {
-				http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
-				return
-			}
-
-			if _, ok := allowed[session.Role]; !ok {
-				http.Error(w, "Forbidden", http.StatusForbidden)
-				return
-			}
-
-			next(w, r)
-		}
-	}
-}
-
 // IsAuthenticated checks if the current request is authenticated
 func IsAuthenticated(r *http.Request) bool {
 	cookie, err := r.Cookie(sessionCookieName)
@@ -240,17 +329,20 @@ func IsAuthenticated(r *http.Request) bool {
 	return valid
 }
 
-// RoleFromRequest returns the role for the authenticated admin
-func RoleFromRequest(r *http.Request) (string, bool) {
-	cookie, err := r.Cookie(sessionCookieName)
-	if err != nil {
-		return "", false
+// ActorFromRequest returns the id and username of the authenticated admin, for the audit log
+func ActorFromRequest(r *http.Request) (int, string, bool) {
+	session, valid := sessionFromRequest(r)
+	if !valid {
+		return 0, "", false
 	}
+	return session.AdminID, session.Username, true
+}
 
-	session, valid := GetSession(cookie.Value)
+// AdminIDFromRequest returns the id of the authenticated admin
+func AdminIDFromRequest(r *http.Request) (int, bool) {
+	session, valid := sessionFromRequest(r)
 	if !valid {
-		return "", false
+		return 0, false
 	}
-
-	return session.Role, true
+	return session.AdminID, true
 }
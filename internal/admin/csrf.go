@@ -0,0 +1,81 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+
+	"lojagtec/internal/logging"
+)
+
+// CSRF protection for the admin. Every session holds a random token that the admin pages
+// expose in a <meta name="csrf-token"> tag and in the hx-headers of <body>, so HTMX sends
+// it back in the X-CSRF-Token header; plain forms send it in the csrf_token field.
+const (
+	CSRFHeaderName = "X-CSRF-Token"
+	CSRFFieldName  = "csrf_token"
+)
+
+const csrfErrorMessage = "Não foi possível confirmar a origem desta ação (token de segurança inválido ou expirado). Recarregue a página e tente novamente."
+
+// CSRFToken returns the CSRF token of the session behind the request, or "" without a session
+func CSRFToken(r *http.Request) string {
+	session, ok := sessionFromRequest(r)
+	if !ok {
+		return ""
+	}
+	return session.CSRFToken
+}
+
+// ValidCSRFToken reports whether an unsafe request carries the CSRF token of its session.
+// Safe methods (GET, HEAD, OPTIONS) are always valid.
+func ValidCSRFToken(r *http.Request) bool {
+	session, ok := sessionFromRequest(r)
+	if !ok {
+		return isSafeMethod(r.Method)
+	}
+	return validCSRFToken(r, session)
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func validCSRFToken(r *http.Request, session *Session) bool {
+	if isSafeMethod(r.Method) {
+		return true
+	}
+	if session.CSRFToken == "" {
+		return false
+	}
+
+	token := r.Header.Get(CSRFHeaderName)
+	if token == "" {
+		token = r.PostFormValue(CSRFFieldName)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) == 1
+}
+
+// rejectCSRF answers a request whose CSRF token is missing or wrong. HTMX requests get the
+// usual admin error fragment so the message shows where the action was triggered.
+func rejectCSRF(w http.ResponseWriter, r *http.Request) {
+	logging.LogError("admin", "csrf", "invalid CSRF token", map[string]interface{}{
+		"method": r.Method,
+		"path":   r.URL.Path,
+		"ip":     ClientIP(r),
+	})
+
+	if r.Header.Get("HX-Request") != "true" {
+		http.Error(w, csrfErrorMessage, http.StatusForbidden)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("web/templates/admin-error-message.html")
+	if err != nil {
+		http.Error(w, csrfErrorMessage, http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("HX-Reswap", "innerHTML")
+	tmpl.Execute(w, csrfErrorMessage)
+}
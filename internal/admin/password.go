@@ -0,0 +1,163 @@
+package admin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"lojagtec/internal/logging"
+)
+
+// Password policy: long passwords that are not known to be breached, following NIST SP 800-63B
+// (no composition rules). bcrypt only looks at the first 72 bytes, so longer ones are refused.
+const (
+	minPasswordLength     = 12
+	maxPasswordBytes      = 72
+	defaultDenylistPath   = "configs/password-denylist.txt"
+	passwordChangePath    = "/admin/password"
+	minDistinctCharacters = 5
+)
+
+var (
+	ErrPasswordTooShort         = fmt.Errorf("A senha deve ter pelo menos %d caracteres.", minPasswordLength)
+	ErrPasswordTooLong          = fmt.Errorf("A senha deve ter no máximo %d bytes.", maxPasswordBytes)
+	ErrPasswordTooSimple        = errors.New("A senha é muito repetitiva. Use uma frase ou combinação menos previsível.")
+	ErrPasswordContainsUsername = errors.New("A senha não pode conter o nome de usuário.")
+	ErrPasswordBreached         = errors.New("Esta senha aparece em listas de senhas vazadas. Escolha outra.")
+	ErrPasswordMismatch         = errors.New("A confirmação não confere com a nova senha.")
+	ErrPasswordUnchanged        = errors.New("A nova senha deve ser diferente da atual.")
+	ErrWrongPassword            = errors.New("Senha atual incorreta.")
+)
+
+var (
+	denylist     map[string]struct{}
+	denylistOnce sync.Once
+)
+
+// loadDenylist reads the breached-password list, one password per line ("#" starts a comment).
+// The path can be overridden with PASSWORD_DENYLIST_FILE.
+func loadDenylist() {
+	denylist = make(map[string]struct{})
+
+	path := strings.TrimSpace(os.Getenv("PASSWORD_DENYLIST_FILE"))
+	if path == "" {
+		path = defaultDenylistPath
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		logging.LogError("admin", "load_password_denylist", err.Error(), map[string]interface{}{"path": path})
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		denylist[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		logging.LogError("admin", "load_password_denylist", err.Error(), map[string]interface{}{"path": path})
+	}
+}
+
+func isBreachedPassword(password string) bool {
+	denylistOnce.Do(loadDenylist)
+	_, found := denylist[strings.ToLower(password)]
+	return found
+}
+
+// ValidatePassword checks a new password against the policy
+func ValidatePassword(password, username string) error {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return ErrPasswordTooShort
+	}
+	if len(password) > maxPasswordBytes {
+		return ErrPasswordTooLong
+	}
+
+	distinct := make(map[rune]struct{})
+	for _, r := range strings.ToLower(password) {
+		distinct[r] = struct{}{}
+	}
+	if len(distinct) < minDistinctCharacters {
+		return ErrPasswordTooSimple
+	}
+
+	username = strings.ToLower(strings.TrimSpace(username))
+	if len(username) >= 3 && strings.Contains(strings.ToLower(password), username) {
+		return ErrPasswordContainsUsername
+	}
+
+	if isBreachedPassword(password) {
+		return ErrPasswordBreached
+	}
+	return nil
+}
+
+// ChangePassword replaces the password of the logged-in admin. Every other session of the
+// admin ends and the current one is renewed.
+func ChangePassword(w http.ResponseWriter, r *http.Request, current, password, confirmation string) error {
+	session, ok := sessionFromRequest(r)
+	if !ok {
+		return ErrAdminNotFound
+	}
+
+	account, err := GetAdminByID(session.AdminID)
+	if err != nil {
+		return err
+	}
+	if !CheckPassword(current, account.PasswordHash) {
+		return ErrWrongPassword
+	}
+	if password != confirmation {
+		return ErrPasswordMismatch
+	}
+	if password == current {
+		return ErrPasswordUnchanged
+	}
+	if err := ValidatePassword(password, account.Username); err != nil {
+		return err
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		UPDATE admin_users
+		SET password_hash = $1, must_change_password = FALSE, password_changed_at = CURRENT_TIMESTAMP,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+	`, hash, account.ID)
+	if err != nil {
+		return fmt.Errorf("failed to change password: %v", err)
+	}
+
+	DeleteSessionsForAdmin(account.ID)
+	return startSession(w, account.ID, account.Role)
+}
+
+// MustChangePassword reports whether the admin behind the request still uses a temporary password
+func MustChangePassword(r *http.Request) bool {
+	session, ok := sessionFromRequest(r)
+	return ok && session.MustChangePassword
+}
+
+// redirectToPasswordChange sends admins with a temporary password to the password form
+func redirectToPasswordChange(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", passwordChangePath)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	http.Redirect(w, r, passwordChangePath, http.StatusSeeOther)
+}
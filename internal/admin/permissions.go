@@ -0,0 +1,308 @@
+package admin
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Permissions granted to admin roles
+const (
+	PermProductsWrite   = "products.write"
+	PermOffersWrite     = "offers.write"
+	PermBannersWrite    = "banners.write"
+	PermOrdersRead      = "orders.read"
+	PermOrdersWrite     = "orders.write"
+	PermOrdersFinancial = "orders.financial"
+	PermOrdersRefund    = "orders.refund"
+	PermUsersManage     = "users.manage"
+	PermAuditRead       = "audit.read"
+
+	PermDeliveriesManage = "deliveries.manage"
+	PermDeliveriesRun    = "deliveries.run"
+)
+
+// Permission describes a permission for the role editor
+type Permission struct {
+	Name        string
+	Description string
+}
+
+// AllPermissions lists every permission, in the order shown in the admin
+var AllPermissions = []Permission{
+	{PermProductsWrite, "Produtos, marcas e categorias"},
+	{PermOffersWrite, "Ofertas"},
+	{PermBannersWrite, "Banners"},
+	{PermOrdersRead, "Ver pedidos"},
+	{PermOrdersWrite, "Atualizar status de pedidos"},
+	{PermOrdersFinancial, "Ver valores e totais financeiros"},
+	{PermOrdersRefund, "Cancelar pedidos pagos (estorno)"},
+	{PermUsersManage, "Gerenciar usuários e funções"},
+	{PermAuditRead, "Ver o registro de auditoria"},
+	{PermDeliveriesManage, "Planejar rotas de entrega"},
+	{PermDeliveriesRun, "Executar rotas de entrega atribuídas"},
+}
+
+// Role is a named set of permissions
+type Role struct {
+	Name        string
+	Description string
+	Permissions map[string]bool
+	UserCount   int
+
+	// RequireTwoFactor makes users of the role enroll a second factor before logging in
+	RequireTwoFactor bool
+}
+
+var (
+	ErrRoleNotFound    = errors.New("Função não encontrada.")
+	ErrInvalidRoleName = errors.New("Nome de função inválido: use letras minúsculas, números e _.")
+	ErrRoleInUse       = errors.New("Esta função ainda está atribuída a usuários.")
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{1,49}$`)
+
+func isKnownPermission(permission string) bool {
+	for _, p := range AllPermissions {
+		if p.Name == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRolePermissions returns the permissions granted to a role
+func GetRolePermissions(role string) (map[string]bool, error) {
+	rows, err := db.Query("SELECT permission FROM admin_role_permissions WHERE role = $1", role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := make(map[string]bool)
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions[permission] = true
+	}
+	return permissions, rows.Err()
+}
+
+// GetRoles lists every role with its permissions and how many users hold it
+func GetRoles() ([]Role, error) {
+	rows, err := db.Query(`
+		SELECT r.name, r.description, r.require_two_factor, COUNT(u.id)
+		FROM admin_roles r
+		LEFT JOIN admin_users u ON u.role = r.name
+		GROUP BY r.name, r.description, r.require_two_factor
+		ORDER BY r.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []Role
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.Name, &role.Description, &role.RequireTwoFactor, &role.UserCount); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range roles {
+		roles[i].Permissions, err = GetRolePermissions(roles[i].Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return roles, nil
+}
+
+// RoleExists reports whether a role with the given name exists
+func RoleExists(name string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM admin_roles WHERE name = $1)", name).Scan(&exists)
+	return exists, err
+}
+
+// CreateRole creates a role without permissions
+func CreateRole(name, description string) error {
+	name = strings.TrimSpace(name)
+	if !roleNamePattern.MatchString(name) {
+		return ErrInvalidRoleName
+	}
+
+	_, err := db.Exec("INSERT INTO admin_roles (name, description) VALUES ($1, $2)", name, strings.TrimSpace(description))
+	if err != nil {
+		return fmt.Errorf("failed to create role: %v", err)
+	}
+	return nil
+}
+
+// SetRolePermissions replaces the permissions of a role.
+// Removing users.manage from every active user is refused so the admin cannot be locked out.
+func SetRolePermissions(role string, permissions []string) error {
+	exists, err := RoleExists(role)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrRoleNotFound
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM admin_role_permissions WHERE role = $1", role); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to clear role permissions: %v", err)
+	}
+
+	for _, permission := range permissions {
+		if !isKnownPermission(permission) {
+			_ = tx.Rollback()
+			return fmt.Errorf("unknown permission: %s", permission)
+		}
+		if _, err := tx.Exec("INSERT INTO admin_role_permissions (role, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING", role, permission); err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to grant permission: %v", err)
+		}
+	}
+
+	if err := ensureUserManagerRemains(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit role permissions: %v", err)
+	}
+	return nil
+}
+
+// SetRoleTwoFactorRequired sets whether users of a role must use a second factor
+func SetRoleTwoFactorRequired(role string, required bool) error {
+	result, err := db.Exec("UPDATE admin_roles SET require_two_factor = $1 WHERE name = $2", required, role)
+	if err != nil {
+		return fmt.Errorf("failed to update role policy: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrRoleNotFound
+	}
+	return nil
+}
+
+// DeleteRole removes a role that no user holds
+func DeleteRole(role string) error {
+	var users int
+	if err := db.QueryRow("SELECT COUNT(*) FROM admin_users WHERE role = $1", role).Scan(&users); err != nil {
+		return err
+	}
+	if users > 0 {
+		return ErrRoleInUse
+	}
+
+	result, err := db.Exec("DELETE FROM admin_roles WHERE name = $1", role)
+	if err != nil {
+		return fmt.Errorf("failed to delete role: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrRoleNotFound
+	}
+	return nil
+}
+
+// ensureUserManagerRemains fails when no active user would be left with users.manage
+func ensureUserManagerRemains(tx *sql.Tx) error {
+	var managers int
+	err := tx.QueryRow(`
+		SELECT COUNT(*)
+		FROM admin_users u
+		JOIN admin_role_permissions p ON p.role = u.role AND p.permission = $1
+		WHERE u.is_active
+	`, PermUsersManage).Scan(&managers)
+	if err != nil {
+		return err
+	}
+	if managers == 0 {
+		return ErrLastUserManager
+	}
+	return nil
+}
+
+// sessionFromRequest returns the valid session of the request, if any
+func sessionFromRequest(r *http.Request) (*Session, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil, false
+	}
+	return GetSession(cookie.Value)
+}
+
+// HasPermission reports whether the admin behind the request holds the permission
+func HasPermission(r *http.Request, permission string) bool {
+	session, ok := sessionFromRequest(r)
+	if !ok {
+		return false
+	}
+
+	permissions, err := GetRolePermissions(session.Role)
+	if err != nil {
+		return false
+	}
+	return permissions[permission]
+}
+
+// PermissionsFromRequest returns the permissions of the admin behind the request
+func PermissionsFromRequest(r *http.Request) map[string]bool {
+	session, ok := sessionFromRequest(r)
+	if !ok {
+		return map[string]bool{}
+	}
+
+	permissions, err := GetRolePermissions(session.Role)
+	if err != nil {
+		return map[string]bool{}
+	}
+	return permissions
+}
+
+// RequirePermission ensures the admin is logged in and holds the permission
+func RequirePermission(permission string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			session, valid := sessionFromRequest(r)
+			if !valid {
+				http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+				return
+			}
+			if session.MustChangePassword {
+				redirectToPasswordChange(w, r)
+				return
+			}
+			if !validCSRFToken(r, session) {
+				rejectCSRF(w, r)
+				return
+			}
+
+			if !HasPermission(r, permission) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"lojagtec/internal/logging"
+	"lojagtec/internal/mailer"
+)
+
+// Password reset links are valid for an hour and work once. At most a few links are
+// sent per admin per hour so the form cannot be used to flood an inbox.
+const (
+	passwordResetLifetime   = time.Hour
+	passwordResetMaxPerHour = 3
+	passwordResetRetention  = 30 * 24 * time.Hour
+)
+
+var ErrInvalidResetToken = errors.New("Este link de redefinição é inválido, já foi usado ou expirou. Solicite um novo.")
+
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RequestPasswordReset emails a reset link to the active admin whose username or email is
+// login. resetURL is the absolute address of the reset form; the token is appended to it.
+// Nothing tells the caller whether the account exists: unknown logins, accounts without an
+// email and rate-limited requests all return nil.
+func RequestPasswordReset(r *http.Request, login, resetURL string) error {
+	login = strings.TrimSpace(login)
+	if login == "" {
+		return nil
+	}
+
+	var adminID int
+	var username, email string
+	err := db.QueryRow(`
+		SELECT id, username, COALESCE(email, '')
+		FROM admin_users
+		WHERE is_active AND (LOWER(username) = LOWER($1) OR LOWER(email) = LOWER($1))
+		ORDER BY LOWER(username) = LOWER($1) DESC
+		LIMIT 1
+	`, login).Scan(&adminID, &username, &email)
+	if err == sql.ErrNoRows || (err == nil && email == "") {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find admin for password reset: %v", err)
+	}
+
+	var recent int
+	err = db.QueryRow(
+		"SELECT COUNT(*) FROM admin_password_resets WHERE admin_id = $1 AND created_at > $2",
+		adminID, time.Now().Add(-time.Hour),
+	).Scan(&recent)
+	if err != nil {
+		return fmt.Errorf("failed to count password resets: %v", err)
+	}
+	if recent >= passwordResetMaxPerHour {
+		logging.LogError("admin", "password_reset_rate_limited", "too many reset requests", map[string]interface{}{
+			"admin_id": adminID,
+			"ip":       ClientIP(r),
+		})
+		return nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	expiresAt := time.Now().Add(passwordResetLifetime)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// A new link replaces the ones sent before
+	if _, err := tx.Exec("UPDATE admin_password_resets SET used_at = CURRENT_TIMESTAMP WHERE admin_id = $1 AND used_at IS NULL", adminID); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to revoke password resets: %v", err)
+	}
+	_, err = tx.Exec(
+		"INSERT INTO admin_password_resets (admin_id, token_hash, requested_ip, expires_at) VALUES ($1, $2, $3, $4)",
+		adminID, hashResetToken(token), ClientIP(r), expiresAt,
+	)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to create password reset: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	link := resetURL + "?token=" + url.QueryEscape(token)
+	// Sent in the background so the response time does not reveal whether the account exists
+	go func() {
+		err := mailer.SendTemplate(email, "Redefinição de senha do painel G-TEC", "admin-password-reset.html", map[string]interface{}{
+			"Username":  username,
+			"ResetURL":  link,
+			"ExpiresAt": expiresAt,
+		})
+		if err != nil {
+			logging.LogError("admin", "password_reset_send", err.Error(), map[string]interface{}{
+				"admin_id": adminID,
+			})
+		}
+	}()
+	return nil
+}
+
+// ValidateResetToken returns the admin a reset token belongs to, or ErrInvalidResetToken
+func ValidateResetToken(token string) (*Admin, error) {
+	var adminID int
+	err := db.QueryRow(`
+		SELECT r.admin_id
+		FROM admin_password_resets r
+		JOIN admin_users u ON u.id = r.admin_id
+		WHERE r.token_hash = $1 AND r.used_at IS NULL AND r.expires_at > CURRENT_TIMESTAMP AND u.is_active
+	`, hashResetToken(token)).Scan(&adminID)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidResetToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check password reset: %v", err)
+	}
+	return GetAdminByID(adminID)
+}
+
+// ResetPasswordWithToken sets a new password through a reset link. The token is spent, every
+// session of the admin ends and earlier failed logins of the username stop counting.
+func ResetPasswordWithToken(r *http.Request, token, password, confirmation string) error {
+	account, err := ValidateResetToken(token)
+	if err != nil {
+		return err
+	}
+	if password != confirmation {
+		return ErrPasswordMismatch
+	}
+	if err := ValidatePassword(password, account.Username); err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// Spending the token first makes concurrent submissions of the same link fail
+	result, err := tx.Exec(`
+		UPDATE admin_password_resets SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	`, hashResetToken(token))
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to use password reset: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		_ = tx.Rollback()
+		return ErrInvalidResetToken
+	}
+	_, err = tx.Exec(`
+		UPDATE admin_users
+		SET password_hash = $1, must_change_password = FALSE, password_changed_at = CURRENT_TIMESTAMP,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+	`, hash, account.ID)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to reset password: %v", err)
+	}
+	if _, err := tx.Exec("UPDATE admin_password_resets SET used_at = CURRENT_TIMESTAMP WHERE admin_id = $1 AND used_at IS NULL", account.ID); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to revoke password resets: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	DeleteSessionsForAdmin(account.ID)
+	RecordLoginAttempt(account.Username, ClientIP(r), true, loginReasonPasswordReset)
+	return nil
+}
+
+// PruneExpiredPasswordResets deletes old reset links; it runs as a scheduled job
+func PruneExpiredPasswordResets(now time.Time) error {
+	_, err := db.Exec("DELETE FROM admin_password_resets WHERE expires_at < $1", now.Add(-passwordResetRetention))
+	if err != nil {
+		return fmt.Errorf("failed to prune password resets: %v", err)
+	}
+	return nil
+}
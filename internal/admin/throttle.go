@@ -0,0 +1,184 @@
+package admin
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"lojagtec/internal/logging"
+)
+
+// Login throttling. Failures are counted per username (since its last successful login)
+// and per IP address over a sliding window. After a few free attempts every new one has
+// to wait twice as long as the previous, and too many failures lock the login for a while.
+const (
+	loginAttemptWindow      = 15 * time.Minute
+	loginLockoutDuration    = 15 * time.Minute
+	loginBaseDelay          = time.Second
+	loginMaxDelay           = 5 * time.Minute
+	usernameFreeAttempts    = 3
+	usernameLockoutAttempts = 10
+	ipFreeAttempts          = 10
+	ipLockoutAttempts       = 30
+	loginAttemptsRetention  = 90 * 24 * time.Hour
+)
+
+// Reasons recorded in login_attempts
+const (
+	loginReasonSuccess     = "success"
+	loginReasonUnknownUser = "unknown_user"
+	loginReasonBadPassword = "bad_password"
+	loginReasonInactive    = "inactive"
+	loginReasonBadCode     = "bad_second_factor"
+	loginReasonThrottled   = "throttled"
+
+	// loginReasonPasswordReset is a success recorded when a reset link sets a new password
+	loginReasonPasswordReset = "password_reset"
+)
+
+// LoginThrottledError is returned while a username or IP must wait before trying again
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LoginThrottledError) Error() string {
+	wait := e.RetryAfter.Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	if e.Locked {
+		return fmt.Sprintf("Muitas tentativas de login. Acesso bloqueado temporariamente; tente novamente em %s.", formatWait(wait))
+	}
+	return fmt.Sprintf("Muitas tentativas de login. Aguarde %s antes de tentar novamente.", formatWait(wait))
+}
+
+func formatWait(d time.Duration) string {
+	if d >= time.Minute {
+		return fmt.Sprintf("%d min", int(math.Ceil(d.Minutes())))
+	}
+	return fmt.Sprintf("%d s", int(d.Seconds()))
+}
+
+// ClientIP returns the address of the client. X-Forwarded-For and X-Real-IP are only
+// trusted when TRUST_PROXY_HEADERS=true, i.e. when the server runs behind a reverse proxy.
+func ClientIP(r *http.Request) string {
+	if strings.EqualFold(os.Getenv("TRUST_PROXY_HEADERS"), "true") {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			if ip := strings.TrimSpace(strings.Split(forwarded, ",")[0]); ip != "" {
+				return ip
+			}
+		}
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func normalizeLoginUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// RecordLoginAttempt stores a login attempt
+func RecordLoginAttempt(username, ip string, success bool, reason string) {
+	_, err := db.Exec(
+		"INSERT INTO login_attempts (username, ip_address, success, reason) VALUES ($1, $2, $3, $4)",
+		normalizeLoginUsername(username), ip, success, reason,
+	)
+	if err != nil {
+		logging.LogError("admin", "record_login_attempt", err.Error(), map[string]interface{}{
+			"username": username,
+			"ip":       ip,
+		})
+	}
+}
+
+// checkLoginThrottle fails with a LoginThrottledError while the username or the IP must wait
+func checkLoginThrottle(username, ip string, now time.Time) error {
+	since := now.Add(-loginAttemptWindow)
+
+	var userFailures int
+	var userLast *time.Time
+	err := db.QueryRow(`
+		SELECT COUNT(*), MAX(attempted_at)
+		FROM login_attempts
+		WHERE username = $1 AND NOT success AND reason <> $2
+			AND attempted_at > GREATEST($3, COALESCE(
+				(SELECT MAX(attempted_at) FROM login_attempts WHERE username = $1 AND success),
+				'-infinity'::timestamptz))
+	`, normalizeLoginUsername(username), loginReasonThrottled, since).Scan(&userFailures, &userLast)
+	if err != nil {
+		return fmt.Errorf("failed to count login attempts: %v", err)
+	}
+
+	var ipFailures int
+	var ipLast *time.Time
+	err = db.QueryRow(`
+		SELECT COUNT(*), MAX(attempted_at)
+		FROM login_attempts
+		WHERE ip_address = $1 AND NOT success AND reason <> $2 AND attempted_at > $3
+	`, ip, loginReasonThrottled, since).Scan(&ipFailures, &ipLast)
+	if err != nil {
+		return fmt.Errorf("failed to count login attempts: %v", err)
+	}
+
+	var throttled *LoginThrottledError
+	for _, check := range []struct {
+		failures, free, lockout int
+		last                    *time.Time
+	}{
+		{userFailures, usernameFreeAttempts, usernameLockoutAttempts, userLast},
+		{ipFailures, ipFreeAttempts, ipLockoutAttempts, ipLast},
+	} {
+		if check.last == nil {
+			continue
+		}
+		wait, locked := loginDelay(check.failures, check.free, check.lockout)
+		retryAfter := check.last.Add(wait).Sub(now)
+		if retryAfter <= 0 {
+			continue
+		}
+		if throttled == nil || retryAfter > throttled.RetryAfter {
+			throttled = &LoginThrottledError{RetryAfter: retryAfter, Locked: locked}
+		}
+	}
+	if throttled != nil {
+		return throttled
+	}
+	return nil
+}
+
+// loginDelay returns how long to wait after the last of n failures
+func loginDelay(failures, free, lockout int) (time.Duration, bool) {
+	if failures >= lockout {
+		return loginLockoutDuration, true
+	}
+	if failures < free {
+		return 0, false
+	}
+
+	delay := loginBaseDelay << uint(failures-free)
+	if delay > loginMaxDelay || delay <= 0 {
+		delay = loginMaxDelay
+	}
+	return delay, false
+}
+
+// PruneLoginAttempts deletes attempts older than the retention period; it runs as a scheduled job
+func PruneLoginAttempts(now time.Time) error {
+	_, err := db.Exec("DELETE FROM login_attempts WHERE attempted_at < $1", now.Add(-loginAttemptsRetention))
+	if err != nil {
+		return fmt.Errorf("failed to prune login attempts: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,485 @@
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+var (
+	ErrTwoFactorRequired      = errors.New("Informe o código do aplicativo autenticador.")
+	ErrTwoFactorSetupRequired = errors.New("Sua função exige verificação em duas etapas. Configure-a para continuar.")
+	ErrInvalidTwoFactorCode   = errors.New("Código inválido.")
+	ErrTwoFactorLoginExpired  = errors.New("A verificação expirou. Entre novamente.")
+	ErrTwoFactorEnforced      = errors.New("Sua função exige verificação em duas etapas; ela não pode ser desativada.")
+	ErrTwoFactorNotEnabled    = errors.New("A verificação em duas etapas não está ativa.")
+	ErrTwoFactorEnabled       = errors.New("A verificação em duas etapas já está ativa.")
+	ErrEnrollmentExpired      = errors.New("A configuração expirou. Comece novamente.")
+)
+
+const (
+	twoFactorCookieName   = "admin_2fa"
+	pendingLoginTTL       = 10 * time.Minute
+	enrollmentTTL         = 10 * time.Minute
+	maxTwoFactorAttempts  = 5
+	backupCodeCount       = 10
+	backupCodeLength      = 10
+	twoFactorQRCodeSize   = 256
+	backupCodeAlphabet    = "abcdefghjkmnpqrstuvwxyz23456789"
+	backupCodeGroupLength = 5
+)
+
+// TwoFactorStatus describes the second factor of an admin user
+type TwoFactorStatus struct {
+	Enabled         bool
+	Required        bool
+	BackupCodesLeft int
+}
+
+// PendingLogin is a login that passed the password check and waits for the second factor
+type PendingLogin struct {
+	AdminID   int
+	Username  string
+	Role      string
+	Enroll    bool
+	Attempts  int
+	ExpiresAt time.Time
+}
+
+// Enrollment holds a TOTP secret that has not been confirmed yet
+type Enrollment struct {
+	Secret          string
+	ProvisioningURI string
+	QRCode          string
+	ExpiresAt       time.Time
+}
+
+var (
+	pendingLogins = make(map[string]PendingLogin)
+	enrollments   = make(map[int]Enrollment)
+	twoFactorMu   sync.Mutex
+)
+
+// GetTwoFactorStatus reports whether the admin uses a second factor and whether the role demands it
+func GetTwoFactorStatus(adminID int) (*TwoFactorStatus, error) {
+	var status TwoFactorStatus
+	err := db.QueryRow(`
+		SELECT u.totp_enabled, COALESCE(r.require_two_factor, FALSE),
+			(SELECT COUNT(*) FROM admin_backup_codes c WHERE c.admin_id = u.id AND c.used_at IS NULL)
+		FROM admin_users u
+		LEFT JOIN admin_roles r ON r.name = u.role
+		WHERE u.id = $1
+	`, adminID).Scan(&status.Enabled, &status.Required, &status.BackupCodesLeft)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAdminNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// startPendingLogin remembers a login waiting for the second factor in a short-lived cookie
+func startPendingLogin(w http.ResponseWriter, admin *Admin, enroll bool) error {
+	token, err := generateSessionToken()
+	if err != nil {
+		return err
+	}
+
+	twoFactorMu.Lock()
+	pendingLogins[token] = PendingLogin{
+		AdminID:   admin.ID,
+		Username:  admin.Username,
+		Role:      admin.Role,
+		Enroll:    enroll,
+		ExpiresAt: time.Now().Add(pendingLoginTTL),
+	}
+	twoFactorMu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     twoFactorCookieName,
+		Value:    token,
+		Path:     "/admin/login",
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(pendingLoginTTL.Seconds()),
+	})
+	return nil
+}
+
+// PendingLoginFromRequest returns the login waiting for a second factor, if any
+func PendingLoginFromRequest(r *http.Request) (*PendingLogin, bool) {
+	_, pending, ok := pendingLoginFromRequest(r)
+	return pending, ok
+}
+
+func pendingLoginFromRequest(r *http.Request) (string, *PendingLogin, bool) {
+	cookie, err := r.Cookie(twoFactorCookieName)
+	if err != nil {
+		return "", nil, false
+	}
+
+	twoFactorMu.Lock()
+	defer twoFactorMu.Unlock()
+	pending, exists := pendingLogins[cookie.Value]
+	if !exists {
+		return "", nil, false
+	}
+	if time.Now().After(pending.ExpiresAt) {
+		delete(pendingLogins, cookie.Value)
+		return "", nil, false
+	}
+	return cookie.Value, &pending, true
+}
+
+// recordFailedAttempt counts a wrong code and drops the pending login after too many
+func recordFailedAttempt(token string) error {
+	twoFactorMu.Lock()
+	defer twoFactorMu.Unlock()
+
+	pending, exists := pendingLogins[token]
+	if !exists {
+		return ErrTwoFactorLoginExpired
+	}
+	pending.Attempts++
+	if pending.Attempts >= maxTwoFactorAttempts {
+		delete(pendingLogins, token)
+		return ErrTwoFactorLoginExpired
+	}
+	pendingLogins[token] = pending
+	return ErrInvalidTwoFactorCode
+}
+
+// finishPendingLogin turns a verified pending login into a session
+func finishPendingLogin(w http.ResponseWriter, r *http.Request, token string, pending *PendingLogin) error {
+	twoFactorMu.Lock()
+	delete(pendingLogins, token)
+	twoFactorMu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     twoFactorCookieName,
+		Value:    "",
+		Path:     "/admin/login",
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+
+	RecordLoginAttempt(pending.Username, ClientIP(r), true, loginReasonSuccess)
+	return startSession(w, pending.AdminID, pending.Role)
+}
+
+// VerifyTwoFactorLogin completes a login with a TOTP or backup code
+func VerifyTwoFactorLogin(w http.ResponseWriter, r *http.Request, code string) error {
+	token, pending, ok := pendingLoginFromRequest(r)
+	if !ok || pending.Enroll {
+		return ErrTwoFactorLoginExpired
+	}
+
+	valid, err := checkSecondFactor(pending.AdminID, code)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		RecordLoginAttempt(pending.Username, ClientIP(r), false, loginReasonBadCode)
+		return recordFailedAttempt(token)
+	}
+
+	return finishPendingLogin(w, r, token, pending)
+}
+
+// BeginLoginEnrollment starts the TOTP setup demanded by the role of a pending login
+func BeginLoginEnrollment(r *http.Request) (*Enrollment, error) {
+	_, pending, ok := pendingLoginFromRequest(r)
+	if !ok || !pending.Enroll {
+		return nil, ErrTwoFactorLoginExpired
+	}
+	return BeginTOTPEnrollment(pending.AdminID, pending.Username)
+}
+
+// CompleteLoginEnrollment confirms the setup of a pending login, starts the session
+// and returns the backup codes
+func CompleteLoginEnrollment(w http.ResponseWriter, r *http.Request, code string) ([]string, error) {
+	token, pending, ok := pendingLoginFromRequest(r)
+	if !ok || !pending.Enroll {
+		return nil, ErrTwoFactorLoginExpired
+	}
+
+	codes, err := ConfirmTOTPEnrollment(pending.AdminID, code)
+	if errors.Is(err, ErrInvalidTwoFactorCode) {
+		RecordLoginAttempt(pending.Username, ClientIP(r), false, loginReasonBadCode)
+		return nil, recordFailedAttempt(token)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := finishPendingLogin(w, r, token, pending); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// BeginTOTPEnrollment creates (or reuses) an unconfirmed secret and its QR code
+func BeginTOTPEnrollment(adminID int, account string) (*Enrollment, error) {
+	status, err := GetTwoFactorStatus(adminID)
+	if err != nil {
+		return nil, err
+	}
+	if status.Enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	twoFactorMu.Lock()
+	defer twoFactorMu.Unlock()
+
+	if enrollment, exists := enrollments[adminID]; exists && time.Now().Before(enrollment.ExpiresAt) {
+		return &enrollment, nil
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	uri := totpProvisioningURI(account, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, twoFactorQRCodeSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate totp qr code: %v", err)
+	}
+
+	enrollment := Enrollment{
+		Secret:          secret,
+		ProvisioningURI: uri,
+		QRCode:          "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+		ExpiresAt:       time.Now().Add(enrollmentTTL),
+	}
+	enrollments[adminID] = enrollment
+	return &enrollment, nil
+}
+
+// ConfirmTOTPEnrollment enables TOTP once the admin proves the app is set up, returning fresh backup codes
+func ConfirmTOTPEnrollment(adminID int, code string) ([]string, error) {
+	twoFactorMu.Lock()
+	enrollment, exists := enrollments[adminID]
+	twoFactorMu.Unlock()
+	if !exists || time.Now().After(enrollment.ExpiresAt) {
+		return nil, ErrEnrollmentExpired
+	}
+
+	step, valid := validateTOTP(enrollment.Secret, code, time.Now())
+	if !valid {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		UPDATE admin_users
+		SET totp_secret = $1, totp_enabled = TRUE, totp_last_step = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+	`, enrollment.Secret, step, adminID)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, fmt.Errorf("failed to enable two-factor authentication: %v", err)
+	}
+
+	codes, err := replaceBackupCodes(tx, adminID)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit two-factor enrollment: %v", err)
+	}
+
+	twoFactorMu.Lock()
+	delete(enrollments, adminID)
+	twoFactorMu.Unlock()
+	return codes, nil
+}
+
+// RegenerateBackupCodes replaces every backup code after checking a current code
+func RegenerateBackupCodes(adminID int, code string) ([]string, error) {
+	if err := requireSecondFactor(adminID, code); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	codes, err := replaceBackupCodes(tx, adminID)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit backup codes: %v", err)
+	}
+	return codes, nil
+}
+
+// DisableTwoFactor turns TOTP off for an admin whose role does not require it
+func DisableTwoFactor(adminID int, code string) error {
+	status, err := GetTwoFactorStatus(adminID)
+	if err != nil {
+		return err
+	}
+	if status.Required {
+		return ErrTwoFactorEnforced
+	}
+	if err := requireSecondFactor(adminID, code); err != nil {
+		return err
+	}
+	return clearTwoFactor(adminID)
+}
+
+// ResetTwoFactor removes the second factor of another admin, e.g. after a lost phone.
+// The admin has to enroll again on the next login if the role requires it.
+func ResetTwoFactor(id, actorID int) error {
+	if id == actorID {
+		return ErrCannotChangeSelf
+	}
+	if err := clearTwoFactor(id); err != nil {
+		return err
+	}
+	DeleteSessionsForAdmin(id)
+	return nil
+}
+
+func clearTwoFactor(adminID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+
+	result, err := tx.Exec(`
+		UPDATE admin_users
+		SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`, adminID)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to disable two-factor authentication: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		_ = tx.Rollback()
+		return ErrAdminNotFound
+	}
+
+	if _, err := tx.Exec("DELETE FROM admin_backup_codes WHERE admin_id = $1", adminID); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to delete backup codes: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit two-factor reset: %v", err)
+	}
+	return nil
+}
+
+func requireSecondFactor(adminID int, code string) error {
+	valid, err := checkSecondFactor(adminID, code)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// checkSecondFactor accepts a TOTP code not used before or an unused backup code
+func checkSecondFactor(adminID int, code string) (bool, error) {
+	var secret sql.NullString
+	var enabled bool
+	err := db.QueryRow("SELECT totp_secret, totp_enabled FROM admin_users WHERE id = $1", adminID).Scan(&secret, &enabled)
+	if err != nil {
+		return false, err
+	}
+	if !enabled || !secret.Valid {
+		return false, ErrTwoFactorNotEnabled
+	}
+
+	if step, valid := validateTOTP(secret.String, code, time.Now()); valid {
+		result, err := db.Exec(`
+			UPDATE admin_users SET totp_last_step = $1
+			WHERE id = $2 AND (totp_last_step IS NULL OR totp_last_step < $1)
+		`, step, adminID)
+		if err != nil {
+			return false, fmt.Errorf("failed to record totp step: %v", err)
+		}
+		affected, _ := result.RowsAffected()
+		return affected == 1, nil
+	}
+
+	result, err := db.Exec(`
+		UPDATE admin_backup_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE admin_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, adminID, hashBackupCode(code))
+	if err != nil {
+		return false, fmt.Errorf("failed to use backup code: %v", err)
+	}
+	affected, _ := result.RowsAffected()
+	return affected == 1, nil
+}
+
+// replaceBackupCodes deletes the old backup codes and stores the hashes of new ones
+func replaceBackupCodes(tx *sql.Tx, adminID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM admin_backup_codes WHERE admin_id = $1", adminID); err != nil {
+		return nil, fmt.Errorf("failed to delete backup codes: %v", err)
+	}
+
+	codes := make([]string, 0, backupCodeCount)
+	for i := 0; i < backupCodeCount; i++ {
+		code, err := generateBackupCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("INSERT INTO admin_backup_codes (admin_id, code_hash) VALUES ($1, $2)", adminID, hashBackupCode(code)); err != nil {
+			return nil, fmt.Errorf("failed to store backup code: %v", err)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// generateBackupCode returns a code like "k3m9p-x7q2r"
+func generateBackupCode() (string, error) {
+	max := big.NewInt(int64(len(backupCodeAlphabet)))
+
+	var b strings.Builder
+	for i := 0; i < backupCodeLength; i++ {
+		if i > 0 && i%backupCodeGroupLength == 0 {
+			b.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate backup code: %v", err)
+		}
+		b.WriteByte(backupCodeAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// hashBackupCode hashes a backup code ignoring case, spaces and hyphens
+func hashBackupCode(code string) string {
+	normalized := strings.ToLower(normalizeTOTPCode(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
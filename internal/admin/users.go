@@ -0,0 +1,234 @@
+package admin
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrAdminNotFound    = errors.New("Usuário não encontrado.")
+	ErrUsernameTaken    = errors.New("Este nome de usuário já está em uso.")
+	ErrInvalidUsername  = errors.New("Nome de usuário inválido: use de 3 a 50 letras, números, ponto, hífen ou _.")
+	ErrInvalidEmail     = errors.New("Email inválido.")
+	ErrCannotChangeSelf = errors.New("Você não pode alterar a própria conta por aqui.")
+	ErrLastUserManager  = errors.New("Deve existir ao menos um usuário ativo com permissão para gerenciar usuários.")
+)
+
+var (
+	usernamePattern   = regexp.MustCompile(`^[a-zA-Z0-9._-]{3,50}$`)
+	adminEmailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+)
+
+const temporaryPasswordLength = 14
+
+// ListAdmins returns every admin user, active ones first
+func ListAdmins() ([]Admin, error) {
+	rows, err := db.Query(`
+		SELECT id, username, COALESCE(email, ''), role, is_active, created_at, totp_enabled
+		FROM admin_users
+		ORDER BY is_active DESC, username
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var admins []Admin
+	for rows.Next() {
+		var a Admin
+		if err := rows.Scan(&a.ID, &a.Username, &a.Email, &a.Role, &a.IsActive, &a.CreatedAt, &a.TwoFactorEnabled); err != nil {
+			return nil, err
+		}
+		admins = append(admins, a)
+	}
+	return admins, rows.Err()
+}
+
+// ListActiveAdminsWithPermission returns the active admins whose role grants the permission
+func ListActiveAdminsWithPermission(permission string) ([]Admin, error) {
+	rows, err := db.Query(`
+		SELECT u.id, u.username, COALESCE(u.email, ''), u.role, u.is_active, u.created_at, u.totp_enabled
+		FROM admin_users u
+		JOIN admin_role_permissions p ON p.role = u.role AND p.permission = $1
+		WHERE u.is_active
+		ORDER BY u.username
+	`, permission)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var admins []Admin
+	for rows.Next() {
+		var a Admin
+		if err := rows.Scan(&a.ID, &a.Username, &a.Email, &a.Role, &a.IsActive, &a.CreatedAt, &a.TwoFactorEnabled); err != nil {
+			return nil, err
+		}
+		admins = append(admins, a)
+	}
+	return admins, rows.Err()
+}
+
+// GetAdminByID retrieves an admin by id
+func GetAdminByID(id int) (*Admin, error) {
+	var a Admin
+	err := db.QueryRow(
+		"SELECT id, username, COALESCE(email, ''), password_hash, role, is_active, created_at FROM admin_users WHERE id = $1",
+		id,
+	).Scan(&a.ID, &a.Username, &a.Email, &a.PasswordHash, &a.Role, &a.IsActive, &a.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAdminNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// InviteAdmin creates an admin with a temporary password, returned so it can be handed over once.
+// The password must be changed on the first login.
+func InviteAdmin(username, email, role string) (string, error) {
+	username = strings.TrimSpace(username)
+	email = strings.TrimSpace(email)
+	if !usernamePattern.MatchString(username) {
+		return "", ErrInvalidUsername
+	}
+	if email != "" && !adminEmailPattern.MatchString(email) {
+		return "", ErrInvalidEmail
+	}
+
+	exists, err := RoleExists(role)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", ErrRoleNotFound
+	}
+
+	var taken bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM admin_users WHERE LOWER(username) = LOWER($1))", username).Scan(&taken); err != nil {
+		return "", err
+	}
+	if taken {
+		return "", ErrUsernameTaken
+	}
+
+	password, err := GenerateTemporaryPassword()
+	if err != nil {
+		return "", err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO admin_users (username, email, password_hash, role, must_change_password) VALUES ($1, NULLIF($2, ''), $3, $4, TRUE)",
+		username, email, hash, role,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create admin user: %v", err)
+	}
+	return password, nil
+}
+
+// SetAdminActive enables or disables an admin; disabling ends the admin's sessions
+func SetAdminActive(id int, active bool, actorID int) error {
+	if id == actorID {
+		return ErrCannotChangeSelf
+	}
+
+	return updateAdmin(id, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec("UPDATE admin_users SET is_active = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2", active, id)
+	})
+}
+
+// ChangeAdminRole assigns another role to an admin, who must log in again
+func ChangeAdminRole(id int, role string, actorID int) error {
+	if id == actorID {
+		return ErrCannotChangeSelf
+	}
+
+	exists, err := RoleExists(role)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrRoleNotFound
+	}
+
+	return updateAdmin(id, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec("UPDATE admin_users SET role = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2", role, id)
+	})
+}
+
+// ResetAdminPassword replaces the password of an admin with a temporary one and returns it
+func ResetAdminPassword(id int) (string, error) {
+	password, err := GenerateTemporaryPassword()
+	if err != nil {
+		return "", err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	err = updateAdmin(id, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec("UPDATE admin_users SET password_hash = $1, must_change_password = TRUE, updated_at = CURRENT_TIMESTAMP WHERE id = $2", hash, id)
+	})
+	if err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// updateAdmin runs an update on one admin, keeps at least one user manager and ends the admin's sessions
+func updateAdmin(id int, update func(tx *sql.Tx) (sql.Result, error)) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+
+	result, err := update(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("failed to update admin user: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		_ = tx.Rollback()
+		return ErrAdminNotFound
+	}
+
+	if err := ensureUserManagerRemains(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit admin user update: %v", err)
+	}
+
+	DeleteSessionsForAdmin(id)
+	return nil
+}
+
+// GenerateTemporaryPassword returns a random password without ambiguous characters
+func GenerateTemporaryPassword() (string, error) {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnpqrstuvwxyz23456789"
+	max := big.NewInt(int64(len(alphabet)))
+
+	password := make([]byte, temporaryPasswordLength)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate password: %v", err)
+		}
+		password[i] = alphabet[n.Int64()]
+	}
+	return string(password), nil
+}
@@ -0,0 +1,245 @@
+package analytics
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Sales are the orders that were paid and not cancelled afterwards
+const saleCondition = "o.payment_status = 'paid' AND o.status <> 'cancelled'"
+
+// Granularities of the revenue series
+const (
+	GranularityDay   = "day"
+	GranularityWeek  = "week"
+	GranularityMonth = "month"
+)
+
+// Range is a reporting period: From inclusive, To exclusive
+type Range struct {
+	From time.Time
+	To   time.Time
+}
+
+// Summary holds the headline numbers of a period
+type Summary struct {
+	Revenue           float64
+	Orders            int
+	AverageOrderValue float64
+}
+
+// Point is a bucket of the revenue series
+type Point struct {
+	Start   time.Time
+	Revenue float64
+	Orders  int
+}
+
+// Ranked is a row of a top products/categories/neighborhoods report
+type Ranked struct {
+	Name     string
+	Revenue  float64
+	Quantity int
+}
+
+// OfferSplit compares sales at offer prices with regular sales
+type OfferSplit struct {
+	OfferRevenue    float64
+	OfferQuantity   int
+	RegularRevenue  float64
+	RegularQuantity int
+}
+
+// Conversion follows the orders created in a period through payment
+type Conversion struct {
+	Created   int
+	Paid      int
+	Pending   int
+	Cancelled int
+}
+
+// Rate returns the share of created orders that were paid, in percent
+func (c Conversion) Rate() float64 {
+	if c.Created == 0 {
+		return 0
+	}
+	return float64(c.Paid) * 100 / float64(c.Created)
+}
+
+var db *sql.DB
+
+// SetDatabase sets the database connection for the analytics package
+func SetDatabase(database *sql.DB) {
+	db = database
+}
+
+// ValidGranularity reports whether g is a supported granularity
+func ValidGranularity(g string) bool {
+	return g == GranularityDay || g == GranularityWeek || g == GranularityMonth
+}
+
+// GetSummary returns revenue, number of sales and average order value of a period
+func GetSummary(r Range) (Summary, error) {
+	var summary Summary
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(o.total_amount), 0), COUNT(*)
+		FROM orders o
+		WHERE `+saleCondition+` AND o.created_at >= $1 AND o.created_at < $2
+	`, r.From, r.To).Scan(&summary.Revenue, &summary.Orders)
+	if err != nil {
+		return Summary{}, fmt.Errorf("failed to load sales summary: %v", err)
+	}
+	if summary.Orders > 0 {
+		summary.AverageOrderValue = summary.Revenue / float64(summary.Orders)
+	}
+	return summary, nil
+}
+
+// GetRevenueSeries returns revenue and number of sales per day, week or month, including empty buckets
+func GetRevenueSeries(r Range, granularity string) ([]Point, error) {
+	if !ValidGranularity(granularity) {
+		return nil, fmt.Errorf("invalid granularity: %s", granularity)
+	}
+
+	// granularity is one of the constants above, so it can be written into the query
+	rows, err := db.Query(`
+		SELECT b.bucket, COALESCE(SUM(o.total_amount), 0), COUNT(o.id)
+		FROM generate_series(date_trunc('`+granularity+`', $1::timestamp), $2::timestamp - interval '1 microsecond', interval '1 `+granularity+`') AS b(bucket)
+		LEFT JOIN orders o ON date_trunc('`+granularity+`', o.created_at) = b.bucket
+			AND `+saleCondition+` AND o.created_at >= $1 AND o.created_at < $2
+		GROUP BY b.bucket
+		ORDER BY b.bucket
+	`, r.From, r.To)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load revenue series: %v", err)
+	}
+	defer rows.Close()
+
+	var points []Point
+	for rows.Next() {
+		var p Point
+		if err := rows.Scan(&p.Start, &p.Revenue, &p.Orders); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// orderByColumn returns the ORDER BY expression of a ranking: "quantity" or revenue by default
+func orderByColumn(by string) string {
+	if by == "quantity" {
+		return "quantity DESC, revenue DESC"
+	}
+	return "revenue DESC, quantity DESC"
+}
+
+func queryRanked(query string, args ...interface{}) ([]Ranked, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ranked []Ranked
+	for rows.Next() {
+		var item Ranked
+		if err := rows.Scan(&item.Name, &item.Revenue, &item.Quantity); err != nil {
+			return nil, err
+		}
+		ranked = append(ranked, item)
+	}
+	return ranked, rows.Err()
+}
+
+// GetTopProducts returns the best-selling items by "revenue" or "quantity"
+func GetTopProducts(r Range, by string, limit int) ([]Ranked, error) {
+	ranked, err := queryRanked(`
+		SELECT MAX(oi.item_name), SUM(oi.total_price) AS revenue, SUM(oi.quantity) AS quantity
+		FROM order_items oi
+		JOIN orders o ON o.id = oi.order_id
+		WHERE `+saleCondition+` AND o.created_at >= $1 AND o.created_at < $2
+		GROUP BY oi.item_id
+		ORDER BY `+orderByColumn(by)+`
+		LIMIT $3
+	`, r.From, r.To, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load top products: %v", err)
+	}
+	return ranked, nil
+}
+
+// GetTopCategories returns the best-selling categories by "revenue" or "quantity".
+// Items that are not products (such as the installation service) are grouped as "Serviços".
+func GetTopCategories(r Range, by string, limit int) ([]Ranked, error) {
+	ranked, err := queryRanked(`
+		SELECT COALESCE(c.name, 'Serviços') AS name, SUM(oi.total_price) AS revenue, SUM(oi.quantity) AS quantity
+		FROM order_items oi
+		JOIN orders o ON o.id = oi.order_id
+		LEFT JOIN products p ON p.item_id = oi.item_id
+		LEFT JOIN categories c ON c.id = p.category_id
+		WHERE `+saleCondition+` AND o.created_at >= $1 AND o.created_at < $2
+		GROUP BY COALESCE(c.name, 'Serviços')
+		ORDER BY `+orderByColumn(by)+`
+		LIMIT $3
+	`, r.From, r.To, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load top categories: %v", err)
+	}
+	return ranked, nil
+}
+
+// GetNeighborhoods returns revenue and number of sales per delivery neighborhood
+func GetNeighborhoods(r Range, limit int) ([]Ranked, error) {
+	ranked, err := queryRanked(`
+		SELECT INITCAP(TRIM(o.neighborhood)) AS name, SUM(o.total_amount) AS revenue, COUNT(*) AS quantity
+		FROM orders o
+		WHERE `+saleCondition+` AND o.created_at >= $1 AND o.created_at < $2
+		GROUP BY INITCAP(TRIM(o.neighborhood))
+		ORDER BY revenue DESC, quantity DESC
+		LIMIT $3
+	`, r.From, r.To, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load neighborhoods: %v", err)
+	}
+	return ranked, nil
+}
+
+// GetOfferSplit returns item revenue and quantity sold at offer prices and at regular prices
+func GetOfferSplit(r Range) (OfferSplit, error) {
+	var split OfferSplit
+	err := db.QueryRow(`
+		SELECT
+			COALESCE(SUM(CASE WHEN oi.is_on_offer THEN oi.total_price END), 0),
+			COALESCE(SUM(CASE WHEN oi.is_on_offer THEN oi.quantity END), 0),
+			COALESCE(SUM(CASE WHEN NOT oi.is_on_offer THEN oi.total_price END), 0),
+			COALESCE(SUM(CASE WHEN NOT oi.is_on_offer THEN oi.quantity END), 0)
+		FROM order_items oi
+		JOIN orders o ON o.id = oi.order_id
+		WHERE `+saleCondition+` AND o.created_at >= $1 AND o.created_at < $2
+	`, r.From, r.To).Scan(&split.OfferRevenue, &split.OfferQuantity, &split.RegularRevenue, &split.RegularQuantity)
+	if err != nil {
+		return OfferSplit{}, fmt.Errorf("failed to load offer sales: %v", err)
+	}
+	return split, nil
+}
+
+// GetConversion counts the orders created in a period by how far they got: paid, still
+// pending or cancelled (including expired boletos/PIX)
+func GetConversion(r Range) (Conversion, error) {
+	var c Conversion
+	err := db.QueryRow(`
+		SELECT
+			COUNT(*),
+			COUNT(*) FILTER (WHERE o.payment_status = 'paid'),
+			COUNT(*) FILTER (WHERE o.status = 'pending' AND COALESCE(o.payment_status, 'pending') <> 'paid'),
+			COUNT(*) FILTER (WHERE o.status = 'cancelled' AND COALESCE(o.payment_status, 'pending') <> 'paid')
+		FROM orders o
+		WHERE o.created_at >= $1 AND o.created_at < $2
+	`, r.From, r.To).Scan(&c.Created, &c.Paid, &c.Pending, &c.Cancelled)
+	if err != nil {
+		return Conversion{}, fmt.Errorf("failed to load conversion: %v", err)
+	}
+	return c, nil
+}
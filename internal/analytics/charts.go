@@ -0,0 +1,147 @@
+package analytics
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Dimensions of the revenue chart, in SVG user units
+const (
+	chartWidth        = 800
+	chartHeight       = 240
+	chartPaddingLeft  = 72
+	chartPaddingRight = 8
+	chartPaddingTop   = 12
+	chartPaddingBelow = 28
+	chartGridLines    = 5
+)
+
+// Bar is a bar of the revenue chart, already positioned
+type Bar struct {
+	Label   string
+	Revenue float64
+	Orders  int
+	X       float64
+	Y       float64
+	Width   float64
+	Height  float64
+
+	// ShowLabel is false for the labels skipped so they do not overlap
+	ShowLabel bool
+}
+
+// GridLine is a horizontal guide of the revenue chart
+type GridLine struct {
+	Y     float64
+	Label string
+}
+
+// BarChart is an SVG bar chart of the revenue series
+type BarChart struct {
+	Width     float64
+	Height    float64
+	Left      float64
+	Right     float64
+	Baseline  float64
+	Bars      []Bar
+	GridLines []GridLine
+}
+
+// BucketLabel formats the start of a bucket for the chart axis
+func BucketLabel(start time.Time, granularity string) string {
+	switch granularity {
+	case GranularityMonth:
+		return start.Format("01/2006")
+	default:
+		return start.Format("02/01")
+	}
+}
+
+// NewRevenueChart lays out the revenue series as bars scaled to the largest bucket
+func NewRevenueChart(points []Point, granularity string) BarChart {
+	chart := BarChart{
+		Width:    chartWidth,
+		Height:   chartHeight,
+		Left:     chartPaddingLeft,
+		Right:    chartWidth - chartPaddingRight,
+		Baseline: chartHeight - chartPaddingBelow,
+	}
+	if len(points) == 0 {
+		return chart
+	}
+
+	max := 0.0
+	for _, p := range points {
+		max = math.Max(max, p.Revenue)
+	}
+	scaleMax := niceCeiling(max)
+	plotHeight := chart.Baseline - chartPaddingTop
+
+	for i := 0; i <= chartGridLines; i++ {
+		value := scaleMax * float64(i) / chartGridLines
+		chart.GridLines = append(chart.GridLines, GridLine{
+			Y:     chart.Baseline - plotHeight*float64(i)/chartGridLines,
+			Label: FormatCompactBRL(value),
+		})
+	}
+
+	slot := (chart.Right - chart.Left) / float64(len(points))
+	labelEvery := int(math.Ceil(float64(len(points)) / 12))
+	for i, p := range points {
+		height := 0.0
+		if scaleMax > 0 {
+			height = plotHeight * p.Revenue / scaleMax
+		}
+		chart.Bars = append(chart.Bars, Bar{
+			Label:     BucketLabel(p.Start, granularity),
+			Revenue:   p.Revenue,
+			Orders:    p.Orders,
+			X:         chart.Left + slot*float64(i) + slot*0.15,
+			Y:         chart.Baseline - height,
+			Width:     slot * 0.7,
+			Height:    height,
+			ShowLabel: i%labelEvery == 0,
+		})
+	}
+	return chart
+}
+
+// niceCeiling rounds a maximum up to 1, 2 or 5 times a power of ten so the grid has round values
+func niceCeiling(value float64) float64 {
+	if value <= 0 {
+		return 1
+	}
+	magnitude := math.Pow(10, math.Floor(math.Log10(value)))
+	for _, step := range []float64{1, 2, 5, 10} {
+		if value <= step*magnitude {
+			return step * magnitude
+		}
+	}
+	return 10 * magnitude
+}
+
+// FormatCompactBRL formats an amount for chart axes, e.g. "R$ 1,5 mil"
+func FormatCompactBRL(value float64) string {
+	switch {
+	case value >= 1000000:
+		return "R$ " + strings.Replace(trimZero(fmt.Sprintf("%.1f", value/1000000)), ".", ",", 1) + " mi"
+	case value >= 1000:
+		return "R$ " + strings.Replace(trimZero(fmt.Sprintf("%.1f", value/1000)), ".", ",", 1) + " mil"
+	default:
+		return fmt.Sprintf("R$ %.0f", value)
+	}
+}
+
+func trimZero(s string) string {
+	return strings.TrimSuffix(s, ".0")
+}
+
+// Percent returns value as a percentage of total, 0 when total is 0
+func Percent(value, total float64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return value * 100 / total
+}
@@ -0,0 +1,149 @@
+package analytics
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Where a search was made
+const (
+	SearchSourceDropdown = "dropdown"
+	SearchSourcePage     = "page"
+)
+
+// minLoggedQueryLength skips the first keystrokes of the search dropdown
+const minLoggedQueryLength = 2
+
+// SearchSummary holds the number of searches of a period and how many found nothing
+type SearchSummary struct {
+	Searches    int
+	ZeroResults int
+}
+
+// ZeroResultRate returns the share of searches that found nothing, in percent
+func (s SearchSummary) ZeroResultRate() float64 {
+	return Percent(float64(s.ZeroResults), float64(s.Searches))
+}
+
+// SearchTerm is a row of the search report. Queries are grouped ignoring case and accents;
+// Query is the form customers typed most often.
+type SearchTerm struct {
+	Query          string
+	Searches       int
+	AverageResults float64
+	LastSearched   time.Time
+}
+
+// LogSearch records a customer search and its number of results. sessionKey identifies the
+// visitor (it is stored hashed) so the dropdown, which searches while the customer types,
+// keeps a single row as the query grows ("pur", "purif", "purificador").
+func LogSearch(query string, resultCount int, source, sessionKey string) error {
+	query = strings.Join(strings.Fields(query), " ")
+	if utf8.RuneCountInString(query) < minLoggedQueryLength {
+		return nil
+	}
+	normalized := strings.ToLower(query)
+
+	var session sql.NullString
+	if sessionKey != "" {
+		sum := sha256.Sum256([]byte(sessionKey))
+		session = sql.NullString{String: hex.EncodeToString(sum[:]), Valid: true}
+	}
+
+	if source == SearchSourceDropdown && session.Valid {
+		// Typing more replaces the previous query of the session, deleting characters keeps it
+		result, err := db.Exec(`
+			WITH last AS (
+				SELECT id, normalized_query FROM search_queries
+				WHERE session_hash = $4 AND source = $5 AND created_at > CURRENT_TIMESTAMP - INTERVAL '2 minutes'
+				ORDER BY id DESC
+				LIMIT 1
+			)
+			UPDATE search_queries q
+			SET query = $1, normalized_query = immutable_unaccent($2), result_count = $3, created_at = CURRENT_TIMESTAMP
+			FROM last
+			WHERE q.id = last.id AND starts_with(immutable_unaccent($2), last.normalized_query)`,
+			query, normalized, resultCount, session, source)
+		if err != nil {
+			return fmt.Errorf("failed to update search log: %v", err)
+		}
+		if affected, err := result.RowsAffected(); err == nil && affected > 0 {
+			return nil
+		}
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO search_queries (query, normalized_query, result_count, source, session_hash)
+		SELECT $1, immutable_unaccent($2), $3, $4, $5
+		WHERE $5::text IS NULL OR $4 <> '`+SearchSourceDropdown+`' OR NOT EXISTS (
+			SELECT 1 FROM search_queries
+			WHERE session_hash = $5 AND source = $4 AND created_at > CURRENT_TIMESTAMP - INTERVAL '2 minutes'
+				AND starts_with(normalized_query, immutable_unaccent($2))
+		)`, query, normalized, resultCount, source, session)
+	if err != nil {
+		return fmt.Errorf("failed to log search: %v", err)
+	}
+	return nil
+}
+
+// GetSearchSummary returns the number of searches of a period and how many found nothing
+func GetSearchSummary(r Range) (SearchSummary, error) {
+	var summary SearchSummary
+	err := db.QueryRow(`
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE result_count = 0)
+		FROM search_queries
+		WHERE created_at >= $1 AND created_at < $2
+	`, r.From, r.To).Scan(&summary.Searches, &summary.ZeroResults)
+	if err != nil {
+		return SearchSummary{}, fmt.Errorf("failed to load search summary: %v", err)
+	}
+	return summary, nil
+}
+
+// GetTopSearches returns the most frequent queries of a period
+func GetTopSearches(r Range, limit int) ([]SearchTerm, error) {
+	terms, err := querySearchTerms("", r, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load top searches: %v", err)
+	}
+	return terms, nil
+}
+
+// GetZeroResultSearches returns the most frequent queries of a period that found nothing
+func GetZeroResultSearches(r Range, limit int) ([]SearchTerm, error) {
+	terms, err := querySearchTerms("AND result_count = 0", r, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load zero-result searches: %v", err)
+	}
+	return terms, nil
+}
+
+func querySearchTerms(condition string, r Range, limit int) ([]SearchTerm, error) {
+	rows, err := db.Query(`
+		SELECT mode() WITHIN GROUP (ORDER BY query), COUNT(*) AS searches, AVG(result_count), MAX(created_at)
+		FROM search_queries
+		WHERE created_at >= $1 AND created_at < $2 `+condition+`
+		GROUP BY normalized_query
+		ORDER BY searches DESC, MAX(created_at) DESC
+		LIMIT $3
+	`, r.From, r.To, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var terms []SearchTerm
+	for rows.Next() {
+		var t SearchTerm
+		if err := rows.Scan(&t.Query, &t.Searches, &t.AverageResults, &t.LastSearched); err != nil {
+			return nil, err
+		}
+		terms = append(terms, t)
+	}
+	return terms, rows.Err()
+}
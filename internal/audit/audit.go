@@ -0,0 +1,335 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"lojagtec/internal/admin"
+	"lojagtec/internal/logging"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// Entity types recorded in the audit log
+const (
+	EntityProduct      = "product"
+	EntityProductImage = "product_image"
+	EntityCategory     = "category"
+	EntityBrand        = "brand"
+	EntityOffer        = "offer"
+	EntityBanner       = "banner"
+	EntityOrder        = "order"
+	EntityAdminUser    = "admin_user"
+	EntityAdminRole    = "admin_role"
+	EntityDeliveryRun  = "delivery_run"
+
+	EntitySearchSynonym        = "search_synonym"
+	EntityProductCompatibility = "product_compatibility"
+)
+
+// EntityTypes lists the entity types with their labels, in the order shown in the admin
+var EntityTypes = []struct {
+	Name  string
+	Label string
+}{
+	{EntityProduct, "Produto"},
+	{EntityProductImage, "Imagem de produto"},
+	{EntityCategory, "Categoria"},
+	{EntityBrand, "Marca"},
+	{EntityOffer, "Oferta"},
+	{EntityBanner, "Banner"},
+	{EntityOrder, "Pedido"},
+	{EntityAdminUser, "Usuário admin"},
+	{EntityAdminRole, "Função admin"},
+	{EntityDeliveryRun, "Rota de entrega"},
+	{EntitySearchSynonym, "Sinônimo de busca"},
+	{EntityProductCompatibility, "Compatibilidade de peça"},
+}
+
+// Change is the value of a field before and after a mutation
+type Change struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// Entry is a recorded admin mutation
+type Entry struct {
+	ID            int64
+	AdminID       *int
+	AdminUsername string
+	Action        string
+	EntityType    string
+	EntityID      string
+	Changes       map[string]Change
+	IPAddress     string
+	CreatedAt     time.Time
+}
+
+// Filter narrows the audit log listing
+type Filter struct {
+	AdminID    int
+	EntityType string
+	EntityID   string
+	From       *time.Time
+	To         *time.Time
+	Limit      int
+	Offset     int
+}
+
+var db *sql.DB
+
+// SetDatabase sets the database connection for the audit package
+func SetDatabase(database *sql.DB) {
+	db = database
+}
+
+// Record stores a mutation made by the admin behind the request. before is nil for
+// creations and after is nil for deletions; only the fields that differ are kept.
+// Failures are logged and never interrupt the request.
+func Record(r *http.Request, action, entityType string, entityID interface{}, before, after interface{}) {
+	changes, err := Diff(before, after)
+	if err != nil {
+		logging.LogError("audit", "diff", err.Error(), map[string]interface{}{
+			"entity_type": entityType,
+			"entity_id":   fmt.Sprint(entityID),
+		})
+		changes = map[string]Change{}
+	}
+	if action == ActionUpdate && len(changes) == 0 {
+		return
+	}
+
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		changesJSON = []byte("{}")
+	}
+
+	var adminID *int
+	adminUsername := ""
+	if id, username, ok := admin.ActorFromRequest(r); ok {
+		adminID = &id
+		adminUsername = username
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO admin_audit_log (admin_id, admin_username, action, entity_type, entity_id, changes, ip_address)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, adminID, adminUsername, action, entityType, fmt.Sprint(entityID), changesJSON, admin.ClientIP(r))
+	if err != nil {
+		logging.LogError("audit", "record", err.Error(), map[string]interface{}{
+			"action":      action,
+			"entity_type": entityType,
+			"entity_id":   fmt.Sprint(entityID),
+		})
+	}
+}
+
+// Diff compares the JSON representation of two values field by field
+func Diff(before, after interface{}) (map[string]Change, error) {
+	beforeFields, err := toFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := toFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]Change)
+	for field, value := range afterFields {
+		previous, existed := beforeFields[field]
+		if !existed || !reflect.DeepEqual(previous, value) {
+			changes[field] = Change{From: previous, To: value}
+		}
+	}
+	for field, value := range beforeFields {
+		if _, exists := afterFields[field]; !exists {
+			changes[field] = Change{From: value, To: nil}
+		}
+	}
+	return changes, nil
+}
+
+// toFields turns a value into a field map through its JSON encoding; scalars become {"value": v}
+func toFields(value interface{}) (map[string]interface{}, error) {
+	if value == nil {
+		return map[string]interface{}{}, nil
+	}
+	if v := reflect.ValueOf(value); v.Kind() == reflect.Ptr && v.IsNil() {
+		return map[string]interface{}{}, nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode audit value: %v", err)
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, fmt.Errorf("failed to decode audit value: %v", err)
+	}
+	if fields, ok := decoded.(map[string]interface{}); ok {
+		return fields, nil
+	}
+	return map[string]interface{}{"value": decoded}, nil
+}
+
+// buildWhere returns the WHERE clause and arguments of a filter
+func buildWhere(filter Filter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, strings.Replace(condition, "?", "$"+strconv.Itoa(len(args)), 1))
+	}
+
+	if filter.AdminID > 0 {
+		add("admin_id = ?", filter.AdminID)
+	}
+	if filter.EntityType != "" {
+		add("entity_type = ?", filter.EntityType)
+	}
+	if filter.EntityID != "" {
+		add("entity_id = ?", filter.EntityID)
+	}
+	if filter.From != nil {
+		add("created_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		add("created_at < ?", *filter.To)
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// ListEntries returns a page of entries, newest first, and the number of matching entries
+func ListEntries(filter Filter) ([]Entry, int, error) {
+	where, args := buildWhere(filter)
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM admin_audit_log "+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count audit entries: %v", err)
+	}
+
+	query := "SELECT id, admin_id, admin_username, action, entity_type, entity_id, changes, ip_address, created_at FROM admin_audit_log " +
+		where + " ORDER BY created_at DESC, id DESC"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit, filter.Offset)
+		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	}
+
+	entries, err := queryEntries(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
+
+// EachEntry calls fn for every entry matching the filter, newest first, without loading them all
+func EachEntry(filter Filter, fn func(Entry) error) error {
+	where, args := buildWhere(filter)
+	rows, err := db.Query("SELECT id, admin_id, admin_username, action, entity_type, entity_id, changes, ip_address, created_at FROM admin_audit_log "+
+		where+" ORDER BY created_at DESC, id DESC", args...)
+	if err != nil {
+		return fmt.Errorf("failed to query audit entries: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func queryEntries(query string, args ...interface{}) ([]Entry, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit entries: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func scanEntry(rows *sql.Rows) (Entry, error) {
+	var entry Entry
+	var adminID sql.NullInt64
+	var changes []byte
+	err := rows.Scan(&entry.ID, &adminID, &entry.AdminUsername, &entry.Action, &entry.EntityType,
+		&entry.EntityID, &changes, &entry.IPAddress, &entry.CreatedAt)
+	if err != nil {
+		return entry, err
+	}
+	if adminID.Valid {
+		id := int(adminID.Int64)
+		entry.AdminID = &id
+	}
+	if err := json.Unmarshal(changes, &entry.Changes); err != nil {
+		entry.Changes = map[string]Change{}
+	}
+	return entry, nil
+}
+
+// ChangedFields returns the changed field names of an entry in alphabetical order
+func (e Entry) ChangedFields() []string {
+	fields := make([]string, 0, len(e.Changes))
+	for field := range e.Changes {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// EntityLabel returns the label of an entity type
+func EntityLabel(entityType string) string {
+	for _, t := range EntityTypes {
+		if t.Name == entityType {
+			return t.Label
+		}
+	}
+	return entityType
+}
+
+// ActionLabel returns the label of an action
+func ActionLabel(action string) string {
+	switch action {
+	case ActionCreate:
+		return "Criação"
+	case ActionUpdate:
+		return "Alteração"
+	case ActionDelete:
+		return "Exclusão"
+	default:
+		return action
+	}
+}
@@ -0,0 +1,338 @@
+package carts
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"lojagtec/internal/offers"
+	"lojagtec/internal/orders"
+)
+
+// Line represents an item in a cart, priced from the current catalog
+type Line struct {
+	ItemID      int     `json:"item_id"`
+	Name        string  `json:"name"`
+	Image       string  `json:"image"`
+	Quantity    int     `json:"quantity"`
+	ListPrice   float64 `json:"list_price"`
+	UnitPrice   float64 `json:"unit_price"`
+	Subtotal    float64 `json:"subtotal"`
+	IsOnOffer   bool    `json:"is_on_offer"`
+	IsAvailable bool    `json:"is_available"`
+	IsService   bool    `json:"is_service"`
+}
+
+// Cart represents a shopping cart with authoritative prices
+type Cart struct {
+	ID             int     `json:"id"`
+	Token          string  `json:"-"`
+	Lines          []Line  `json:"lines"`
+	Total          float64 `json:"total"`
+	ItemCount      int     `json:"item_count"`
+	HasUnavailable bool    `json:"has_unavailable"`
+}
+
+var db *sql.DB
+
+const (
+	cookieName   = "cart_token"
+	cookieMaxAge = 90 * 24 * 60 * 60 // 90 days
+	maxQuantity  = 99
+)
+
+var (
+	ErrItemUnavailable = errors.New("Este produto está indisponível no momento.")
+	ErrItemNotFound    = errors.New("Produto não encontrado.")
+)
+
+// SetDatabase sets the database connection for the carts package
+func SetDatabase(database *sql.DB) {
+	db = database
+}
+
+// TokenFromRequest returns the anonymous cart token sent by the browser, if any
+func TokenFromRequest(r *http.Request) string {
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// EnsureToken returns the request's cart token, issuing a new cookie when missing
+func EnsureToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if token := TokenFromRequest(r); token != "" {
+		return token, nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate cart token: %v", err)
+	}
+	token := base64.URLEncoding.EncodeToString(b)
+	setCookie(w, token)
+	return token, nil
+}
+
+func setCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   cookieMaxAge,
+	})
+}
+
+// getOrCreateCartID returns the cart id for a token, creating the cart if needed
+func getOrCreateCartID(token string) (int, error) {
+	var id int
+	err := db.QueryRow(`
+		INSERT INTO carts (token) VALUES ($1)
+		ON CONFLICT (token) DO UPDATE SET updated_at = CURRENT_TIMESTAMP
+		RETURNING id
+	`, token).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get cart: %v", err)
+	}
+	return id, nil
+}
+
+// GetCart loads the cart for a token. A missing cart is returned empty.
+func GetCart(token string) (*Cart, error) {
+	cart := &Cart{Token: token, Lines: []Line{}}
+	if token == "" {
+		return cart, nil
+	}
+
+	err := db.QueryRow("SELECT id FROM carts WHERE token = $1", token).Scan(&cart.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return cart, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cart: %v", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT ci.item_id, i.name, COALESCE(pi.image_url, ''), ci.quantity, i.price, i.is_available,
+			s.id IS NOT NULL, o.offer_price, o.start_date, o.end_date, COALESCE(o.is_active, FALSE)
+		FROM cart_items ci
+		JOIN items i ON i.id = ci.item_id
+		LEFT JOIN products p ON p.item_id = i.id
+		LEFT JOIN offers o ON o.product_id = p.id AND o.is_active = TRUE
+		LEFT JOIN product_images pi ON pi.product_id = p.id AND pi.is_primary = TRUE
+		LEFT JOIN services s ON s.item_id = i.id
+		WHERE ci.cart_id = $1
+		ORDER BY ci.added_at, ci.item_id
+	`, cart.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cart items: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var line Line
+		var offerPrice sql.NullFloat64
+		var startDate, endDate sql.NullTime
+		var offer offers.Offer
+
+		if err := rows.Scan(&line.ItemID, &line.Name, &line.Image, &line.Quantity, &line.ListPrice, &line.IsAvailable,
+			&line.IsService, &offerPrice, &startDate, &endDate, &offer.IsActive); err != nil {
+			return nil, fmt.Errorf("failed to scan cart item: %v", err)
+		}
+
+		if startDate.Valid {
+			offer.StartDate = &startDate.Time
+		}
+		if endDate.Valid {
+			offer.EndDate = &endDate.Time
+		}
+
+		line.UnitPrice = line.ListPrice
+		if offerPrice.Valid && offerPrice.Float64 > 0 && offers.IsOfferActive(offer) {
+			line.IsOnOffer = true
+			line.UnitPrice = offerPrice.Float64
+		}
+		line.Subtotal = line.UnitPrice * float64(line.Quantity)
+
+		if line.IsAvailable {
+			cart.Total += line.Subtotal
+		} else {
+			cart.HasUnavailable = true
+		}
+		if !line.IsService {
+			cart.ItemCount += line.Quantity
+		}
+		cart.Lines = append(cart.Lines, line)
+	}
+
+	return cart, rows.Err()
+}
+
+// ProductLines returns the cart lines that are not services
+func (c *Cart) ProductLines() []Line {
+	var lines []Line
+	for _, line := range c.Lines {
+		if !line.IsService {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// HasInstallationService reports whether the installation service is in the cart
+func (c *Cart) HasInstallationService() bool {
+	for _, line := range c.Lines {
+		if line.IsService && line.Name == orders.InstallationServiceName {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckoutItems converts the available cart lines into order items
+func (c *Cart) CheckoutItems() []orders.CartItem {
+	var items []orders.CartItem
+	for _, line := range c.Lines {
+		if !line.IsAvailable {
+			continue
+		}
+		items = append(items, orders.CartItem{
+			ID:        line.ItemID,
+			Name:      line.Name,
+			Price:     line.UnitPrice,
+			Quantity:  line.Quantity,
+			IsOnOffer: line.IsOnOffer,
+		})
+	}
+	return items
+}
+
+// AddItem adds quantity units of an item to the cart identified by token
+func AddItem(token string, itemID, quantity int) error {
+	if quantity <= 0 {
+		quantity = 1
+	}
+
+	var isAvailable bool
+	err := db.QueryRow("SELECT is_available FROM items WHERE id = $1", itemID).Scan(&isAvailable)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrItemNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check item: %v", err)
+	}
+	if !isAvailable {
+		return ErrItemUnavailable
+	}
+
+	cartID, err := getOrCreateCartID(token)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO cart_items (cart_id, item_id, quantity)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (cart_id, item_id) DO UPDATE
+		SET quantity = LEAST(cart_items.quantity + EXCLUDED.quantity, $4)
+	`, cartID, itemID, min(quantity, maxQuantity), maxQuantity)
+	if err != nil {
+		return fmt.Errorf("failed to add cart item: %v", err)
+	}
+	return nil
+}
+
+// UpdateQuantity sets the quantity of an item, removing it when quantity is zero or less
+func UpdateQuantity(token string, itemID, quantity int) error {
+	if quantity <= 0 {
+		return RemoveItem(token, itemID)
+	}
+
+	_, err := db.Exec(`
+		UPDATE cart_items SET quantity = $3
+		FROM carts
+		WHERE carts.id = cart_items.cart_id AND carts.token = $1 AND cart_items.item_id = $2
+	`, token, itemID, min(quantity, maxQuantity))
+	if err != nil {
+		return fmt.Errorf("failed to update cart item: %v", err)
+	}
+	return touch(token)
+}
+
+// RemoveItem removes an item from the cart
+func RemoveItem(token string, itemID int) error {
+	_, err := db.Exec(`
+		DELETE FROM cart_items
+		USING carts
+		WHERE carts.id = cart_items.cart_id AND carts.token = $1 AND cart_items.item_id = $2
+	`, token, itemID)
+	if err != nil {
+		return fmt.Errorf("failed to remove cart item: %v", err)
+	}
+	return touch(token)
+}
+
+// Clear removes every item from the cart
+func Clear(token string) error {
+	_, err := db.Exec(`
+		DELETE FROM cart_items
+		USING carts
+		WHERE carts.id = cart_items.cart_id AND carts.token = $1
+	`, token)
+	if err != nil {
+		return fmt.Errorf("failed to clear cart: %v", err)
+	}
+	return touch(token)
+}
+
+// SetInstallationService adds or removes the installation service from the cart
+func SetInstallationService(token string, include bool) error {
+	var itemID int
+	err := db.QueryRow(`
+		SELECT i.id FROM services s
+		JOIN items i ON i.id = s.item_id
+		WHERE i.name = $1
+	`, orders.InstallationServiceName).Scan(&itemID)
+	if errors.Is(err, sql.ErrNoRows) {
+		if !include {
+			return nil
+		}
+		return orders.ErrInstallationServiceUnavailable
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find installation service: %v", err)
+	}
+
+	if !include {
+		return RemoveItem(token, itemID)
+	}
+
+	cartID, err := getOrCreateCartID(token)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		INSERT INTO cart_items (cart_id, item_id, quantity)
+		VALUES ($1, $2, 1)
+		ON CONFLICT (cart_id, item_id) DO NOTHING
+	`, cartID, itemID)
+	if err != nil {
+		return fmt.Errorf("failed to add installation service: %v", err)
+	}
+	return nil
+}
+
+func touch(token string) error {
+	_, err := db.Exec("UPDATE carts SET updated_at = CURRENT_TIMESTAMP WHERE token = $1", token)
+	if err != nil {
+		return fmt.Errorf("failed to update cart: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package checkout
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"lojagtec/internal/logging"
+	"lojagtec/internal/mailer"
+	"lojagtec/internal/orders"
+
+	"github.com/stripe/stripe-go/v84"
+	checkoutsession "github.com/stripe/stripe-go/v84/checkout/session"
+)
+
+const defaultBoletoExpirationDays = 3
+
+// brazilTime is the zone boleto due dates refer to (Brasília has no daylight saving time)
+var brazilTime = time.FixedZone("BRT", -3*60*60)
+
+// boletoExpirationDays returns how many days a boleto may be paid (BOLETO_EXPIRATION_DAYS)
+func boletoExpirationDays() int {
+	if days, err := strconv.Atoi(strings.TrimSpace(os.Getenv("BOLETO_EXPIRATION_DAYS"))); err == nil && days > 0 {
+		return days
+	}
+	return defaultBoletoExpirationDays
+}
+
+// pixExpiration returns how long a PIX charge may be paid (PIX_EXPIRATION_MINUTES)
+func pixExpiration() time.Duration {
+	if minutes, err := strconv.Atoi(strings.TrimSpace(os.Getenv("PIX_EXPIRATION_MINUTES"))); err == nil && minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return pixDefaultExpiration
+}
+
+// asyncPaymentDeadline returns the deadline of a boleto or PIX generated at the given time.
+// Boletos are due at the end of the day, Brasília time.
+func asyncPaymentDeadline(paymentMethod string, generatedAt time.Time) time.Time {
+	if paymentMethod == "boleto" {
+		due := generatedAt.In(brazilTime).AddDate(0, 0, boletoExpirationDays())
+		return time.Date(due.Year(), due.Month(), due.Day(), 23, 59, 59, 0, brazilTime)
+	}
+	return generatedAt.Add(pixExpiration())
+}
+
+// SendPaymentReminders emails customers whose boleto or PIX is about to expire
+func SendPaymentReminders(now time.Time) error {
+	due, err := orders.GetOrdersDueForPaymentReminder(now)
+	if err != nil {
+		return fmt.Errorf("failed to list orders due for reminder: %v", err)
+	}
+
+	for i := range due {
+		order := &due[i]
+		claimed, err := orders.ClaimPaymentReminder(order.ID)
+		if err != nil {
+			return fmt.Errorf("failed to claim payment reminder: %v", err)
+		}
+		if !claimed {
+			continue
+		}
+
+		err = mailer.SendTemplate(order.Email, fmt.Sprintf("Seu pedido #%s aguarda pagamento", order.OrderNumber), "payment-reminder.html", map[string]interface{}{
+			"Order":       order,
+			"TrackingURL": OrderTrackingURL(order),
+		})
+		if err != nil {
+			logging.LogError("payment", "payment_reminder_send", err.Error(), map[string]interface{}{
+				"order_id": order.ID,
+			})
+		}
+	}
+	return nil
+}
+
+// CancelExpiredOrders cancels unpaid boleto/PIX orders whose deadline passed and tells the customer
+func CancelExpiredOrders(now time.Time) error {
+	expired, err := orders.GetExpiredUnpaidOrders(now)
+	if err != nil {
+		return fmt.Errorf("failed to list expired orders: %v", err)
+	}
+
+	for i := range expired {
+		order := &expired[i]
+		expireOpenStripeSessions(order.ID)
+
+		cancelled, err := orders.CancelExpiredOrder(order.ID)
+		if err != nil {
+			return err
+		}
+		if !cancelled {
+			continue
+		}
+
+		err = mailer.SendTemplate(order.Email, fmt.Sprintf("Pedido #%s cancelado", order.OrderNumber), "order-cancelled.html", map[string]interface{}{
+			"Order":    order,
+			"StoreURL": BaseURL(),
+		})
+		if err != nil {
+			logging.LogError("payment", "order_cancelled_send", err.Error(), map[string]interface{}{
+				"order_id": order.ID,
+			})
+		}
+	}
+	return nil
+}
+
+// expireOpenStripeSessions closes checkout sessions the customer never finished,
+// so an expired order can no longer be paid through them
+func expireOpenStripeSessions(orderID int) {
+	stripeKey := strings.TrimSpace(os.Getenv("STRIPE_SECRET_KEY"))
+	if stripeKey == "" {
+		return
+	}
+
+	attempts, err := orders.GetPaymentAttempts(orderID)
+	if err != nil {
+		logging.LogError("stripe", "expire_sessions_list_attempts", err.Error(), map[string]interface{}{
+			"order_id": orderID,
+		})
+		return
+	}
+
+	stripe.Key = stripeKey
+	for _, attempt := range attempts {
+		if attempt.Provider != "stripe" || attempt.Status != "pending" || attempt.ExternalID == "" {
+			continue
+		}
+		if _, err := checkoutsession.Expire(attempt.ExternalID, nil); err != nil {
+			// Completed sessions (a generated boleto) cannot be expired; the bank deadline applies
+			logging.LogError("stripe", "checkout_session_expire", err.Error(), map[string]interface{}{
+				"order_id":          orderID,
+				"stripe_session_id": attempt.ExternalID,
+			})
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package checkout
+
+import (
+	"net/http"
+	"strings"
+
+	"lojagtec/internal/logging"
+	"lojagtec/internal/orders"
+)
+
+// fakeProvider simulates a payment gateway for local development.
+// The payment page offers approve/decline buttons that post to its webhook,
+// so the whole checkout flow can be exercised without real credentials.
+// It only answers webhooks when PAYMENT_PROVIDER selects it.
+type fakeProvider struct{}
+
+func (fakeProvider) Name() string { return "fake" }
+
+func (fakeProvider) Supports(paymentMethod string) bool {
+	return paymentMethods[paymentMethod]
+}
+
+func (p fakeProvider) CreatePayment(form orders.CheckoutForm, order *orders.Order) (string, error) {
+	reference, err := generateReference(24)
+	if err != nil {
+		return "", err
+	}
+
+	attempt := orders.PaymentAttempt{
+		OrderID:       order.ID,
+		Provider:      p.Name(),
+		PaymentMethod: form.PaymentMethod,
+		ExternalID:    "fake_" + reference,
+		Amount:        order.TotalAmount,
+	}
+	if err := orders.RecordPaymentAttempt(attempt); err != nil {
+		return "", err
+	}
+
+	return PaymentPageURL(order), nil
+}
+
+// HandleWebhook receives the result chosen on the simulation page (external_id, result=approved|declined)
+func (p fakeProvider) HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	attempt, err := orders.GetPaymentAttempt(p.Name(), strings.TrimSpace(r.FormValue("external_id")))
+	if err != nil {
+		http.Error(w, "Unknown payment", http.StatusNotFound)
+		return
+	}
+
+	status := "failed"
+	if r.FormValue("result") == "approved" {
+		status = "paid"
+	}
+
+	if err := settlePayment(attempt, status, attempt.ExternalID); err != nil {
+		logging.LogError("fake", "webhook_update_payment_status", err.Error(), map[string]interface{}{
+			"order_id":    attempt.OrderID,
+			"external_id": attempt.ExternalID,
+			"new_status":  status,
+		})
+		http.Error(w, "Failed to update payment", http.StatusInternalServerError)
+		return
+	}
+
+	// Lets the simulation page check the new status right away
+	w.Header().Set("HX-Trigger", "paymentUpdated")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,313 @@
+package checkout
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"lojagtec/internal/logging"
+	"lojagtec/internal/orders"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	pixTxIDLength         = 25
+	pixDefaultExpiration  = 30 * time.Minute
+	pixMaxMerchantName    = 25
+	pixMaxMerchantCity    = 15
+	pixSignatureHeader    = "X-Signature"
+	pixGUI                = "br.gov.bcb.pix"
+	pixQRCodeImageSize    = 320
+	pixAmountTolerance    = 0.005
+	pixMaxWebhookBodySize = 1 << 20
+)
+
+// pixProvider charges orders with a PIX BR Code shown on our own payment page.
+// Payments are confirmed by the receiving bank's webhook, which reports the txid
+// embedded in the QR code.
+type pixProvider struct{}
+
+type pixConfig struct {
+	Key           string
+	MerchantName  string
+	MerchantCity  string
+	WebhookSecret string
+	Expiration    time.Duration
+}
+
+func loadPixConfig() (pixConfig, error) {
+	cfg := pixConfig{
+		Key:           strings.TrimSpace(os.Getenv("PIX_KEY")),
+		MerchantName:  strings.TrimSpace(os.Getenv("PIX_MERCHANT_NAME")),
+		MerchantCity:  strings.TrimSpace(os.Getenv("PIX_MERCHANT_CITY")),
+		WebhookSecret: strings.TrimSpace(os.Getenv("PIX_WEBHOOK_SECRET")),
+		Expiration:    pixExpiration(),
+	}
+	if cfg.Key == "" || cfg.MerchantName == "" || cfg.MerchantCity == "" {
+		return cfg, fmt.Errorf("%w: pix", ErrProviderNotConfigured)
+	}
+	return cfg, nil
+}
+
+func (pixProvider) Name() string { return "pix" }
+
+func (pixProvider) Supports(paymentMethod string) bool {
+	return paymentMethod == "pix"
+}
+
+func (p pixProvider) CreatePayment(form orders.CheckoutForm, order *orders.Order) (string, error) {
+	cfg, err := loadPixConfig()
+	if err != nil {
+		return "", err
+	}
+	if order.TotalAmount <= 0 {
+		return "", ValidationError{Field: "cart", Message: "Seu carrinho está vazio"}
+	}
+
+	txID, err := generateReference(pixTxIDLength)
+	if err != nil {
+		return "", err
+	}
+
+	payload := BuildPixPayload(PixCharge{
+		Key:          cfg.Key,
+		MerchantName: cfg.MerchantName,
+		MerchantCity: cfg.MerchantCity,
+		Amount:       order.TotalAmount,
+		TxID:         txID,
+	})
+
+	expiresAt := time.Now().Add(cfg.Expiration)
+	attempt := orders.PaymentAttempt{
+		OrderID:       order.ID,
+		Provider:      p.Name(),
+		PaymentMethod: form.PaymentMethod,
+		ExternalID:    txID,
+		Amount:        order.TotalAmount,
+		Payload:       payload,
+		ExpiresAt:     &expiresAt,
+	}
+	if err := orders.RecordPaymentAttempt(attempt); err != nil {
+		logging.LogError("pix", "record_payment_attempt", err.Error(), map[string]interface{}{
+			"order_id": order.ID,
+			"txid":     txID,
+		})
+		return "", err
+	}
+
+	// The charge exists as soon as the QR code is shown: the order now waits for the customer
+	if err := orders.UpdateOrderPaymentStatus(order.ID, "waiting", txID); err != nil {
+		logging.LogError("pix", "update_payment_status", err.Error(), map[string]interface{}{
+			"order_id": order.ID,
+		})
+	}
+	if err := orders.SetOrderPaymentExpiry(order.ID, expiresAt); err != nil {
+		logging.LogError("pix", "set_payment_expiry", err.Error(), map[string]interface{}{
+			"order_id": order.ID,
+		})
+	}
+
+	return PaymentPageURL(order), nil
+}
+
+// pixWebhookPayload follows the notification body of the BACEN PIX API
+type pixWebhookPayload struct {
+	Pix []struct {
+		EndToEndID string `json:"endToEndId"`
+		TxID       string `json:"txid"`
+		Valor      string `json:"valor"`
+		Horario    string `json:"horario"`
+	} `json:"pix"`
+}
+
+// HandleWebhook confirms PIX charges. The body is authenticated with an
+// HMAC-SHA256 of the raw payload, keyed by PIX_WEBHOOK_SECRET, sent hex encoded
+// in the X-Signature header.
+func (p pixProvider) HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cfg, _ := loadPixConfig()
+	if cfg.WebhookSecret == "" {
+		http.Error(w, "Webhook secret not configured", http.StatusInternalServerError)
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(r.Body, pixMaxWebhookBodySize))
+	if err != nil {
+		logging.LogError("pix", "webhook_read_payload", err.Error(), nil)
+		http.Error(w, "Failed to read payload", http.StatusBadRequest)
+		return
+	}
+
+	if !validPixSignature(payload, r.Header.Get(pixSignatureHeader), cfg.WebhookSecret) {
+		logging.LogError("pix", "webhook_signature_invalid", "Invalid webhook signature", nil)
+		http.Error(w, "Invalid signature", http.StatusBadRequest)
+		return
+	}
+
+	var notification pixWebhookPayload
+	if err := json.Unmarshal(payload, &notification); err != nil {
+		logging.LogError("pix", "webhook_unmarshal", err.Error(), nil)
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	for _, pix := range notification.Pix {
+		details := map[string]interface{}{
+			"txid":       pix.TxID,
+			"endToEndId": pix.EndToEndID,
+			"valor":      pix.Valor,
+		}
+
+		attempt, err := orders.GetPaymentAttempt(p.Name(), pix.TxID)
+		if err != nil {
+			logging.LogError("pix", "webhook_unknown_txid", err.Error(), details)
+			continue
+		}
+		if attempt.Status == "paid" {
+			continue
+		}
+
+		amount, err := strconv.ParseFloat(pix.Valor, 64)
+		if err != nil || math.Abs(amount-attempt.Amount) > pixAmountTolerance {
+			logging.LogError("pix", "webhook_amount_mismatch", "Received amount differs from the charge", details)
+			continue
+		}
+
+		if err := settlePayment(attempt, "paid", pix.EndToEndID); err != nil {
+			logging.LogError("pix", "webhook_update_payment_status", err.Error(), details)
+			http.Error(w, "Failed to update payment", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func validPixSignature(payload []byte, signature, secret string) bool {
+	expected, err := hex.DecodeString(strings.TrimSpace(signature))
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// PixCharge holds the data encoded in a BR Code
+type PixCharge struct {
+	Key          string
+	MerchantName string
+	MerchantCity string
+	Amount       float64
+	TxID         string
+}
+
+// BuildPixPayload builds the "copia e cola" BR Code (EMV QR) for a PIX charge
+func BuildPixPayload(charge PixCharge) string {
+	merchantAccount := emvField("00", pixGUI) + emvField("01", charge.Key)
+	txID := sanitizePixText(charge.TxID, pixTxIDLength, true)
+	if txID == "" {
+		txID = "***"
+	}
+
+	var b strings.Builder
+	b.WriteString(emvField("00", "01"))
+	b.WriteString(emvField("26", merchantAccount))
+	b.WriteString(emvField("52", "0000"))
+	b.WriteString(emvField("53", "986"))
+	if charge.Amount > 0 {
+		b.WriteString(emvField("54", strconv.FormatFloat(charge.Amount, 'f', 2, 64)))
+	}
+	b.WriteString(emvField("58", "BR"))
+	b.WriteString(emvField("59", sanitizePixText(charge.MerchantName, pixMaxMerchantName, false)))
+	b.WriteString(emvField("60", sanitizePixText(charge.MerchantCity, pixMaxMerchantCity, false)))
+	b.WriteString(emvField("62", emvField("05", txID)))
+	b.WriteString("6304")
+
+	payload := b.String()
+	return payload + fmt.Sprintf("%04X", crc16CCITT([]byte(payload)))
+}
+
+// PixQRCodeDataURI renders a BR Code as a PNG data URI ready for an <img> tag
+func PixQRCodeDataURI(payload string) (string, error) {
+	if payload == "" {
+		return "", errors.New("empty pix payload")
+	}
+	png, err := qrcode.Encode(payload, qrcode.Medium, pixQRCodeImageSize)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate pix qr code: %v", err)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(png), nil
+}
+
+func emvField(id, value string) string {
+	return fmt.Sprintf("%s%02d%s", id, len(value), value)
+}
+
+var pixAccentReplacer = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a", "ä", "a",
+	"é", "e", "ê", "e", "è", "e", "ë", "e",
+	"í", "i", "î", "i", "ì", "i", "ï", "i",
+	"ó", "o", "ô", "o", "õ", "o", "ò", "o", "ö", "o",
+	"ú", "u", "û", "u", "ù", "u", "ü", "u",
+	"ç", "c", "ñ", "n",
+	"Á", "A", "À", "A", "Â", "A", "Ã", "A", "Ä", "A",
+	"É", "E", "Ê", "E", "È", "E", "Ë", "E",
+	"Í", "I", "Î", "I", "Ì", "I", "Ï", "I",
+	"Ó", "O", "Ô", "O", "Õ", "O", "Ò", "O", "Ö", "O",
+	"Ú", "U", "Û", "U", "Ù", "U", "Ü", "U",
+	"Ç", "C", "Ñ", "N",
+)
+
+// sanitizePixText keeps the ASCII subset accepted by the BR Code fields and truncates it
+func sanitizePixText(value string, maxLength int, alphanumericOnly bool) string {
+	value = pixAccentReplacer.Replace(strings.TrimSpace(value))
+
+	var b strings.Builder
+	for _, r := range value {
+		isAlphanumeric := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+		if alphanumericOnly && !isAlphanumeric {
+			continue
+		}
+		if r < 0x20 || r > 0x7E {
+			continue
+		}
+		if b.Len() == maxLength {
+			break
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// crc16CCITT computes the CRC16-CCITT (polynomial 0x1021, initial value 0xFFFF) required by the BR Code
+func crc16CCITT(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
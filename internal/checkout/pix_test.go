@@ -0,0 +1,84 @@
+package checkout
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCRC16CCITT(t *testing.T) {
+	tests := []struct {
+		data string
+		want uint16
+	}{
+		// Check value of CRC-16/CCITT-FALSE
+		{"123456789", 0x29B1},
+		{"", 0xFFFF},
+	}
+	for _, tt := range tests {
+		if got := crc16CCITT([]byte(tt.data)); got != tt.want {
+			t.Errorf("crc16CCITT(%q) = %04X, want %04X", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestBuildPixPayload(t *testing.T) {
+	tests := []struct {
+		name   string
+		charge PixCharge
+		want   string
+	}{
+		{
+			// Example of the BACEN BR Code manual (static, without amount or txid)
+			name: "bacen example",
+			charge: PixCharge{
+				Key:          "123e4567-e12b-12d1-a456-426655440000",
+				MerchantName: "Fulano de Tal",
+				MerchantCity: "BRASILIA",
+			},
+			want: "00020126580014br.gov.bcb.pix0136123e4567-e12b-12d1-a456-4266554400005204000053039865802BR5913Fulano de Tal6008BRASILIA62070503***63041D3D",
+		},
+		{
+			name: "amount, txid and accented names",
+			charge: PixCharge{
+				Key:          "loja@gtec.com.br",
+				MerchantName: "Loja G-TEC Multimarcas Ltda ME",
+				MerchantCity: "Campo Grande/MS",
+				Amount:       1234.5,
+				TxID:         "PED-2024 0001",
+			},
+			want: "0002012638" + "0014br.gov.bcb.pix" + "0116loja@gtec.com.br" +
+				"52040000" + "5303986" + "54071234.50" + "5802BR" +
+				"5925Loja G-TEC Multimarcas Lt" + "6015Campo Grande/MS" +
+				"6215" + "0511PED20240001" + "6304",
+		},
+		{
+			name: "accents removed",
+			charge: PixCharge{
+				Key:          "+5567999999999",
+				MerchantName: "João Ação",
+				MerchantCity: "Maracajú",
+				Amount:       0.1,
+				TxID:         "abc",
+			},
+			want: "0002012636" + "0014br.gov.bcb.pix" + "0114+5567999999999" +
+				"52040000" + "5303986" + "54040.10" + "5802BR" +
+				"5909Joao Acao" + "6008Maracaju" +
+				"6207" + "0503abc" + "6304",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := BuildPixPayload(tt.charge)
+			want := tt.want
+			if strings.HasSuffix(want, "6304") {
+				// The CRC covers everything up to and including its own ID and length
+				want += fmt.Sprintf("%04X", crc16CCITT([]byte(want)))
+			}
+			if got != want {
+				t.Errorf("BuildPixPayload() =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package checkout
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"lojagtec/internal/logging"
+	"lojagtec/internal/orders"
+)
+
+// PaymentProvider is a payment backend able to charge an order and confirm it through a webhook
+type PaymentProvider interface {
+	// Name identifies the provider in payment attempts and webhook URLs
+	Name() string
+	// Supports reports whether the provider can charge the given payment method
+	Supports(paymentMethod string) bool
+	// CreatePayment starts a payment for the order and returns the URL the customer must be sent to
+	CreatePayment(form orders.CheckoutForm, order *orders.Order) (string, error)
+	// HandleWebhook processes a payment notification sent by the provider
+	HandleWebhook(w http.ResponseWriter, r *http.Request)
+}
+
+var ErrProviderNotConfigured = errors.New("payment_provider_not_configured")
+
+var providers = map[string]PaymentProvider{
+	"stripe": stripeProvider{},
+	"pix":    pixProvider{},
+	"fake":   fakeProvider{},
+}
+
+// ProviderFor returns the provider configured for a payment method.
+//
+// PAYMENT_PROVIDER selects the default provider (stripe when unset) and
+// PAYMENT_PROVIDER_<METHOD> overrides it per method, e.g.
+// PAYMENT_PROVIDER_PIX=pix to charge PIX directly while cards stay on Stripe.
+func ProviderFor(paymentMethod string) (PaymentProvider, error) {
+	name := configuredProviderName(paymentMethod)
+	provider, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown provider %q", ErrProviderNotConfigured, name)
+	}
+	if !provider.Supports(paymentMethod) {
+		return nil, ValidationError{Field: "paymentMethod", Message: "Forma de pagamento inválida"}
+	}
+	return provider, nil
+}
+
+func configuredProviderName(paymentMethod string) string {
+	if paymentMethod != "" {
+		if name := strings.TrimSpace(os.Getenv("PAYMENT_PROVIDER_" + strings.ToUpper(paymentMethod))); name != "" {
+			return strings.ToLower(name)
+		}
+	}
+	if name := strings.TrimSpace(os.Getenv("PAYMENT_PROVIDER")); name != "" {
+		return strings.ToLower(name)
+	}
+	return "stripe"
+}
+
+// isProviderEnabled reports whether any payment method is routed to the provider
+func isProviderEnabled(name string) bool {
+	for method := range paymentMethods {
+		if configuredProviderName(method) == name {
+			return true
+		}
+	}
+	return false
+}
+
+var paymentMethods = map[string]bool{
+	"credit_card": true,
+	"boleto":      true,
+	"pix":         true,
+}
+
+// StartPayment charges the order with the provider configured for its payment method
+func StartPayment(form orders.CheckoutForm, order *orders.Order) (string, error) {
+	provider, err := ProviderFor(form.PaymentMethod)
+	if err != nil {
+		return "", err
+	}
+	return provider.CreatePayment(form, order)
+}
+
+// HandleWebhook routes a provider notification to the provider named in the URL
+func HandleWebhook(w http.ResponseWriter, r *http.Request, name string) {
+	provider, ok := providers[name]
+	if !ok || !isProviderEnabled(name) {
+		http.NotFound(w, r)
+		return
+	}
+	provider.HandleWebhook(w, r)
+}
+
+// SuccessURL returns the page the customer sees after paying the order
+func SuccessURL(order *orders.Order) string {
+	return fmt.Sprintf("%s/checkout/success?order_id=%d&token=%s", BaseURL(), order.ID, url.QueryEscape(order.AccessToken))
+}
+
+// CancelURL returns the page the customer sees after abandoning the payment
+func CancelURL(order *orders.Order) string {
+	return fmt.Sprintf("%s/checkout/cancel?order_id=%d&token=%s", BaseURL(), order.ID, url.QueryEscape(order.AccessToken))
+}
+
+// PaymentPageURL returns our page that renders a payment handled on-site (PIX QR code, fake provider)
+func PaymentPageURL(order *orders.Order) string {
+	return fmt.Sprintf("%s/pagamento/%s?token=%s", BaseURL(), url.PathEscape(order.OrderNumber), url.QueryEscape(order.AccessToken))
+}
+
+// settlePayment applies a confirmed provider result to the attempt and its order.
+// A failed attempt never overrides an order that was already paid by another attempt.
+func settlePayment(attempt *orders.PaymentAttempt, status, paymentID string) error {
+	if status == "paid" {
+		return settlePaidAttempt(attempt, paymentID)
+	}
+
+	if err := orders.UpdatePaymentAttemptStatus(attempt.Provider, attempt.ExternalID, status); err != nil {
+		return fmt.Errorf("failed to update payment attempt: %v", err)
+	}
+
+	if err := orders.UpdateOrderPaymentStatus(attempt.OrderID, status, paymentID); err != nil {
+		return fmt.Errorf("failed to update order payment status: %v", err)
+	}
+	return nil
+}
+
+// refundReasons explains, for the error log, why a received payment was not taken as the
+// order's payment
+var refundReasons = map[string]string{
+	orders.PaymentDuplicate:      "Order already paid by another payment; this payment must be refunded",
+	orders.PaymentOrderCancelled: "Order was cancelled before the payment arrived; this payment must be refunded",
+}
+
+// settlePaidAttempt marks the order paid by the attempt. A payment the order cannot take
+// (a second payment of a paid order, or a payment of a cancelled order) leaves the attempt
+// as refund_pending and is logged, so someone refunds it.
+func settlePaidAttempt(attempt *orders.PaymentAttempt, paymentID string) error {
+	outcome, err := orders.ApplyOrderPayment(attempt.OrderID, paymentID)
+	if err != nil {
+		return fmt.Errorf("failed to update order payment status: %v", err)
+	}
+
+	// An expired attempt paid while the order was still open pays it, but its amount may
+	// predate a change of payment method, so it is logged to be checked against the order
+	if outcome == orders.PaymentApplied && attempt.Status == "expired" {
+		details := map[string]interface{}{
+			"order_id":    attempt.OrderID,
+			"provider":    attempt.Provider,
+			"external_id": attempt.ExternalID,
+			"payment_id":  paymentID,
+			"amount":      attempt.Amount,
+		}
+		if order, err := orders.GetOrderByID(attempt.OrderID); err == nil {
+			details["order_total"] = order.TotalAmount
+		}
+		log.Printf("Order %d was paid by its expired payment attempt %s", attempt.OrderID, attempt.ExternalID)
+		logging.LogError("payment", "payment_on_expired_attempt", "Order paid by an expired payment attempt; check the amount against the order total", details)
+	}
+
+	attemptStatus := "paid"
+	if outcome != orders.PaymentApplied {
+		attemptStatus = "refund_pending"
+		log.Printf("Payment %s of order %d needs a refund: %s", paymentID, attempt.OrderID, outcome)
+		logging.LogError("payment", "payment_needs_refund", refundReasons[outcome], map[string]interface{}{
+			"order_id":    attempt.OrderID,
+			"provider":    attempt.Provider,
+			"external_id": attempt.ExternalID,
+			"payment_id":  paymentID,
+			"amount":      attempt.Amount,
+			"outcome":     outcome,
+		})
+	}
+
+	if err := orders.UpdatePaymentAttemptStatus(attempt.Provider, attempt.ExternalID, attemptStatus); err != nil {
+		return fmt.Errorf("failed to update payment attempt: %v", err)
+	}
+	return nil
+}
+
+// ExpireOpenPayments closes the unfinished payments of an order before a new one starts,
+// so an old tab or link cannot charge the order a second time. Generated boletos and
+// static PIX codes cannot be revoked; paying them later is caught by settlePayment.
+func ExpireOpenPayments(orderID int) error {
+	expireOpenStripeSessions(orderID)
+	return orders.ExpireOpenPaymentAttempts(orderID)
+}
+
+// generateReference returns a random alphanumeric identifier of the given length
+func generateReference(length int) (string, error) {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	buf := make([]byte, length)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate payment reference: %v", err)
+	}
+	for i, b := range buf {
+		buf[i] = alphabet[int(b)%len(alphabet)]
+	}
+	return string(buf), nil
+}
@@ -3,25 +3,27 @@ package checkout
 import (
 	"database/sql"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"lojagtec/internal/logging"
 	"lojagtec/internal/orders"
 
 	"github.com/stripe/stripe-go/v84"
 	checkoutsession "github.com/stripe/stripe-go/v84/checkout/session"
+	"github.com/stripe/stripe-go/v84/paymentintent"
 	"github.com/stripe/stripe-go/v84/webhook"
 )
 
-var ErrStripeNotConfigured = errors.New("stripe_not_configured")
+var ErrStripeNotConfigured = fmt.Errorf("%w: stripe", ErrProviderNotConfigured)
 
 var db *sql.DB
 
@@ -38,6 +40,24 @@ func (e ValidationError) Error() string {
 	return e.Message
 }
 
+// stripeProvider charges orders through Stripe Checkout, which hosts the payment page
+type stripeProvider struct{}
+
+func (stripeProvider) Name() string { return "stripe" }
+
+func (stripeProvider) Supports(paymentMethod string) bool {
+	_, err := stripePaymentMethodTypes(paymentMethod)
+	return err == nil
+}
+
+func (stripeProvider) CreatePayment(form orders.CheckoutForm, order *orders.Order) (string, error) {
+	return CreateCheckoutSession(form, order)
+}
+
+func (stripeProvider) HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	HandleStripeWebhook(w, r)
+}
+
 func CreateCheckoutSession(form orders.CheckoutForm, order *orders.Order) (string, error) {
 	stripeKey := strings.TrimSpace(os.Getenv("STRIPE_SECRET_KEY"))
 	if stripeKey == "" {
@@ -55,18 +75,25 @@ func CreateCheckoutSession(form orders.CheckoutForm, order *orders.Order) (strin
 	if err != nil {
 		return "", err
 	}
-
-	baseURL := strings.TrimRight(strings.TrimSpace(os.Getenv("BASE_URL")), "/")
-	if baseURL == "" {
-		baseURL = "http://localhost:8080"
+	if order.InstallmentInterest > 0 {
+		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
+			PriceData: &stripe.CheckoutSessionLineItemPriceDataParams{
+				Currency:   stripe.String(string(stripe.CurrencyBRL)),
+				UnitAmount: stripe.Int64(int64(math.Round(order.InstallmentInterest * 100))),
+				ProductData: &stripe.CheckoutSessionLineItemPriceDataProductDataParams{
+					Name: stripe.String(fmt.Sprintf("Juros do parcelamento (%dx)", order.Installments)),
+				},
+			},
+			Quantity: stripe.Int64(1),
+		})
 	}
 
 	params := &stripe.CheckoutSessionParams{
 		Mode:               stripe.String(string(stripe.CheckoutSessionModePayment)),
 		PaymentMethodTypes: paymentMethodTypes,
 		LineItems:          lineItems,
-		SuccessURL:         stripe.String(fmt.Sprintf("%s/checkout/success?order_id=%d&session_id={CHECKOUT_SESSION_ID}", baseURL, order.ID)),
-		CancelURL:          stripe.String(fmt.Sprintf("%s/checkout/cancel?order_id=%d", baseURL, order.ID)),
+		SuccessURL:         stripe.String(SuccessURL(order) + "&session_id={CHECKOUT_SESSION_ID}"),
+		CancelURL:          stripe.String(CancelURL(order)),
 		CustomerEmail:      stripe.String(form.Email),
 		ClientReferenceID:  stripe.String(strconv.Itoa(order.ID)),
 		Metadata: map[string]string{
@@ -74,9 +101,38 @@ func CreateCheckoutSession(form orders.CheckoutForm, order *orders.Order) (strin
 			"order_number":   order.OrderNumber,
 			"cpf_cnpj":       form.CPF,
 			"payment_method": form.PaymentMethod,
+			"installments":   strconv.Itoa(order.Installments),
 		},
 	}
 
+	switch form.PaymentMethod {
+	case "credit_card":
+		// Checkout cannot preset the plan: Stripe offers the plans the card supports and the customer
+		// picks one on its page. The count charged here is kept in the metadata and checked against
+		// the confirmed plan when the session is paid (checkInstallmentPlan).
+		if order.Installments > 1 {
+			params.PaymentMethodOptions = &stripe.CheckoutSessionPaymentMethodOptionsParams{
+				Card: &stripe.CheckoutSessionPaymentMethodOptionsCardParams{
+					Installments: &stripe.CheckoutSessionPaymentMethodOptionsCardInstallmentsParams{
+						Enabled: stripe.Bool(true),
+					},
+				},
+			}
+		}
+	case "boleto":
+		params.PaymentMethodOptions = &stripe.CheckoutSessionPaymentMethodOptionsParams{
+			Boleto: &stripe.CheckoutSessionPaymentMethodOptionsBoletoParams{
+				ExpiresAfterDays: stripe.Int64(int64(boletoExpirationDays())),
+			},
+		}
+	case "pix":
+		params.PaymentMethodOptions = &stripe.CheckoutSessionPaymentMethodOptionsParams{
+			Pix: &stripe.CheckoutSessionPaymentMethodOptionsPixParams{
+				ExpiresAfterSeconds: stripe.Int64(int64(pixExpiration().Seconds())),
+			},
+		}
+	}
+
 	stripeSession, err := checkoutsession.New(params)
 	if err != nil {
 		logging.LogError("stripe", "checkout_session_create", err.Error(), map[string]interface{}{
@@ -93,9 +149,46 @@ func CreateCheckoutSession(form orders.CheckoutForm, order *orders.Order) (strin
 		return "", err
 	}
 
+	// Until the customer generates the boleto/PIX, the deadline is the session's own expiry
+	if _, expires := orders.PaymentExpiryRules[form.PaymentMethod]; expires && stripeSession.ExpiresAt > 0 {
+		if err := orders.SetOrderPaymentExpiry(order.ID, time.Unix(stripeSession.ExpiresAt, 0)); err != nil {
+			logging.LogError("stripe", "set_payment_expiry", err.Error(), map[string]interface{}{
+				"order_id": order.ID,
+			})
+		}
+	}
+
+	attempt := orders.PaymentAttempt{
+		OrderID:       order.ID,
+		Provider:      "stripe",
+		PaymentMethod: form.PaymentMethod,
+		ExternalID:    stripeSession.ID,
+		Amount:        order.TotalAmount,
+	}
+	if err := orders.RecordPaymentAttempt(attempt); err != nil {
+		logging.LogError("stripe", "record_payment_attempt", err.Error(), map[string]interface{}{
+			"order_id":          order.ID,
+			"stripe_session_id": stripeSession.ID,
+		})
+	}
+
 	return stripeSession.URL, nil
 }
 
+// BaseURL returns the public URL of the store, used to build links sent to customers
+func BaseURL() string {
+	baseURL := strings.TrimRight(strings.TrimSpace(os.Getenv("BASE_URL")), "/")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+	return baseURL
+}
+
+// OrderTrackingURL returns the customer link to follow an order and pay it again
+func OrderTrackingURL(order *orders.Order) string {
+	return fmt.Sprintf("%s/pedido/%s?token=%s", BaseURL(), url.PathEscape(order.OrderNumber), url.QueryEscape(order.AccessToken))
+}
+
 func HandleStripeWebhook(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -129,7 +222,7 @@ func HandleStripeWebhook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	switch event.Type {
-	case "checkout.session.completed", "checkout.session.async_payment_succeeded", "checkout.session.async_payment_failed":
+	case "checkout.session.completed", "checkout.session.async_payment_succeeded", "checkout.session.async_payment_failed", "checkout.session.expired":
 		var session stripe.CheckoutSession
 		if err := json.Unmarshal(event.Data.Raw, &session); err != nil {
 			fmt.Printf("payload unmarshal: %v", err.Error())
@@ -167,24 +260,67 @@ func HandleStripeWebhook(w http.ResponseWriter, r *http.Request) {
 			stripePaymentID = session.PaymentIntent.ID
 		}
 
-		switch event.Type {
-		case "checkout.session.completed", "checkout.session.async_payment_succeeded":
-			if err := orders.UpdateOrderPaymentStatus(orderID, "paid", stripePaymentID); err != nil {
+		// A completed boleto/PIX session only means the customer generated the payment
+		awaitingPayment := event.Type == "checkout.session.completed" && session.PaymentStatus == stripe.CheckoutSessionPaymentStatusUnpaid
+
+		attempt, err := orders.GetPaymentAttempt("stripe", session.ID)
+		if err != nil {
+			// Sessions whose attempt failed to be recorded are still settled
+			attempt = &orders.PaymentAttempt{
+				OrderID:    orderID,
+				Provider:   "stripe",
+				ExternalID: session.ID,
+				Amount:     float64(session.AmountTotal) / 100,
+			}
+		}
+
+		switch {
+		case awaitingPayment:
+			if err := orders.UpdatePaymentAttemptStatus("stripe", session.ID, "waiting"); err != nil {
+				logging.LogError("stripe", "webhook_update_payment_attempt", err.Error(), map[string]interface{}{
+					"order_id":          orderID,
+					"stripe_session_id": session.ID,
+					"new_status":        "waiting",
+				})
+			}
+			if err := orders.UpdateOrderPaymentStatus(orderID, "waiting", stripePaymentID); err != nil {
 				log.Printf("Failed to update payment status: %v", err)
 				logging.LogError("stripe", "webhook_update_payment_status", err.Error(), map[string]interface{}{
 					"order_id":          orderID,
 					"stripe_payment_id": stripePaymentID,
-					"new_status":        "paid",
+					"new_status":        "waiting",
+				})
+			}
+			if err := orders.SetOrderPaymentExpiry(orderID, asyncPaymentDeadline(session.Metadata["payment_method"], time.Now())); err != nil {
+				logging.LogError("stripe", "webhook_set_payment_expiry", err.Error(), map[string]interface{}{
+					"order_id": orderID,
 				})
 			}
-		case "checkout.session.async_payment_failed":
-			if err := orders.UpdateOrderPaymentStatus(orderID, "failed", stripePaymentID); err != nil {
+		case event.Type == "checkout.session.expired":
+			if err := orders.UpdatePaymentAttemptStatus("stripe", session.ID, "expired"); err != nil {
+				logging.LogError("stripe", "webhook_update_payment_attempt", err.Error(), map[string]interface{}{
+					"order_id":          orderID,
+					"stripe_session_id": session.ID,
+					"new_status":        "expired",
+				})
+			}
+		default:
+			status := "paid"
+			if event.Type == "checkout.session.async_payment_failed" {
+				status = "failed"
+			}
+			if err := settlePayment(attempt, status, stripePaymentID); err != nil {
 				log.Printf("Failed to update payment status: %v", err)
 				logging.LogError("stripe", "webhook_update_payment_status", err.Error(), map[string]interface{}{
 					"order_id":          orderID,
 					"stripe_payment_id": stripePaymentID,
-					"new_status":        "failed",
+					"new_status":        status,
 				})
+				http.Error(w, "Failed to update payment", http.StatusInternalServerError)
+				return
+			}
+			if status == "paid" {
+				checkInstallmentPlan(&session, orderID)
 			}
 		}
 
@@ -194,6 +330,45 @@ func HandleStripeWebhook(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// checkInstallmentPlan compares the installment plan the customer confirmed on Stripe with the
+// count the order charged interest for. Checkout cannot preset the plan, so a different choice
+// (or a card without installments) is logged for the staff to adjust the interest with the customer.
+func checkInstallmentPlan(session *stripe.CheckoutSession, orderID int) {
+	charged, _ := strconv.Atoi(session.Metadata["installments"])
+	if session.Metadata["payment_method"] != "credit_card" || charged <= 1 || session.PaymentIntent == nil {
+		return
+	}
+
+	params := &stripe.PaymentIntentParams{}
+	params.AddExpand("latest_charge")
+	intent, err := paymentintent.Get(session.PaymentIntent.ID, params)
+	if err != nil {
+		logging.LogError("stripe", "installment_plan_check", err.Error(), map[string]interface{}{
+			"order_id":          orderID,
+			"stripe_payment_id": session.PaymentIntent.ID,
+		})
+		return
+	}
+
+	confirmed := int64(1)
+	if charge := intent.LatestCharge; charge != nil && charge.PaymentMethodDetails != nil &&
+		charge.PaymentMethodDetails.Card != nil && charge.PaymentMethodDetails.Card.Installments != nil &&
+		charge.PaymentMethodDetails.Card.Installments.Plan != nil {
+		confirmed = charge.PaymentMethodDetails.Card.Installments.Plan.Count
+	}
+	if confirmed == int64(charged) {
+		return
+	}
+
+	log.Printf("Order %d charged interest for %dx but the customer confirmed %dx on Stripe", orderID, charged, confirmed)
+	logging.LogError("stripe", "installment_plan_mismatch", "Installment plan confirmed on Stripe differs from the one charged; review the interest with the customer", map[string]interface{}{
+		"order_id":               orderID,
+		"stripe_payment_id":      session.PaymentIntent.ID,
+		"charged_installments":   charged,
+		"confirmed_installments": confirmed,
+	})
+}
+
 func stripePaymentMethodTypes(method string) ([]*string, error) {
 	switch method {
 	case "credit_card":
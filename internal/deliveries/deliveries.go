@@ -0,0 +1,520 @@
+package deliveries
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"lojagtec/internal/orders"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrNoOrdersSelected    = errors.New("Selecione ao menos um pedido.")
+	ErrOrderNotReady       = errors.New("Algum pedido selecionado não está mais pronto para entrega. Atualize a página.")
+	ErrRunNotFound         = errors.New("Rota não encontrada.")
+	ErrStopNotFound        = errors.New("Parada não encontrada.")
+	ErrRunStarted          = errors.New("Esta rota já tem entregas registradas e não pode ser excluída.")
+	ErrOrderNotDeliverable = errors.New("O pedido desta parada foi cancelado ou não está pago e não pode ser marcado como entregue.")
+)
+
+// Run is a van run of a day
+type Run struct {
+	ID             int
+	RunDate        time.Time
+	AssigneeID     *int
+	AssigneeName   string
+	CreatedAt      time.Time
+	StopCount      int
+	DeliveredCount int
+	Stops          []Stop
+}
+
+// Completed reports whether every stop of the run was delivered
+func (r Run) Completed() bool {
+	return r.StopCount > 0 && r.DeliveredCount == r.StopCount
+}
+
+// Stop is an order to deliver in a run
+type Stop struct {
+	ID          int
+	RunID       int
+	OrderID     int
+	Position    int
+	Location    *Point
+	Source      string
+	DeliveredAt *time.Time
+	Order       orders.OrderDocument
+}
+
+// Approximate reports whether the stop is located by its neighborhood only
+func (s Stop) Approximate() bool {
+	return s.Source == LocationNeighborhood
+}
+
+// NeighborhoodGroup holds the orders ready for delivery in a neighborhood
+type NeighborhoodGroup struct {
+	Name   string
+	Orders []orders.Order
+}
+
+var db *sql.DB
+
+// SetDatabase sets the database connection for the deliveries package
+func SetDatabase(database *sql.DB) {
+	db = database
+}
+
+// pendingOrderIDs returns the orders already in a run and not delivered yet
+func pendingOrderIDs() (map[int]bool, error) {
+	rows, err := db.Query("SELECT order_id FROM delivery_stops WHERE delivered_at IS NULL")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load scheduled orders: %v", err)
+	}
+	defer rows.Close()
+
+	ids := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// GetReadyOrders returns the orders in processing that are not in a run yet, grouped by
+// neighborhood
+func GetReadyOrders() ([]NeighborhoodGroup, error) {
+	scheduled, err := pendingOrderIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*NeighborhoodGroup)
+	filters := orders.OrderFilters{Status: "processing", SortBy: "created_at"}
+	err = orders.EachOrder(filters, false, func(order orders.Order, _ *orders.OrderItem) error {
+		if scheduled[order.ID] {
+			return nil
+		}
+		key := normalizeKey(order.Neighborhood)
+		group, ok := groups[key]
+		if !ok {
+			group = &NeighborhoodGroup{Name: strings.TrimSpace(order.Neighborhood)}
+			groups[key] = group
+		}
+		group.Orders = append(group.Orders, order)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]NeighborhoodGroup, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, *group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return strings.ToLower(result[i].Name) < strings.ToLower(result[j].Name)
+	})
+	return result, nil
+}
+
+// plannedStop is a stop being routed
+type plannedStop struct {
+	StopID   int
+	OrderID  int
+	Order    orders.Order
+	Location Point
+	Source   string
+}
+
+// routeStops orders the stops from start: located stops along the planned route, then the
+// stops without a location grouped by neighborhood
+func routeStops(start *Point, stops []plannedStop) []plannedStop {
+	var located, unknown []plannedStop
+	for _, stop := range stops {
+		if stop.Source == LocationUnknown {
+			unknown = append(unknown, stop)
+		} else {
+			located = append(located, stop)
+		}
+	}
+
+	points := make([]Point, len(located))
+	for i, stop := range located {
+		points[i] = stop.Location
+	}
+	routed := make([]plannedStop, 0, len(stops))
+	for _, index := range PlanRoute(start, points) {
+		routed = append(routed, located[index])
+	}
+
+	sort.SliceStable(unknown, func(i, j int) bool {
+		return normalizeKey(unknown[i].Order.Neighborhood) < normalizeKey(unknown[j].Order.Neighborhood)
+	})
+	return append(routed, unknown...)
+}
+
+// locateStop fills the location of a stop from the geocode cache
+func locateStop(stop *plannedStop) error {
+	point, source, err := Locate(stop.Order)
+	if err != nil {
+		return err
+	}
+	stop.Location, stop.Source = point, source
+	return nil
+}
+
+// nullableLocation returns the latitude and longitude to store for a stop
+func nullableLocation(stop plannedStop) (interface{}, interface{}) {
+	if stop.Source == LocationUnknown {
+		return nil, nil
+	}
+	return stop.Location.Latitude, stop.Location.Longitude
+}
+
+// CreateRun plans a run with the given orders, which must be in processing and not in another
+// run, and returns its id
+func CreateRun(runDate time.Time, assigneeID, createdBy int, orderIDs []int) (int, error) {
+	if len(orderIDs) == 0 {
+		return 0, ErrNoOrdersSelected
+	}
+
+	scheduled, err := pendingOrderIDs()
+	if err != nil {
+		return 0, err
+	}
+	var stops []plannedStop
+	err = orders.EachOrder(orders.OrderFilters{IDs: orderIDs, Status: "processing"}, false, func(order orders.Order, _ *orders.OrderItem) error {
+		if scheduled[order.ID] {
+			return ErrOrderNotReady
+		}
+		stops = append(stops, plannedStop{OrderID: order.ID, Order: order})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(stops) != len(uniqueIDs(orderIDs)) {
+		return 0, ErrOrderNotReady
+	}
+	for i := range stops {
+		if err := locateStop(&stops[i]); err != nil {
+			return 0, err
+		}
+	}
+	stops = routeStops(Origin(), stops)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %v", err)
+	}
+
+	var runID int
+	err = tx.QueryRow(`
+		INSERT INTO delivery_runs (run_date, assignee_id, created_by)
+		VALUES ($1, $2, NULLIF($3, 0))
+		RETURNING id
+	`, runDate, assigneeID, createdBy).Scan(&runID)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, fmt.Errorf("failed to create delivery run: %v", err)
+	}
+
+	for i, stop := range stops {
+		lat, lng := nullableLocation(stop)
+		_, err := tx.Exec(`
+			INSERT INTO delivery_stops (run_id, order_id, position, latitude, longitude, location_source)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, runID, stop.OrderID, i+1, lat, lng, stop.Source)
+		if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == "23505" {
+			// Another run took the order meanwhile
+			_ = tx.Rollback()
+			return 0, ErrOrderNotReady
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, fmt.Errorf("failed to add delivery stop: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit delivery run: %v", err)
+	}
+	return runID, nil
+}
+
+func uniqueIDs(ids []int) map[int]bool {
+	unique := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		unique[id] = true
+	}
+	return unique
+}
+
+// ReplanRun locates the stops not delivered yet again, since coordinates may have been added
+// since, and reorders them from the last delivered stop (or the origin)
+func ReplanRun(runID int) error {
+	run, err := GetRun(runID)
+	if err != nil {
+		return err
+	}
+
+	start := Origin()
+	var pending []plannedStop
+	for _, stop := range run.Stops {
+		if stop.DeliveredAt != nil {
+			if stop.Location != nil {
+				location := *stop.Location
+				start = &location
+			}
+			continue
+		}
+		planned := plannedStop{StopID: stop.ID, OrderID: stop.OrderID, Order: stop.Order.Order}
+		if err := locateStop(&planned); err != nil {
+			return err
+		}
+		pending = append(pending, planned)
+	}
+	pending = routeStops(start, pending)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	// Delivered stops keep their positions; the remaining ones follow them
+	first := len(run.Stops) - len(pending) + 1
+	for i, stop := range pending {
+		lat, lng := nullableLocation(stop)
+		_, err := tx.Exec(`
+			UPDATE delivery_stops
+			SET position = $1, latitude = $2, longitude = $3, location_source = $4
+			WHERE id = $5
+		`, first+i, lat, lng, stop.Source, stop.StopID)
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to reorder delivery stop: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit delivery run: %v", err)
+	}
+	return nil
+}
+
+const runColumns = `
+	r.id, r.run_date, r.assignee_id, COALESCE(u.username, ''), r.created_at,
+	(SELECT COUNT(*) FROM delivery_stops s WHERE s.run_id = r.id),
+	(SELECT COUNT(*) FROM delivery_stops s WHERE s.run_id = r.id AND s.delivered_at IS NOT NULL)
+`
+
+func scanRun(scanner interface{ Scan(...interface{}) error }) (Run, error) {
+	var run Run
+	var assigneeID sql.NullInt64
+	err := scanner.Scan(&run.ID, &run.RunDate, &assigneeID, &run.AssigneeName, &run.CreatedAt,
+		&run.StopCount, &run.DeliveredCount)
+	if err != nil {
+		return run, err
+	}
+	if assigneeID.Valid {
+		id := int(assigneeID.Int64)
+		run.AssigneeID = &id
+	}
+	return run, nil
+}
+
+// GetRuns returns the most recent runs, only those assigned to assigneeID when it is not 0
+func GetRuns(assigneeID, limit int) ([]Run, error) {
+	rows, err := db.Query(`
+		SELECT `+runColumns+`
+		FROM delivery_runs r
+		LEFT JOIN admin_users u ON u.id = r.assignee_id
+		WHERE $1 = 0 OR r.assignee_id = $1
+		ORDER BY r.run_date DESC, r.id DESC
+		LIMIT $2
+	`, assigneeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list delivery runs: %v", err)
+	}
+	defer rows.Close()
+
+	var runs []Run
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// GetRun returns a run with its stops in route order
+func GetRun(runID int) (*Run, error) {
+	run, err := scanRun(db.QueryRow(`
+		SELECT `+runColumns+`
+		FROM delivery_runs r
+		LEFT JOIN admin_users u ON u.id = r.assignee_id
+		WHERE r.id = $1
+	`, runID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRunNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load delivery run: %v", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT id, order_id, position, latitude, longitude, location_source, delivered_at
+		FROM delivery_stops
+		WHERE run_id = $1
+		ORDER BY position, id
+	`, runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load delivery stops: %v", err)
+	}
+	defer rows.Close()
+
+	var orderIDs []int
+	for rows.Next() {
+		stop := Stop{RunID: runID}
+		var lat, lng sql.NullFloat64
+		if err := rows.Scan(&stop.ID, &stop.OrderID, &stop.Position, &lat, &lng, &stop.Source, &stop.DeliveredAt); err != nil {
+			return nil, err
+		}
+		if lat.Valid && lng.Valid {
+			stop.Location = &Point{Latitude: lat.Float64, Longitude: lng.Float64}
+		}
+		run.Stops = append(run.Stops, stop)
+		orderIDs = append(orderIDs, stop.OrderID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(orderIDs) > 0 {
+		documents, err := orders.GetOrderDocuments(orders.OrderFilters{IDs: orderIDs})
+		if err != nil {
+			return nil, err
+		}
+		byID := make(map[int]orders.OrderDocument, len(documents))
+		for _, document := range documents {
+			byID[document.ID] = document
+		}
+		for i := range run.Stops {
+			run.Stops[i].Order = byID[run.Stops[i].OrderID]
+		}
+	}
+	return &run, nil
+}
+
+// GetStop returns a stop of a run, with its order
+func GetStop(stopID int) (*Stop, error) {
+	var runID int
+	err := db.QueryRow("SELECT run_id FROM delivery_stops WHERE id = $1", stopID).Scan(&runID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrStopNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load delivery stop: %v", err)
+	}
+
+	run, err := GetRun(runID)
+	if err != nil {
+		return nil, err
+	}
+	for _, stop := range run.Stops {
+		if stop.ID == stopID {
+			return &stop, nil
+		}
+	}
+	return nil, ErrStopNotFound
+}
+
+// MarkStopDelivered records that the stop was delivered by the admin and completes its order,
+// in one transaction. Delivering it again keeps the first time. ErrOrderNotDeliverable is
+// returned, and nothing changes, when the order is no longer a paid order awaiting delivery.
+func MarkStopDelivered(stopID, adminID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var orderID int
+	err = tx.QueryRow(`
+		UPDATE delivery_stops
+		SET delivered_at = CURRENT_TIMESTAMP, delivered_by = NULLIF($2, 0)
+		WHERE id = $1 AND delivered_at IS NULL
+		RETURNING order_id
+	`, stopID, adminID).Scan(&orderID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mark stop delivered: %v", err)
+	}
+
+	completed, err := orders.CompleteDeliveredOrder(tx, orderID)
+	if err != nil {
+		return err
+	}
+	if !completed {
+		return ErrOrderNotDeliverable
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit stop delivery: %v", err)
+	}
+	return nil
+}
+
+// SetStopLocation stores the coordinates of the stop address (or of its whole neighborhood)
+// in the geocode cache and replans the run
+func SetStopLocation(stopID int, point Point, wholeNeighborhood bool) (*Stop, error) {
+	stop, err := GetStop(stopID)
+	if err != nil {
+		return nil, err
+	}
+
+	key := AddressKey(stop.Order.Order)
+	if wholeNeighborhood {
+		key = NeighborhoodKey(stop.Order.Order)
+	}
+	if err := SaveLocation(key, point); err != nil {
+		return nil, err
+	}
+	if stop.DeliveredAt != nil {
+		// Delivered stops keep their place; only record the location for future runs
+		return stop, nil
+	}
+	if err := ReplanRun(stop.RunID); err != nil {
+		return nil, err
+	}
+	return stop, nil
+}
+
+// DeleteRun removes a run whose stops were not delivered yet, freeing its orders
+func DeleteRun(runID int) error {
+	result, err := db.Exec(`
+		DELETE FROM delivery_runs r
+		WHERE r.id = $1
+		  AND NOT EXISTS (SELECT 1 FROM delivery_stops s WHERE s.run_id = r.id AND s.delivered_at IS NOT NULL)
+	`, runID)
+	if err != nil {
+		return fmt.Errorf("failed to delete delivery run: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		if _, err := GetRun(runID); err != nil {
+			return err
+		}
+		return ErrRunStarted
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package deliveries
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"lojagtec/internal/orders"
+)
+
+var ErrInvalidCoordinates = errors.New("Coordenadas inválidas. Use latitude e longitude, por exemplo: -20.4697, -54.6201")
+
+// Sources of a stop location
+const (
+	LocationAddress      = "address"
+	LocationNeighborhood = "neighborhood"
+	LocationUnknown      = ""
+)
+
+// AddressKey normalizes the delivery address of an order for the geocode cache
+func AddressKey(order orders.Order) string {
+	return normalizeKey(order.Address + "|" + order.Neighborhood + "|" + order.City + "|" + order.State)
+}
+
+// NeighborhoodKey is the geocode cache key of the point standing for the order's neighborhood
+func NeighborhoodKey(order orders.Order) string {
+	return "bairro:" + normalizeKey(order.Neighborhood+"|"+order.City)
+}
+
+func normalizeKey(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+// ParseCoordinates reads "latitude, longitude" in decimal degrees, as copied from a map app
+func ParseCoordinates(value string) (Point, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return Point{}, ErrInvalidCoordinates
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return Point{}, ErrInvalidCoordinates
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return Point{}, ErrInvalidCoordinates
+	}
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return Point{}, ErrInvalidCoordinates
+	}
+	return Point{Latitude: lat, Longitude: lng}, nil
+}
+
+// Origin returns where the runs start (the store), from DELIVERY_ORIGIN="lat,lng". Without it
+// routes start at the first stop.
+func Origin() *Point {
+	value := strings.TrimSpace(os.Getenv("DELIVERY_ORIGIN"))
+	if value == "" {
+		return nil
+	}
+	point, err := ParseCoordinates(value)
+	if err != nil {
+		return nil
+	}
+	return &point
+}
+
+// Locate looks up the order address in the geocode cache, falling back to its neighborhood.
+// The source is LocationUnknown when neither is known.
+func Locate(order orders.Order) (Point, string, error) {
+	for _, candidate := range []struct {
+		key    string
+		source string
+	}{
+		{AddressKey(order), LocationAddress},
+		{NeighborhoodKey(order), LocationNeighborhood},
+	} {
+		var point Point
+		err := db.QueryRow("SELECT latitude, longitude FROM geocode_cache WHERE address_key = $1", candidate.key).
+			Scan(&point.Latitude, &point.Longitude)
+		if err == nil {
+			return point, candidate.source, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return Point{}, LocationUnknown, fmt.Errorf("failed to look up address: %v", err)
+		}
+	}
+	return Point{}, LocationUnknown, nil
+}
+
+// SaveLocation stores the coordinates of an address key in the geocode cache
+func SaveLocation(key string, point Point) error {
+	_, err := db.Exec(`
+		INSERT INTO geocode_cache (address_key, latitude, longitude)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (address_key) DO UPDATE
+		SET latitude = EXCLUDED.latitude, longitude = EXCLUDED.longitude, updated_at = CURRENT_TIMESTAMP
+	`, key, point.Latitude, point.Longitude)
+	if err != nil {
+		return fmt.Errorf("failed to save location: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package deliveries
+
+import "math"
+
+// Point is a position in decimal degrees
+type Point struct {
+	Latitude  float64
+	Longitude float64
+}
+
+const earthRadiusKm = 6371.0
+
+// DistanceKm returns the great-circle distance between two points
+func DistanceKm(a, b Point) float64 {
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// PlanRoute returns the visiting order of points as indexes, starting from origin when given.
+// It builds a nearest-neighbor route and improves it with 2-opt. The route is open: it ends at
+// the last stop instead of returning.
+func PlanRoute(origin *Point, points []Point) []int {
+	if len(points) == 0 {
+		return nil
+	}
+
+	// The origin, when given, is node 0 and stays first
+	var nodes []Point
+	offset := 0
+	if origin != nil {
+		nodes = append(nodes, *origin)
+		offset = 1
+	}
+	nodes = append(nodes, points...)
+
+	path := nearestNeighbor(nodes)
+	twoOpt(nodes, path, origin != nil)
+
+	order := make([]int, 0, len(points))
+	for _, node := range path {
+		if node >= offset {
+			order = append(order, node-offset)
+		}
+	}
+	return order
+}
+
+// nearestNeighbor starts at node 0 and always moves to the closest unvisited node
+func nearestNeighbor(nodes []Point) []int {
+	visited := make([]bool, len(nodes))
+	path := []int{0}
+	visited[0] = true
+
+	for len(path) < len(nodes) {
+		current := nodes[path[len(path)-1]]
+		next, best := -1, math.Inf(1)
+		for i, node := range nodes {
+			if visited[i] {
+				continue
+			}
+			if d := DistanceKm(current, node); d < best {
+				next, best = i, d
+			}
+		}
+		visited[next] = true
+		path = append(path, next)
+	}
+	return path
+}
+
+// twoOpt reverses segments of the path while that shortens it. With fixedStart the first node
+// (the origin) stays in place.
+func twoOpt(nodes []Point, path []int, fixedStart bool) {
+	dist := func(i, j int) float64 {
+		return DistanceKm(nodes[path[i]], nodes[path[j]])
+	}
+	first := 0
+	if fixedStart {
+		first = 1
+	}
+
+	for improved := true; improved; {
+		improved = false
+		for i := first; i < len(path)-1; i++ {
+			for j := i + 1; j < len(path); j++ {
+				// Reversing path[i..j] replaces the edges (i-1, i) and (j, j+1)
+				delta := 0.0
+				if i > 0 {
+					delta += dist(i-1, j) - dist(i-1, i)
+				}
+				if j+1 < len(path) {
+					delta += dist(i, j+1) - dist(j, j+1)
+				}
+				if delta < -1e-9 {
+					for a, b := i, j; a < b; a, b = a+1, b-1 {
+						path[a], path[b] = path[b], path[a]
+					}
+					improved = true
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package deliveries
+
+import (
+	"reflect"
+	"testing"
+)
+
+// pathLength is the length of the open path through nodes
+func pathLength(nodes []Point, path []int) float64 {
+	total := 0.0
+	for i := 1; i < len(path); i++ {
+		total += DistanceKm(nodes[path[i-1]], nodes[path[i]])
+	}
+	return total
+}
+
+func TestPlanRouteEmptyAndSingle(t *testing.T) {
+	origin := &Point{Latitude: -23.55, Longitude: -46.63}
+	single := []Point{{Latitude: -23.56, Longitude: -46.65}}
+
+	tests := []struct {
+		name   string
+		origin *Point
+		points []Point
+		want   []int
+	}{
+		{"no points", nil, nil, nil},
+		{"no points with origin", origin, []Point{}, nil},
+		{"single point", nil, single, []int{0}},
+		{"single point with origin", origin, single, []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PlanRoute(tt.origin, tt.points); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PlanRoute() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanRouteStartsFromOrigin(t *testing.T) {
+	// Stops on the equator; going west first and then east is the shortest open route from the origin
+	origin := &Point{Latitude: 0, Longitude: 0}
+	points := []Point{
+		{Latitude: 0, Longitude: 2.2},
+		{Latitude: 0, Longitude: -1},
+		{Latitude: 0, Longitude: 1.2},
+	}
+
+	want := []int{1, 2, 0}
+	if got := PlanRoute(origin, points); !reflect.DeepEqual(got, want) {
+		t.Errorf("PlanRoute() = %v, want %v", got, want)
+	}
+}
+
+func TestTwoOptRemovesCrossing(t *testing.T) {
+	// Corners of a small square; visiting them 0, 2, 1, 3 crosses the diagonals
+	nodes := []Point{
+		{Latitude: 0, Longitude: 0},
+		{Latitude: 0, Longitude: 0.01},
+		{Latitude: 0.01, Longitude: 0.01},
+		{Latitude: 0.01, Longitude: 0},
+	}
+	path := []int{0, 2, 1, 3}
+	before := pathLength(nodes, path)
+
+	twoOpt(nodes, path, true)
+
+	if want := []int{0, 1, 2, 3}; !reflect.DeepEqual(path, want) {
+		t.Errorf("twoOpt() path = %v, want %v", path, want)
+	}
+	if after := pathLength(nodes, path); after >= before {
+		t.Errorf("twoOpt() length = %.3f km, want less than %.3f km", after, before)
+	}
+}
+
+func TestTwoOptFixedStart(t *testing.T) {
+	// Starting from the west stop would be shorter, which only a free start may take
+	nodes := []Point{
+		{Latitude: 0, Longitude: 0},
+		{Latitude: 0, Longitude: -1},
+		{Latitude: 0, Longitude: 1.2},
+		{Latitude: 0, Longitude: 2.2},
+	}
+
+	fixed := []int{0, 1, 2, 3}
+	twoOpt(nodes, fixed, true)
+	if fixed[0] != 0 {
+		t.Errorf("twoOpt() with fixed start moved the origin: %v", fixed)
+	}
+
+	free := []int{0, 1, 2, 3}
+	twoOpt(nodes, free, false)
+	if free[0] == 0 {
+		t.Errorf("twoOpt() without fixed start kept the longer path %v", free)
+	}
+	if pathLength(nodes, free) >= pathLength(nodes, fixed) {
+		t.Errorf("twoOpt() without fixed start = %v, want a path shorter than %v", free, fixed)
+	}
+}
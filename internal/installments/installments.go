@@ -0,0 +1,177 @@
+package installments
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config holds the installment (parcelamento) rules offered for credit card payments
+type Config struct {
+	// MaxInstallments is the largest number of installments offered
+	MaxInstallments int `toml:"max_installments"`
+	// MinInstallmentValue is the smallest value a single installment may have
+	MinInstallmentValue float64 `toml:"min_installment_value"`
+	// InterestFreeInstallments is how many installments are offered without interest
+	InterestFreeInstallments int `toml:"interest_free_installments"`
+	// InterestFreeMinAmount is the smallest purchase that gets interest-free installments
+	InterestFreeMinAmount float64 `toml:"interest_free_min_amount"`
+	// MonthlyRates maps an installment count to its monthly interest rate in percent
+	MonthlyRates map[string]float64 `toml:"monthly_rates"`
+}
+
+// Plan is one installment option for a given amount
+type Plan struct {
+	Count        int     `json:"count"`
+	Value        float64 `json:"value"`
+	Total        float64 `json:"total"`
+	Interest     float64 `json:"interest"`
+	MonthlyRate  float64 `json:"monthlyRate"`
+	InterestFree bool    `json:"interestFree"`
+}
+
+var ErrInvalidPlan = errors.New("Parcelamento inválido para este valor.")
+
+var defaultConfig = Config{
+	MaxInstallments:          12,
+	MinInstallmentValue:      50,
+	InterestFreeInstallments: 10,
+	InterestFreeMinAmount:    300,
+	MonthlyRates: map[string]float64{
+		"2": 1.99, "3": 1.99, "4": 1.99, "5": 1.99, "6": 1.99,
+		"7": 1.99, "8": 1.99, "9": 1.99, "10": 1.99, "11": 1.99, "12": 1.99,
+	},
+}
+
+var (
+	mu     sync.RWMutex
+	config = defaultConfig
+)
+
+// Load reads the [installments] section of the config file, keeping the defaults when it is absent
+func Load(path string) error {
+	var file struct {
+		Installments *Config `toml:"installments"`
+	}
+	if _, err := toml.DecodeFile(path, &file); err != nil {
+		return fmt.Errorf("failed to read installment config: %v", err)
+	}
+	if file.Installments == nil {
+		return nil
+	}
+	return SetConfig(*file.Installments)
+}
+
+// SetConfig replaces the installment rules
+func SetConfig(cfg Config) error {
+	if cfg.MaxInstallments < 1 {
+		return fmt.Errorf("max_installments must be at least 1")
+	}
+	if cfg.InterestFreeInstallments < 1 {
+		cfg.InterestFreeInstallments = 1
+	}
+	for count, rate := range cfg.MonthlyRates {
+		if _, err := strconv.Atoi(count); err != nil {
+			return fmt.Errorf("invalid installment count in monthly_rates: %q", count)
+		}
+		if rate < 0 {
+			return fmt.Errorf("negative monthly rate for %s installments", count)
+		}
+	}
+
+	mu.Lock()
+	config = cfg
+	mu.Unlock()
+	return nil
+}
+
+func currentConfig() Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return config
+}
+
+// Plans lists every installment option available for the amount, starting with 1x
+func Plans(amount float64) []Plan {
+	if amount <= 0 {
+		return nil
+	}
+
+	cfg := currentConfig()
+	plans := []Plan{{Count: 1, Value: amount, Total: amount, InterestFree: true}}
+	for count := 2; count <= cfg.MaxInstallments; count++ {
+		plan, ok := buildPlan(cfg, amount, count)
+		if !ok {
+			continue
+		}
+		if plan.Value < cfg.MinInstallmentValue {
+			break
+		}
+		plans = append(plans, plan)
+	}
+	return plans
+}
+
+// PlanFor returns the option with the given number of installments, if it is offered for the amount
+func PlanFor(amount float64, count int) (Plan, error) {
+	for _, plan := range Plans(amount) {
+		if plan.Count == count {
+			return plan, nil
+		}
+	}
+	return Plan{}, ErrInvalidPlan
+}
+
+// Highlight returns the option shown next to a price: the longest interest-free plan,
+// or the longest plan overall when no interest-free split is available
+func Highlight(amount float64) Plan {
+	plans := Plans(amount)
+	if len(plans) == 0 {
+		return Plan{}
+	}
+
+	best := plans[len(plans)-1]
+	for i := len(plans) - 1; i >= 0; i-- {
+		if plans[i].InterestFree {
+			if plans[i].Count > 1 {
+				best = plans[i]
+			}
+			break
+		}
+	}
+	return best
+}
+
+func buildPlan(cfg Config, amount float64, count int) (Plan, bool) {
+	if count <= cfg.InterestFreeInstallments && amount >= cfg.InterestFreeMinAmount {
+		return Plan{Count: count, Value: roundCents(amount / float64(count)), Total: amount, InterestFree: true}, true
+	}
+
+	rate, ok := cfg.MonthlyRates[strconv.Itoa(count)]
+	if !ok {
+		return Plan{}, false
+	}
+	if rate == 0 {
+		return Plan{Count: count, Value: roundCents(amount / float64(count)), Total: amount, InterestFree: true}, true
+	}
+
+	// Price table (French amortization): fixed installments including interest
+	i := rate / 100
+	value := roundCents(amount * i / (1 - math.Pow(1+i, -float64(count))))
+	total := roundCents(value * float64(count))
+	return Plan{
+		Count:       count,
+		Value:       value,
+		Total:       total,
+		Interest:    roundCents(total - amount),
+		MonthlyRate: rate,
+	}, true
+}
+
+func roundCents(value float64) float64 {
+	return math.Round(value*100) / 100
+}
@@ -0,0 +1,168 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Message is an HTML email addressed to a single recipient
+type Message struct {
+	To      string
+	Subject string
+	HTML    string
+}
+
+// Sender delivers email messages
+type Sender interface {
+	Send(msg Message) error
+}
+
+var sender Sender
+
+// SetSender replaces the sender used by Send
+func SetSender(s Sender) {
+	sender = s
+}
+
+// Send delivers a message with the configured sender.
+// Without SMTP_HOST the message is written to MAIL_DIR when set (one HTML file per message);
+// otherwise only its recipient and subject are logged and the message is dropped.
+func Send(msg Message) error {
+	if sender == nil {
+		sender = senderFromEnv()
+	}
+	if strings.TrimSpace(msg.To) == "" {
+		return fmt.Errorf("email recipient is empty")
+	}
+	if strings.ContainsAny(msg.To+msg.Subject, "\r\n") {
+		return fmt.Errorf("email headers must not contain line breaks")
+	}
+	return sender.Send(msg)
+}
+
+// SendTemplate renders an email template from web/templates/emails and sends it
+func SendTemplate(to, subject, name string, data interface{}) error {
+	body, err := Render(name, data)
+	if err != nil {
+		return err
+	}
+	return Send(Message{To: to, Subject: subject, HTML: body})
+}
+
+// Render executes an email template from web/templates/emails
+func Render(name string, data interface{}) (string, error) {
+	tmpl, err := template.ParseFiles("web/templates/emails/layout.html", "web/templates/emails/"+name)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse email template: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "layout", data); err != nil {
+		return "", fmt.Errorf("failed to render email template: %v", err)
+	}
+	return buf.String(), nil
+}
+
+func senderFromEnv() Sender {
+	host := strings.TrimSpace(os.Getenv("SMTP_HOST"))
+	if host == "" {
+		if dir := strings.TrimSpace(os.Getenv("MAIL_DIR")); dir != "" {
+			return FileSender{Dir: dir}
+		}
+		return LogSender{}
+	}
+
+	port := strings.TrimSpace(os.Getenv("SMTP_PORT"))
+	if port == "" {
+		port = "587"
+	}
+
+	from := strings.TrimSpace(os.Getenv("MAIL_FROM"))
+	if from == "" {
+		from = "Lojagtec <nao-responda@lojagtec.com.br>"
+	}
+
+	return SMTPSender{
+		Addr:     net.JoinHostPort(host, port),
+		Host:     host,
+		Username: strings.TrimSpace(os.Getenv("SMTP_USERNAME")),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     from,
+	}
+}
+
+// LogSender logs the recipient and subject of messages instead of delivering them. The body is
+// left out: it holds order links and password reset links that must not end up in the logs.
+type LogSender struct{}
+
+func (LogSender) Send(msg Message) error {
+	log.Printf("[mailer] SMTP_HOST not set, email dropped: to=%s subject=%q", msg.To, msg.Subject)
+	return nil
+}
+
+// FileSender writes each message to an HTML file in Dir, so development emails can be opened in a browser
+type FileSender struct {
+	Dir string
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9@._-]+`)
+
+func (s FileSender) Send(msg Message) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create mail directory: %v", err)
+	}
+
+	name := fmt.Sprintf("%s-%s.html", time.Now().Format("20060102-150405.000000"), unsafeFileChars.ReplaceAllString(msg.To, "_"))
+	header := fmt.Sprintf("<!--\nTo: %s\nSubject: %s\n-->\n", msg.To, msg.Subject)
+	if err := os.WriteFile(filepath.Join(s.Dir, name), []byte(header+msg.HTML), 0644); err != nil {
+		return fmt.Errorf("failed to write email file: %v", err)
+	}
+	log.Printf("[mailer] to=%s subject=%q written to %s", msg.To, msg.Subject, filepath.Join(s.Dir, name))
+	return nil
+}
+
+// SMTPSender delivers messages through an SMTP server (STARTTLS is used when offered)
+type SMTPSender struct {
+	Addr     string
+	Host     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s SMTPSender) Send(msg Message) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	fromAddress := s.From
+	if start, end := strings.LastIndex(s.From, "<"), strings.LastIndex(s.From, ">"); start >= 0 && end > start {
+		fromAddress = s.From[start+1 : end]
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", s.From)
+	fmt.Fprintf(&body, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&body, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\n")
+	body.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
+	body.WriteString("\r\n")
+	body.WriteString(msg.HTML)
+
+	if err := smtp.SendMail(s.Addr, auth, fromAddress, []string{msg.To}, body.Bytes()); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return nil
+}
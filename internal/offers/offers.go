@@ -312,6 +312,41 @@ func GetOfferByProductID(productID int) (*Offer, error) {
 	return &o, nil
 }
 
+// GetOfferByID retrieves a single offer by its ID
+func GetOfferByID(offerID int) (*Offer, error) {
+	query := `
+		SELECT o.id, o.product_id, i.name, i.price, o.offer_price,
+		       c.slug, c.name, o.start_date, o.end_date, o.is_active
+		FROM offers o
+		JOIN products p ON o.product_id = p.id
+		JOIN items i ON p.item_id = i.id
+		JOIN categories c ON p.category_id = c.id
+		WHERE o.id = $1
+	`
+
+	var o Offer
+	var startDate, endDate sql.NullTime
+	err := db.QueryRow(query, offerID).Scan(
+		&o.ID, &o.ProductID, &o.Name, &o.Price, &o.OfferPrice,
+		&o.Category, &o.CategoryName, &startDate, &endDate, &o.IsActive,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("oferta não encontrada")
+		}
+		return nil, err
+	}
+
+	if startDate.Valid {
+		o.StartDate = &startDate.Time
+	}
+	if endDate.Valid {
+		o.EndDate = &endDate.Time
+	}
+
+	return &o, nil
+}
+
 // GetActiveOfferByProductID retrieves an active offer for a product if one exists
 func GetActiveOfferByProductID(productID int) (*Offer, error) {
 	query := `
@@ -0,0 +1,178 @@
+package orders
+
+import (
+	"fmt"
+	"time"
+)
+
+// PaymentExpiryRule controls what happens around the deadline of an async payment method
+type PaymentExpiryRule struct {
+	// Grace is how long after the deadline a payment may still be confirmed by the bank
+	Grace time.Duration
+	// ReminderLead is how long before the deadline the customer is reminded
+	ReminderLead time.Duration
+}
+
+// PaymentExpiryRules lists the payment methods whose orders expire when left unpaid.
+// Boletos paid on the due date take up to 3 business days to be confirmed.
+var PaymentExpiryRules = map[string]PaymentExpiryRule{
+	"boleto": {Grace: 4 * 24 * time.Hour, ReminderLead: 24 * time.Hour},
+	"pix":    {Grace: 30 * time.Minute, ReminderLead: 10 * time.Minute},
+}
+
+// awaitingPaymentCondition matches orders still waiting for the customer to pay
+const awaitingPaymentCondition = `status = 'pending' AND COALESCE(payment_status, 'pending') IN ('pending', 'waiting')`
+
+// SetOrderPaymentExpiry stores the deadline of the current payment and re-arms the reminder
+func SetOrderPaymentExpiry(orderID int, expiresAt time.Time) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	_, err := db.Exec(`
+		UPDATE orders
+		SET payment_expires_at = $1, payment_reminder_sent_at = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+	`, expiresAt, orderID)
+	return err
+}
+
+// GetOrdersDueForPaymentReminder returns orders with a generated boleto/PIX whose deadline is close
+func GetOrdersDueForPaymentReminder(now time.Time) ([]Order, error) {
+	var due []Order
+	for method, rule := range PaymentExpiryRules {
+		ids, err := queryOrderIDs(`
+			SELECT id FROM orders
+			WHERE status = 'pending' AND payment_status = 'waiting'
+			  AND payment_method = $1
+			  AND payment_reminder_sent_at IS NULL
+			  AND payment_expires_at > $2
+			  AND payment_expires_at <= $3
+		`, method, now, now.Add(rule.ReminderLead))
+		if err != nil {
+			return nil, err
+		}
+		orders, err := getOrdersByIDs(ids)
+		if err != nil {
+			return nil, err
+		}
+		due = append(due, orders...)
+	}
+	return due, nil
+}
+
+// ClaimPaymentReminder marks the reminder of an order as sent.
+// It reports false when another run already claimed it, so each customer gets a single reminder.
+func ClaimPaymentReminder(orderID int) (bool, error) {
+	if db == nil {
+		return false, fmt.Errorf("database not initialized")
+	}
+
+	result, err := db.Exec(`
+		UPDATE orders
+		SET payment_reminder_sent_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND payment_reminder_sent_at IS NULL
+	`, orderID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// GetExpiredUnpaidOrders returns unpaid orders whose payment deadline and grace period have passed
+func GetExpiredUnpaidOrders(now time.Time) ([]Order, error) {
+	var expired []Order
+	for method, rule := range PaymentExpiryRules {
+		ids, err := queryOrderIDs(`
+			SELECT id FROM orders
+			WHERE `+awaitingPaymentCondition+`
+			  AND payment_method = $1
+			  AND payment_expires_at < $2
+		`, method, now.Add(-rule.Grace))
+		if err != nil {
+			return nil, err
+		}
+		orders, err := getOrdersByIDs(ids)
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, orders...)
+	}
+	return expired, nil
+}
+
+// CancelExpiredOrder cancels an order whose payment deadline passed, expiring its open attempts.
+// It reports false when the order was paid or changed in the meantime.
+func CancelExpiredOrder(orderID int) (bool, error) {
+	if db == nil {
+		return false, fmt.Errorf("database not initialized")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to start transaction: %v", err)
+	}
+
+	result, err := tx.Exec(`
+		UPDATE orders
+		SET status = 'cancelled', payment_status = 'expired', updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND `+awaitingPaymentCondition, orderID)
+	if err != nil {
+		_ = tx.Rollback()
+		return false, fmt.Errorf("failed to cancel order: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		_ = tx.Rollback()
+		return false, nil
+	}
+
+	_, err = tx.Exec(`
+		UPDATE payment_attempts
+		SET status = 'expired', updated_at = CURRENT_TIMESTAMP
+		WHERE order_id = $1 AND status IN ('pending', 'waiting')
+	`, orderID)
+	if err != nil {
+		_ = tx.Rollback()
+		return false, fmt.Errorf("failed to expire payment attempts: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit order cancellation: %v", err)
+	}
+	return true, nil
+}
+
+func queryOrderIDs(query string, args ...interface{}) ([]int, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func getOrdersByIDs(ids []int) ([]Order, error) {
+	orders := make([]Order, 0, len(ids))
+	for _, id := range ids {
+		order, err := GetOrderByID(id)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, *order)
+	}
+	return orders, nil
+}
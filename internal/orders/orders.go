@@ -1,13 +1,19 @@
 package orders
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"lojagtec/internal/installments"
+
+	"github.com/lib/pq"
 )
 
 // Order represents a customer order
@@ -28,10 +34,19 @@ type Order struct {
 	PaymentMethod   string    `json:"payment_method"`
 	PaymentStatus   string    `json:"payment_status"`
 	StripePaymentID string    `json:"stripe_payment_id"`
+	AccessToken     string    `json:"-"`
 	TotalAmount     float64   `json:"total_amount"`
 	Status          string    `json:"status"`
 	CreatedAt       time.Time `json:"created_at"`
 	UpdatedAt       time.Time `json:"updated_at"`
+
+	// Installment plan for credit card orders; TotalAmount already includes the interest
+	Installments        int     `json:"installments"`
+	InstallmentValue    float64 `json:"installment_value"`
+	InstallmentInterest float64 `json:"installment_interest"`
+
+	// Deadline of the current boleto/PIX payment, after which the unpaid order is cancelled
+	PaymentExpiresAt *time.Time `json:"payment_expires_at,omitempty"`
 }
 
 // OrderItem represents an item in an order
@@ -60,6 +75,7 @@ type CheckoutForm struct {
 	Apartment     string `json:"apartment"`
 	CPF           string `json:"cpf"`
 	PaymentMethod string `json:"payment_method"`
+	Installments  int    `json:"installments"`
 
 	// Cart items
 	CartItems []CartItem `json:"cart_items"`
@@ -71,6 +87,9 @@ type CartItem struct {
 	Name     string  `json:"name"`
 	Price    float64 `json:"price"`
 	Quantity int     `json:"quantity"`
+
+	// IsOnOffer marks items sold at an offer price, kept on the order for the sales reports
+	IsOnOffer bool `json:"is_on_offer"`
 }
 
 // ValidationError represents a field validation error
@@ -87,7 +106,8 @@ type ValidationResult struct {
 
 var db *sql.DB
 
-const installationServiceName = "Serviço de Instalação"
+// InstallationServiceName is the item name of the optional installation service
+const InstallationServiceName = "Serviço de Instalação"
 
 var (
 	ErrInstallationServiceUnavailable = errors.New("No momento não conseguimos oferecer o serviço de instalação.")
@@ -392,6 +412,15 @@ func GenerateOrderNumber() string {
 	return fmt.Sprintf("ORD-%d-%s", timestamp, random)
 }
 
+// generateAccessToken creates the secret used in customer-facing order links
+func generateAccessToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate order access token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
 func resolveCartItems(items []CartItem) ([]CartItem, error) {
 	resolved := make([]CartItem, len(items))
 	copy(resolved, items)
@@ -409,7 +438,7 @@ func resolveCartItems(items []CartItem) ([]CartItem, error) {
 		err := db.QueryRow("SELECT id FROM items WHERE name = $1", item.Name).Scan(&itemID)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				if item.Name == installationServiceName {
+				if item.Name == InstallationServiceName {
 					return nil, ErrInstallationServiceUnavailable
 				}
 				return nil, ErrInvalidCartItem
@@ -450,14 +479,25 @@ func CreateOrder(form CheckoutForm) (*Order, error) {
 		totalAmount += item.Price * float64(item.Quantity)
 	}
 
+	plan, err := installmentPlanFor(form, totalAmount)
+	if err != nil {
+		return nil, err
+	}
+	totalAmount = plan.Total
+
 	orderNumber := GenerateOrderNumber()
+	accessToken, err := generateAccessToken()
+	if err != nil {
+		return nil, err
+	}
 
 	query := `
 		INSERT INTO orders (
 			order_number, email, phone, first_name, last_name, address,
 			neighborhood, city, state, zip_code, apartment, cpf_cnpj,
-			payment_method, total_amount, status
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+			payment_method, total_amount, status, access_token,
+			installments, installment_value, installment_interest
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
 		RETURNING id, created_at, updated_at
 	`
 
@@ -479,6 +519,10 @@ func CreateOrder(form CheckoutForm) (*Order, error) {
 		form.PaymentMethod,
 		totalAmount,
 		"pending",
+		accessToken,
+		plan.Count,
+		plan.Value,
+		plan.Interest,
 	).Scan(&order.ID, &order.CreatedAt, &order.UpdatedAt)
 
 	if err != nil {
@@ -500,14 +544,18 @@ func CreateOrder(form CheckoutForm) (*Order, error) {
 	order.CPF = form.CPF
 	order.PaymentMethod = form.PaymentMethod
 	order.TotalAmount = totalAmount
+	order.Installments = plan.Count
+	order.InstallmentValue = plan.Value
+	order.InstallmentInterest = plan.Interest
 	order.Status = "pending"
+	order.AccessToken = accessToken
 
 	// Create order items
 	for _, item := range resolvedItems {
 		_, err := tx.Exec(`
-			INSERT INTO order_items (order_id, item_id, item_name, quantity, unit_price, total_price)
-			VALUES ($1, $2, $3, $4, $5, $6)
-		`, order.ID, item.ID, item.Name, item.Quantity, item.Price, item.Price*float64(item.Quantity))
+			INSERT INTO order_items (order_id, item_id, item_name, quantity, unit_price, total_price, is_on_offer)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, order.ID, item.ID, item.Name, item.Quantity, item.Price, item.Price*float64(item.Quantity), item.IsOnOffer)
 
 		if err != nil {
 			return nil, fmt.Errorf("failed to create order item: %v", err)
@@ -522,7 +570,17 @@ func CreateOrder(form CheckoutForm) (*Order, error) {
 	return &order, nil
 }
 
-// UpdateOrderPaymentStatus updates the payment status of an order
+// installmentPlanFor resolves the installment plan chosen at checkout; only credit cards are split
+func installmentPlanFor(form CheckoutForm, amount float64) (installments.Plan, error) {
+	count := form.Installments
+	if form.PaymentMethod != "credit_card" || count < 1 {
+		count = 1
+	}
+	return installments.PlanFor(amount, count)
+}
+
+// UpdateOrderPaymentStatus updates the payment status of an unpaid order. Cancelled and paid
+// orders keep theirs; payments received go through ApplyOrderPayment.
 func UpdateOrderPaymentStatus(orderID int, paymentStatus, stripePaymentID string) error {
 	if db == nil {
 		return fmt.Errorf("database not initialized")
@@ -531,7 +589,7 @@ func UpdateOrderPaymentStatus(orderID int, paymentStatus, stripePaymentID string
 	query := `
 		UPDATE orders 
 		SET payment_status = $1, stripe_payment_id = $2, updated_at = CURRENT_TIMESTAMP
-		WHERE id = $3
+		WHERE id = $3 AND status <> 'cancelled' AND COALESCE(payment_status, 'pending') <> 'paid'
 	`
 
 	_, err := db.Exec(query, paymentStatus, stripePaymentID, orderID)
@@ -583,6 +641,25 @@ func UpdateOrderStatus(orderID int, status string) error {
 	return err
 }
 
+// CompleteDeliveredOrder completes a delivered order within the caller's transaction. Only
+// paid orders still in processing or shipped are completed; it returns false for any other
+// order (cancelled meanwhile, for one), which is left unchanged.
+func CompleteDeliveredOrder(tx *sql.Tx, orderID int) (bool, error) {
+	result, err := tx.Exec(`
+		UPDATE orders
+		SET status = 'completed', updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status IN ('processing', 'shipped') AND payment_status = 'paid'
+	`, orderID)
+	if err != nil {
+		return false, fmt.Errorf("failed to complete order: %v", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to complete order: %v", err)
+	}
+	return rows > 0, nil
+}
+
 // GetOrderByID retrieves an order by ID
 func GetOrderByID(orderID int) (*Order, error) {
 	if db == nil {
@@ -592,17 +669,22 @@ func GetOrderByID(orderID int) (*Order, error) {
 	query := `
 		SELECT id, order_number, email, phone, first_name, last_name, address,
 		       neighborhood, city, state, zip_code, apartment, cpf_cnpj, payment_method,
-		       payment_status, stripe_payment_id, total_amount, status, created_at, updated_at
+		       payment_status, stripe_payment_id, total_amount, status, created_at, updated_at,
+		       COALESCE(access_token, ''), installments, COALESCE(installment_value, total_amount),
+		       installment_interest, payment_expires_at
 		FROM orders WHERE id = $1
 	`
 
 	var order Order
 	var stripePaymentID sql.NullString
+	var paymentExpiresAt sql.NullTime
 	err := db.QueryRow(query, orderID).Scan(
 		&order.ID, &order.OrderNumber, &order.Email, &order.Phone, &order.FirstName,
 		&order.LastName, &order.Address, &order.Neighborhood, &order.City, &order.State,
 		&order.ZipCode, &order.Apartment, &order.CPF, &order.PaymentMethod, &order.PaymentStatus,
 		&stripePaymentID, &order.TotalAmount, &order.Status, &order.CreatedAt, &order.UpdatedAt,
+		&order.AccessToken, &order.Installments, &order.InstallmentValue, &order.InstallmentInterest,
+		&paymentExpiresAt,
 	)
 
 	if err != nil {
@@ -613,6 +695,9 @@ func GetOrderByID(orderID int) (*Order, error) {
 	if stripePaymentID.Valid {
 		order.StripePaymentID = stripePaymentID.String
 	}
+	if paymentExpiresAt.Valid {
+		order.PaymentExpiresAt = &paymentExpiresAt.Time
+	}
 
 	return &order, nil
 }
@@ -656,6 +741,127 @@ type OrderFilters struct {
 	PaymentStatus string
 	Limit         int
 	Offset        int
+
+	// AwaitingPayment keeps only pending orders whose payment was not made yet
+	AwaitingPayment bool
+
+	// Search matches the order number, customer name, email, phone or CPF
+	Search        string
+	PaymentMethod string
+	Neighborhood  string
+	// Product matches the name of an item in the order
+	Product string
+	// From and To limit the creation date: From inclusive, To exclusive
+	From *time.Time
+	To   *time.Time
+
+	// IDs keeps only the given orders
+	IDs []int
+
+	// SortBy is one of the OrderSortColumns keys (created_at by default); SortDesc reverses it
+	SortBy   string
+	SortDesc bool
+}
+
+// OrderSortColumns maps the sortable columns of the admin order list to their ORDER BY expression
+var OrderSortColumns = map[string]string{
+	"created_at":   "orders.created_at",
+	"order_number": "order_number",
+	"customer":     "LOWER(first_name || ' ' || last_name)",
+	"total_amount": "total_amount",
+	"status":       "status",
+}
+
+var nonDigits = regexp.MustCompile(`\D`)
+
+// likePattern escapes the LIKE wildcards of a search term and wraps it in %
+func likePattern(term string) string {
+	term = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term)
+	return "%" + term + "%"
+}
+
+// whereClause builds the WHERE clause shared by the order list, count, totals and export. The
+// searches use the trigram indexes of migration 13_order_search_indexes.sql. Columns shared
+// with order_items are qualified so the export can join the items.
+func (filters OrderFilters) whereClause() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if strings.TrimSpace(filters.Status) != "" {
+		conditions = append(conditions, "status = "+arg(filters.Status))
+	}
+
+	if strings.TrimSpace(filters.PaymentStatus) != "" {
+		conditions = append(conditions, "payment_status = "+arg(filters.PaymentStatus))
+	}
+
+	if filters.AwaitingPayment {
+		conditions = append(conditions, awaitingPaymentCondition)
+	}
+
+	if search := strings.TrimSpace(filters.Search); search != "" {
+		pattern := arg(likePattern(search))
+		matches := []string{
+			"order_number ILIKE " + pattern,
+			"(first_name || ' ' || last_name) ILIKE " + pattern,
+			"email ILIKE " + pattern,
+		}
+		// Phones and CPFs are compared digits only, whatever punctuation was typed or stored
+		if digits := nonDigits.ReplaceAllString(search, ""); len(digits) >= 3 {
+			digitsPattern := arg(likePattern(digits))
+			matches = append(matches,
+				"regexp_replace(phone, '\\D', '', 'g') LIKE "+digitsPattern,
+				"regexp_replace(COALESCE(cpf_cnpj, ''), '\\D', '', 'g') LIKE "+digitsPattern,
+			)
+		}
+		conditions = append(conditions, "("+strings.Join(matches, " OR ")+")")
+	}
+
+	if strings.TrimSpace(filters.PaymentMethod) != "" {
+		conditions = append(conditions, "payment_method = "+arg(filters.PaymentMethod))
+	}
+
+	if strings.TrimSpace(filters.Neighborhood) != "" {
+		conditions = append(conditions, "LOWER(TRIM(neighborhood)) = LOWER(TRIM("+arg(filters.Neighborhood)+"))")
+	}
+
+	if product := strings.TrimSpace(filters.Product); product != "" {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM order_items oi WHERE oi.order_id = orders.id AND oi.item_name ILIKE "+arg(likePattern(product))+")")
+	}
+
+	if len(filters.IDs) > 0 {
+		conditions = append(conditions, "orders.id = ANY("+arg(pq.Array(filters.IDs))+")")
+	}
+
+	if filters.From != nil {
+		conditions = append(conditions, "orders.created_at >= "+arg(*filters.From))
+	}
+
+	if filters.To != nil {
+		conditions = append(conditions, "orders.created_at < "+arg(*filters.To))
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// orderByClause returns the ORDER BY clause of the admin order list
+func (filters OrderFilters) orderByClause() string {
+	column, ok := OrderSortColumns[filters.SortBy]
+	if !ok {
+		return "ORDER BY orders.created_at DESC, orders.id DESC"
+	}
+	direction := "ASC"
+	if filters.SortDesc {
+		direction = "DESC"
+	}
+	return fmt.Sprintf("ORDER BY %s %s, orders.id %s", column, direction, direction)
 }
 
 // OrderTotals represents summary totals for orders
@@ -687,24 +893,7 @@ func GetOrderTotals(filters OrderFilters) (OrderTotals, error) {
 		FROM orders
 	`
 
-	var conditions []string
-	var args []interface{}
-
-	if strings.TrimSpace(filters.Status) != "" {
-		args = append(args, filters.Status)
-		conditions = append(conditions, fmt.Sprintf("status = $%d", len(args)))
-	}
-
-	if strings.TrimSpace(filters.PaymentStatus) != "" {
-		args = append(args, filters.PaymentStatus)
-		conditions = append(conditions, fmt.Sprintf("payment_status = $%d", len(args)))
-	}
-
-	whereClause := ""
-	if len(conditions) > 0 {
-		whereClause = "WHERE " + strings.Join(conditions, " AND ")
-	}
-
+	whereClause, args := filters.whereClause()
 	query := fmt.Sprintf("%s %s", baseQuery, whereClause)
 
 	var totals OrderTotals
@@ -724,6 +913,48 @@ func GetOrderTotals(filters OrderFilters) (OrderTotals, error) {
 	return totals, nil
 }
 
+// CountOrders returns how many orders match the filters, ignoring Limit and Offset
+func CountOrders(filters OrderFilters) (int, error) {
+	if db == nil {
+		return 0, fmt.Errorf("database not initialized")
+	}
+
+	whereClause, args := filters.whereClause()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM orders "+whereClause, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count orders: %v", err)
+	}
+	return count, nil
+}
+
+// GetNeighborhoods returns the distinct delivery neighborhoods of the orders, for the admin filter
+func GetNeighborhoods() ([]string, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	rows, err := db.Query(`
+		SELECT DISTINCT INITCAP(TRIM(neighborhood)) AS name
+		FROM orders
+		WHERE TRIM(neighborhood) <> ''
+		ORDER BY name
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list neighborhoods: %v", err)
+	}
+	defer rows.Close()
+
+	var neighborhoods []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		neighborhoods = append(neighborhoods, name)
+	}
+	return neighborhoods, rows.Err()
+}
+
 // GetOrders retrieves orders with optional filters
 func GetOrders(filters OrderFilters) ([]Order, error) {
 	if db == nil {
@@ -740,37 +971,16 @@ func GetOrders(filters OrderFilters) ([]Order, error) {
 		offset = 0
 	}
 
-	baseQuery := `
-		SELECT id, order_number, email, phone, first_name, last_name, address,
-		       neighborhood, city, state, zip_code, apartment, cpf_cnpj, payment_method,
-		       payment_status, stripe_payment_id, total_amount, status, created_at, updated_at
-		FROM orders
-	`
-
-	var conditions []string
-	var args []interface{}
-
-	if strings.TrimSpace(filters.Status) != "" {
-		args = append(args, filters.Status)
-		conditions = append(conditions, fmt.Sprintf("status = $%d", len(args)))
-	}
-
-	if strings.TrimSpace(filters.PaymentStatus) != "" {
-		args = append(args, filters.PaymentStatus)
-		conditions = append(conditions, fmt.Sprintf("payment_status = $%d", len(args)))
-	}
+	baseQuery := "SELECT " + orderListColumns + " FROM orders"
 
-	whereClause := ""
-	if len(conditions) > 0 {
-		whereClause = "WHERE " + strings.Join(conditions, " AND ")
-	}
+	whereClause, args := filters.whereClause()
 
 	args = append(args, limit)
 	limitPlaceholder := len(args)
 	args = append(args, offset)
 	offsetPlaceholder := len(args)
 
-	query := fmt.Sprintf("%s %s ORDER BY created_at DESC LIMIT $%d OFFSET $%d", baseQuery, whereClause, limitPlaceholder, offsetPlaceholder)
+	query := fmt.Sprintf("%s %s %s LIMIT $%d OFFSET $%d", baseQuery, whereClause, filters.orderByClause(), limitPlaceholder, offsetPlaceholder)
 
 	rows, err := db.Query(query, args...)
 	if err != nil {
@@ -781,25 +991,135 @@ func GetOrders(filters OrderFilters) ([]Order, error) {
 	var ordersList []Order
 	for rows.Next() {
 		var order Order
-		var stripePaymentID sql.NullString
-		err := rows.Scan(
-			&order.ID, &order.OrderNumber, &order.Email, &order.Phone, &order.FirstName,
-			&order.LastName, &order.Address, &order.Neighborhood, &order.City, &order.State,
-			&order.ZipCode, &order.Apartment, &order.CPF, &order.PaymentMethod, &order.PaymentStatus,
-			&stripePaymentID, &order.TotalAmount, &order.Status, &order.CreatedAt, &order.UpdatedAt,
-		)
-		if err != nil {
+		if err := rows.Scan(order.listScanDest()...); err != nil {
 			return nil, err
 		}
-		if stripePaymentID.Valid {
-			order.StripePaymentID = stripePaymentID.String
-		}
 		ordersList = append(ordersList, order)
 	}
 
 	return ordersList, nil
 }
 
+// orderListColumns are the columns scanned by listScanDest
+const orderListColumns = `
+	orders.id, orders.order_number, orders.email, orders.phone, orders.first_name, orders.last_name,
+	orders.address, orders.neighborhood, orders.city, orders.state, orders.zip_code, orders.apartment,
+	COALESCE(orders.cpf_cnpj, ''), orders.payment_method, orders.payment_status,
+	COALESCE(orders.stripe_payment_id, ''), orders.total_amount, orders.status, orders.created_at,
+	orders.updated_at, orders.installments, COALESCE(orders.installment_value, orders.total_amount),
+	orders.payment_expires_at
+`
+
+// listScanDest returns the scan destinations of orderListColumns
+func (order *Order) listScanDest() []interface{} {
+	return []interface{}{
+		&order.ID, &order.OrderNumber, &order.Email, &order.Phone, &order.FirstName,
+		&order.LastName, &order.Address, &order.Neighborhood, &order.City, &order.State,
+		&order.ZipCode, &order.Apartment, &order.CPF, &order.PaymentMethod, &order.PaymentStatus,
+		&order.StripePaymentID, &order.TotalAmount, &order.Status, &order.CreatedAt, &order.UpdatedAt,
+		&order.Installments, &order.InstallmentValue, &order.PaymentExpiresAt,
+	}
+}
+
+// EachOrder calls fn for every order matching the filters, in the list order and ignoring
+// Limit and Offset, without loading them all. With withItems, fn is called once per item of
+// each order (and once with a nil item for orders without items).
+func EachOrder(filters OrderFilters, withItems bool, fn func(Order, *OrderItem) error) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	whereClause, args := filters.whereClause()
+	orderBy := filters.orderByClause()
+	query := "SELECT " + orderListColumns + " FROM orders " + whereClause + " " + orderBy
+	if withItems {
+		query = "SELECT " + orderListColumns + `,
+			oi.id, oi.item_id, oi.item_name, oi.quantity, oi.unit_price, oi.total_price
+			FROM orders
+			LEFT JOIN order_items oi ON oi.order_id = orders.id
+			` + whereClause + " " + orderBy + ", oi.id"
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query orders: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var order Order
+		dest := order.listScanDest()
+		if !withItems {
+			if err := rows.Scan(dest...); err != nil {
+				return err
+			}
+			if err := fn(order, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var itemID, catalogItemID, quantity sql.NullInt64
+		var itemName sql.NullString
+		var unitPrice, totalPrice sql.NullFloat64
+		dest = append(dest, &itemID, &catalogItemID, &itemName, &quantity, &unitPrice, &totalPrice)
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		var item *OrderItem
+		if itemID.Valid {
+			item = &OrderItem{
+				ID:         int(itemID.Int64),
+				OrderID:    order.ID,
+				ItemID:     int(catalogItemID.Int64),
+				ItemName:   itemName.String,
+				Quantity:   int(quantity.Int64),
+				UnitPrice:  unitPrice.Float64,
+				TotalPrice: totalPrice.Float64,
+			}
+		}
+		if err := fn(order, item); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// OrderDocument is an order with its items, for the printed packing slips and service orders
+type OrderDocument struct {
+	Order
+	Items []OrderItem
+}
+
+// NeedsInstallation reports whether the order includes the installation service
+func (d OrderDocument) NeedsInstallation() bool {
+	for _, item := range d.Items {
+		if item.ItemName == InstallationServiceName {
+			return true
+		}
+	}
+	return false
+}
+
+// GetOrderDocuments loads the orders matching the filters with their items, in the list order
+func GetOrderDocuments(filters OrderFilters) ([]OrderDocument, error) {
+	var documents []OrderDocument
+	err := EachOrder(filters, true, func(order Order, item *OrderItem) error {
+		if len(documents) == 0 || documents[len(documents)-1].ID != order.ID {
+			documents = append(documents, OrderDocument{Order: order})
+		}
+		if item != nil {
+			last := &documents[len(documents)-1]
+			last.Items = append(last.Items, *item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return documents, nil
+}
+
 // GetOrderWithItems retrieves an order and its items
 func GetOrderWithItems(orderID int) (*Order, []OrderItem, error) {
 	order, err := GetOrderByID(orderID)
@@ -0,0 +1,320 @@
+package orders
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// PaymentAttempt represents one attempt to pay an order (a checkout session, a PIX charge...)
+type PaymentAttempt struct {
+	ID            int        `json:"id"`
+	OrderID       int        `json:"order_id"`
+	Provider      string     `json:"provider"`
+	PaymentMethod string     `json:"payment_method"`
+	ExternalID    string     `json:"external_id"`
+	Status        string     `json:"status"`
+	Amount        float64    `json:"amount"`
+	Payload       string     `json:"payload,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+var (
+	ErrOrderNotFound       = errors.New("Pedido não encontrado.")
+	ErrPaymentNotRetryable = errors.New("Este pedido não aceita um novo pagamento.")
+)
+
+var validPaymentMethods = map[string]bool{
+	"credit_card": true,
+	"boleto":      true,
+	"pix":         true,
+}
+
+// GetOrderForCustomer retrieves an order by number, checking the access token from the customer link
+func GetOrderForCustomer(orderNumber, accessToken string) (*Order, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	if orderNumber == "" || accessToken == "" {
+		return nil, ErrOrderNotFound
+	}
+
+	var orderID int
+	err := db.QueryRow("SELECT id FROM orders WHERE order_number = $1", orderNumber).Scan(&orderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := GetOrderByID(orderID)
+	if err != nil {
+		return nil, err
+	}
+	if !order.HasAccessToken(accessToken) {
+		return nil, ErrOrderNotFound
+	}
+
+	return order, nil
+}
+
+// CanRetryPayment reports whether the customer may start a new payment for the order
+func CanRetryPayment(order *Order) bool {
+	return order.Status == "pending" && order.PaymentStatus != "paid"
+}
+
+// UpdateOrderPaymentMethod switches the payment method of an unpaid order.
+// Any installment plan is dropped along with its interest, since it only applied to the previous method.
+func UpdateOrderPaymentMethod(orderID int, paymentMethod string) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	if !validPaymentMethods[paymentMethod] {
+		return fmt.Errorf("invalid payment method: %s", paymentMethod)
+	}
+
+	_, err := db.Exec(`
+		UPDATE orders
+		SET payment_method = $1, payment_status = 'pending',
+		    total_amount = total_amount - installment_interest,
+		    installments = 1, installment_value = total_amount - installment_interest, installment_interest = 0,
+		    payment_expires_at = NULL, payment_reminder_sent_at = NULL,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2 AND COALESCE(payment_status, 'pending') <> 'paid'
+	`, paymentMethod, orderID)
+	return err
+}
+
+// CheckoutFormFromOrder rebuilds the checkout data of an existing order so a new payment can be started
+func CheckoutFormFromOrder(order *Order, items []OrderItem) CheckoutForm {
+	form := CheckoutForm{
+		Email:         order.Email,
+		Phone:         order.Phone,
+		FirstName:     order.FirstName,
+		LastName:      order.LastName,
+		Address:       order.Address,
+		Neighborhood:  order.Neighborhood,
+		City:          order.City,
+		State:         order.State,
+		ZipCode:       order.ZipCode,
+		Apartment:     order.Apartment,
+		CPF:           order.CPF,
+		PaymentMethod: order.PaymentMethod,
+		Installments:  order.Installments,
+	}
+
+	for _, item := range items {
+		form.CartItems = append(form.CartItems, CartItem{
+			ID:       item.ItemID,
+			Name:     item.ItemName,
+			Price:    item.UnitPrice,
+			Quantity: item.Quantity,
+		})
+	}
+
+	return form
+}
+
+// RecordPaymentAttempt stores a new payment attempt for an order
+func RecordPaymentAttempt(attempt PaymentAttempt) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	var payload sql.NullString
+	if attempt.Payload != "" {
+		payload = sql.NullString{String: attempt.Payload, Valid: true}
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO payment_attempts (order_id, provider, payment_method, external_id, amount, payload, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, attempt.OrderID, attempt.Provider, attempt.PaymentMethod, attempt.ExternalID, attempt.Amount, payload, attempt.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to record payment attempt: %v", err)
+	}
+	return nil
+}
+
+// ExpireOpenPaymentAttempts marks the attempts the customer has not paid yet as expired,
+// before a new attempt replaces them
+func ExpireOpenPaymentAttempts(orderID int) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	_, err := db.Exec(`
+		UPDATE payment_attempts
+		SET status = 'expired', updated_at = CURRENT_TIMESTAMP
+		WHERE order_id = $1 AND status IN ('pending', 'waiting')
+	`, orderID)
+	if err != nil {
+		return fmt.Errorf("failed to expire payment attempts: %v", err)
+	}
+	return nil
+}
+
+// Outcomes of ApplyOrderPayment
+const (
+	PaymentApplied        = "applied"
+	PaymentDuplicate      = "duplicate"
+	PaymentOrderCancelled = "order_cancelled"
+)
+
+// ApplyOrderPayment marks the order paid by the provider payment paymentID. When another
+// payment already paid the order, nothing changes and PaymentDuplicate is returned so the
+// extra charge can be refunded. A notification repeated for the same payment is applied again.
+// A payment arriving after the order was cancelled does not reopen it, since its stock was
+// released: the order is left cancelled with payment status refund_pending and
+// PaymentOrderCancelled is returned.
+func ApplyOrderPayment(orderID int, paymentID string) (string, error) {
+	if db == nil {
+		return "", fmt.Errorf("database not initialized")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var status, paymentStatus, currentPaymentID string
+	err = tx.QueryRow(`
+		SELECT status, COALESCE(payment_status, 'pending'), COALESCE(stripe_payment_id, '')
+		FROM orders WHERE id = $1 FOR UPDATE
+	`, orderID).Scan(&status, &paymentStatus, &currentPaymentID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get order: %v", err)
+	}
+	if paymentStatus == "paid" {
+		if currentPaymentID == paymentID {
+			return PaymentApplied, nil
+		}
+		return PaymentDuplicate, nil
+	}
+
+	if status == "cancelled" {
+		_, err = tx.Exec(`
+			UPDATE orders
+			SET payment_status = 'refund_pending', updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`, orderID)
+		if err != nil {
+			return "", fmt.Errorf("failed to flag order refund: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return "", fmt.Errorf("failed to commit order payment: %v", err)
+		}
+		return PaymentOrderCancelled, nil
+	}
+
+	_, err = tx.Exec(`
+		UPDATE orders
+		SET payment_status = 'paid', stripe_payment_id = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+	`, paymentID, orderID)
+	if err != nil {
+		return "", fmt.Errorf("failed to mark order paid: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit order payment: %v", err)
+	}
+	return PaymentApplied, nil
+}
+
+// UpdatePaymentAttemptStatus updates the status of the attempt with the given provider reference
+func UpdatePaymentAttemptStatus(provider, externalID, status string) error {
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	_, err := db.Exec(`
+		UPDATE payment_attempts
+		SET status = $3, updated_at = CURRENT_TIMESTAMP
+		WHERE provider = $1 AND external_id = $2
+	`, provider, externalID, status)
+	return err
+}
+
+const paymentAttemptColumns = `id, order_id, provider, payment_method, COALESCE(external_id, ''), status,
+	COALESCE(amount, 0), COALESCE(payload, ''), expires_at, created_at, updated_at`
+
+func scanPaymentAttempt(scanner interface{ Scan(...interface{}) error }) (PaymentAttempt, error) {
+	var a PaymentAttempt
+	var expiresAt sql.NullTime
+	err := scanner.Scan(&a.ID, &a.OrderID, &a.Provider, &a.PaymentMethod, &a.ExternalID, &a.Status,
+		&a.Amount, &a.Payload, &expiresAt, &a.CreatedAt, &a.UpdatedAt)
+	if expiresAt.Valid {
+		a.ExpiresAt = &expiresAt.Time
+	}
+	return a, err
+}
+
+// GetPaymentAttempt retrieves an attempt by its provider reference (session id, txid...)
+func GetPaymentAttempt(provider, externalID string) (*PaymentAttempt, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	row := db.QueryRow("SELECT "+paymentAttemptColumns+" FROM payment_attempts WHERE provider = $1 AND external_id = $2", provider, externalID)
+	a, err := scanPaymentAttempt(row)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// GetLatestPaymentAttempt retrieves the most recent attempt of an order made with the given provider
+func GetLatestPaymentAttempt(orderID int, provider string) (*PaymentAttempt, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	row := db.QueryRow("SELECT "+paymentAttemptColumns+` FROM payment_attempts
+		WHERE order_id = $1 AND provider = $2
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1`, orderID, provider)
+	a, err := scanPaymentAttempt(row)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// GetPaymentAttempts retrieves every payment attempt of an order, newest first
+func GetPaymentAttempts(orderID int) ([]PaymentAttempt, error) {
+	if db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	rows, err := db.Query("SELECT "+paymentAttemptColumns+`
+		FROM payment_attempts
+		WHERE order_id = $1
+		ORDER BY created_at DESC, id DESC`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []PaymentAttempt
+	for rows.Next() {
+		a, err := scanPaymentAttempt(rows)
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+
+	return attempts, rows.Err()
+}
+
+// HasAccessToken reports whether token matches the order's customer link secret
+func (o *Order) HasAccessToken(token string) bool {
+	return o.AccessToken != "" && subtle.ConstantTimeCompare([]byte(o.AccessToken), []byte(token)) == 1
+}
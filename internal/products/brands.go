@@ -0,0 +1,293 @@
+package products
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrBrandNotFound    = errors.New("marca não encontrada")
+	ErrBrandSlugTaken   = errors.New("já existe uma marca com este endereço")
+	ErrInvalidBrandSlug = errors.New("o endereço da marca deve ter apenas letras minúsculas sem acento, números e hífens")
+	ErrMergeSameBrand   = errors.New("escolha outra marca para receber os produtos")
+	ErrBrandInUse       = errors.New("a marca ainda tem produtos; junte-a com outra marca em vez de excluí-la")
+)
+
+const brandColumns = "id, name, slug, logo, description"
+
+// BrandWithCount is a brand of the admin brand list, with the number of its products
+type BrandWithCount struct {
+	Brand
+	ProductCount int `json:"productCount"`
+}
+
+var brandSlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+var brandAccents = strings.NewReplacer(
+	"á", "a", "à", "a", "â", "a", "ã", "a", "ä", "a",
+	"é", "e", "è", "e", "ê", "e", "ë", "e",
+	"í", "i", "ì", "i", "î", "i", "ï", "i",
+	"ó", "o", "ò", "o", "ô", "o", "õ", "o", "ö", "o",
+	"ú", "u", "ù", "u", "û", "u", "ü", "u",
+	"ç", "c", "ñ", "n",
+)
+
+// brandSlug makes the /marca/{slug} address of a brand name: lowercase, without accents,
+// with every run of other characters turned into a hyphen. It matches the slugs migration
+// 20 gave the existing brands.
+func brandSlug(name string) string {
+	name = brandAccents.Replace(strings.ToLower(name))
+
+	var slug strings.Builder
+	hyphen := false
+	for _, r := range name {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if hyphen && slug.Len() > 0 {
+				slug.WriteByte('-')
+			}
+			slug.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	if slug.Len() == 0 {
+		return "marca"
+	}
+	return slug.String()
+}
+
+// brandConflict turns a unique violation of the brand name or slug into its user error,
+// returning nil for other errors
+func brandConflict(err error) error {
+	if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == "23505" {
+		if pgErr.Constraint == "idx_brands_slug" {
+			return ErrBrandSlugTaken
+		}
+		return fmt.Errorf("marca ja cadastrada")
+	}
+	return nil
+}
+
+// PageDescription is the meta description of the brand page, the start of its description
+func (b Brand) PageDescription() string {
+	return metaDescription(b.Description)
+}
+
+func scanBrand(row interface{ Scan(...interface{}) error }) (*Brand, error) {
+	var b Brand
+	if err := row.Scan(&b.ID, &b.Name, &b.Slug, &b.Logo, &b.Description); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// GetBrandByID returns a brand, or ErrBrandNotFound
+func GetBrandByID(id int) (*Brand, error) {
+	b, err := scanBrand(db.QueryRow("SELECT "+brandColumns+" FROM brands WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrBrandNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get brand: %v", err)
+	}
+	return b, nil
+}
+
+// GetBrandBySlug returns the brand of a /marca/{slug} page, or ErrBrandNotFound
+func GetBrandBySlug(slug string) (*Brand, error) {
+	b, err := scanBrand(db.QueryRow("SELECT "+brandColumns+" FROM brands WHERE slug = $1", slug))
+	if err == sql.ErrNoRows {
+		return nil, ErrBrandNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get brand: %v", err)
+	}
+	return b, nil
+}
+
+// GetBrandsWithCount returns every brand by name with its number of products
+func GetBrandsWithCount() ([]BrandWithCount, error) {
+	rows, err := db.Query(`SELECT b.id, b.name, b.slug, b.logo, b.description,
+			(SELECT COUNT(*) FROM product_brands pb WHERE pb.brand_id = b.id)
+		FROM brands b
+		ORDER BY b.name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query brands: %v", err)
+	}
+	defer rows.Close()
+
+	var brands []BrandWithCount
+	for rows.Next() {
+		var b BrandWithCount
+		if err := rows.Scan(&b.ID, &b.Name, &b.Slug, &b.Logo, &b.Description, &b.ProductCount); err != nil {
+			return nil, fmt.Errorf("failed to scan brand: %v", err)
+		}
+		brands = append(brands, b)
+	}
+	return brands, rows.Err()
+}
+
+// UpdateBrand saves a brand. An empty slug is made from the name. Renaming it rebuilds
+// the search documents of its products, which include brand names.
+func UpdateBrand(id int, name, slug, logo, description string) error {
+	trimmed := strings.TrimSpace(name)
+	if trimmed == "" {
+		return fmt.Errorf("nome da marca nao pode ser vazio")
+	}
+	slug = strings.TrimSpace(slug)
+	if slug == "" {
+		slug = brandSlug(trimmed)
+	}
+	if !brandSlugPattern.MatchString(slug) {
+		return ErrInvalidBrandSlug
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var oldName string
+	err = tx.QueryRow("SELECT name FROM brands WHERE id = $1 FOR UPDATE", id).Scan(&oldName)
+	if err == sql.ErrNoRows {
+		return ErrBrandNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get brand: %v", err)
+	}
+
+	_, err = tx.Exec("UPDATE brands SET name = $1, slug = $2, logo = $3, description = $4 WHERE id = $5",
+		trimmed, slug, logo, strings.TrimSpace(description), id)
+	if err != nil {
+		if conflict := brandConflict(err); conflict != nil {
+			return conflict
+		}
+		return fmt.Errorf("failed to update brand: %v", err)
+	}
+
+	if trimmed != oldName {
+		if err := refreshBrandSearchDocuments(tx, id); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// MergeBrands moves the products of the source brand to the target brand and deletes the
+// source, returning how many products it had. Products of both brands keep a single link
+// to the target.
+func MergeBrands(sourceID, targetID int) (int, error) {
+	if sourceID == targetID {
+		return 0, ErrMergeSameBrand
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Locking both brands keeps products from being linked to the source meanwhile
+	var found int
+	err = tx.QueryRow("SELECT COUNT(*) FROM (SELECT id FROM brands WHERE id IN ($1, $2) FOR UPDATE) locked",
+		sourceID, targetID).Scan(&found)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lock brands: %v", err)
+	}
+	if found != 2 {
+		return 0, ErrBrandNotFound
+	}
+
+	rows, err := tx.Query("SELECT product_id FROM product_brands WHERE brand_id = $1", sourceID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get brand products: %v", err)
+	}
+	var productIDs []int
+	for rows.Next() {
+		var productID int
+		if err := rows.Scan(&productID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan brand product: %v", err)
+		}
+		productIDs = append(productIDs, productID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to get brand products: %v", err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO product_brands (product_id, brand_id)
+		SELECT product_id, $2::int FROM product_brands WHERE brand_id = $1
+		ON CONFLICT DO NOTHING`, sourceID, targetID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to move brand products: %v", err)
+	}
+
+	// The source links go with the brand (ON DELETE CASCADE)
+	if _, err := tx.Exec("DELETE FROM brands WHERE id = $1", sourceID); err != nil {
+		return 0, fmt.Errorf("failed to delete merged brand: %v", err)
+	}
+
+	for _, productID := range productIDs {
+		if err := refreshSearchDocument(tx, productID); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return len(productIDs), nil
+}
+
+// DeleteBrand deletes a brand without products. Brands with products are merged into
+// another one instead, so no product silently loses its brand.
+func DeleteBrand(id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var inUse bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM product_brands WHERE brand_id = b.id)
+		FROM brands b WHERE b.id = $1 FOR UPDATE`, id).Scan(&inUse)
+	if err == sql.ErrNoRows {
+		return ErrBrandNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get brand: %v", err)
+	}
+	if inUse {
+		return ErrBrandInUse
+	}
+
+	if _, err := tx.Exec("DELETE FROM brands WHERE id = $1", id); err != nil {
+		return fmt.Errorf("failed to delete brand: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// refreshBrandSearchDocuments rebuilds the search documents of the products of a brand
+func refreshBrandSearchDocuments(tx *sql.Tx, brandID int) error {
+	_, err := tx.Exec("SELECT refresh_product_search_document(product_id) FROM product_brands WHERE brand_id = $1", brandID)
+	if err != nil {
+		return fmt.Errorf("failed to refresh search documents: %v", err)
+	}
+	return nil
+}
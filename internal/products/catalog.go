@@ -0,0 +1,556 @@
+package products
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// CatalogFilters narrows the storefront product listing. Zero values mean "no filter".
+type CatalogFilters struct {
+	// Category is a category slug; its subcategories' products are listed too
+	Category  string
+	BrandIDs  []int
+	MinPrice  float64
+	MaxPrice  float64 // exclusive upper bound
+	OnOffer   bool
+	Available bool
+	// Specs maps a technical spec key to the accepted values; a product must match
+	// one value of every key
+	Specs map[string][]string
+
+	// Sort is one of the Sort* constants; empty lists the newest first
+	Sort string
+}
+
+// Catalog sort orders
+const (
+	SortNewest      = "newest"
+	SortPriceAsc    = "price_asc"
+	SortPriceDesc   = "price_desc"
+	SortName        = "name"
+	SortBestSelling = "best_selling"
+)
+
+// bestSellingDays is how far back the sales behind SortBestSelling are counted
+const bestSellingDays = 90
+
+// Pagination is the position of a page in a paged listing, shared by the catalog and search pages
+type Pagination struct {
+	Total    int `json:"total"`
+	Page     int `json:"page"`
+	PageSize int `json:"pageSize"`
+}
+
+// HasMore reports whether there are entries after this page
+func (page Pagination) HasMore() bool {
+	return page.Page*page.PageSize < page.Total
+}
+
+// NextPage returns the number of the following page
+func (page Pagination) NextPage() int {
+	return page.Page + 1
+}
+
+// PrevPage returns the number of the previous page
+func (page Pagination) PrevPage() int {
+	return page.Page - 1
+}
+
+// CatalogPage is one page of the catalog listing
+type CatalogPage struct {
+	Products []Product `json:"products"`
+	Pagination
+}
+
+// ValidCatalogSort reports whether sort is one of the Sort* constants
+func ValidCatalogSort(sort string) bool {
+	switch sort {
+	case SortNewest, SortPriceAsc, SortPriceDesc, SortName, SortBestSelling:
+		return true
+	}
+	return false
+}
+
+// PriceRange is a price facet bucket; Max 0 means no upper bound
+type PriceRange struct {
+	Min float64
+	Max float64
+}
+
+// PriceRanges are the buckets offered by the price facet
+var PriceRanges = []PriceRange{
+	{Min: 0, Max: 200},
+	{Min: 200, Max: 500},
+	{Min: 500, Max: 1000},
+	{Min: 1000, Max: 2000},
+	{Min: 2000, Max: 0},
+}
+
+// FacetValue is one option of a facet with the number of products it would list
+type FacetValue struct {
+	Value    string
+	Label    string
+	Count    int
+	Selected bool
+
+	// Depth is the level of a category value in the category tree
+	Depth int
+}
+
+// PriceFacet is a price bucket with its product count
+type PriceFacet struct {
+	PriceRange
+	Count    int
+	Selected bool
+}
+
+// SpecFacet groups the values of one technical spec key
+type SpecFacet struct {
+	Key    string
+	Values []FacetValue
+}
+
+// CatalogFacets holds the counts shown next to the listing. Each facet is counted with
+// every filter applied except its own, so choosing another value of it widens the list.
+type CatalogFacets struct {
+	Filters     CatalogFilters
+	Categories  []FacetValue
+	Brands      []FacetValue
+	Prices      []PriceFacet
+	Specs       []SpecFacet
+	OnOffer     int
+	Available   int
+	ResultCount int
+}
+
+// maxSpecFacetValues leaves out spec keys that are practically free text (dimensions,
+// model codes) and would make useless facets
+const maxSpecFacetValues = 15
+
+// Facet names for whereClause's skip argument
+const (
+	facetNone      = ""
+	facetCategory  = "category"
+	facetBrand     = "brand"
+	facetPrice     = "price"
+	facetOffer     = "offer"
+	facetAvailable = "available"
+	facetSpec      = "spec"
+)
+
+const catalogFrom = `
+	FROM products
+	JOIN items ON products.item_id = items.id
+	JOIN categories c ON products.category_id = c.id
+	LEFT JOIN offers o ON products.id = o.product_id AND o.is_active = TRUE`
+
+// currentOfferCondition matches products whose active offer is within its dates
+const currentOfferCondition = `(o.id IS NOT NULL AND (o.start_date IS NULL OR o.start_date <= CURRENT_TIMESTAMP) AND (o.end_date IS NULL OR o.end_date >= CURRENT_TIMESTAMP))`
+
+// currentPriceExpr is the price the customer pays today, like GetCurrentPrice
+const currentPriceExpr = `(CASE WHEN ` + currentOfferCondition + ` AND o.offer_price > 0 THEN o.offer_price ELSE items.price END)`
+
+// HasFilters reports whether any filter is set
+func (filters CatalogFilters) HasFilters() bool {
+	return filters.Category != "" || len(filters.BrandIDs) > 0 || filters.MinPrice > 0 || filters.MaxPrice > 0 ||
+		filters.OnOffer || filters.Available || len(filters.Specs) > 0
+}
+
+// specKeys returns the filtered spec keys in a stable order
+func (filters CatalogFilters) specKeys() []string {
+	keys := make([]string, 0, len(filters.Specs))
+	for key, values := range filters.Specs {
+		if len(values) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// specCondition matches products having one of values for the spec key
+func specCondition(key string, values []string, args *[]interface{}) string {
+	*args = append(*args, key, pq.Array(values))
+	return fmt.Sprintf(`EXISTS (SELECT 1 FROM product_technical_specs ps WHERE ps.product_id = products.id
+		AND TRIM(ps.spec_key) = $%d AND TRIM(ps.spec_value) = ANY($%d))`, len(*args)-1, len(*args))
+}
+
+// whereClause builds the WHERE clause of the filters, leaving out the skip facet
+func (filters CatalogFilters) whereClause(skip string) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if filters.Category != "" && skip != facetCategory {
+		args = append(args, filters.Category)
+		conditions = append(conditions, fmt.Sprintf("products.category_id IN (%s)", categorySubtree(len(args))))
+	}
+	if len(filters.BrandIDs) > 0 && skip != facetBrand {
+		args = append(args, pq.Array(filters.BrandIDs))
+		conditions = append(conditions, fmt.Sprintf("EXISTS (SELECT 1 FROM product_brands pb WHERE pb.product_id = products.id AND pb.brand_id = ANY($%d))", len(args)))
+	}
+	if skip != facetPrice {
+		if filters.MinPrice > 0 {
+			args = append(args, filters.MinPrice)
+			conditions = append(conditions, fmt.Sprintf("%s >= $%d", currentPriceExpr, len(args)))
+		}
+		if filters.MaxPrice > 0 {
+			args = append(args, filters.MaxPrice)
+			conditions = append(conditions, fmt.Sprintf("%s < $%d", currentPriceExpr, len(args)))
+		}
+	}
+	if filters.OnOffer && skip != facetOffer {
+		conditions = append(conditions, currentOfferCondition+" AND o.offer_price > 0")
+	}
+	if filters.Available && skip != facetAvailable {
+		conditions = append(conditions, "items.is_available = TRUE")
+	}
+	if skip != facetSpec {
+		for _, key := range filters.specKeys() {
+			conditions = append(conditions, specCondition(key, filters.Specs[key], &args))
+		}
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// orderByClause returns the ORDER BY of the sort, with the newest first as the tie-break
+// so pages never overlap, and the join it needs
+func (filters CatalogFilters) orderByClause() (string, string) {
+	switch filters.Sort {
+	case SortPriceAsc:
+		return "", " ORDER BY " + currentPriceExpr + " ASC, items.id DESC"
+	case SortPriceDesc:
+		return "", " ORDER BY " + currentPriceExpr + " DESC, items.id DESC"
+	case SortName:
+		return "", " ORDER BY LOWER(items.name) ASC, items.id DESC"
+	case SortBestSelling:
+		join := fmt.Sprintf(`
+		LEFT JOIN (
+			SELECT oi.item_id, SUM(oi.quantity) AS quantity
+			FROM order_items oi
+			JOIN orders so ON so.id = oi.order_id
+			WHERE so.payment_status = 'paid' AND so.status <> 'cancelled'
+				AND so.created_at >= CURRENT_TIMESTAMP - INTERVAL '%d days'
+			GROUP BY oi.item_id
+		) sales ON sales.item_id = items.id`, bestSellingDays)
+		return join, " ORDER BY COALESCE(sales.quantity, 0) DESC, items.id DESC"
+	default:
+		return "", " ORDER BY items.id DESC"
+	}
+}
+
+// GetCatalogProducts retrieves every product matching the filters in the filters' order
+func GetCatalogProducts(filters CatalogFilters) ([]Product, error) {
+	return queryCatalog(filters, 0, 0)
+}
+
+// GetCatalogPage retrieves one page of the products matching the filters and their total.
+// Pages start at 1.
+func GetCatalogPage(filters CatalogFilters, page, pageSize int) (*CatalogPage, error) {
+	if page < 1 {
+		page = 1
+	}
+
+	total, err := countCatalog(filters, facetNone, "")
+	if err != nil {
+		return nil, err
+	}
+	prods, err := queryCatalog(filters, pageSize, (page-1)*pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CatalogPage{Products: prods, Pagination: Pagination{Total: total, Page: page, PageSize: pageSize}}, nil
+}
+
+// queryCatalog runs the listing query; a zero limit returns every product
+func queryCatalog(filters CatalogFilters, limit, offset int) ([]Product, error) {
+	where, args := filters.whereClause(facetNone)
+	join, orderBy := filters.orderByClause()
+	query := `SELECT items.id, products.id, items.name, items.price, COALESCE(pi.image_url, ''), products.category_id, c.slug, c.name, c.allows_compatibility,
+		products.description, products.sku, items.is_available, o.id, o.offer_price, o.start_date, o.end_date, o.is_active` +
+		catalogFrom + `
+		LEFT JOIN product_images pi ON products.id = pi.product_id AND pi.is_primary = TRUE` +
+		join + where + orderBy
+	if limit > 0 {
+		args = append(args, limit, offset)
+		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query catalog: %v", err)
+	}
+	defer rows.Close()
+
+	var products []Product
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan product: %v", err)
+		}
+		products = append(products, p)
+	}
+
+	return products, rows.Err()
+}
+
+// GetCatalogFacets counts the products behind every facet value for the filters
+func GetCatalogFacets(filters CatalogFilters) (*CatalogFacets, error) {
+	facets := &CatalogFacets{Filters: filters}
+
+	var err error
+	if facets.Categories, err = categoryFacet(filters); err != nil {
+		return nil, err
+	}
+	if facets.Brands, err = brandFacet(filters); err != nil {
+		return nil, err
+	}
+	if facets.Prices, err = priceFacet(filters); err != nil {
+		return nil, err
+	}
+	if facets.Specs, err = specFacets(filters); err != nil {
+		return nil, err
+	}
+	if facets.OnOffer, err = countCatalog(filters, facetOffer, currentOfferCondition+" AND o.offer_price > 0"); err != nil {
+		return nil, err
+	}
+	if facets.Available, err = countCatalog(filters, facetAvailable, "items.is_available = TRUE"); err != nil {
+		return nil, err
+	}
+	if facets.ResultCount, err = countCatalog(filters, facetNone, ""); err != nil {
+		return nil, err
+	}
+
+	return facets, nil
+}
+
+// countCatalog counts the products matching the filters (minus skip) and the extra condition
+func countCatalog(filters CatalogFilters, skip, condition string) (int, error) {
+	where, args := filters.whereClause(skip)
+	if condition != "" {
+		if where == "" {
+			where = " WHERE " + condition
+		} else {
+			where += " AND " + condition
+		}
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*)`+catalogFrom+where, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count catalog: %v", err)
+	}
+	return count, nil
+}
+
+// categoryFacet counts each active category with its subcategories' products. Besides the
+// top-level categories, it lists the subcategories of the selected one and of its ancestors.
+func categoryFacet(filters CatalogFilters) ([]FacetValue, error) {
+	categories, err := GetActiveCategories()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get categories: %v", err)
+	}
+
+	where, args := filters.whereClause(facetCategory)
+	rows, err := db.Query(`WITH RECURSIVE category_tree AS (
+			SELECT id AS ancestor_id, id FROM categories
+			UNION
+			SELECT category_tree.ancestor_id, child.id FROM categories child JOIN category_tree ON child.parent_id = category_tree.id
+		)
+		SELECT category_tree.ancestor_id, COUNT(DISTINCT products.id)`+catalogFrom+`
+		JOIN category_tree ON category_tree.id = products.category_id`+where+`
+		GROUP BY category_tree.ancestor_id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count categories: %v", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[int]int)
+	for rows.Next() {
+		var id, count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan category facet: %v", err)
+		}
+		counts[id] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The selected category and its ancestors have their subcategories listed
+	expanded := make(map[int]bool)
+	parents := make(map[int]int, len(categories))
+	selectedID := 0
+	for _, c := range categories {
+		parents[c.ID] = c.ParentID
+		if c.Slug == filters.Category {
+			selectedID = c.ID
+		}
+	}
+	for id := selectedID; id != 0 && !expanded[id]; id = parents[id] {
+		expanded[id] = true
+	}
+
+	var values []FacetValue
+	for _, c := range categories {
+		selected := c.ID == selectedID
+		if c.Depth > 0 && !expanded[c.ParentID] || counts[c.ID] == 0 && !selected {
+			continue
+		}
+		values = append(values, FacetValue{Value: c.Slug, Label: c.Name, Count: counts[c.ID], Selected: selected, Depth: c.Depth})
+	}
+	return values, nil
+}
+
+func brandFacet(filters CatalogFilters) ([]FacetValue, error) {
+	where, args := filters.whereClause(facetBrand)
+
+	rows, err := db.Query(`SELECT b.id, b.name, COUNT(DISTINCT products.id)`+catalogFrom+`
+		JOIN product_brands pbf ON pbf.product_id = products.id
+		JOIN brands b ON b.id = pbf.brand_id`+where+`
+		GROUP BY b.id, b.name ORDER BY b.name`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count brands: %v", err)
+	}
+	defer rows.Close()
+
+	selected := make(map[int]bool, len(filters.BrandIDs))
+	for _, id := range filters.BrandIDs {
+		selected[id] = true
+	}
+
+	var values []FacetValue
+	for rows.Next() {
+		var id int
+		var value FacetValue
+		if err := rows.Scan(&id, &value.Label, &value.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan brand facet: %v", err)
+		}
+		value.Value = strconv.Itoa(id)
+		value.Selected = selected[id]
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+func priceFacet(filters CatalogFilters) ([]PriceFacet, error) {
+	where, args := filters.whereClause(facetPrice)
+
+	counts := make([]string, len(PriceRanges))
+	for i, priceRange := range PriceRanges {
+		args = append(args, priceRange.Min)
+		condition := fmt.Sprintf("%s >= $%d", currentPriceExpr, len(args))
+		if priceRange.Max > 0 {
+			args = append(args, priceRange.Max)
+			condition += fmt.Sprintf(" AND %s < $%d", currentPriceExpr, len(args))
+		}
+		counts[i] = "COUNT(*) FILTER (WHERE " + condition + ")"
+	}
+
+	results := make([]int, len(PriceRanges))
+	dest := make([]interface{}, len(results))
+	for i := range results {
+		dest[i] = &results[i]
+	}
+	if err := db.QueryRow(`SELECT `+strings.Join(counts, ", ")+catalogFrom+where, args...).Scan(dest...); err != nil {
+		return nil, fmt.Errorf("failed to count price ranges: %v", err)
+	}
+
+	facets := make([]PriceFacet, len(PriceRanges))
+	for i, priceRange := range PriceRanges {
+		facets[i] = PriceFacet{
+			PriceRange: priceRange,
+			Count:      results[i],
+			Selected:   priceRange.Min == filters.MinPrice && priceRange.Max == filters.MaxPrice,
+		}
+	}
+	return facets, nil
+}
+
+// specFacets counts spec values. Every other filtered key still applies to a key's values,
+// but not the key itself.
+func specFacets(filters CatalogFilters) ([]SpecFacet, error) {
+	where, args := filters.whereClause(facetSpec)
+	conditions := []string{"TRIM(s.spec_value) <> ''"}
+	for _, key := range filters.specKeys() {
+		args = append(args, key)
+		keyParam := len(args)
+		conditions = append(conditions, fmt.Sprintf("(TRIM(s.spec_key) = $%d OR %s)", keyParam, specCondition(key, filters.Specs[key], &args)))
+	}
+	if where == "" {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	} else {
+		where += " AND " + strings.Join(conditions, " AND ")
+	}
+
+	rows, err := db.Query(`SELECT TRIM(s.spec_key), TRIM(s.spec_value), COUNT(DISTINCT products.id)`+catalogFrom+`
+		JOIN product_technical_specs s ON s.product_id = products.id`+where+`
+		GROUP BY 1, 2 ORDER BY 1`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count technical specs: %v", err)
+	}
+	defer rows.Close()
+
+	var facets []SpecFacet
+	for rows.Next() {
+		var key string
+		var value FacetValue
+		if err := rows.Scan(&key, &value.Value, &value.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan spec facet: %v", err)
+		}
+		value.Label = value.Value
+		for _, selected := range filters.Specs[key] {
+			if selected == value.Value {
+				value.Selected = true
+			}
+		}
+		if len(facets) == 0 || facets[len(facets)-1].Key != key {
+			facets = append(facets, SpecFacet{Key: key})
+		}
+		facets[len(facets)-1].Values = append(facets[len(facets)-1].Values, value)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Only keys that tell products apart make a facet, unless the customer filters by them
+	kept := facets[:0]
+	for _, facet := range facets {
+		_, filtered := filters.Specs[facet.Key]
+		if !filtered && (len(facet.Values) < 2 || len(facet.Values) > maxSpecFacetValues) {
+			continue
+		}
+		sort.SliceStable(facet.Values, func(i, j int) bool {
+			return specValueLess(facet.Values[i].Value, facet.Values[j].Value)
+		})
+		kept = append(kept, facet)
+	}
+	return kept, nil
+}
+
+// specValueLess orders values by their leading number when both have one ("5 L" before
+// "10 L"), alphabetically otherwise
+func specValueLess(a, b string) bool {
+	numberA, okA := leadingNumber(a)
+	numberB, okB := leadingNumber(b)
+	if okA && okB && numberA != numberB {
+		return numberA < numberB
+	}
+	return strings.ToLower(a) < strings.ToLower(b)
+}
+
+func leadingNumber(value string) (float64, bool) {
+	end := 0
+	for end < len(value) && (value[end] >= '0' && value[end] <= '9' || value[end] == '.' || value[end] == ',') {
+		end++
+	}
+	number, err := strconv.ParseFloat(strings.ReplaceAll(value[:end], ",", "."), 64)
+	return number, err == nil
+}
@@ -0,0 +1,312 @@
+package products
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Where MoveCategory places a category relative to the target category
+const (
+	CategoryBefore = "before"
+	CategoryAfter  = "after"
+	CategoryInside = "inside"
+)
+
+var (
+	ErrCategoryNotFound     = errors.New("categoria não encontrada")
+	ErrCategoryLoop         = errors.New("uma categoria não pode ficar dentro dela mesma nem de uma de suas subcategorias")
+	ErrInvalidCategoryPlace = errors.New("posição inválida para a categoria")
+)
+
+// Longest SEO title and meta description search engines show in full
+const (
+	maxSEOTitleLength        = 70
+	maxMetaDescriptionLength = 160
+)
+
+const categoryColumns = `id, name, slug, allows_compatibility, is_active, COALESCE(parent_id, 0), display_order,
+	description, hero_image, seo_title, meta_description`
+
+// nextCategoryOrder selects the display order after the last child of the parent ID
+// parameter (0 for the top level)
+func nextCategoryOrder(parentParam int) string {
+	return fmt.Sprintf("SELECT COALESCE(MAX(display_order), 0) + 1 FROM categories WHERE parent_id IS NOT DISTINCT FROM NULLIF($%d::int, 0)", parentParam)
+}
+
+// categorySubtree selects the IDs of the category with the slug parameter and of all
+// its descendants
+func categorySubtree(slugParam int) string {
+	return fmt.Sprintf(`WITH RECURSIVE subtree AS (
+			SELECT id FROM categories WHERE slug = $%d
+			UNION
+			SELECT child.id FROM categories child JOIN subtree ON child.parent_id = subtree.id
+		)
+		SELECT id FROM subtree`, slugParam)
+}
+
+// IndentedName prefixes the name with a dash per level, for tree-ordered select options
+func (c Category) IndentedName() string {
+	return strings.Repeat("— ", c.Depth) + c.Name
+}
+
+// PageDescription is the meta description of the category landing page: the SEO one or,
+// without it, the start of the description
+func (c Category) PageDescription() string {
+	if c.MetaDescription != "" {
+		return c.MetaDescription
+	}
+	return metaDescription(c.Description)
+}
+
+// metaDescription shortens a page text to a meta description, on a single line
+func metaDescription(text string) string {
+	description := []rune(strings.Join(strings.Fields(text), " "))
+	if len(description) <= maxMetaDescriptionLength {
+		return string(description)
+	}
+	// Cut at a word boundary, leaving room for the ellipsis
+	short := string(description[:maxMetaDescriptionLength-1])
+	if space := strings.LastIndex(short, " "); space > 0 {
+		short = short[:space]
+	}
+	return short + "…"
+}
+
+// validateCategoryContent trims the landing page fields and checks the SEO lengths
+func validateCategoryContent(content CategoryContent) (CategoryContent, error) {
+	content.Description = strings.TrimSpace(content.Description)
+	content.SEOTitle = strings.TrimSpace(content.SEOTitle)
+	content.MetaDescription = strings.Join(strings.Fields(content.MetaDescription), " ")
+
+	if utf8.RuneCountInString(content.SEOTitle) > maxSEOTitleLength {
+		return content, fmt.Errorf("título SEO deve ter no máximo %d caracteres", maxSEOTitleLength)
+	}
+	if utf8.RuneCountInString(content.MetaDescription) > maxMetaDescriptionLength {
+		return content, fmt.Errorf("meta descrição deve ter no máximo %d caracteres", maxMetaDescriptionLength)
+	}
+	return content, nil
+}
+
+func scanCategory(row interface{ Scan(...interface{}) error }) (*Category, error) {
+	var c Category
+	if err := row.Scan(&c.ID, &c.Name, &c.Slug, &c.AllowsCompatibility, &c.IsActive, &c.ParentID, &c.DisplayOrder,
+		&c.Description, &c.HeroImage, &c.SEOTitle, &c.MetaDescription); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// queryCategories runs a categoryColumns query and returns the categories in tree order
+func queryCategories(query string, args ...interface{}) ([]Category, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []Category
+	for rows.Next() {
+		c, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, *c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return categoryTree(categories), nil
+}
+
+// categoryTree orders categories depth-first, keeping the order of siblings, and sets
+// their Depth. Categories whose parent is not in the list become top-level ones.
+func categoryTree(categories []Category) []Category {
+	present := make(map[int]bool, len(categories))
+	for _, c := range categories {
+		present[c.ID] = true
+	}
+	children := make(map[int][]Category)
+	for _, c := range categories {
+		parentID := c.ParentID
+		if !present[parentID] {
+			parentID = 0
+		}
+		children[parentID] = append(children[parentID], c)
+	}
+
+	sorted := make([]Category, 0, len(categories))
+	var walk func(parentID, depth int)
+	walk = func(parentID, depth int) {
+		for _, c := range children[parentID] {
+			c.Depth = depth
+			sorted = append(sorted, c)
+			walk(c.ID, depth+1)
+		}
+	}
+	walk(0, 0)
+	return sorted
+}
+
+// WithoutSubtree returns the tree-ordered categories without the category id and its
+// descendants, the parents it can be moved to
+func WithoutSubtree(categories []Category, id int) []Category {
+	kept := make([]Category, 0, len(categories))
+	skipDepth := -1
+	for _, c := range categories {
+		if skipDepth >= 0 && c.Depth > skipDepth {
+			continue
+		}
+		skipDepth = -1
+		if c.ID == id {
+			skipDepth = c.Depth
+			continue
+		}
+		kept = append(kept, c)
+	}
+	return kept
+}
+
+// GetCategoryPath returns the category and its ancestors, from the top-level one down
+func GetCategoryPath(id int) ([]Category, error) {
+	categories, err := GetAllCategories()
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[int]Category, len(categories))
+	for _, c := range categories {
+		byID[c.ID] = c
+	}
+
+	var path []Category
+	for c, ok := byID[id]; ok && len(path) < len(categories); c, ok = byID[c.ParentID] {
+		path = append(path, c)
+	}
+	slices.Reverse(path)
+	return path, nil
+}
+
+// MoveCategory places a category before or after the target category, among the
+// target's siblings, or inside it as its last subcategory
+func MoveCategory(id, targetID int, placement string) error {
+	if placement != CategoryBefore && placement != CategoryAfter && placement != CategoryInside {
+		return ErrInvalidCategoryPlace
+	}
+	if id == targetID {
+		return ErrCategoryLoop
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var parentID int
+	err = tx.QueryRow("SELECT COALESCE(parent_id, 0) FROM categories WHERE id = $1", targetID).Scan(&parentID)
+	if err == sql.ErrNoRows {
+		return ErrCategoryNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get target category: %v", err)
+	}
+	if placement == CategoryInside {
+		parentID = targetID
+	}
+	if err := checkCategoryParent(tx, id, parentID); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT id FROM categories WHERE parent_id IS NOT DISTINCT FROM NULLIF($1::int, 0) AND id <> $2
+		ORDER BY display_order, name`, parentID, id)
+	if err != nil {
+		return fmt.Errorf("failed to get sibling categories: %v", err)
+	}
+	var siblings []int
+	for rows.Next() {
+		var siblingID int
+		if err := rows.Scan(&siblingID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan sibling category: %v", err)
+		}
+		siblings = append(siblings, siblingID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to get sibling categories: %v", err)
+	}
+
+	position := len(siblings)
+	if placement != CategoryInside {
+		position = slices.Index(siblings, targetID)
+		if placement == CategoryAfter {
+			position++
+		}
+	}
+	siblings = slices.Insert(siblings, position, id)
+
+	result, err := tx.Exec("UPDATE categories SET parent_id = NULLIF($1::int, 0) WHERE id = $2", parentID, id)
+	if err != nil {
+		return fmt.Errorf("failed to move category: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrCategoryNotFound
+	}
+
+	_, err = tx.Exec(`UPDATE categories SET display_order = ordered.position
+		FROM unnest($1::int[]) WITH ORDINALITY AS ordered(id, position)
+		WHERE categories.id = ordered.id`, pq.Array(siblings))
+	if err != nil {
+		return fmt.Errorf("failed to reorder categories: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
+// checkCategoryParent makes sure parentID (0 for none) exists and is neither the
+// category id (0 for a new one) nor one of its descendants. It locks the categories table
+// until the transaction ends, so two concurrent moves (A into B and B into A) cannot both
+// pass the check and create a cycle.
+func checkCategoryParent(tx *sql.Tx, id, parentID int) error {
+	if parentID == 0 {
+		return nil
+	}
+	if parentID == id {
+		return ErrCategoryLoop
+	}
+
+	// SHARE ROW EXCLUSIVE conflicts with itself and with writes, while reads go on
+	if _, err := tx.Exec("LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return fmt.Errorf("failed to lock categories: %v", err)
+	}
+
+	var exists, loop bool
+	err := tx.QueryRow(`WITH RECURSIVE subtree AS (
+			SELECT id FROM categories WHERE id = $1
+			UNION
+			SELECT child.id FROM categories child JOIN subtree ON child.parent_id = subtree.id
+		)
+		SELECT EXISTS (SELECT 1 FROM categories WHERE id = $2), EXISTS (SELECT 1 FROM subtree WHERE id = $2)`,
+		id, parentID,
+	).Scan(&exists, &loop)
+	if err != nil {
+		return fmt.Errorf("failed to check parent category: %v", err)
+	}
+	if !exists {
+		return ErrCategoryNotFound
+	}
+	if loop {
+		return ErrCategoryLoop
+	}
+	return nil
+}
@@ -0,0 +1,545 @@
+package products
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+
+	"lojagtec/internal/spreadsheet"
+
+	"github.com/lib/pq"
+)
+
+// Column titles of the compatibility spreadsheet
+const (
+	CompatibilityPartSKUColumn  = "SKU da peça"
+	CompatibilityModelSKUColumn = "SKU do modelo"
+)
+
+// maxMatrixProducts caps each axis of the compatibility matrix
+const maxMatrixProducts = 200
+
+// maxImportErrors caps the errors reported for an invalid compatibility file
+const maxImportErrors = 20
+
+var (
+	ErrNotAPart                 = errors.New("a peça precisa ser de uma categoria que permite compatibilidade")
+	ErrCompatibleWithItself     = errors.New("um produto não pode ser compatível consigo mesmo")
+	ErrCompatibilityNotFound    = errors.New("peça, modelo ou marca não encontrados")
+	ErrInvalidCompatibilityFile = errors.New(`arquivo inválido: use um CSV com as colunas "` + CompatibilityPartSKUColumn + `" e "` + CompatibilityModelSKUColumn + `"`)
+)
+
+// MatrixProduct is a part or a model of the compatibility matrix
+type MatrixProduct struct {
+	ID   int // product ID
+	Name string
+	SKU  string
+}
+
+// MatrixFilter narrows the parts and models of the compatibility matrix
+type MatrixFilter struct {
+	PartCategoryID  int
+	ModelCategoryID int
+	ModelBrandID    int
+}
+
+// CompatibilityMatrix holds parts (products of categories that allow compatibility), models
+// (the other products) and which parts fit which models
+type CompatibilityMatrix struct {
+	Parts     []MatrixProduct
+	Models    []MatrixProduct
+	Truncated bool
+	fits      map[[2]int]bool
+}
+
+// Fits reports whether the part fits the model
+func (m *CompatibilityMatrix) Fits(partID, modelID int) bool {
+	return m.fits[[2]int{partID, modelID}]
+}
+
+// CompatibilityChange is the list of models a part fits before and after a change
+type CompatibilityChange struct {
+	PartID int
+	Before []int
+	After  []int
+}
+
+// CompatibilityPair is a row of the compatibility spreadsheet
+type CompatibilityPair struct {
+	PartSKU   string
+	PartName  string
+	ModelSKU  string
+	ModelName string
+}
+
+// CompatibilityImport is the outcome of a compatibility file import. When Errors is not
+// empty nothing was changed.
+type CompatibilityImport struct {
+	Rows    int
+	Added   int
+	Removed int
+	Skipped int
+	Errors  []string
+	Changes []CompatibilityChange
+}
+
+// GetCompatibilityMatrix returns the parts, the models and their compatibility
+func GetCompatibilityMatrix(filter MatrixFilter) (*CompatibilityMatrix, error) {
+	matrix := &CompatibilityMatrix{fits: map[[2]int]bool{}}
+
+	var err error
+	matrix.Parts, err = queryMatrixProducts(`
+		SELECT products.id, items.name, COALESCE(products.sku, '')
+		FROM products
+		JOIN items ON products.item_id = items.id
+		JOIN categories c ON products.category_id = c.id
+		WHERE c.allows_compatibility = TRUE AND ($1 = 0 OR products.category_id = $1)
+		ORDER BY items.name, products.id
+		LIMIT $2`, filter.PartCategoryID, maxMatrixProducts+1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query matrix parts: %v", err)
+	}
+	matrix.Models, err = queryMatrixProducts(`
+		SELECT products.id, items.name, COALESCE(products.sku, '')
+		FROM products
+		JOIN items ON products.item_id = items.id
+		JOIN categories c ON products.category_id = c.id
+		WHERE c.allows_compatibility = FALSE AND ($1 = 0 OR products.category_id = $1)
+			AND ($2 = 0 OR EXISTS (SELECT 1 FROM product_brands pb WHERE pb.product_id = products.id AND pb.brand_id = $2))
+		ORDER BY items.name, products.id
+		LIMIT $3`, filter.ModelCategoryID, filter.ModelBrandID, maxMatrixProducts+1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query matrix models: %v", err)
+	}
+	if len(matrix.Parts) > maxMatrixProducts {
+		matrix.Parts = matrix.Parts[:maxMatrixProducts]
+		matrix.Truncated = true
+	}
+	if len(matrix.Models) > maxMatrixProducts {
+		matrix.Models = matrix.Models[:maxMatrixProducts]
+		matrix.Truncated = true
+	}
+	if len(matrix.Parts) == 0 || len(matrix.Models) == 0 {
+		return matrix, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT part_product_id, fits_product_id FROM product_compatibility
+		WHERE part_product_id = ANY($1) AND fits_product_id = ANY($2)`,
+		pq.Array(matrixIDs(matrix.Parts)), pq.Array(matrixIDs(matrix.Models)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query matrix compatibility: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var partID, modelID int
+		if err := rows.Scan(&partID, &modelID); err != nil {
+			return nil, fmt.Errorf("failed to scan matrix compatibility: %v", err)
+		}
+		matrix.fits[[2]int{partID, modelID}] = true
+	}
+	return matrix, rows.Err()
+}
+
+func queryMatrixProducts(query string, args ...interface{}) ([]MatrixProduct, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var products []MatrixProduct
+	for rows.Next() {
+		var p MatrixProduct
+		if err := rows.Scan(&p.ID, &p.Name, &p.SKU); err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+	return products, rows.Err()
+}
+
+func matrixIDs(products []MatrixProduct) []int64 {
+	ids := make([]int64, len(products))
+	for i, p := range products {
+		ids[i] = int64(p.ID)
+	}
+	return ids
+}
+
+// SetCompatibility marks whether a part fits a model
+func SetCompatibility(partID, modelID int, fits bool) (*CompatibilityChange, error) {
+	if partID == modelID {
+		return nil, ErrCompatibleWithItself
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := checkCompatibilityPart(tx, partID); err != nil {
+		return nil, err
+	}
+	before, err := fitsByPart(tx, []int{partID})
+	if err != nil {
+		return nil, err
+	}
+
+	if fits {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM products WHERE id = $1)", modelID).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("failed to check model: %v", err)
+		}
+		if !exists {
+			return nil, ErrCompatibilityNotFound
+		}
+		_, err = tx.Exec(`INSERT INTO product_compatibility (part_product_id, fits_product_id) VALUES ($1, $2)
+			ON CONFLICT DO NOTHING`, partID, modelID)
+	} else {
+		_, err = tx.Exec("DELETE FROM product_compatibility WHERE part_product_id = $1 AND fits_product_id = $2", partID, modelID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update compatibility: %v", err)
+	}
+
+	return commitCompatibilityChange(tx, partID, before[partID])
+}
+
+// SetCompatibilityByBrand marks whether a part fits every model of a brand, the products
+// of the brand in categories without compatibility
+func SetCompatibilityByBrand(partID, brandID int, fits bool) (*CompatibilityChange, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := checkCompatibilityPart(tx, partID); err != nil {
+		return nil, err
+	}
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM brands WHERE id = $1)", brandID).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to check brand: %v", err)
+	}
+	if !exists {
+		return nil, ErrCompatibilityNotFound
+	}
+	before, err := fitsByPart(tx, []int{partID})
+	if err != nil {
+		return nil, err
+	}
+
+	const brandModels = `
+		SELECT products.id FROM products
+		JOIN categories c ON products.category_id = c.id
+		JOIN product_brands pb ON pb.product_id = products.id
+		WHERE pb.brand_id = $2 AND c.allows_compatibility = FALSE AND products.id <> $1`
+	if fits {
+		_, err = tx.Exec(`INSERT INTO product_compatibility (part_product_id, fits_product_id)
+			SELECT $1::int, id FROM (`+brandModels+`) AS models
+			ON CONFLICT DO NOTHING`, partID, brandID)
+	} else {
+		_, err = tx.Exec(`DELETE FROM product_compatibility
+			WHERE part_product_id = $1 AND fits_product_id IN (`+brandModels+`)`, partID, brandID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update brand compatibility: %v", err)
+	}
+
+	return commitCompatibilityChange(tx, partID, before[partID])
+}
+
+// checkCompatibilityPart checks that the product exists and can be a part, the same rule
+// insertProductCompatibility applies when a product is saved
+func checkCompatibilityPart(tx *sql.Tx, partID int) error {
+	var allowsCompat bool
+	err := tx.QueryRow("SELECT c.allows_compatibility FROM products p JOIN categories c ON p.category_id = c.id WHERE p.id = $1", partID).Scan(&allowsCompat)
+	if err == sql.ErrNoRows {
+		return ErrCompatibilityNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check part category: %v", err)
+	}
+	if !allowsCompat {
+		return ErrNotAPart
+	}
+	return nil
+}
+
+func commitCompatibilityChange(tx *sql.Tx, partID int, before []int) (*CompatibilityChange, error) {
+	after, err := fitsByPart(tx, []int{partID})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return &CompatibilityChange{PartID: partID, Before: before, After: after[partID]}, nil
+}
+
+// fitsByPart returns the models each part fits, ordered by ID
+func fitsByPart(tx *sql.Tx, partIDs []int) (map[int][]int, error) {
+	ids := make([]int64, len(partIDs))
+	for i, id := range partIDs {
+		ids[i] = int64(id)
+	}
+	rows, err := tx.Query(`
+		SELECT part_product_id, fits_product_id FROM product_compatibility
+		WHERE part_product_id = ANY($1)
+		ORDER BY part_product_id, fits_product_id`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query compatibility: %v", err)
+	}
+	defer rows.Close()
+
+	fits := make(map[int][]int, len(partIDs))
+	for rows.Next() {
+		var partID, modelID int
+		if err := rows.Scan(&partID, &modelID); err != nil {
+			return nil, fmt.Errorf("failed to scan compatibility: %v", err)
+		}
+		fits[partID] = append(fits[partID], modelID)
+	}
+	return fits, rows.Err()
+}
+
+// GetCompatibilityPairs returns every part and model pair, for the spreadsheet export
+func GetCompatibilityPairs() ([]CompatibilityPair, error) {
+	rows, err := db.Query(`
+		SELECT COALESCE(part.sku, ''), part_item.name, COALESCE(model.sku, ''), model_item.name
+		FROM product_compatibility pc
+		JOIN products part ON part.id = pc.part_product_id
+		JOIN items part_item ON part_item.id = part.item_id
+		JOIN products model ON model.id = pc.fits_product_id
+		JOIN items model_item ON model_item.id = model.item_id
+		ORDER BY part_item.name, part.id, model_item.name, model.id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query compatibility pairs: %v", err)
+	}
+	defer rows.Close()
+
+	var pairs []CompatibilityPair
+	for rows.Next() {
+		var p CompatibilityPair
+		if err := rows.Scan(&p.PartSKU, &p.PartName, &p.ModelSKU, &p.ModelName); err != nil {
+			return nil, fmt.Errorf("failed to scan compatibility pair: %v", err)
+		}
+		pairs = append(pairs, p)
+	}
+	return pairs, rows.Err()
+}
+
+// importRow is a part and model SKU pair read from line Line of the file
+type importRow struct {
+	Line     int
+	PartSKU  string
+	ModelSKU string
+}
+
+// ImportCompatibility reads part SKU and model SKU pairs from a CSV file (";" or ","
+// separated, as exported) and adds them. With replace, the parts in the file stop fitting
+// the models that are not listed for them. Every row is validated first; if any is
+// invalid, nothing is changed and the errors are returned in the result.
+func ImportCompatibility(file io.Reader, replace bool) (*CompatibilityImport, error) {
+	rows, skipped, err := readCompatibilityFile(file)
+	if err != nil {
+		return nil, err
+	}
+	result := &CompatibilityImport{Rows: len(rows) + skipped, Skipped: skipped}
+
+	skus := make([]string, 0, len(rows)*2)
+	for _, row := range rows {
+		skus = append(skus, row.PartSKU, row.ModelSKU)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	type skuProduct struct {
+		ID           int
+		AllowsCompat bool
+	}
+	bySKU := map[string]skuProduct{}
+	skuRows, err := tx.Query(`
+		SELECT p.id, p.sku, c.allows_compatibility
+		FROM products p
+		JOIN categories c ON p.category_id = c.id
+		WHERE p.sku = ANY($1)`, pq.Array(skus))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query products by SKU: %v", err)
+	}
+	for skuRows.Next() {
+		var p skuProduct
+		var sku string
+		if err := skuRows.Scan(&p.ID, &sku, &p.AllowsCompat); err != nil {
+			skuRows.Close()
+			return nil, fmt.Errorf("failed to scan product by SKU: %v", err)
+		}
+		bySKU[sku] = p
+	}
+	skuRows.Close()
+	if err := skuRows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query products by SKU: %v", err)
+	}
+
+	pairs := map[int][]int{}
+	seen := map[[2]int]bool{}
+	for _, row := range rows {
+		part, partFound := bySKU[row.PartSKU]
+		model, modelFound := bySKU[row.ModelSKU]
+		var message string
+		switch {
+		case !partFound:
+			message = fmt.Sprintf("peça com SKU %q não encontrada", row.PartSKU)
+		case !modelFound:
+			message = fmt.Sprintf("modelo com SKU %q não encontrado", row.ModelSKU)
+		case !part.AllowsCompat:
+			message = fmt.Sprintf("%q não é de uma categoria que permite compatibilidade", row.PartSKU)
+		case part.ID == model.ID:
+			message = "peça e modelo são o mesmo produto"
+		}
+		if message != "" {
+			if len(result.Errors) < maxImportErrors {
+				result.Errors = append(result.Errors, fmt.Sprintf("linha %d: %s", row.Line, message))
+			} else if len(result.Errors) == maxImportErrors {
+				result.Errors = append(result.Errors, "outras linhas com erro foram omitidas")
+			}
+			continue
+		}
+		if seen[[2]int{part.ID, model.ID}] {
+			continue
+		}
+		seen[[2]int{part.ID, model.ID}] = true
+		pairs[part.ID] = append(pairs[part.ID], model.ID)
+	}
+	if len(result.Errors) > 0 || len(pairs) == 0 {
+		return result, nil
+	}
+
+	partIDs := make([]int, 0, len(pairs))
+	for partID := range pairs {
+		partIDs = append(partIDs, partID)
+	}
+	sort.Ints(partIDs)
+
+	before, err := fitsByPart(tx, partIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, partID := range partIDs {
+		modelIDs := make([]int64, len(pairs[partID]))
+		for i, id := range pairs[partID] {
+			modelIDs[i] = int64(id)
+		}
+
+		if replace {
+			removed, err := tx.Exec(`DELETE FROM product_compatibility
+				WHERE part_product_id = $1 AND NOT (fits_product_id = ANY($2))`, partID, pq.Array(modelIDs))
+			if err != nil {
+				return nil, fmt.Errorf("failed to remove compatibility: %v", err)
+			}
+			if n, err := removed.RowsAffected(); err == nil {
+				result.Removed += int(n)
+			}
+		}
+
+		added, err := tx.Exec(`INSERT INTO product_compatibility (part_product_id, fits_product_id)
+			SELECT $1::int, unnest($2::int[])
+			ON CONFLICT DO NOTHING`, partID, pq.Array(modelIDs))
+		if err != nil {
+			return nil, fmt.Errorf("failed to add compatibility: %v", err)
+		}
+		if n, err := added.RowsAffected(); err == nil {
+			result.Added += int(n)
+		}
+	}
+
+	after, err := fitsByPart(tx, partIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	for _, partID := range partIDs {
+		if !slices.Equal(before[partID], after[partID]) {
+			result.Changes = append(result.Changes, CompatibilityChange{PartID: partID, Before: before[partID], After: after[partID]})
+		}
+	}
+	return result, nil
+}
+
+// readCompatibilityFile reads the SKU columns of a compatibility CSV, locating them by their
+// titles in the first line. Lines without one of the SKUs are skipped and counted.
+func readCompatibilityFile(file io.Reader) ([]importRow, int, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read compatibility file: %v", err)
+	}
+	text := strings.TrimPrefix(string(data), "\ufeff")
+
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	firstLine, _, _ := strings.Cut(text, "\n")
+	if strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+		reader.Comma = ';'
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, 0, ErrInvalidCompatibilityFile
+	}
+	partColumn, modelColumn := -1, -1
+	for i, title := range header {
+		title = strings.TrimSpace(title)
+		if strings.EqualFold(title, CompatibilityPartSKUColumn) {
+			partColumn = i
+		} else if strings.EqualFold(title, CompatibilityModelSKUColumn) {
+			modelColumn = i
+		}
+	}
+	if partColumn < 0 || modelColumn < 0 {
+		return nil, 0, ErrInvalidCompatibilityFile
+	}
+
+	var rows []importRow
+	skipped := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, ErrInvalidCompatibilityFile
+		}
+		if len(record) <= partColumn || len(record) <= modelColumn {
+			skipped++
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		row := importRow{
+			Line:     line,
+			PartSKU:  spreadsheet.UnescapeFormula(strings.TrimSpace(record[partColumn])),
+			ModelSKU: spreadsheet.UnescapeFormula(strings.TrimSpace(record[modelColumn])),
+		}
+		if row.PartSKU == "" || row.ModelSKU == "" {
+			skipped++
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, skipped, nil
+}
@@ -0,0 +1,135 @@
+package products
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// FinderModel is an appliance (a product of a category without compatibility, such as a
+// purifier) that has parts or refills registered for it
+type FinderModel struct {
+	ID        int    `json:"id"` // product ID
+	Name      string `json:"name"`
+	SKU       string `json:"sku"`
+	Image     string `json:"image"`
+	PartCount int    `json:"partCount"`
+}
+
+// finderModelFrom selects the appliances with at least one compatible part
+const finderModelFrom = `
+	FROM products
+	JOIN items ON products.item_id = items.id
+	JOIN categories c ON products.category_id = c.id
+	LEFT JOIN product_images pi ON products.id = pi.product_id AND pi.is_primary = TRUE`
+
+const finderModelCondition = `c.allows_compatibility = FALSE
+	AND EXISTS (SELECT 1 FROM product_compatibility pc WHERE pc.fits_product_id = products.id)`
+
+const finderModelColumns = `products.id, items.name, COALESCE(products.sku, ''), COALESCE(pi.image_url, ''),
+	(SELECT COUNT(*) FROM product_compatibility pc WHERE pc.fits_product_id = products.id)`
+
+// GetFinderBrands returns the brands with appliances that have parts, with their number of
+// such models
+func GetFinderBrands() ([]BrandSearchResult, error) {
+	rows, err := db.Query(`
+		SELECT b.id, b.name, COUNT(DISTINCT products.id)
+		FROM brands b
+		JOIN product_brands pb ON pb.brand_id = b.id
+		JOIN products ON products.id = pb.product_id
+		JOIN categories c ON products.category_id = c.id
+		WHERE ` + finderModelCondition + `
+		GROUP BY b.id, b.name
+		ORDER BY b.name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query finder brands: %v", err)
+	}
+	defer rows.Close()
+
+	brands := []BrandSearchResult{}
+	for rows.Next() {
+		var b BrandSearchResult
+		if err := rows.Scan(&b.ID, &b.Name, &b.ProductCount); err != nil {
+			return nil, fmt.Errorf("failed to scan finder brand: %v", err)
+		}
+		brands = append(brands, b)
+	}
+	return brands, rows.Err()
+}
+
+// GetFinderModels returns the appliances of a brand that have parts
+func GetFinderModels(brandID int) ([]FinderModel, error) {
+	models, err := queryFinderModels(`
+		SELECT `+finderModelColumns+finderModelFrom+`
+		WHERE `+finderModelCondition+`
+			AND EXISTS (SELECT 1 FROM product_brands pb WHERE pb.product_id = products.id AND pb.brand_id = $1)
+		ORDER BY items.name`, brandID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query finder models: %v", err)
+	}
+	return models, nil
+}
+
+// GetFinderModel returns an appliance that has parts, or sql.ErrNoRows
+func GetFinderModel(productID int) (*FinderModel, error) {
+	var m FinderModel
+	err := db.QueryRow(`
+		SELECT `+finderModelColumns+finderModelFrom+`
+		WHERE products.id = $1 AND `+finderModelCondition, productID).
+		Scan(&m.ID, &m.Name, &m.SKU, &m.Image, &m.PartCount)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query finder model: %v", err)
+	}
+	return &m, nil
+}
+
+// FindModels looks up appliances that have parts by name, brand or SKU as typed by the
+// customer ("ibbl fr600", "europa da vinci"), tolerating typos in the name
+func FindModels(query string, limit int) ([]FinderModel, error) {
+	query = strings.TrimSpace(query)
+	synonyms, err := searchSynonyms(query)
+	if err != nil {
+		return nil, err
+	}
+	tsQuery := searchTSQuery(query, synonyms)
+	if tsQuery == "" {
+		return []FinderModel{}, nil
+	}
+
+	models, err := queryFinderModels(`
+		SELECT `+finderModelColumns+finderModelFrom+`
+		CROSS JOIN to_tsquery('portuguese_unaccent', $1) AS tsq
+		WHERE `+finderModelCondition+`
+			AND (products.search_document @@ tsq
+				OR word_similarity(immutable_unaccent($2), immutable_unaccent(items.name)) > 0.5
+				OR products.sku ILIKE $3)
+		ORDER BY (ts_rank_cd(products.search_document, tsq, 32) * 2
+			+ word_similarity(immutable_unaccent($2), immutable_unaccent(items.name))
+			+ CASE WHEN LOWER(products.sku) = LOWER($2) THEN 2 ELSE 0 END) DESC, items.name
+		LIMIT $4`, tsQuery, query, likePattern(query), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find models: %v", err)
+	}
+	return models, nil
+}
+
+func queryFinderModels(query string, args ...interface{}) ([]FinderModel, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	models := []FinderModel{}
+	for rows.Next() {
+		var m FinderModel
+		if err := rows.Scan(&m.ID, &m.Name, &m.SKU, &m.Image, &m.PartCount); err != nil {
+			return nil, err
+		}
+		models = append(models, m)
+	}
+	return models, rows.Err()
+}
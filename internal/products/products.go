@@ -57,8 +57,11 @@ type ProductTechnicalSpec struct {
 }
 
 type Brand struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Slug        string `json:"slug"`
+	Logo        string `json:"logo"`
+	Description string `json:"description"`
 }
 
 type Category struct {
@@ -67,6 +70,21 @@ type Category struct {
 	Slug                string `json:"slug"`
 	AllowsCompatibility bool   `json:"allowsCompatibility"`
 	IsActive            bool   `json:"isActive"`
+	ParentID            int    `json:"parentId"` // 0 for a top-level category
+	DisplayOrder        int    `json:"displayOrder"`
+
+	// Depth is the level of the category in a tree-ordered list, 0 for top-level
+	Depth int `json:"depth"`
+
+	CategoryContent
+}
+
+// CategoryContent is what the category landing page shows besides the products
+type CategoryContent struct {
+	Description     string `json:"description"`
+	HeroImage       string `json:"heroImage"`
+	SEOTitle        string `json:"seoTitle"`
+	MetaDescription string `json:"metaDescription"`
 }
 
 type ProductOption struct {
@@ -128,53 +146,6 @@ func scanProduct(rows *sql.Rows) (Product, error) {
 	return p, nil
 }
 
-// scanSearchProduct scans a product row with similarity score from search queries
-func scanSearchProduct(rows *sql.Rows) (Product, error) {
-	var p Product
-	var offerID sql.NullInt64
-	var offerPrice sql.NullFloat64
-	var startDate, endDate sql.NullTime
-	var isActive sql.NullBool
-	var similarityScore float64 // Ignored, just for ORDER BY
-
-	err := rows.Scan(&p.ID, &p.ProductID, &p.Name, &p.Price, &p.Image, &p.CategoryID, &p.Category, &p.CategoryName, &p.AllowsCompatibility, &p.Description, &p.SKU, &p.IsAvailable,
-		&offerID, &offerPrice, &startDate, &endDate, &isActive, &similarityScore)
-	if err != nil {
-		return p, err
-	}
-
-	// Check if product has an active offer
-	if offerID.Valid && isActive.Valid && isActive.Bool {
-		now := time.Now()
-		offerStart := startDate.Time
-		offerEnd := endDate.Time
-
-		// Check if offer is currently active based on dates
-		isCurrentlyActive := true
-		if startDate.Valid && now.Before(offerStart) {
-			isCurrentlyActive = false
-		}
-		if endDate.Valid && now.After(offerEnd) {
-			isCurrentlyActive = false
-		}
-
-		if isCurrentlyActive {
-			p.IsOnOffer = true
-			if offerPrice.Valid {
-				p.OfferPrice = offerPrice.Float64
-			}
-			if startDate.Valid {
-				p.OfferStartDate = &offerStart
-			}
-			if endDate.Valid {
-				p.OfferEndDate = &offerEnd
-			}
-		}
-	}
-
-	return p, nil
-}
-
 // GetAllProducts retrieves all products from the database
 func GetAllProducts() ([]Product, error) {
 	query := `SELECT items.id, products.id, items.name, items.price, COALESCE(pi.image_url, ''), products.category_id, c.slug, c.name, c.allows_compatibility,
@@ -211,56 +182,7 @@ func GetProductsByCategory(categorySlug string) ([]Product, error) {
 
 // GetProductsByCategoryAndBrands retrieves products by category and brand filters from the database
 func GetProductsByCategoryAndBrands(categorySlug string, brandIDs []int) ([]Product, error) {
-	var rows *sql.Rows
-	var err error
-
-	if categorySlug == "" && len(brandIDs) == 0 {
-		return GetAllProducts()
-	}
-
-	query := `SELECT DISTINCT items.id, products.id, items.name, items.price, COALESCE(pi.image_url, ''), products.category_id, c.slug, c.name, c.allows_compatibility,
-		products.description, products.sku, items.is_available, o.id, o.offer_price, o.start_date, o.end_date, o.is_active
-		FROM products
-		JOIN items ON products.item_id = items.id
-		JOIN categories c ON products.category_id = c.id
-		LEFT JOIN offers o ON products.id = o.product_id AND o.is_active = TRUE
-		LEFT JOIN product_images pi ON products.id = pi.product_id AND pi.is_primary = TRUE`
-	var args []interface{}
-	var conditions []string
-
-	if len(brandIDs) > 0 {
-		query += " JOIN product_brands ON products.id = product_brands.product_id"
-		conditions = append(conditions, "product_brands.brand_id = ANY($"+string(rune('0'+len(args)+1))+")")
-		args = append(args, pq.Array(brandIDs))
-	}
-
-	if categorySlug != "" {
-		conditions = append(conditions, "c.slug = $"+string(rune('0'+len(args)+1)))
-		args = append(args, categorySlug)
-	}
-
-	if len(conditions) > 0 {
-		query += " WHERE " + strings.Join(conditions, " AND ")
-	}
-
-	query += " ORDER BY items.id DESC"
-
-	rows, err = db.Query(query, args...)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var products []Product
-	for rows.Next() {
-		p, err := scanProduct(rows)
-		if err != nil {
-			return nil, err
-		}
-		products = append(products, p)
-	}
-
-	return products, nil
+	return GetCatalogProducts(CatalogFilters{Category: categorySlug, BrandIDs: brandIDs})
 }
 
 // GetProductByID retrieves a single product by ID
@@ -390,6 +312,11 @@ func CreateProduct(name string, price float64, categoryID int, description, sku
 		return nil, err
 	}
 
+	if err := refreshSearchDocument(tx, productID); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
 	if err = tx.Commit(); err != nil {
 		return nil, err
 	}
@@ -478,6 +405,11 @@ func UpdateProduct(id int, name string, price float64, categoryID int, descripti
 		return err
 	}
 
+	if err := refreshSearchDocument(tx, productID); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
 	if err = tx.Commit(); err != nil {
 		return err
 	}
@@ -486,7 +418,7 @@ func UpdateProduct(id int, name string, price float64, categoryID int, descripti
 }
 
 func GetAllBrands() ([]Brand, error) {
-	rows, err := db.Query("SELECT id, name FROM brands ORDER BY name")
+	rows, err := db.Query("SELECT " + brandColumns + " FROM brands ORDER BY name")
 	if err != nil {
 		return nil, err
 	}
@@ -494,11 +426,11 @@ func GetAllBrands() ([]Brand, error) {
 
 	var brands []Brand
 	for rows.Next() {
-		var b Brand
-		if err := rows.Scan(&b.ID, &b.Name); err != nil {
+		b, err := scanBrand(rows)
+		if err != nil {
 			return nil, err
 		}
-		brands = append(brands, b)
+		brands = append(brands, *b)
 	}
 
 	return brands, nil
@@ -512,10 +444,11 @@ func CreateBrand(name string) (*Brand, error) {
 
 	var brand Brand
 	brand.Name = trimmed
-	err := db.QueryRow("INSERT INTO brands (name) VALUES ($1) RETURNING id", trimmed).Scan(&brand.ID)
+	brand.Slug = brandSlug(trimmed)
+	err := db.QueryRow("INSERT INTO brands (name, slug) VALUES ($1, $2) RETURNING id", trimmed, brand.Slug).Scan(&brand.ID)
 	if err != nil {
-		if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == "23505" {
-			return nil, fmt.Errorf("marca ja cadastrada")
+		if conflict := brandConflict(err); conflict != nil {
+			return nil, conflict
 		}
 		return nil, err
 	}
@@ -724,7 +657,7 @@ func DeleteProduct(id int) error {
 
 // GetBrandNamesByProductID returns brand names for a product
 func GetBrandNamesByProductID(productID int) ([]Brand, error) {
-	query := `SELECT b.id, b.name
+	query := `SELECT b.id, b.name, b.slug
 		FROM brands b
 		JOIN product_brands pb ON b.id = pb.brand_id
 		WHERE pb.product_id = $1
@@ -739,7 +672,7 @@ func GetBrandNamesByProductID(productID int) ([]Brand, error) {
 	var brands []Brand
 	for rows.Next() {
 		var b Brand
-		if err := rows.Scan(&b.ID, &b.Name); err != nil {
+		if err := rows.Scan(&b.ID, &b.Name, &b.Slug); err != nil {
 			return nil, err
 		}
 		brands = append(brands, b)
@@ -814,69 +747,39 @@ func GetPartsForProduct(productID int) ([]Product, error) {
 type BrandSearchResult struct {
 	ID           int    `json:"id"`
 	Name         string `json:"name"`
+	Slug         string `json:"slug"`
 	ProductCount int    `json:"productCount"`
 }
 
-// SearchProducts searches for products using fuzzy matching (trigram similarity)
-func SearchProducts(query string, limit int) ([]Product, error) {
+// SearchBrandsWithCount searches for brands using fuzzy matching and returns product counts
+func SearchBrandsWithCount(query string, limit int) ([]BrandSearchResult, error) {
 	if query == "" {
-		return []Product{}, nil
+		return []BrandSearchResult{}, nil
 	}
 
-	// Use trigram similarity for fuzzy search with ILIKE as fallback
-	// similarity > 0.3 provides good fuzzy matching while filtering out irrelevant results
-	searchQuery := `%` + query + `%`
-
-	rows, err := db.Query(`
-		SELECT DISTINCT items.id, products.id, items.name, items.price, COALESCE(pi.image_url, ''), products.category_id, c.slug, c.name, c.allows_compatibility,
-			products.description, products.sku, items.is_available, o.id, o.offer_price, o.start_date, o.end_date, o.is_active,
-			similarity(items.name, $2) as similarity_score
-		FROM products
-		JOIN items ON products.item_id = items.id
-		JOIN categories c ON products.category_id = c.id
-		LEFT JOIN offers o ON products.id = o.product_id AND o.is_active = TRUE
-		LEFT JOIN product_images pi ON products.id = pi.product_id AND pi.is_primary = TRUE
-		WHERE items.name ILIKE $1
-			OR similarity(items.name, $2) > 0.3
-		ORDER BY similarity_score DESC, items.name
-		LIMIT $3`,
-		searchQuery, query, limit)
+	// Use trigram similarity for fuzzy search with ILIKE as fallback, ignoring accents.
+	// The synonyms of the query or of its words match brand names too.
+	synonyms, err := searchSynonyms(query)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var products []Product
-	for rows.Next() {
-		p, err := scanSearchProduct(rows)
-		if err != nil {
-			return nil, err
+	patterns := []string{likePattern(query)}
+	for _, alternatives := range synonyms {
+		for _, synonym := range alternatives {
+			patterns = append(patterns, likePattern(synonym))
 		}
-		products = append(products, p)
-	}
-
-	return products, nil
-}
-
-// SearchBrandsWithCount searches for brands using fuzzy matching and returns product counts
-func SearchBrandsWithCount(query string, limit int) ([]BrandSearchResult, error) {
-	if query == "" {
-		return []BrandSearchResult{}, nil
 	}
 
-	// Use trigram similarity for fuzzy search with ILIKE as fallback
-	searchQuery := `%` + query + `%`
-
 	rows, err := db.Query(`
-		SELECT b.id, b.name, COUNT(DISTINCT pb.product_id) as product_count
+		SELECT b.id, b.name, b.slug, COUNT(DISTINCT pb.product_id) as product_count
 		FROM brands b
 		LEFT JOIN product_brands pb ON b.id = pb.brand_id
-		WHERE b.name ILIKE $1
-			OR similarity(b.name, $2) > 0.3
-		GROUP BY b.id, b.name
-		ORDER BY similarity(b.name, $2) DESC, b.name
+		WHERE immutable_unaccent(b.name) ILIKE ANY (SELECT immutable_unaccent(p) FROM unnest($1::text[]) AS p)
+			OR similarity(immutable_unaccent(b.name), immutable_unaccent($2)) > 0.3
+		GROUP BY b.id, b.name, b.slug
+		ORDER BY similarity(immutable_unaccent(b.name), immutable_unaccent($2)) DESC, b.name
 		LIMIT $3`,
-		searchQuery, query, limit)
+		pq.Array(patterns), query, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -885,7 +788,7 @@ func SearchBrandsWithCount(query string, limit int) ([]BrandSearchResult, error)
 	var brands []BrandSearchResult
 	for rows.Next() {
 		var b BrandSearchResult
-		if err := rows.Scan(&b.ID, &b.Name, &b.ProductCount); err != nil {
+		if err := rows.Scan(&b.ID, &b.Name, &b.Slug, &b.ProductCount); err != nil {
 			return nil, err
 		}
 		brands = append(brands, b)
@@ -1063,82 +966,60 @@ func SaveProductTechnicalSpecs(productID int, specs []ProductTechnicalSpec) erro
 		}
 	}
 
+	if err := refreshSearchDocument(tx, productID); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
 	return tx.Commit()
 }
 
 // Category functions
 
+// GetAllCategories returns every category in tree order: each one is followed by its
+// subcategories, siblings sorted by their display order
 func GetAllCategories() ([]Category, error) {
-	rows, err := db.Query("SELECT id, name, slug, allows_compatibility, is_active FROM categories ORDER BY name")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var categories []Category
-	for rows.Next() {
-		var c Category
-		if err := rows.Scan(&c.ID, &c.Name, &c.Slug, &c.AllowsCompatibility, &c.IsActive); err != nil {
-			return nil, err
-		}
-		categories = append(categories, c)
-	}
-
-	return categories, nil
+	return queryCategories("SELECT " + categoryColumns + " FROM categories ORDER BY display_order, name")
 }
 
+// GetActiveCategories returns the active categories in tree order. A category whose
+// parent is inactive is listed as a top-level one.
 func GetActiveCategories() ([]Category, error) {
-	rows, err := db.Query("SELECT id, name, slug, allows_compatibility, is_active FROM categories WHERE is_active = TRUE ORDER BY name")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var categories []Category
-	for rows.Next() {
-		var c Category
-		if err := rows.Scan(&c.ID, &c.Name, &c.Slug, &c.AllowsCompatibility, &c.IsActive); err != nil {
-			return nil, err
-		}
-		categories = append(categories, c)
-	}
-
-	return categories, nil
+	return queryCategories("SELECT " + categoryColumns + " FROM categories WHERE is_active = TRUE ORDER BY display_order, name")
 }
 
 func GetCategoryBySlug(slug string) (*Category, error) {
-	var c Category
-	err := db.QueryRow("SELECT id, name, slug, allows_compatibility, is_active FROM categories WHERE slug = $1", slug).Scan(
-		&c.ID, &c.Name, &c.Slug, &c.AllowsCompatibility, &c.IsActive,
-	)
+	c, err := scanCategory(db.QueryRow("SELECT "+categoryColumns+" FROM categories WHERE slug = $1", slug))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("categoria nao encontrada")
+			return nil, ErrCategoryNotFound
 		}
 		return nil, err
 	}
-	return &c, nil
+	return c, nil
 }
 
 func GetCategoryByID(id int) (*Category, error) {
-	var c Category
-	err := db.QueryRow("SELECT id, name, slug, allows_compatibility, is_active FROM categories WHERE id = $1", id).Scan(
-		&c.ID, &c.Name, &c.Slug, &c.AllowsCompatibility, &c.IsActive,
-	)
+	c, err := scanCategory(db.QueryRow("SELECT "+categoryColumns+" FROM categories WHERE id = $1", id))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("categoria nao encontrada")
+			return nil, ErrCategoryNotFound
 		}
 		return nil, err
 	}
-	return &c, nil
+	return c, nil
 }
 
-func CreateCategory(name string, allowsCompatibility bool) (*Category, error) {
+// CreateCategory adds a category as the last child of parentID (0 for a top-level one)
+func CreateCategory(name string, allowsCompatibility bool, parentID int, content CategoryContent) (*Category, error) {
 	trimmed := strings.TrimSpace(name)
 	if trimmed == "" {
 		return nil, fmt.Errorf("nome da categoria nao pode ser vazio")
 	}
+	content, err := validateCategoryContent(content)
+	if err != nil {
+		return nil, err
+	}
 
 	slug := strings.ToLower(trimmed)
 	slug = strings.ReplaceAll(slug, " ", "-")
@@ -1160,11 +1041,27 @@ func CreateCategory(name string, allowsCompatibility bool) (*Category, error) {
 	c.Slug = slug
 	c.AllowsCompatibility = allowsCompatibility
 	c.IsActive = true
+	c.ParentID = parentID
+	c.CategoryContent = content
 
-	err := db.QueryRow(
-		"INSERT INTO categories (name, slug, allows_compatibility) VALUES ($1, $2, $3) RETURNING id",
-		trimmed, slug, allowsCompatibility,
-	).Scan(&c.ID)
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := checkCategoryParent(tx, 0, parentID); err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow(
+		`INSERT INTO categories (name, slug, allows_compatibility, parent_id, display_order,
+			description, hero_image, seo_title, meta_description)
+		VALUES ($1, $2, $3, NULLIF($4::int, 0), (`+nextCategoryOrder(4)+`), $5, $6, $7, $8)
+		RETURNING id, display_order`,
+		trimmed, slug, allowsCompatibility, parentID,
+		content.Description, content.HeroImage, content.SEOTitle, content.MetaDescription,
+	).Scan(&c.ID, &c.DisplayOrder)
 	if err != nil {
 		if pgErr, ok := err.(*pq.Error); ok && pgErr.Code == "23505" {
 			return nil, fmt.Errorf("categoria ja cadastrada")
@@ -1172,18 +1069,42 @@ func CreateCategory(name string, allowsCompatibility bool) (*Category, error) {
 		return nil, err
 	}
 
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 	return &c, nil
 }
 
-func UpdateCategory(id int, name string, allowsCompatibility bool, isActive bool) error {
+// UpdateCategory saves a category. Moving it to another parent puts it after its new
+// siblings.
+func UpdateCategory(id int, name string, allowsCompatibility bool, isActive bool, parentID int, content CategoryContent) error {
 	trimmed := strings.TrimSpace(name)
 	if trimmed == "" {
 		return fmt.Errorf("nome da categoria nao pode ser vazio")
 	}
+	content, err := validateCategoryContent(content)
+	if err != nil {
+		return err
+	}
 
-	result, err := db.Exec(
-		"UPDATE categories SET name = $1, allows_compatibility = $2, is_active = $3 WHERE id = $4",
-		trimmed, allowsCompatibility, isActive, id,
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := checkCategoryParent(tx, id, parentID); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(
+		`UPDATE categories SET name = $1, allows_compatibility = $2, is_active = $3,
+			display_order = CASE WHEN parent_id IS NOT DISTINCT FROM NULLIF($5::int, 0) THEN display_order ELSE (`+nextCategoryOrder(5)+`) END,
+			parent_id = NULLIF($5::int, 0),
+			description = $6, hero_image = $7, seo_title = $8, meta_description = $9
+		WHERE id = $4`,
+		trimmed, allowsCompatibility, isActive, id, parentID,
+		content.Description, content.HeroImage, content.SEOTitle, content.MetaDescription,
 	)
 	if err != nil {
 		return err
@@ -1198,7 +1119,7 @@ func UpdateCategory(id int, name string, allowsCompatibility bool, isActive bool
 		return fmt.Errorf("categoria nao encontrada")
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 func ToggleCategoryActive(id int) error {
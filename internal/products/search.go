@@ -0,0 +1,237 @@
+package products
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Markers around the matched words of SearchResult highlights. They are control characters
+// so they never clash with product text; templates turn them into <mark> after escaping.
+const (
+	HighlightStart = "\x02"
+	HighlightStop  = "\x03"
+)
+
+// SearchResult is a product found by a search, with the matched words between the
+// highlight markers
+type SearchResult struct {
+	Product
+	NameHighlight string `json:"nameHighlight"`
+	Snippet       string `json:"snippet,omitempty"`
+}
+
+// SearchPage is one page of search results
+type SearchPage struct {
+	Query   string
+	Results []SearchResult
+	Pagination
+}
+
+// searchFrom joins the full-text query as tsq. It uses the document and text search
+// configuration of migration 16_product_search.sql.
+const searchFrom = `
+	FROM products
+	JOIN items ON products.item_id = items.id
+	JOIN categories c ON products.category_id = c.id
+	LEFT JOIN offers o ON products.id = o.product_id AND o.is_active = TRUE
+	CROSS JOIN to_tsquery('portuguese_unaccent', $1) AS tsq`
+
+// searchCondition matches the full-text document (name, SKU, brands, specs, description),
+// partial or misspelled names and partial SKUs. $2 is the LIKE pattern, $3 the typed text.
+const searchCondition = `
+	WHERE (products.search_document @@ tsq
+		OR immutable_unaccent(items.name) ILIKE immutable_unaccent($2)
+		OR word_similarity(immutable_unaccent($3), immutable_unaccent(items.name)) > 0.5
+		OR products.sku ILIKE $2)`
+
+// searchRank weighs the full-text rank, the name similarity and exact SKU matches
+const searchRank = `(ts_rank_cd(products.search_document, tsq, 32) * 2
+	+ word_similarity(immutable_unaccent($3), immutable_unaccent(items.name))
+	+ CASE WHEN LOWER(products.sku) = LOWER($3) THEN 2 ELSE 0 END)`
+
+var headlineOptions = `StartSel="` + HighlightStart + `", StopSel="` + HighlightStop + `"`
+
+// searchWords splits the typed text into words, dropping punctuation
+func searchWords(query string) []string {
+	return strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// prefixQuery turns the words of text into a prefix query ("purif agu" becomes
+// "purif:* & agu:*") so products show up while the customer is still typing
+func prefixQuery(text string) string {
+	words := searchWords(text)
+	for i, word := range words {
+		words[i] = word + ":*"
+	}
+	return strings.Join(words, " & ")
+}
+
+// withSynonyms adds the synonyms as alternatives of a query part
+func withSynonyms(part string, synonyms []string) string {
+	if len(synonyms) == 0 {
+		return part
+	}
+	alternatives := []string{part}
+	for _, synonym := range synonyms {
+		alternatives = append(alternatives, "("+prefixQuery(synonym)+")")
+	}
+	return "(" + strings.Join(alternatives, " | ") + ")"
+}
+
+// searchTSQuery builds the prefix query of the typed text, where each word also matches
+// its synonyms ("filtro agua" becomes "(filtro:* | (refil:*)) & agua:*") and a query of
+// several words also matches the synonyms of the whole phrase
+func searchTSQuery(query string, synonyms map[string][]string) string {
+	words := searchWords(query)
+	parts := make([]string, len(words))
+	for i, word := range words {
+		parts[i] = withSynonyms(word+":*", synonyms[word])
+	}
+	tsQuery := strings.Join(parts, " & ")
+	if len(words) > 1 {
+		tsQuery = withSynonyms("("+tsQuery+")", synonyms[strings.Join(words, " ")])
+	}
+	return tsQuery
+}
+
+// likePattern escapes the LIKE wildcards of term and wraps it for a substring match
+func likePattern(term string) string {
+	term = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term)
+	return "%" + term + "%"
+}
+
+// SearchProducts returns the best matches for the query, for the search dropdown
+func SearchProducts(query string, limit int) ([]SearchResult, error) {
+	query = strings.TrimSpace(query)
+	synonyms, err := searchSynonyms(query)
+	if err != nil {
+		return nil, err
+	}
+	tsQuery := searchTSQuery(query, synonyms)
+	if tsQuery == "" {
+		return []SearchResult{}, nil
+	}
+	return searchProducts(query, tsQuery, limit, 0)
+}
+
+// SearchProductsPage returns one page of the matches for the query and their total.
+// Pages start at 1.
+func SearchProductsPage(query string, page, pageSize int) (*SearchPage, error) {
+	if page < 1 {
+		page = 1
+	}
+	query = strings.TrimSpace(query)
+	result := &SearchPage{Query: query, Pagination: Pagination{Page: page, PageSize: pageSize}}
+
+	synonyms, err := searchSynonyms(query)
+	if err != nil {
+		return nil, err
+	}
+	tsQuery := searchTSQuery(query, synonyms)
+	if tsQuery == "" {
+		return result, nil
+	}
+
+	err = db.QueryRow(`SELECT COUNT(*)`+searchFrom+searchCondition, tsQuery, likePattern(query), query).Scan(&result.Total)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count search results: %v", err)
+	}
+	if result.Total == 0 {
+		return result, nil
+	}
+
+	result.Results, err = searchProducts(query, tsQuery, pageSize, (page-1)*pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func searchProducts(query, tsQuery string, limit, offset int) ([]SearchResult, error) {
+	rows, err := db.Query(`
+		SELECT items.id, products.id, items.name, items.price, COALESCE(pi.image_url, ''), products.category_id, c.slug, c.name, c.allows_compatibility,
+			COALESCE(products.description, ''), COALESCE(products.sku, ''), items.is_available, o.id, o.offer_price, o.start_date, o.end_date, o.is_active,
+			ts_headline('portuguese_unaccent', items.name, tsq, 'HighlightAll=true, ' || $4::text),
+			ts_headline('portuguese_unaccent', COALESCE(products.description, ''), tsq, 'MaxFragments=1, MaxWords=25, MinWords=10, ' || $4::text)`+
+		searchFrom+`
+		LEFT JOIN product_images pi ON products.id = pi.product_id AND pi.is_primary = TRUE`+
+		searchCondition+`
+		ORDER BY `+searchRank+` DESC, items.name, items.id
+		LIMIT $5 OFFSET $6`,
+		tsQuery, likePattern(query), query, headlineOptions, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search products: %v", err)
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		result, err := scanSearchProduct(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan search result: %v", err)
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// scanSearchProduct scans a product row followed by its name and description highlights
+func scanSearchProduct(rows *sql.Rows) (SearchResult, error) {
+	var r SearchResult
+	var offerID sql.NullInt64
+	var offerPrice sql.NullFloat64
+	var startDate, endDate sql.NullTime
+	var isActive sql.NullBool
+
+	err := rows.Scan(&r.ID, &r.ProductID, &r.Name, &r.Price, &r.Image, &r.CategoryID, &r.Category, &r.CategoryName, &r.AllowsCompatibility, &r.Description, &r.SKU, &r.IsAvailable,
+		&offerID, &offerPrice, &startDate, &endDate, &isActive, &r.NameHighlight, &r.Snippet)
+	if err != nil {
+		return r, err
+	}
+
+	// Check if product has an active offer
+	if offerID.Valid && isActive.Valid && isActive.Bool {
+		now := time.Now()
+		offerStart := startDate.Time
+		offerEnd := endDate.Time
+
+		// Check if offer is currently active based on dates
+		isCurrentlyActive := true
+		if startDate.Valid && now.Before(offerStart) {
+			isCurrentlyActive = false
+		}
+		if endDate.Valid && now.After(offerEnd) {
+			isCurrentlyActive = false
+		}
+
+		if isCurrentlyActive {
+			r.IsOnOffer = true
+			if offerPrice.Valid {
+				r.OfferPrice = offerPrice.Float64
+			}
+			if startDate.Valid {
+				r.OfferStartDate = &offerStart
+			}
+			if endDate.Valid {
+				r.OfferEndDate = &offerEnd
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// refreshSearchDocument rebuilds the full-text document of a product after its name, SKU,
+// description, brands or specs change
+func refreshSearchDocument(tx *sql.Tx, productID int) error {
+	if _, err := tx.Exec("SELECT refresh_product_search_document($1)", productID); err != nil {
+		return fmt.Errorf("failed to refresh search document: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package products
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrInvalidSynonym  = errors.New("informe o termo e o sinônimo, diferentes entre si")
+	ErrSynonymExists   = errors.New("este sinônimo já está cadastrado")
+	ErrSynonymNotFound = errors.New("sinônimo não encontrado")
+)
+
+// SearchSynonym makes searches for Term also find products matching Synonym. Both are
+// stored lower case and without accents.
+type SearchSynonym struct {
+	ID        int       `json:"id"`
+	Term      string    `json:"term"`
+	Synonym   string    `json:"synonym"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// normalizeSearchTerm keeps only the words of a term, separated by single spaces
+func normalizeSearchTerm(term string) string {
+	return strings.Join(searchWords(term), " ")
+}
+
+// GetSearchSynonyms returns every synonym ordered by term
+func GetSearchSynonyms() ([]SearchSynonym, error) {
+	rows, err := db.Query("SELECT id, term, synonym, created_at FROM search_synonyms ORDER BY term, synonym")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query search synonyms: %v", err)
+	}
+	defer rows.Close()
+
+	synonyms := []SearchSynonym{}
+	for rows.Next() {
+		var s SearchSynonym
+		if err := rows.Scan(&s.ID, &s.Term, &s.Synonym, &s.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan search synonym: %v", err)
+		}
+		synonyms = append(synonyms, s)
+	}
+	return synonyms, rows.Err()
+}
+
+// CreateSearchSynonym registers synonym as an alternative of term and, when twoWay is set,
+// term as an alternative of synonym. It returns the rows created.
+func CreateSearchSynonym(term, synonym string, twoWay bool) ([]SearchSynonym, error) {
+	term = normalizeSearchTerm(term)
+	synonym = normalizeSearchTerm(synonym)
+	if term == "" || synonym == "" || strings.EqualFold(term, synonym) {
+		return nil, ErrInvalidSynonym
+	}
+
+	pairs := [][2]string{{term, synonym}}
+	if twoWay {
+		pairs = append(pairs, [2]string{synonym, term})
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	created := []SearchSynonym{}
+	for _, pair := range pairs {
+		var s SearchSynonym
+		err := tx.QueryRow(`
+			INSERT INTO search_synonyms (term, synonym)
+			VALUES (LOWER(immutable_unaccent($1)), LOWER(immutable_unaccent($2)))
+			ON CONFLICT (term, synonym) DO NOTHING
+			RETURNING id, term, synonym, created_at`, pair[0], pair[1]).Scan(&s.ID, &s.Term, &s.Synonym, &s.CreatedAt)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create search synonym: %v", err)
+		}
+		created = append(created, s)
+	}
+	if len(created) == 0 {
+		return nil, ErrSynonymExists
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return created, nil
+}
+
+// DeleteSearchSynonym removes a synonym and returns it
+func DeleteSearchSynonym(id int) (*SearchSynonym, error) {
+	var s SearchSynonym
+	err := db.QueryRow("DELETE FROM search_synonyms WHERE id = $1 RETURNING id, term, synonym, created_at", id).
+		Scan(&s.ID, &s.Term, &s.Synonym, &s.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrSynonymNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete search synonym: %v", err)
+	}
+	return &s, nil
+}
+
+// searchSynonyms looks up the synonyms of each word of the query and, for queries of
+// several words, of the whole query. The map is keyed by the word or phrase as typed.
+func searchSynonyms(query string) (map[string][]string, error) {
+	terms := searchWords(query)
+	if len(terms) == 0 {
+		return map[string][]string{}, nil
+	}
+	if len(terms) > 1 {
+		terms = append(terms, strings.Join(terms, " "))
+	}
+
+	rows, err := db.Query(`
+		SELECT t.term, s.synonym
+		FROM unnest($1::text[]) AS t(term)
+		JOIN search_synonyms s ON s.term = LOWER(immutable_unaccent(t.term))
+		ORDER BY s.synonym`, pq.Array(terms))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query search synonyms: %v", err)
+	}
+	defer rows.Close()
+
+	synonyms := map[string][]string{}
+	for rows.Next() {
+		var term, synonym string
+		if err := rows.Scan(&term, &synonym); err != nil {
+			return nil, fmt.Errorf("failed to scan search synonym: %v", err)
+		}
+		synonyms[term] = append(synonyms[term], synonym)
+	}
+	return synonyms, rows.Err()
+}
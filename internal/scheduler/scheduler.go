@@ -0,0 +1,40 @@
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"lojagtec/internal/logging"
+)
+
+// Job is a background task; it receives the time of the tick
+type Job func(now time.Time) error
+
+// Every runs job right away and then once per interval, for as long as the process lives.
+// Errors and panics are logged and never stop the schedule.
+func Every(name string, interval time.Duration, job Job) {
+	go func() {
+		run(name, job, time.Now())
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			run(name, job, now)
+		}
+	}()
+}
+
+func run(name string, job Job, now time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Scheduled job %s panicked: %v", name, r)
+			logging.LogError("scheduler", name, fmt.Sprintf("panic: %v", r), nil)
+		}
+	}()
+
+	if err := job(now); err != nil {
+		log.Printf("Scheduled job %s failed: %v", name, err)
+		logging.LogError("scheduler", name, err.Error(), nil)
+	}
+}
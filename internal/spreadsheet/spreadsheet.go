@@ -0,0 +1,136 @@
+package spreadsheet
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of cell values
+const (
+	KindText = iota
+	KindMoney
+	KindInt
+	KindDateTime
+)
+
+// Cell is a typed value, formatted by each writer the way Brazilian spreadsheets expect
+type Cell struct {
+	Kind   int
+	Text   string
+	Number float64
+	Time   time.Time
+}
+
+// Text returns a text cell
+func Text(s string) Cell {
+	return Cell{Kind: KindText, Text: s}
+}
+
+// Money returns a currency cell with two decimals
+func Money(value float64) Cell {
+	return Cell{Kind: KindMoney, Number: value}
+}
+
+// Int returns an integer cell
+func Int(value int) Cell {
+	return Cell{Kind: KindInt, Number: float64(value)}
+}
+
+// DateTime returns a date and time cell; a zero time is an empty cell
+func DateTime(t time.Time) Cell {
+	if t.IsZero() {
+		return Text("")
+	}
+	return Cell{Kind: KindDateTime, Time: t}
+}
+
+// Writer streams rows of a single sheet
+type Writer interface {
+	// WriteHeader writes the column titles; it must be called before any row
+	WriteHeader(titles []string) error
+	WriteRow(cells []Cell) error
+	// Close finishes the file; it does not close the underlying io.Writer
+	Close() error
+}
+
+// csvWriter writes ";"-separated UTF-8 with a BOM so spreadsheet apps configured for pt-BR
+// open the file directly
+type csvWriter struct {
+	w *csv.Writer
+}
+
+// NewCSV returns a Writer of CSV with decimal commas and dd/mm/yyyy dates
+func NewCSV(w io.Writer) (Writer, error) {
+	if _, err := io.WriteString(w, "\ufeff"); err != nil {
+		return nil, err
+	}
+	writer := csv.NewWriter(w)
+	writer.Comma = ';'
+	return &csvWriter{w: writer}, nil
+}
+
+func (c *csvWriter) WriteHeader(titles []string) error {
+	return c.w.Write(titles)
+}
+
+func (c *csvWriter) WriteRow(cells []Cell) error {
+	record := make([]string, len(cells))
+	for i, cell := range cells {
+		switch cell.Kind {
+		case KindMoney:
+			record[i] = FormatBRL(cell.Number)
+		case KindInt:
+			record[i] = strconv.FormatInt(int64(cell.Number), 10)
+		case KindDateTime:
+			record[i] = cell.Time.Format("02/01/2006 15:04")
+		default:
+			record[i] = escapeFormula(cell.Text)
+		}
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// escapeFormula keeps customer-typed text such as "=HYPERLINK(...)" from being run as a
+// formula when the CSV is opened
+func escapeFormula(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// UnescapeFormula reverses escapeFormula for text read back from an exported CSV
+func UnescapeFormula(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune("=+-@\t\r", rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
+
+// FormatBRL formats an amount with a thousands dot and a decimal comma, e.g. "1.234,56"
+func FormatBRL(value float64) string {
+	s := fmt.Sprintf("%.2f", value)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	integer, decimals := s[:len(s)-3], s[len(s)-2:]
+
+	var grouped strings.Builder
+	for i, digit := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			grouped.WriteByte('.')
+		}
+		grouped.WriteRune(digit)
+	}
+	return sign + grouped.String() + "," + decimals
+}
@@ -0,0 +1,13 @@
+-- Self-service password resets. Only the SHA-256 of the emailed token is stored; a token
+-- works once and until expires_at.
+CREATE TABLE IF NOT EXISTS admin_password_resets (
+    id BIGSERIAL PRIMARY KEY,
+    admin_id INTEGER NOT NULL REFERENCES admin_users(id) ON DELETE CASCADE,
+    token_hash TEXT NOT NULL UNIQUE,
+    requested_ip TEXT NOT NULL DEFAULT '',
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_admin_password_resets_admin ON admin_password_resets(admin_id, created_at DESC);
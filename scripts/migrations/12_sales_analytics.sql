@@ -0,0 +1,8 @@
+-- Whether each order item was sold at an offer price, for the sales reports. Older orders did
+-- not record it and stay FALSE: comparing them with today's prices would turn any later price
+-- increase into offer sales.
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS is_on_offer BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- The reports aggregate orders by creation date and join their items
+CREATE INDEX IF NOT EXISTS idx_orders_created_at ON orders(created_at);
+CREATE INDEX IF NOT EXISTS idx_order_items_order ON order_items(order_id);
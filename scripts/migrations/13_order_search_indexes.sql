@@ -0,0 +1,17 @@
+-- Trigram indexes for the admin order search (substring ILIKE/LIKE matches)
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS idx_orders_order_number_trgm ON orders USING gin (order_number gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_orders_customer_name_trgm ON orders USING gin ((first_name || ' ' || last_name) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_orders_email_trgm ON orders USING gin (email gin_trgm_ops);
+
+-- Phones and CPFs are searched by their digits only
+CREATE INDEX IF NOT EXISTS idx_orders_phone_digits_trgm ON orders USING gin ((regexp_replace(phone, '\D', '', 'g')) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_orders_cpf_digits_trgm ON orders USING gin ((regexp_replace(COALESCE(cpf_cnpj, ''), '\D', '', 'g')) gin_trgm_ops);
+
+-- Exact filters of the order list
+CREATE INDEX IF NOT EXISTS idx_orders_payment_method ON orders(payment_method);
+CREATE INDEX IF NOT EXISTS idx_orders_neighborhood ON orders(LOWER(TRIM(neighborhood)));
+
+-- "Contains product" filter
+CREATE INDEX IF NOT EXISTS idx_order_items_item_name_trgm ON order_items USING gin (item_name gin_trgm_ops);
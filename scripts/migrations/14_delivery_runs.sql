@@ -0,0 +1,50 @@
+-- Known coordinates of delivery addresses, filled in by the staff. address_key is a normalized
+-- address, or "bairro:<name>|<city>" for a point standing for a whole neighborhood.
+CREATE TABLE IF NOT EXISTS geocode_cache (
+    address_key TEXT PRIMARY KEY,
+    latitude DOUBLE PRECISION NOT NULL,
+    longitude DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- A van run of a day, assigned to a driver/technician
+CREATE TABLE IF NOT EXISTS delivery_runs (
+    id SERIAL PRIMARY KEY,
+    run_date DATE NOT NULL,
+    assignee_id INTEGER REFERENCES admin_users(id) ON DELETE SET NULL,
+    created_by INTEGER REFERENCES admin_users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- The orders of a run in route order; stops without coordinates go last
+CREATE TABLE IF NOT EXISTS delivery_stops (
+    id SERIAL PRIMARY KEY,
+    run_id INTEGER NOT NULL REFERENCES delivery_runs(id) ON DELETE CASCADE,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL,
+    latitude DOUBLE PRECISION,
+    longitude DOUBLE PRECISION,
+    -- "address", "neighborhood" (approximate) or '' when the location is unknown
+    location_source TEXT NOT NULL DEFAULT '',
+    delivered_at TIMESTAMP,
+    delivered_by INTEGER REFERENCES admin_users(id) ON DELETE SET NULL,
+    UNIQUE (run_id, order_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_delivery_runs_date ON delivery_runs(run_date DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_delivery_runs_assignee ON delivery_runs(assignee_id, run_date DESC);
+CREATE INDEX IF NOT EXISTS idx_delivery_stops_run ON delivery_stops(run_id, position);
+-- An order can only wait in one run at a time
+CREATE UNIQUE INDEX IF NOT EXISTS idx_delivery_stops_pending_order ON delivery_stops(order_id) WHERE delivered_at IS NULL;
+
+INSERT INTO admin_roles (name, description) VALUES
+    ('delivery', 'Entregas e instalações')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO admin_role_permissions (role, permission) VALUES
+    ('admin', 'deliveries.manage'),
+    ('admin', 'deliveries.run'),
+    ('order_admin', 'deliveries.manage'),
+    ('order_admin', 'deliveries.run'),
+    ('delivery', 'deliveries.run')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,4 @@
+-- Storefront facets filter and count products by brand and by technical spec value
+CREATE INDEX IF NOT EXISTS idx_product_brands_brand ON product_brands(brand_id, product_id);
+CREATE INDEX IF NOT EXISTS idx_product_technical_specs_key_value
+    ON product_technical_specs((TRIM(spec_key)), (TRIM(spec_value)), product_id);
@@ -0,0 +1,44 @@
+-- Full-text product search: accents are ignored and Portuguese words are stemmed
+CREATE EXTENSION IF NOT EXISTS unaccent;
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- unaccent() is only STABLE, indexes need an IMMUTABLE wrapper
+CREATE OR REPLACE FUNCTION immutable_unaccent(text) RETURNS text
+    LANGUAGE sql IMMUTABLE PARALLEL SAFE STRICT
+    AS $$ SELECT public.unaccent('public.unaccent'::regdictionary, $1) $$;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_ts_config WHERE cfgname = 'portuguese_unaccent') THEN
+        CREATE TEXT SEARCH CONFIGURATION portuguese_unaccent (COPY = portuguese);
+        ALTER TEXT SEARCH CONFIGURATION portuguese_unaccent
+            ALTER MAPPING FOR hword, hword_part, word WITH unaccent, portuguese_stem;
+    END IF;
+END
+$$;
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS search_document tsvector;
+
+-- Rebuilds the search document of a product (of every product for NULL). Weights: name A,
+-- SKU and brand names B, technical spec values C, description D.
+CREATE OR REPLACE FUNCTION refresh_product_search_document(target_product_id INTEGER) RETURNS void
+    LANGUAGE sql
+    AS $$
+    UPDATE products p SET search_document =
+        setweight(to_tsvector('portuguese_unaccent', i.name), 'A') ||
+        setweight(to_tsvector('portuguese_unaccent', COALESCE(p.sku, '') || ' ' || COALESCE(
+            (SELECT string_agg(b.name, ' ') FROM product_brands pb JOIN brands b ON b.id = pb.brand_id WHERE pb.product_id = p.id), '')), 'B') ||
+        setweight(to_tsvector('portuguese_unaccent', COALESCE(
+            (SELECT string_agg(s.spec_value, ' ') FROM product_technical_specs s WHERE s.product_id = p.id), '')), 'C') ||
+        setweight(to_tsvector('portuguese_unaccent', COALESCE(p.description, '')), 'D')
+    FROM items i
+    WHERE i.id = p.item_id AND (target_product_id IS NULL OR p.id = target_product_id)
+    $$;
+
+SELECT refresh_product_search_document(NULL);
+
+CREATE INDEX IF NOT EXISTS idx_products_search_document ON products USING gin (search_document);
+
+-- Typo tolerance and partial words on the name, partial SKUs
+CREATE INDEX IF NOT EXISTS idx_items_name_unaccent_trgm ON items USING gin (immutable_unaccent(name) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_products_sku_trgm ON products USING gin (sku gin_trgm_ops);
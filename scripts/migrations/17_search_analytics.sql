@@ -0,0 +1,23 @@
+-- Customer searches with their result counts, for the admin search report
+CREATE TABLE IF NOT EXISTS search_queries (
+    id BIGSERIAL PRIMARY KEY,
+    query TEXT NOT NULL,
+    normalized_query TEXT NOT NULL,
+    result_count INTEGER NOT NULL,
+    source VARCHAR(20) NOT NULL,
+    session_hash VARCHAR(64),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_search_queries_created_at ON search_queries (created_at);
+CREATE INDEX IF NOT EXISTS idx_search_queries_session ON search_queries (session_hash, created_at);
+
+-- Words searched as alternatives of a term ("filtro" also finds "refil"). Both columns
+-- are stored lower case and unaccented; a two-way synonym is two rows.
+CREATE TABLE IF NOT EXISTS search_synonyms (
+    id SERIAL PRIMARY KEY,
+    term TEXT NOT NULL,
+    synonym TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (term, synonym)
+);
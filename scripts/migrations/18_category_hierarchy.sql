@@ -0,0 +1,12 @@
+-- Categories nest under a parent category (NULL for a top-level one) and are ordered
+-- among their siblings by display_order
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS parent_id INTEGER REFERENCES categories(id) ON DELETE SET NULL;
+ALTER TABLE categories ADD COLUMN IF NOT EXISTS display_order INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_categories_parent ON categories (parent_id, display_order);
+
+-- Keep the alphabetical order the flat list had
+UPDATE categories SET display_order = ordered.position
+FROM (SELECT id, ROW_NUMBER() OVER (ORDER BY name) AS position FROM categories) ordered
+WHERE categories.id = ordered.id
+    AND NOT EXISTS (SELECT 1 FROM categories WHERE display_order <> 0);
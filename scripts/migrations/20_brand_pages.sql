@@ -0,0 +1,18 @@
+-- Brands get a landing page at /marca/{slug} with a logo and a description
+ALTER TABLE brands ADD COLUMN IF NOT EXISTS slug TEXT;
+ALTER TABLE brands ADD COLUMN IF NOT EXISTS logo TEXT NOT NULL DEFAULT '';
+ALTER TABLE brands ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+
+-- Slugs of existing brands come from their names, without accents or punctuation
+UPDATE brands SET slug = COALESCE(
+    NULLIF(trim(both '-' from regexp_replace(lower(immutable_unaccent(name)), '[^a-z0-9]+', '-', 'g')), ''),
+    'marca-' || id)
+WHERE slug IS NULL;
+
+-- Names differing only in case or punctuation ("Fortlev" and "FortLev") keep the slug
+-- for the oldest brand
+UPDATE brands SET slug = slug || '-' || id
+WHERE EXISTS (SELECT 1 FROM brands older WHERE older.slug = brands.slug AND older.id < brands.id);
+
+ALTER TABLE brands ALTER COLUMN slug SET NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_brands_slug ON brands (slug);
@@ -0,0 +1,7 @@
+-- Order handling belongs to order_admin; product_admin keeps the catalog only
+DELETE FROM admin_role_permissions
+WHERE role = 'product_admin' AND permission IN ('orders.read', 'orders.write');
+
+UPDATE admin_roles
+SET description = 'Catálogo, ofertas e banners'
+WHERE name = 'product_admin' AND description = 'Catálogo, ofertas, banners e pedidos sem valores';
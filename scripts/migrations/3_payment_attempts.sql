@@ -0,0 +1,29 @@
+-- Secret used in customer-facing order links (tracking page, pay again)
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS access_token TEXT;
+
+UPDATE orders
+SET access_token = md5(random()::text || id::text) || md5(clock_timestamp()::text || random()::text)
+WHERE access_token IS NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_orders_access_token ON orders(access_token);
+
+CREATE TABLE IF NOT EXISTS payment_attempts (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL DEFAULT 'stripe',
+    payment_method VARCHAR(50) NOT NULL,
+    external_id TEXT,
+    status VARCHAR(50) NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_payment_attempts_order ON payment_attempts(order_id);
+CREATE INDEX IF NOT EXISTS idx_payment_attempts_external ON payment_attempts(external_id);
+
+-- Orders created before attempts were tracked keep their Stripe session as the first attempt
+INSERT INTO payment_attempts (order_id, provider, payment_method, external_id, status, created_at, updated_at)
+SELECT o.id, 'stripe', o.payment_method, o.stripe_payment_id, COALESCE(o.payment_status, 'pending'), o.created_at, o.updated_at
+FROM orders o
+WHERE o.stripe_payment_id IS NOT NULL
+  AND NOT EXISTS (SELECT 1 FROM payment_attempts pa WHERE pa.order_id = o.id);
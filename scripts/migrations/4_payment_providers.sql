@@ -0,0 +1,8 @@
+-- Data needed by providers that render the payment on our own pages (direct PIX)
+ALTER TABLE payment_attempts ADD COLUMN IF NOT EXISTS amount DECIMAL(10,2);
+ALTER TABLE payment_attempts ADD COLUMN IF NOT EXISTS payload TEXT;
+ALTER TABLE payment_attempts ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_payment_attempts_provider_external
+ON payment_attempts(provider, external_id)
+WHERE external_id IS NOT NULL;
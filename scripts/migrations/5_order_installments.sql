@@ -0,0 +1,4 @@
+-- Credit card installment plan chosen at checkout
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS installments INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS installment_value DECIMAL(10,2);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS installment_interest DECIMAL(10,2) NOT NULL DEFAULT 0;
@@ -0,0 +1,9 @@
+-- Deadline of async payments (boleto, PIX); unpaid orders are cancelled once it passes.
+-- Deadlines are compared with the application clock, so they keep their time zone.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_expires_at TIMESTAMPTZ;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_reminder_sent_at TIMESTAMPTZ;
+ALTER TABLE payment_attempts ALTER COLUMN expires_at TYPE TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_orders_awaiting_payment
+ON orders(payment_expires_at)
+WHERE status = 'pending' AND payment_expires_at IS NOT NULL;
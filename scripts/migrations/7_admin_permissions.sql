@@ -0,0 +1,49 @@
+-- Roles are rows instead of a CHECK constraint; each role grants a set of permissions
+CREATE TABLE IF NOT EXISTS admin_roles (
+    name TEXT PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS admin_role_permissions (
+    role TEXT NOT NULL REFERENCES admin_roles(name) ON DELETE CASCADE ON UPDATE CASCADE,
+    permission TEXT NOT NULL,
+    PRIMARY KEY (role, permission)
+);
+
+INSERT INTO admin_roles (name, description) VALUES
+    ('admin', 'Acesso total à administração'),
+    ('product_admin', 'Catálogo, ofertas, banners e pedidos sem valores'),
+    ('order_admin', 'Atendimento e expedição de pedidos')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO admin_role_permissions (role, permission) VALUES
+    ('admin', 'products.write'),
+    ('admin', 'offers.write'),
+    ('admin', 'banners.write'),
+    ('admin', 'orders.read'),
+    ('admin', 'orders.write'),
+    ('admin', 'orders.financial'),
+    ('admin', 'orders.refund'),
+    ('admin', 'users.manage'),
+    ('product_admin', 'products.write'),
+    ('product_admin', 'offers.write'),
+    ('product_admin', 'banners.write'),
+    ('product_admin', 'orders.read'),
+    ('product_admin', 'orders.write'),
+    ('order_admin', 'orders.read'),
+    ('order_admin', 'orders.write')
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE admin_users DROP CONSTRAINT IF EXISTS admin_users_role_check;
+ALTER TABLE admin_users ADD COLUMN IF NOT EXISTS email TEXT;
+ALTER TABLE admin_users ADD COLUMN IF NOT EXISTS is_active BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE admin_users ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'admin_users_role_fkey') THEN
+        ALTER TABLE admin_users
+            ADD CONSTRAINT admin_users_role_fkey FOREIGN KEY (role) REFERENCES admin_roles(name) ON UPDATE CASCADE;
+    END IF;
+END $$;
@@ -0,0 +1,21 @@
+-- TOTP second factor for admin users. The secret is only set once enrollment is confirmed;
+-- totp_last_step keeps an accepted code from being used twice.
+ALTER TABLE admin_users ADD COLUMN IF NOT EXISTS totp_secret TEXT;
+ALTER TABLE admin_users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE admin_users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT;
+
+-- Backup codes are stored as SHA-256 hashes and can be used once
+CREATE TABLE IF NOT EXISTS admin_backup_codes (
+    id SERIAL PRIMARY KEY,
+    admin_id INTEGER NOT NULL REFERENCES admin_users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_admin_backup_codes_admin ON admin_backup_codes(admin_id) WHERE used_at IS NULL;
+
+-- Policy: users of a role with require_two_factor must enroll before their first session
+ALTER TABLE admin_roles ADD COLUMN IF NOT EXISTS require_two_factor BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE admin_roles SET require_two_factor = TRUE WHERE name = 'admin';
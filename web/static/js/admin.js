@@ -45,7 +45,7 @@ function setupHTMXEventListeners() {
 
   document.body.addEventListener('htmx:afterSwap', function(evt) {
     if (evt.detail.successful) {
-      if (evt.detail.requestConfig.path === "/admin/brands/new") {
+      if (evt.detail.requestConfig.path === "/admin/brands/new" || evt.detail.requestConfig.path.includes("/admin/brands/edit/")) {
         const brandDialog = document.querySelector("dialog#brand-modal");
         if (brandDialog) {
           brandDialog.showModal();
@@ -338,3 +338,15 @@ window.closeStatusModal = closeStatusModal;
 window.showStatusConfirmModal = showStatusConfirmModal;
 window.backToStatusSelectModal = backToStatusSelectModal;
 window.submitStatusUpdate = submitStatusUpdate;
+
+// Download the orders matching the current filters with the export options
+function exportOrders(event) {
+  event.preventDefault();
+  const params = new URLSearchParams(new FormData(document.getElementById('orders-filters')));
+  for (const [key, value] of new FormData(event.target)) {
+    params.append(key, value);
+  }
+  window.location.href = `/admin/orders/export?${params.toString()}`;
+}
+
+window.exportOrders = exportOrders;
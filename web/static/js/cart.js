@@ -1,193 +1,75 @@
-function addToCart(productName, price, id) {
-  const cart = getCart();
-  const productIndex = cart.findIndex(item => item.name === productName);
-
-  if (productIndex > -1) {
-    cart[productIndex].quantity += 1;
-  } else {
-    cart.push({ id: Number(id), name: productName, price: price, quantity: 1 });
-  }
-
-  saveCart(cart);
-  updateCartBadge();
-
-  const dialogExists = document.querySelector('#cart-container #cart-modal');
-  if (dialogExists) {
-    showCart();
-  } else {
-    // Load modal first, then render and show
-    loadCartModal().then(() => {
-      showCart();
-    });
-  }
+// The cart lives on the server (see internal/carts). The browser only holds
+// the anonymous cart cookie; every change goes through /api/cart and the
+// modal body is rendered by the server with current prices and availability.
+
+function addToCart(id, quantity = 1) {
+  return loadCartModal()
+    .then(() => htmx.ajax('POST', '/api/cart/items', {
+      target: '#cart-modal-content',
+      swap: 'innerHTML',
+      values: { item_id: id, quantity: quantity }
+    }))
+    .then(() => openCartDialog());
 }
 
-function removeFromCart(productName) {
-  let cart = getCart();
-  cart = cart.filter(item => item.name !== productName);
-  saveCart(cart);
-  updateCartBadge();
-
-  const dialogExists = document.querySelector('#cart-container #cart-modal');
-  if (dialogExists) {
-    renderCart();
-  }
+function removeFromCart(id) {
+  return htmx.ajax('DELETE', `/api/cart/items/${id}`, {
+    target: '#cart-modal-content',
+    swap: 'innerHTML'
+  });
 }
 
-function updateQuantity(productName, delta) {
-  const cart = getCart();
-  const productIndex = cart.findIndex(item => item.name === productName);
-
-  if (productIndex > -1) {
-    cart[productIndex].quantity += delta;
-    if (cart[productIndex].quantity <= 0) {
-      cart.splice(productIndex, 1);
-    }
-    saveCart(cart);
-    updateCartBadge();
-
-    const dialogExists = document.querySelector('#cart-container #cart-modal');
-    if (dialogExists) {
-      renderCart();
-    }
-  }
+function updateQuantity(id, quantity) {
+  return htmx.ajax('PUT', `/api/cart/items/${id}`, {
+    target: '#cart-modal-content',
+    swap: 'innerHTML',
+    values: { quantity: quantity }
+  });
 }
 
 function clearCart() {
-  saveCart([]);
-  updateCartBadge();
+  return htmx.ajax('DELETE', '/api/cart', {
+    target: '#cart-modal-content',
+    swap: 'innerHTML'
+  });
+}
 
-  const dialogExists = document.querySelector('#cart-container #cart-modal');
-  if (dialogExists) {
-    renderCart();
+function renderCart() {
+  if (!document.querySelector('#cart-container #cart-modal-content')) {
+    return Promise.resolve();
   }
-}
 
-function getCart() {
-  return JSON.parse(localStorage.getItem('cart')) || [];
+  return htmx.ajax('GET', '/api/cart', {
+    target: '#cart-modal-content',
+    swap: 'innerHTML'
+  });
 }
 
-function saveCart(cart) {
-  localStorage.setItem('cart', JSON.stringify(cart));
+function showCart() {
+  return loadCartModal()
+    .then(() => renderCart())
+    .then(() => openCartDialog());
 }
 
-const INSTALLATION_SERVICE_NAME = 'Serviço de Instalação';
-
-function renderCart() {
-  const cartItemsContainer = document.getElementById('cart-items');
-  const cartTotalContainer = document.getElementById('cart-total');
-  const cartCountContainer = document.getElementById('cart-count');
-  const proceedToCheckoutButton = document.getElementById('proceed-to-checkout');
-
-  // Early return if cart elements don't exist yet
-  if (!cartItemsContainer || !cartTotalContainer) {
+function openCartDialog() {
+  const dialog = document.querySelector('#cart-container #cart-modal');
+  if (!dialog) {
     return;
   }
 
-  const cart = getCart();
-  // Filter out installation service for display and calculations
-  const displayCart = cart.filter(item => item.name !== INSTALLATION_SERVICE_NAME);
-
-  cartItemsContainer.innerHTML = '';
-  let total = 0;
-  let totalItems = 0;
-
-  if (displayCart.length === 0) {
-    cartItemsContainer.innerHTML = `
-      <div class="text-center py-12">
-        <svg xmlns="http://www.w3.org/2000/svg" class="h-24 w-24 mx-auto text-gray-300 mb-4" fill="none" viewBox="0 0 24 24" stroke="currentColor">
-          <path stroke-linecap="round" stroke-linejoin="round" stroke-width="1.5" d="M16 11V7a4 4 0 00-8 0v4M5 9h14l1 12H4L5 9z" />
-        </svg>
-        <h3 class="text-lg font-semibold text-gray-700 mb-2">Seu carrinho está vazio</h3>
-        <p class="text-gray-500">Adicione alguns produtos para começar!</p>
-      </div>
-    `;
-
-    // Disable checkout button when cart is empty
-    if (proceedToCheckoutButton) {
-      proceedToCheckoutButton.disabled = true;
-      proceedToCheckoutButton.classList.add('opacity-50', 'cursor-not-allowed', 'hover:scale-100');
-      proceedToCheckoutButton.classList.remove('hover:scale-105', 'cursor-pointer');
-    }
-  } else {
-    displayCart.forEach(item => {
-      const itemElement = document.createElement('div');
-      itemElement.className = 'bg-white border border-gray-200 rounded-lg p-4 hover:shadow-md transition-shadow duration-200';
-      itemElement.innerHTML = `
-        <div class="flex justify-between items-start mb-3">
-          <div class="flex-1">
-            <h4 class="font-semibold text-gray-900 text-lg">${item.name}</h4>
-            <p class="text-gray-500 text-sm mt-1">R$ ${item.price.toFixed(2)} cada</p>
-          </div>
-          <button class="remove-item text-gray-400 hover:text-red-500 transition-colors duration-200" data-name="${item.name}">
-            <svg xmlns="http://www.w3.org/2000/svg" class="h-5 w-5" fill="none" viewBox="0 0 24 24" stroke="currentColor">
-              <path stroke-linecap="round" stroke-linejoin="round" stroke-width="2" d="M6 18L18 6M6 6l12 12" />
-            </svg>
-          </button>
-        </div>
-        <div class="flex justify-between items-center">
-          <div class="flex items-center gap-3 bg-gray-100 rounded-lg p-1">
-            <button class="decrease-qty bg-white hover:bg-gray-50 text-gray-700 w-8 h-8 rounded-md flex items-center justify-center transition-colors duration-200 shadow-sm" data-name="${item.name}">
-              <svg xmlns="http://www.w3.org/2000/svg" class="h-4 w-4" fill="none" viewBox="0 0 24 24" stroke="currentColor">
-                <path stroke-linecap="round" stroke-linejoin="round" stroke-width="2" d="M20 12H4" />
-              </svg>
-            </button>
-            <span class="font-semibold text-gray-900 w-8 text-center">${item.quantity}</span>
-            <button class="increase-qty bg-white hover:bg-gray-50 text-gray-700 w-8 h-8 rounded-md flex items-center justify-center transition-colors duration-200 shadow-sm" data-name="${item.name}">
-              <svg xmlns="http://www.w3.org/2000/svg" class="h-4 w-4" fill="none" viewBox="0 0 24 24" stroke="currentColor">
-                <path stroke-linecap="round" stroke-linejoin="round" stroke-width="2" d="M12 4v16m8-8H4" />
-              </svg>
-            </button>
-          </div>
-          <div class="text-right">
-            <p class="text-sm text-gray-500">Subtotal</p>
-            <p class="text-lg font-bold text-gray-900">R$ ${(item.price * item.quantity).toFixed(2)}</p>
-          </div>
-        </div>
-      `;
-      cartItemsContainer.appendChild(itemElement);
-      total += item.price * item.quantity;
-      totalItems += item.quantity;
-    });
-
-    // Enable checkout button when cart has items
-    if (proceedToCheckoutButton) {
-      proceedToCheckoutButton.disabled = false;
-      proceedToCheckoutButton.classList.remove('opacity-50', 'cursor-not-allowed', 'hover:scale-100');
-      proceedToCheckoutButton.classList.add('hover:scale-105', 'cursor-pointer');
-    }
-  }
-
-  cartTotalContainer.innerText = total.toFixed(2);
-  if (cartCountContainer) {
-    cartCountContainer.innerText = `${totalItems} ${totalItems === 1 ? 'item' : 'itens'}`;
+  if (!dialog.open) {
+    dialog.showModal();
   }
-}
-
-function showCart() {
-  loadCartModal().then(() => {
-    const dialog = document.querySelector('#cart-container #cart-modal');
-    if (!dialog) {
-      return;
-    }
 
-    if (dialog.open) {
-      dialog.close();
+  setTimeout(() => {
+    const content = dialog.querySelector('#cart-modal-content');
+    if (content) {
+      content.classList.remove('scale-95', 'opacity-0');
+      content.classList.add('scale-100', 'opacity-100');
     }
+  }, 10);
 
-    dialog.showModal();
-    renderCart();
-
-    setTimeout(() => {
-      const content = dialog.querySelector('#cart-modal-content');
-      if (content) {
-        content.classList.remove('scale-95', 'opacity-0');
-        content.classList.add('scale-100', 'opacity-100');
-      }
-    }, 10);
-
-    cartModalUISetup();
-  });
+  cartModalUISetup();
 }
 
 function hideCart() {
@@ -221,6 +103,11 @@ function loadCartModal() {
   return fetch('/cart-modal')
     .then(response => response.text())
     .then(html => {
+      // The cart icon may have loaded the modal while we were fetching
+      if (container.querySelector('#cart-modal')) {
+        return true;
+      }
+
       const parser = new DOMParser();
       const doc = parser.parseFromString(html, 'text/html');
       const modal = doc.querySelector('#cart-modal');
@@ -228,6 +115,7 @@ function loadCartModal() {
 
       if (modal) {
         container.appendChild(modal);
+        htmx.process(modal);
       }
 
       if (style) {
@@ -242,41 +130,36 @@ function loadCartModal() {
     });
 }
 
-function updateCartBadge() {
-  const cart = getCart();
-  // Exclude installation service from badge count
-  const totalItems = cart.reduce((sum, item) =>
-    item.name === INSTALLATION_SERVICE_NAME ? sum : sum + item.quantity, 0);
-
-  let badge = document.getElementById('cart-badge');
+function setCartBadge(totalItems) {
+  const badge = document.getElementById('cart-badge');
   if (!badge) {
-    badge = document.createElement('span');
-    badge.id = 'cart-badge';
-    badge.className = 'absolute -top-2 -right-2 bg-red-500 text-white text-xs rounded-full h-5 w-5 flex items-center justify-center';
-    const cartIcon = document.getElementById('cart-icon');
-    if (cartIcon) {
-      cartIcon.parentElement.style.position = 'relative';
-      cartIcon.parentElement.appendChild(badge);
-    }
+    return;
   }
 
+  badge.textContent = totalItems;
   if (totalItems > 0) {
-    badge.textContent = totalItems;
-    badge.classList.remove('hidden');
+    badge.classList.remove('opacity-0', 'hidden');
+    badge.classList.add('cart-pulse');
+    setTimeout(() => badge.classList.remove('cart-pulse'), 300);
   } else {
-    badge.classList.add('hidden');
+    badge.classList.add('opacity-0');
   }
 }
 
+function updateCartBadge() {
+  return fetch('/api/cart/count')
+    .then(response => response.ok ? response.text() : '0')
+    .then(count => setCartBadge(parseInt(count, 10) || 0))
+    .catch(error => console.error('Failed to load cart count:', error));
+}
+
 document.addEventListener('DOMContentLoaded', () => {
-  // Don't call renderCart() here - it will be called when modal loads
   updateCartBadge();
 
-  // Cart icon click is now handled by HTMX, but we need to show the dialog after it loads
+  // The cart icon loads the dialog through HTMX on its first click
   const cartIcon = document.getElementById('cart-icon');
   if (cartIcon) {
     cartIcon.addEventListener('click', () => {
-      // Check if dialog is already loaded
       const dialog = document.querySelector('#cart-container #cart-modal');
       if (dialog) {
         showCart();
@@ -286,41 +169,15 @@ document.addEventListener('DOMContentLoaded', () => {
       }
     });
   }
+});
 
-  // Event listeners will be handled by the dialog's own script
-  // but we keep fallbacks for when the dialog isn't loaded yet
-
-  document.querySelectorAll('.add-to-cart').forEach(button => {
-    button.addEventListener('click', (e) => {
-      const productCard = e.target.closest('.product-card');
-      const productName = productCard.dataset.name;
-      const productId = productCard.dataset.id;
-      const productPrice = parseFloat(productCard.dataset.price);
-      addToCart(productName, productPrice, productId);
-    });
-  });
-
-  // Event delegation for dynamically created buttons
-  // This works both in the main page and in the dialog
-  document.addEventListener('click', (e) => {
-    const cartItems = document.getElementById('cart-items');
-    if (cartItems && cartItems.contains(e.target)) {
-      const removeBtn = e.target.closest('.remove-item');
-      const increaseBtn = e.target.closest('.increase-qty');
-      const decreaseBtn = e.target.closest('.decrease-qty');
-
-      if (removeBtn) {
-        const productName = removeBtn.dataset.name;
-        removeFromCart(productName);
-      } else if (increaseBtn) {
-        const productName = increaseBtn.dataset.name;
-        updateQuantity(productName, 1);
-      } else if (decreaseBtn) {
-        const productName = decreaseBtn.dataset.name;
-        updateQuantity(productName, -1);
-      }
-    }
-  });
+// Every cart mutation answers with a cartUpdated trigger carrying the new count
+document.body.addEventListener('cartUpdated', (e) => {
+  if (e.detail && typeof e.detail.count === 'number') {
+    setCartBadge(e.detail.count);
+  } else {
+    updateCartBadge();
+  }
 });
 
 function cartModalUISetup() {
@@ -331,102 +188,23 @@ function cartModalUISetup() {
 
   modal.dataset.bound = 'true';
 
-  const clearCartButton = document.getElementById('clear-cart');
-  const closeButton = document.getElementById('close-cart');
-  const proceedToCheckoutButton = document.getElementById('proceed-to-checkout');
-
-  function handleCartClear() {
-    if (confirm('Tem certeza que deseja limpar seu carrinho?')) {
-      localStorage.setItem('cart', JSON.stringify([]));
-
-      const badge = document.getElementById('cart-badge');
-      if (badge) {
-        badge.classList.add('hidden');
-      }
-
-      // Use renderCart() to handle all display updates including button styling
-      renderCart();
-    }
-  }
-
-  function handleCloseCart(event) {
-    event?.preventDefault();
-    hideCart();
-  }
-
-  function handleCartBackdrop(event) {
+  // The modal body is replaced on every update, so listen on the dialog
+  modal.addEventListener('click', (event) => {
     if (event.target === event.currentTarget) {
       hideCart();
+      return;
     }
-  }
-
-  function handleCartCancel(event) {
-    event.preventDefault();
-    hideCart();
-  }
-
-  function handleProceedToCheckout(event) {
-    event.preventDefault();
-    const cart = getCart();
-    const displayCart = cart.filter(item => item.name !== INSTALLATION_SERVICE_NAME);
 
-    if (displayCart.length === 0) {
-      return; // Don't proceed if cart is empty
+    if (event.target.closest('#close-cart') || event.target.closest('#continue-shopping')) {
+      event.preventDefault();
+      hideCart();
     }
+  });
 
+  modal.addEventListener('cancel', (event) => {
+    event.preventDefault();
     hideCart();
-    proceed(false);
-    //showInstallationServiceModal();
-  }
-
-  clearCartButton?.addEventListener('click', handleCartClear);
-  closeButton?.addEventListener('click', handleCloseCart);
-  modal.addEventListener('click', handleCartBackdrop);
-  modal.addEventListener('cancel', handleCartCancel);
-  proceedToCheckoutButton?.addEventListener('click', handleProceedToCheckout);
-}
-
-function proceed(includeInstallation) {
-  const cart = getCart();
-  const filteredCart = cart.filter(item => item.name !== INSTALLATION_SERVICE_NAME);
-
-  if (filteredCart.length !== cart.length) {
-    saveCart(filteredCart);
-    updateCartBadge();
-  }
-
-  setTimeout(() => {
-    window.location.href = '/checkout';
-  }, 350);
-  return
-
-  if (includeInstallation) {
-    const cart = getCart();
-    const existingInstallation = cart.findIndex(item => item.name === INSTALLATION_SERVICE_NAME);
-
-    if (existingInstallation === -1) {
-      cart.push({ name: INSTALLATION_SERVICE_NAME, price: 120.00, quantity: 1 });
-    } else {
-      cart[existingInstallation].price = 120.00;
-      cart[existingInstallation].quantity = 1;
-    }
-
-    saveCart(cart);
-    updateCartBadge();
-  } else {
-    const cart = getCart();
-    const filteredCart = cart.filter(item => item.name !== INSTALLATION_SERVICE_NAME);
-
-    if (filteredCart.length !== cart.length) {
-      saveCart(filteredCart);
-      updateCartBadge();
-    }
-  }
-
-  hideInstallationServiceModal();
-  /*setTimeout(() => {
-    window.location.href = '/checkout';
-  }, 350);*/
+  });
 }
 
-export { addToCart, removeFromCart, updateQuantity, clearCart, renderCart, showCart, hideCart, updateCartBadge, cartModalUISetup, saveCart };
+export { addToCart, removeFromCart, updateQuantity, clearCart, renderCart, showCart, hideCart, updateCartBadge, cartModalUISetup };
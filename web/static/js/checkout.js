@@ -1,12 +1,3 @@
-import { saveCart, updateCartBadge } from "./cart.js";
-
-const INSTALLATION_SERVICE_NAME = 'Serviço de Instalação';
-
-// Import cart functions
-function getCart() {
-  return JSON.parse(localStorage.getItem('cart')) || [];
-}
-
 // Format CPF/CNPJ
 function formatCPF(value) {
   const cleaned = value.replace(/\D/g, '');
@@ -175,57 +166,8 @@ function setupPaymentMethodSwitching() {
   }
 }
 
-// Render checkout items
-function renderCheckoutItems() {
-  const cart = getCart();
-  const checkoutItemsContainer = document.getElementById('checkout-items');
-  const emptyCartMessage = document.getElementById('empty-cart-message');
-  const totalElement = document.getElementById('total');
-  const placeOrderBtn = document.getElementById('place-order-btn');
-
-  if (cart.length === 0) {
-    checkoutItemsContainer.classList.add('hidden');
-    emptyCartMessage.classList.remove('hidden');
-    placeOrderBtn.disabled = true;
-    return;
-  }
-
-  checkoutItemsContainer.classList.remove('hidden');
-  emptyCartMessage.classList.add('hidden');
-  placeOrderBtn.disabled = false;
-
-  checkoutItemsContainer.innerHTML = '';
-  let subtotal = 0;
-
-  cart.forEach(item => {
-    const itemElement = document.createElement('div');
-    itemElement.className = 'flex justify-between items-start pb-4 border-b border-gray-200';
-    if (item.name !== INSTALLATION_SERVICE_NAME) {
-      itemElement.innerHTML = `
-        <div class="flex-1">
-          <h4 class="font-semibold text-gray-900">${item.name}</h4>
-          <p class="text-sm text-gray-500">Quantidade: ${item.quantity}</p>
-        </div>
-        <p class="font-semibold text-gray-900">R$ ${(item.price * item.quantity).toFixed(2)}</p>
-      `
-    } else {
-      itemElement.innerHTML = `
-        <div class="flex-1">
-          <h4 class="font-semibold text-gray-900">${item.name}</h4>
-        </div>
-        <p class="font-semibold text-gray-900">R$ ${item.price.toFixed(2)}</p>
-      `;
-    }
-    checkoutItemsContainer.appendChild(itemElement);
-    subtotal += item.price * item.quantity;
-  });
-
-  totalElement.textContent = subtotal.toFixed(2);
-}
-
 // Initialize
 document.addEventListener('DOMContentLoaded', () => {
-  renderCheckoutItems();
   setupPaymentMethodSwitching();
 
   // CPF formatting
@@ -405,30 +347,11 @@ function proceed(includeInstallation) {
   }
   hasChosen = true;
 
-  if (includeInstallation) {
-    const cart = getCart();
-    const existingInstallation = cart.findIndex(item => item.name === INSTALLATION_SERVICE_NAME);
-
-    if (existingInstallation === -1) {
-      cart.push({ id: 1, name: INSTALLATION_SERVICE_NAME, price: 120.00, quantity: 1 });
-    } else {
-      cart[existingInstallation].id = 1;
-      cart[existingInstallation].price = 120.00;
-      cart[existingInstallation].quantity = 1;
-    }
-
-    saveCart(cart);
-    updateCartBadge();
-  } else {
-    const cart = getCart();
-    const filteredCart = cart.filter(item => item.name !== INSTALLATION_SERVICE_NAME);
-
-    if (filteredCart.length !== cart.length) {
-      saveCart(filteredCart);
-      updateCartBadge();
-    }
-  }
-  renderCheckoutItems();
+  // The server adds or removes the service and answers with the refreshed summary
+  htmx.ajax(includeInstallation ? 'POST' : 'DELETE', '/api/cart/installation', {
+    target: '#checkout-summary',
+    swap: 'innerHTML'
+  });
   hideInstallationServiceModal();
   /*setTimeout(() => {
     window.location.href = '/checkout';